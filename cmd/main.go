@@ -3,26 +3,169 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
 	"github.com/magnetenstad/dragon-compiler/pkg/error"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/amd64"
 	"github.com/magnetenstad/dragon-compiler/pkg/gen/c"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/golang"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/js"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/llvm"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/wasm"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
 	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+	"github.com/magnetenstad/dragon-compiler/pkg/opt"
 	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+	"github.com/magnetenstad/dragon-compiler/pkg/ssa"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
 )
 
+const usage = `usage:
+	dragon                              compile the examples
+	dragon build [-O0|-O1|-O2] [-target=c|wasm|llvm|amd64|bytecode|js|go] [-dts]
+	             [-package=name] [-header] [-modules] [-g] [-asan] [-I dirs] file.bip
+	                                    compile a file and the modules it imports to C,
+	                                    WebAssembly text, LLVM IR, an x86-64 executable,
+	                                    bytecode, an ES module or a Go package
+	dragon run [-trace] file.bipc [-- args]
+	                                    run bytecode, giving it the arguments after --
+	dragon disasm file.bipc             disassemble bytecode
+	dragon cfg [-O0|-O1|-O2] [-ssa] [-I dirs] file.bip
+	                                    print the control-flow graph as Graphviz DOT`
+
 func main() {
-	compile("examples/hwp")
-	compile("examples/blocks")
-	compile("examples/print")
-	compile("examples/struct")
-	compile("examples/constructor")
-	compile("examples/default_values")
-	compile("examples/readme")
+	if len(os.Args) < 2 {
+		compile("examples/hwp", options{target: "c"})
+		compile("examples/blocks", options{target: "c"})
+		compile("examples/print", options{target: "c"})
+		compile("examples/struct", options{target: "c"})
+		compile("examples/constructor", options{target: "c"})
+		compile("examples/default_values", options{target: "c"})
+		compile("examples/readme", options{target: "c"})
+		compile("examples/skip", options{target: "c"})
+		compile("examples/warnings", options{target: "c"})
+		compile("examples/fold", options{target: "c"})
+		compile("examples/nested_constructors", options{target: "c"})
+		compile("examples/ref", options{target: "c"})
+		compile("examples/assign", options{target: "c"})
+		compile("examples/config", options{target: "c"})
+		compile("examples/enum", options{target: "c"})
+		compile("examples/methods", options{target: "c"})
+		compile("examples/interfaces", options{target: "c"})
+		compile("examples/generics", options{target: "c"})
+		compile("examples/optionals", options{target: "c"})
+		compile("examples/modules", options{target: "c"})
+		compile("examples/stdlib", options{target: "c"})
+		return
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	if len(args) == 0 {
+		exit(usage)
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	level := optimizationFlags(flags)
+	showSsa := flags.Bool("ssa", false, "show the control-flow graph in SSA form (cfg only)")
+	target := flags.String("target", "c", "generate c, wasm, llvm, amd64, bytecode, js or go (build only)")
+	packageName := flags.String("package", "main", "the Go package to generate, with Run instead of main unless main (go only)")
+	types := flags.Bool("dts", false, "also write TypeScript declarations (js only)")
+	header := flags.Bool("header", false, "write a header and an implementation file (c only)")
+	modules := flags.Bool("modules", false, "write a header and an implementation file for each module (c only)")
+	debug := flags.Bool("g", false, "emit #line directives pointing into the .bip file (c only)")
+	asan := flags.Bool("asan", false, "run the program built with AddressSanitizer, failing on leaks (c only)")
+	trace := flags.Bool("trace", false, "print every instruction as it runs (run only)")
+	include := flags.String("I", "", "directories to look for imported modules in after the importing file's, separated by :")
+	flags.Parse(args)
+	path := append(filepath.SplitList(*include), filepath.SplitList(os.Getenv("DRAGON_PATH"))...)
+
+	switch command {
+	case "build":
+		for _, filename := range flags.Args() {
+			compile(strings.TrimSuffix(filename, ".bip"), options{
+				level:       level(),
+				target:      *target,
+				types:       *types,
+				packageName: *packageName,
+				header:      *header,
+				modules:     *modules,
+				debug:       *debug,
+				asan:        *asan,
+				path:        path,
+			})
+		}
+	case "cfg":
+		for _, filename := range flags.Args() {
+			printCfg(strings.TrimSuffix(filename, ".bip"), level(), *showSsa, path)
+		}
+	case "run":
+		filenames, programArgs := flags.Args(), []string{}
+		for i, arg := range filenames {
+			if arg == "--" {
+				filenames, programArgs = filenames[:i], filenames[i+1:]
+				break
+			}
+		}
+		for _, filename := range filenames {
+			run(filename, programArgs, *trace)
+		}
+	case "disasm":
+		for _, filename := range flags.Args() {
+			fmt.Print(bytecode.Disassemble(load(filename)))
+		}
+	default:
+		exit(usage)
+	}
+}
+
+// optimizationFlags defines -O0, -O1 and -O2 and returns a function giving
+// the highest level set after parsing.
+func optimizationFlags(flags *flag.FlagSet) func() int {
+	levels := []*bool{
+		flags.Bool("O0", false, "do not optimize (default)"),
+		flags.Bool("O1", false, "fold and propagate constants, remove unreachable code"),
+		flags.Bool("O2", false, "also propagate copies and remove dead code"),
+	}
+	return func() int {
+		level := 0
+		for i, set := range levels {
+			if *set {
+				level = i
+			}
+		}
+		return level
+	}
+}
+
+func exit(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(2)
+}
+
+type options struct {
+	level       int
+	target      string
+	types       bool     // TypeScript declarations for js
+	packageName string   // The package for go
+	header      bool     // A separate header for c
+	modules     bool     // A header and a file for each module for c
+	debug       bool     // #line directives for c
+	asan        bool     // Run c under AddressSanitizer
+	path        []string // Where to look for imported modules
 }
 
-func compile(filename string) {
+func compile(filename string, options options) {
 
 	file, err := os.Open(filename + ".bip")
 	error.Check(err)
@@ -40,6 +183,7 @@ func compile(filename string) {
 
 	parser := parser.NewParser(tokens)
 	root := parser.Parse()
+	module.Resolve(root, filename+".bip", options.path)
 	fmt.Println(root)
 
 	file, err = os.Create(filename + ".ast")
@@ -47,17 +191,182 @@ func compile(filename string) {
 	defer file.Close()
 	file.Write(toJson(root))
 
-	file, err = os.Create(filename + ".c")
+	program := ir.Lower(root)
+	fmt.Println(program)
+	warn(program)
+	opt.Optimize(program, options.level)
+
+	var output, extension string
+	units := []string{filename + ".c"}
+	switch options.target {
+	case "c":
+		source := ""
+		if options.debug {
+			source = filename + ".bip"
+		}
+		if options.modules {
+			header, implementations := c.GenerateModules(program, filepath.Base(filename), source)
+			writeFile(filename+".h", header)
+			for _, imported := range root.Modules {
+				unit := filename + "_" + imported.Name + ".c"
+				writeFile(unit, implementations[imported.Source])
+				units = append(units, unit)
+			}
+			output = implementations[""]
+		} else if options.header {
+			var header string
+			header, output = c.GenerateSplit(program, filepath.Base(filename), source)
+			writeFile(filename+".h", header)
+		} else {
+			output = c.Generate(program, source)
+		}
+		extension = ".c"
+	case "wasm":
+		output, extension = wasm.Generate(program), ".wat"
+	case "llvm":
+		output, extension = llvm.Generate(program), ".ll"
+	case "amd64":
+		output, extension = amd64.Generate(program), ".s"
+	case "bytecode":
+		output, extension = string(bytecode.Encode(bytecode.Compile(program))), ".bipc"
+	case "js":
+		output, extension = js.Generate(program), ".js"
+		if options.types {
+			writeFile(filename+".d.ts", js.GenerateTypes(program))
+		}
+	case "go":
+		output, extension = golang.Generate(program, options.packageName), ".go"
+	default:
+		exit(fmt.Sprintf("unknown target %s", options.target))
+	}
+
+	file, err = os.Create(filename + extension)
 	error.Check(err)
 	defer file.Close()
-	output := c.Generate(root)
 	file.WriteString(output)
 
-	// file, err = os.Create(filename + ".wast")
-	// error.Check(err)
-	// defer file.Close()
-	// output = generateWasmProgram(root)
-	// file.WriteString(output)
+	if options.target == "amd64" {
+		link(filename, len(program.UsesBuiltins()) > 0)
+	}
+	if options.target == "c" && options.asan {
+		sanitize(filename, units)
+	}
+}
+
+// link assembles and links with the system C compiler, which also links
+// in libc for printf, and the C runtime with the math library if the
+// program uses builtins.
+func link(filename string, builtins bool) {
+	args := []string{"-o", filename, filename + ".s"}
+	if builtins {
+		file, err := os.CreateTemp("", "dragon-runtime-*.c")
+		error.Check(err)
+		defer os.Remove(file.Name())
+		file.WriteString(c.Runtime())
+		file.Close()
+		args = append(args, file.Name(), "-lm")
+	}
+	command := exec.Command("cc", args...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	error.Check(command.Run())
+}
+
+// sanitize builds the translation units with AddressSanitizer, which also
+// checks for leaks when the program exits, and with the math library for
+// the runtime, and runs the program, exiting if it fails.
+func sanitize(filename string, units []string) {
+	args := append([]string{"-fsanitize=address", "-fwrapv", "-g", "-o", filename}, units...)
+	command := exec.Command("cc", append(args, "-lm")...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	error.Check(command.Run())
+
+	path, err := filepath.Abs(filename)
+	error.Check(err)
+	command = exec.Command(path)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	if err := command.Run(); err != nil {
+		exit(fmt.Sprintf("%s: %s", filename, err))
+	}
+}
+
+func writeFile(filename string, text string) {
+	file, err := os.Create(filename)
+	error.Check(err)
+	defer file.Close()
+	file.WriteString(text)
+}
+
+func load(filename string) *bytecode.Program {
+	data, err := os.ReadFile(filename)
+	error.Check(err)
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		exit(fmt.Sprintf("%s: %s", filename, err))
+	}
+	return program
+}
+
+// run runs bytecode reading from stdin, exiting with the code the program
+// exits with, if it is not 0.
+func run(filename string, args []string, trace bool) {
+	machine := vm.New(load(filename), os.Stdout)
+	machine.Input(os.Stdin)
+	machine.Args(args)
+	if trace {
+		machine.Trace(os.Stderr)
+	}
+	if err := machine.Run(); err != nil {
+		var exitError *vm.ExitError
+		if errors.As(err, &exitError) {
+			os.Exit(exitError.Code)
+		}
+		exit(fmt.Sprintf("%s: %s", filename, err))
+	}
+}
+
+func printCfg(filename string, level int, showSsa bool, path []string) {
+	root := parse(filename)
+	module.Resolve(root, filename+".bip", path)
+	program := ir.Lower(root)
+	opt.Optimize(program, level)
+
+	build := cfg.Build
+	if showSsa {
+		build = ssa.Build
+	}
+	var graphs []*cfg.Graph
+	for _, st := range program.Structs {
+		graphs = append(graphs, build(st.Constructor))
+	}
+	for _, method := range program.Methods {
+		graphs = append(graphs, build(method))
+	}
+	graphs = append(graphs, build(program.Main))
+
+	fmt.Print(cfg.Dot(graphs...))
+}
+
+func warn(program *ir.Program) {
+	funcs := append([]*ir.Func{}, program.Methods...)
+	for _, fn := range append(funcs, program.Main) {
+		for _, warning := range dataflow.Check(cfg.Build(fn)) {
+			fmt.Println(warning)
+		}
+	}
+}
+
+func parse(filename string) *ast.RootNode {
+	file, err := os.Open(filename + ".bip")
+	error.Check(err)
+	defer file.Close()
+
+	lexer := lexer.NewLexer(bufio.NewReader(file))
+	parser := parser.NewParser(lexer.ScanAll())
+	return parser.Parse()
 }
 
 func toJson(obj interface{}) []byte {
@@ -1,19 +1,40 @@
 package ast
 
+import "fmt"
+
 type Node struct {
 	Type     NodeType
 	Name     string // For debugging
 	Lexeme   string
 	Number   int
 	TypeHint string
+	Line     int
 	Children []*Node
+	// The type parameters of a generic struct or method, like A and B in
+	// Pair[A, B], with the interface they must implement as type hint
+	TypeParameters []*Node `json:",omitempty"`
 }
 
 type RootNode struct {
 	Declarations []*Node
+	Methods      []*Node
+	Impls        []*Node
+	// The imports of the file, with the path as lexeme and the names
+	// imported without the module name as children
+	Imports []*Node `json:",omitempty"`
+	// The imported modules, once merged into the program
+	Modules []*Module `json:",omitempty"`
 	*Node
 }
 
+// A module imported by the program. Its declarations are renamed to start
+// with its prefix, like Geometry_Point for Point in geometry.bip.
+type Module struct {
+	Name   string
+	Prefix string
+	Source string // The .bip file
+}
+
 func (node *Node) AddChild(child *Node) {
 	node.Children = append(node.Children, child)
 }
@@ -22,6 +43,75 @@ func (parent *Node) ParseAsChild(fn func(*Node) *Node) {
 	parent.AddChild(fn(parent))
 }
 
+// Copy returns a copy of the tree, so that it can be rewritten while the
+// original is kept. Modules are shared, since they are never changed.
+func (node *RootNode) Copy() *RootNode {
+	copied := &RootNode{Node: node.Node.Copy(), Modules: node.Modules}
+	for _, declaration := range node.Declarations {
+		copied.Declarations = append(copied.Declarations, declaration.Copy())
+	}
+	for _, method := range node.Methods {
+		copied.Methods = append(copied.Methods, method.Copy())
+	}
+	for _, impl := range node.Impls {
+		copied.Impls = append(copied.Impls, impl.Copy())
+	}
+	for _, imported := range node.Imports {
+		copied.Imports = append(copied.Imports, imported.Copy())
+	}
+	return copied
+}
+
+// Copy returns a copy of the node and its children.
+func (node *Node) Copy() *Node {
+	copied := *node
+	copied.Children = nil
+	for _, child := range node.Children {
+		copied.Children = append(copied.Children, child.Copy())
+	}
+	copied.TypeParameters = nil
+	for _, parameter := range node.TypeParameters {
+		copied.TypeParameters = append(copied.TypeParameters, parameter.Copy())
+	}
+	return &copied
+}
+
+// Parameters returns the parameters of a method declaration, which are
+// followed by its body, or of a method signature, which has none.
+func (node *Node) Parameters() []*Node {
+	if node.Type == TypeMethodSignature {
+		return node.Children
+	}
+	return node.Children[:len(node.Children)-1]
+}
+
+// Declarations maps the names of the declarations of a program to them,
+// for the backends generating from the tree.
+type Declarations map[string]*Node
+
+// Optional returns the inner type of an optional type.
+func (declarations Declarations) Optional(typeHint string) (string, bool) {
+	st, ok := declarations[typeHint]
+	if !ok || st.Type != TypeOptionalDeclaration {
+		return "", false
+	}
+	return st.TypeHint, true
+}
+
+// FieldType returns the type of a field of a struct.
+func (declarations Declarations) FieldType(typeHint string, lexeme string) string {
+	st, ok := declarations[typeHint]
+	if !ok {
+		panic(fmt.Sprintf("%s is not a struct", typeHint))
+	}
+	for _, field := range st.Children {
+		if field.Lexeme == lexeme {
+			return field.TypeHint
+		}
+	}
+	panic(fmt.Sprintf("%s has no field %s", typeHint, lexeme))
+}
+
 func (node *RootNode) SetNames() {
 	node.Name = node.Type.name()
 	for _, child := range node.Children {
@@ -30,6 +120,15 @@ func (node *RootNode) SetNames() {
 	for _, child := range node.Declarations {
 		child.SetNames()
 	}
+	for _, child := range node.Methods {
+		child.SetNames()
+	}
+	for _, child := range node.Impls {
+		child.SetNames()
+	}
+	for _, child := range node.Imports {
+		child.SetNames()
+	}
 }
 
 func (node *Node) SetNames() {
@@ -37,6 +136,9 @@ func (node *Node) SetNames() {
 	for _, child := range node.Children {
 		child.SetNames()
 	}
+	for _, child := range node.TypeParameters {
+		child.SetNames()
+	}
 }
 
 type NodeType int
@@ -63,6 +165,29 @@ const (
 	TypeStructArgument
 	TypeSkipStatement
 	TypeSkipIfStatement
+	TypeRefStructDeclaration
+	TypeValStatement
+	TypeReadonlyStructField
+	TypeEnumDeclaration
+	TypeEnumVariant
+	TypeMatchStatement
+	TypeMatchArm
+	TypeMethodDeclaration
+	TypeParameter
+	TypeReturnStatement
+	TypeCall
+	TypeCallStatement
+	TypeMember
+	TypeInterfaceDeclaration
+	TypeMethodSignature
+	TypeImplDeclaration
+	TypeTypeParameter
+	TypeNone
+	TypeOptionalMember
+	TypeOptionalCall
+	TypeOptionalDeclaration
+	TypeImport
+	TypeStaticCall
 )
 
 func (sType NodeType) name() string {
@@ -95,10 +220,56 @@ func (sType NodeType) name() string {
 		return "Assignment"
 	case TypeStructDeclaration:
 		return "StructDeclaration"
+	case TypeRefStructDeclaration:
+		return "RefStructDeclaration"
 	case TypeStructField:
 		return "StructField"
+	case TypeReadonlyStructField:
+		return "ReadonlyStructField"
+	case TypeValStatement:
+		return "Val"
+	case TypeEnumDeclaration:
+		return "EnumDeclaration"
+	case TypeEnumVariant:
+		return "EnumVariant"
+	case TypeMatchStatement:
+		return "Match"
+	case TypeMatchArm:
+		return "MatchArm"
+	case TypeMethodDeclaration:
+		return "MethodDeclaration"
+	case TypeParameter:
+		return "Parameter"
+	case TypeReturnStatement:
+		return "Return"
+	case TypeCall:
+		return "Call"
+	case TypeCallStatement:
+		return "CallStatement"
+	case TypeMember:
+		return "Member"
+	case TypeInterfaceDeclaration:
+		return "InterfaceDeclaration"
+	case TypeMethodSignature:
+		return "MethodSignature"
+	case TypeImplDeclaration:
+		return "ImplDeclaration"
 	case TypeStructArgument:
 		return "StructArgument"
+	case TypeTypeParameter:
+		return "TypeParameter"
+	case TypeNone:
+		return "None"
+	case TypeOptionalMember:
+		return "OptionalMember"
+	case TypeOptionalCall:
+		return "OptionalCall"
+	case TypeOptionalDeclaration:
+		return "OptionalDeclaration"
+	case TypeImport:
+		return "Import"
+	case TypeStaticCall:
+		return "StaticCall"
 	default:
 		return string(rune(sType))
 	}
@@ -0,0 +1,278 @@
+package bytecode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	A compact bytecode for a stack machine, run by pkg/vm.
+
+	Every instruction is an opcode byte followed by its operands, which are
+	big-endian and either two bytes for indices or four bytes for jump
+	targets. Jump targets are offsets into the code of the function.
+
+	Struct values are references on the stack. Storing a struct in a local
+	or a field copies it, so assigning a struct copies it like in C, unless
+	it is a ref struct, whose instances are shared.
+
+	A method is called with its receiver and then its arguments on the
+	stack. The arguments become its first locals and the receiver its self,
+	and a method returning a value leaves it on the stack. A method of an
+	interface is called through a table giving the method of each struct
+	implementing it, indexed by the tag of the receiver, and the method gets
+	the struct held by the receiver as its self.
+
+	A function of the standard library is called with its arguments on the
+	stack, the receiver first, and leaves its result, if any. Programs list
+	the ones they call by name, so the VM can check it has them all.
+*/
+
+type Opcode byte
+
+const (
+	OpNop       Opcode = iota
+	OpConst            // const k: push constant k
+	OpLoad             // load n: push local n
+	OpStore            // store n: pop into local n
+	OpSelf             // push the struct being constructed or the receiver of a method
+	OpAddInt           // pop b, pop a, push a + b
+	OpSubInt           // a - b
+	OpMulInt           // a * b
+	OpDivInt           // a / b
+	OpLessInt          // a < b
+	OpMoreInt          // a > b
+	OpAddFloat         // a + b
+	OpSubFloat         // a - b
+	OpMulFloat         // a * b
+	OpDivFloat         // a / b
+	OpLessFloat        // a < b
+	OpMoreFloat        // a > b
+	OpNot              // pop a, push !a
+	OpJump             // jump addr: continue at addr
+	OpJumpIf           // jumpif addr: pop a, continue at addr if a is true
+	OpNew              // new s: push a new instance of struct s after running its constructor
+	OpGetField         // getfield i: pop a struct, push its field i
+	OpSetField         // setfield i: pop a value, pop a struct, set its field i
+	OpPrint            // pop a and print it
+	OpReturn           // return from the function
+	OpCall             // call f: pop the arguments and the receiver of method f and call it
+	OpDispatch         // dispatch t: like call, with the method in table t for the tag of the receiver
+	OpBuiltin          // builtin b: pop the arguments of builtin b, call it and push its result, if any
+)
+
+type opcodeInfo struct {
+	name     string
+	operands []int // The width of each operand in bytes
+}
+
+var opcodes = map[Opcode]opcodeInfo{
+	OpNop:       {"nop", nil},
+	OpConst:     {"const", []int{2}},
+	OpLoad:      {"load", []int{2}},
+	OpStore:     {"store", []int{2}},
+	OpSelf:      {"self", nil},
+	OpAddInt:    {"add.i", nil},
+	OpSubInt:    {"sub.i", nil},
+	OpMulInt:    {"mul.i", nil},
+	OpDivInt:    {"div.i", nil},
+	OpLessInt:   {"lt.i", nil},
+	OpMoreInt:   {"gt.i", nil},
+	OpAddFloat:  {"add.f", nil},
+	OpSubFloat:  {"sub.f", nil},
+	OpMulFloat:  {"mul.f", nil},
+	OpDivFloat:  {"div.f", nil},
+	OpLessFloat: {"lt.f", nil},
+	OpMoreFloat: {"gt.f", nil},
+	OpNot:       {"not", nil},
+	OpJump:      {"jump", []int{4}},
+	OpJumpIf:    {"jumpif", []int{4}},
+	OpNew:       {"new", []int{2}},
+	OpGetField:  {"getfield", []int{2}},
+	OpSetField:  {"setfield", []int{2}},
+	OpPrint:     {"print", nil},
+	OpReturn:    {"return", nil},
+	OpCall:      {"call", []int{2}},
+	OpDispatch:  {"dispatch", []int{2}},
+	OpBuiltin:   {"builtin", []int{2}},
+}
+
+func (op Opcode) String() string {
+	if info, ok := opcodes[op]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("op%d", byte(op))
+}
+
+// Size returns the length of the instruction in bytes, or 0 for an
+// unknown opcode.
+func (op Opcode) Size() int {
+	info, ok := opcodes[op]
+	if !ok {
+		return 0
+	}
+	size := 1
+	for _, width := range info.operands {
+		size += width
+	}
+	return size
+}
+
+// Operands decodes the operands of the instruction at pc.
+func Operands(code []byte, pc int) []int {
+	info := opcodes[Opcode(code[pc])]
+	operands := make([]int, len(info.operands))
+	at := pc + 1
+	for i, width := range info.operands {
+		switch width {
+		case 2:
+			operands[i] = int(binary.BigEndian.Uint16(code[at:]))
+		case 4:
+			operands[i] = int(binary.BigEndian.Uint32(code[at:]))
+		}
+		at += width
+	}
+	return operands
+}
+
+type ConstantKind byte
+
+const (
+	ConstantInt ConstantKind = iota
+	ConstantFloat
+	ConstantBool
+	ConstantString
+)
+
+type Constant struct {
+	Kind   ConstantKind
+	Int    int32 // Value of ints, 0 or 1 for bools
+	Float  float32
+	String string
+}
+
+func (constant Constant) Format() string {
+	switch constant.Kind {
+	case ConstantInt:
+		return strconv.Itoa(int(constant.Int))
+	case ConstantFloat:
+		return strconv.FormatFloat(float64(constant.Float), 'g', -1, 32)
+	case ConstantBool:
+		if constant.Int != 0 {
+			return "true"
+		}
+		return "false"
+	default:
+		return strconv.Quote(constant.String)
+	}
+}
+
+type Field struct {
+	Name string
+	Type string // Int, Float, Bool, String or the name of a struct
+}
+
+type Struct struct {
+	Name        string
+	Fields      []Field
+	Constructor int  // Index of the constructor in Funcs
+	Ref         bool // Instances are shared instead of copied
+}
+
+type Func struct {
+	Name   string
+	Params int // The first locals, which a call stores its arguments in
+	Locals int
+	Code   []byte
+}
+
+// A Table lists the methods a method of an interface runs, like
+// Shape.area, by the tag of the interface value.
+type Table struct {
+	Name  string
+	Funcs []int
+}
+
+type Program struct {
+	Constants []Constant
+	Structs   []Struct
+	Funcs     []Func
+	Tables    []Table
+	Builtins  []string // The functions of the standard library called, like String.length
+	Main      int      // Index of main in Funcs
+}
+
+// Disassemble lists the constants, structs and instructions of a program.
+func Disassemble(program *Program) string {
+	var sb strings.Builder
+	for i, constant := range program.Constants {
+		sb.WriteString(fmt.Sprintf("const %d = %s\n", i, constant.Format()))
+	}
+	for i, st := range program.Structs {
+		if st.Ref {
+			sb.WriteString(fmt.Sprintf("ref struct %d %s {\n", i, st.Name))
+		} else {
+			sb.WriteString(fmt.Sprintf("struct %d %s {\n", i, st.Name))
+		}
+		for j, field := range st.Fields {
+			sb.WriteString(fmt.Sprintf("\t%d %s %s\n", j, field.Name, field.Type))
+		}
+		sb.WriteString("}\n")
+	}
+	for i, table := range program.Tables {
+		sb.WriteString(fmt.Sprintf("table %d %s {\n", i, table.Name))
+		for tag, index := range table.Funcs {
+			sb.WriteString(fmt.Sprintf("\t%d %s\n", tag, program.Funcs[index].Name))
+		}
+		sb.WriteString("}\n")
+	}
+	for i, builtin := range program.Builtins {
+		sb.WriteString(fmt.Sprintf("builtin %d %s\n", i, builtin))
+	}
+	for i, fn := range program.Funcs {
+		if fn.Params > 0 {
+			sb.WriteString(fmt.Sprintf("func %d %s (%d params, %d locals):\n",
+				i, fn.Name, fn.Params, fn.Locals))
+		} else {
+			sb.WriteString(fmt.Sprintf("func %d %s (%d locals):\n", i, fn.Name, fn.Locals))
+		}
+		for pc := 0; pc < len(fn.Code); {
+			sb.WriteString(fmt.Sprintf("\t%s\n", DisassembleInstr(program, fn.Code, pc)))
+			size := Opcode(fn.Code[pc]).Size()
+			if size == 0 {
+				break
+			}
+			pc += size
+		}
+	}
+	return sb.String()
+}
+
+// DisassembleInstr formats the instruction at pc, annotating constants and
+// structs with their value and name.
+func DisassembleInstr(program *Program, code []byte, pc int) string {
+	op := Opcode(code[pc])
+	text := fmt.Sprintf("%04d %s", pc, op)
+	if op.Size() == 0 || pc+op.Size() > len(code) {
+		return text
+	}
+	operands := Operands(code, pc)
+	for _, operand := range operands {
+		text += fmt.Sprintf(" %d", operand)
+	}
+	switch {
+	case op == OpConst && operands[0] < len(program.Constants):
+		text += fmt.Sprintf("  ; %s", program.Constants[operands[0]].Format())
+	case op == OpNew && operands[0] < len(program.Structs):
+		text += fmt.Sprintf("  ; %s", program.Structs[operands[0]].Name)
+	case op == OpCall && operands[0] < len(program.Funcs):
+		text += fmt.Sprintf("  ; %s", program.Funcs[operands[0]].Name)
+	case op == OpDispatch && operands[0] < len(program.Tables):
+		text += fmt.Sprintf("  ; %s", program.Tables[operands[0]].Name)
+	case op == OpBuiltin && operands[0] < len(program.Builtins):
+		text += fmt.Sprintf("  ; %s", program.Builtins[operands[0]])
+	}
+	return text
+}
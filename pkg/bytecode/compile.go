@@ -0,0 +1,341 @@
+package bytecode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Compiles the three-address code to bytecode.
+
+	Every local of a function gets a numbered slot, starting with the
+	parameters of a method. Each instruction pushes its operands, applies an
+	operation and stores the result, and jumps to labels are patched once
+	the function is complete. Functions are numbered like ir.Program.Funcs,
+	and each method of an interface gets a table in the order of the
+	interfaces and their methods.
+*/
+
+type compiler struct {
+	source    *ir.Program
+	program   *Program
+	constants map[Constant]int
+	code      []byte
+	locals    map[string]int
+	labels    map[string]int
+	patches   map[int]string // Jump operand offsets and their labels
+}
+
+func Compile(source *ir.Program) *Program {
+	cp := compiler{
+		source:    source,
+		program:   &Program{},
+		constants: make(map[Constant]int),
+	}
+
+	for i, st := range source.Structs {
+		compiled := Struct{Name: st.Name, Constructor: i, Ref: st.Ref}
+		for _, field := range st.Fields {
+			compiled.Fields = append(compiled.Fields, Field{Name: field.Lexeme, Type: field.Type})
+		}
+		cp.program.Structs = append(cp.program.Structs, compiled)
+	}
+	for _, st := range source.Structs {
+		if !st.Interface {
+			continue
+		}
+		for _, signature := range st.Methods {
+			table := Table{Name: signature.Name}
+			_, lexeme, _ := strings.Cut(signature.Name, ".")
+			for _, variant := range st.Variants {
+				table.Funcs = append(table.Funcs, cp.funcIndex(variant+"."+lexeme))
+			}
+			cp.program.Tables = append(cp.program.Tables, table)
+		}
+	}
+	for _, st := range source.Structs {
+		cp.compileFunc(st.Constructor)
+	}
+	for _, method := range source.Methods {
+		cp.compileFunc(method)
+	}
+	cp.program.Main = len(cp.program.Funcs)
+	cp.compileFunc(source.Main)
+
+	return cp.program
+}
+
+func (cp *compiler) compileFunc(fn *ir.Func) {
+	cp.code = nil
+	cp.locals = make(map[string]int)
+	cp.labels = make(map[string]int)
+	cp.patches = make(map[int]string)
+
+	for _, local := range append(append([]ir.Operand{}, fn.Params...), fn.Locals...) {
+		if _, exists := cp.locals[local.String()]; !exists {
+			cp.locals[local.String()] = len(cp.locals)
+		}
+	}
+	for _, instr := range fn.Code {
+		cp.compile(instr)
+	}
+	if last := len(fn.Code) - 1; last < 0 || fn.Code[last].Op != ir.OpReturn {
+		cp.emit(OpReturn)
+	}
+
+	for at, label := range cp.patches {
+		target, ok := cp.labels[label]
+		if !ok {
+			panic(fmt.Sprintf("jump to unknown label %s", label))
+		}
+		binary.BigEndian.PutUint32(cp.code[at:], uint32(target))
+	}
+
+	cp.program.Funcs = append(cp.program.Funcs, Func{
+		Name:   fn.Name,
+		Params: len(fn.Params),
+		Locals: len(cp.locals),
+		Code:   cp.code,
+	})
+}
+
+func (cp *compiler) compile(instr ir.Instr) {
+
+	switch instr.Op {
+
+	case ir.OpCopy:
+		cp.push(instr.Arg1)
+		cp.store(instr.Dst)
+
+	case ir.OpBinary:
+		cp.push(instr.Arg1)
+		cp.push(instr.Arg2)
+		cp.emit(binaryOpcode(instr.Operator, instr.Arg1.Type))
+		cp.store(instr.Dst)
+
+	case ir.OpNot:
+		cp.push(instr.Arg1)
+		cp.emit(OpNot)
+		cp.store(instr.Dst)
+
+	case ir.OpLabel:
+		cp.labels[instr.Label] = len(cp.code)
+
+	case ir.OpJump:
+		cp.jump(OpJump, instr.Label)
+
+	case ir.OpJumpIf:
+		cp.push(instr.Arg1)
+		cp.jump(OpJumpIf, instr.Label)
+
+	case ir.OpAlloc:
+		cp.emit(OpNew, cp.structIndex(instr.Dst.Type))
+		cp.store(instr.Dst)
+
+	case ir.OpLoad:
+		cp.push(instr.Arg1)
+		typeHint := instr.Arg1.Type
+		for _, field := range strings.Split(instr.Field, ".") {
+			typeHint = cp.field(OpGetField, typeHint, field)
+		}
+		cp.store(instr.Dst)
+
+	case ir.OpStore:
+		cp.push(instr.Dst)
+		path := strings.Split(instr.Field, ".")
+		typeHint := instr.Dst.Type
+		for _, field := range path[:len(path)-1] {
+			typeHint = cp.field(OpGetField, typeHint, field)
+		}
+		cp.push(instr.Arg1)
+		cp.field(OpSetField, typeHint, path[len(path)-1])
+
+	case ir.OpPrint:
+		cp.push(instr.Arg1)
+		cp.emit(OpPrint)
+
+	case ir.OpCall:
+		cp.push(instr.Arg1)
+		for _, arg := range instr.Args {
+			cp.push(arg)
+		}
+		if cp.source.IsInterface(instr.Arg1.Type) {
+			cp.emit(OpDispatch, cp.tableIndex(instr.Func))
+		} else {
+			cp.emit(OpCall, cp.funcIndex(instr.Func))
+		}
+		if instr.Dst.Kind != ir.OperandZero {
+			cp.store(instr.Dst)
+		}
+
+	case ir.OpReturn:
+		cp.push(instr.Arg1)
+		cp.emit(OpReturn)
+
+	case ir.OpBuiltin:
+		for _, arg := range instr.Args {
+			cp.push(arg)
+		}
+		cp.emit(OpBuiltin, cp.builtinIndex(instr.Func))
+		if instr.Dst.Kind != ir.OperandZero {
+			cp.store(instr.Dst)
+		}
+
+	default:
+		panic(fmt.Sprintf("cannot compile %s", instr))
+	}
+}
+
+// builtinIndex returns the index of a function of the standard library in
+// the builtins of the program, adding it the first time.
+func (cp *compiler) builtinIndex(name string) int {
+	for i, builtin := range cp.program.Builtins {
+		if builtin == name {
+			return i
+		}
+	}
+	cp.program.Builtins = append(cp.program.Builtins, name)
+	return len(cp.program.Builtins) - 1
+}
+
+func (cp *compiler) push(operand ir.Operand) {
+	switch operand.Kind {
+	case ir.OperandTemp, ir.OperandVar:
+		cp.emit(OpLoad, cp.locals[operand.String()])
+	case ir.OperandSelf:
+		cp.emit(OpSelf)
+	case ir.OperandInt:
+		cp.emit(OpConst, cp.constant(Constant{Kind: ConstantInt, Int: int32(operand.Number)}))
+	case ir.OperandFloat:
+		cp.emit(OpConst, cp.constant(Constant{Kind: ConstantFloat, Float: float32(operand.Float)}))
+	case ir.OperandBool:
+		cp.emit(OpConst, cp.constant(Constant{Kind: ConstantBool, Int: int32(operand.Number)}))
+	case ir.OperandString:
+		cp.emit(OpConst, cp.constant(Constant{Kind: ConstantString, String: operand.Lexeme}))
+	default:
+		panic(fmt.Sprintf("cannot compile operand %s", operand))
+	}
+}
+
+func (cp *compiler) store(dst ir.Operand) {
+	cp.emit(OpStore, cp.locals[dst.String()])
+}
+
+// field emits a field access on a struct and returns the type of the field.
+func (cp *compiler) field(op Opcode, typeHint string, lexeme string) string {
+	st := cp.program.Structs[cp.structIndex(typeHint)]
+	for i, field := range st.Fields {
+		if field.Name == lexeme {
+			cp.emit(op, i)
+			return field.Type
+		}
+	}
+	panic(fmt.Sprintf("unknown field %s in %s", lexeme, st.Name))
+}
+
+func (cp *compiler) funcIndex(name string) int {
+	for i, method := range cp.source.Methods {
+		if method.Name == name {
+			return len(cp.source.Structs) + i
+		}
+	}
+	panic(fmt.Sprintf("unknown method %s", name))
+}
+
+func (cp *compiler) tableIndex(name string) int {
+	for i, table := range cp.program.Tables {
+		if table.Name == name {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("unknown method %s", name))
+}
+
+func (cp *compiler) structIndex(name string) int {
+	for i, st := range cp.program.Structs {
+		if st.Name == name {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("unknown struct %s", name))
+}
+
+// constant returns the index of a constant in the pool, adding it the
+// first time it is seen. NaN is never equal to itself, so it is compared
+// by its bits.
+func (cp *compiler) constant(constant Constant) int {
+	key := constant
+	if constant.Kind == ConstantFloat {
+		key.Float = 0
+		key.Int = int32(math.Float32bits(constant.Float))
+	}
+	if index, exists := cp.constants[key]; exists {
+		return index
+	}
+	index := len(cp.program.Constants)
+	cp.constants[key] = index
+	cp.program.Constants = append(cp.program.Constants, constant)
+	return index
+}
+
+func (cp *compiler) jump(op Opcode, label string) {
+	cp.emit(op, 0)
+	cp.patches[len(cp.code)-4] = label
+}
+
+func (cp *compiler) emit(op Opcode, operands ...int) {
+	cp.code = append(cp.code, byte(op))
+	for i, width := range opcodes[op].operands {
+		switch width {
+		case 2:
+			if operands[i] > math.MaxUint16 {
+				panic(fmt.Sprintf("operand of %s out of range", op))
+			}
+			cp.code = binary.BigEndian.AppendUint16(cp.code, uint16(operands[i]))
+		case 4:
+			cp.code = binary.BigEndian.AppendUint32(cp.code, uint32(operands[i]))
+		}
+	}
+}
+
+func binaryOpcode(operator string, typeHint string) Opcode {
+	float := typeHint == "Float"
+	switch operator {
+	case "+":
+		if float {
+			return OpAddFloat
+		}
+		return OpAddInt
+	case "-":
+		if float {
+			return OpSubFloat
+		}
+		return OpSubInt
+	case "*":
+		if float {
+			return OpMulFloat
+		}
+		return OpMulInt
+	case "/":
+		if float {
+			return OpDivFloat
+		}
+		return OpDivInt
+	case "<":
+		if float {
+			return OpLessFloat
+		}
+		return OpLessInt
+	case ">":
+		if float {
+			return OpMoreFloat
+		}
+		return OpMoreInt
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
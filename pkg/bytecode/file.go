@@ -0,0 +1,311 @@
+package bytecode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	The .bipc file format.
+
+	A file starts with the magic "BIPC" and a version byte, followed by the
+	constants, the structs, the functions, the tables, the names of the
+	builtins and the index of main. Structs are their name, constructor, a
+	byte that is 1 for ref structs and their fields, functions are their
+	name, parameters, locals and code, and tables are their name and the
+	indices of their functions. Counts,
+	lengths and indices are unsigned varints, ints are signed varints,
+	floats are their four bytes in big-endian order and strings are a
+	length followed by their bytes.
+*/
+
+const magic = "BIPC"
+const version = 5
+
+func Encode(program *Program) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+
+	putUint(&buf, len(program.Constants))
+	for _, constant := range program.Constants {
+		buf.WriteByte(byte(constant.Kind))
+		switch constant.Kind {
+		case ConstantInt, ConstantBool:
+			putInt(&buf, int(constant.Int))
+		case ConstantFloat:
+			buf.Write(binary.BigEndian.AppendUint32(nil, math.Float32bits(constant.Float)))
+		case ConstantString:
+			putString(&buf, constant.String)
+		}
+	}
+
+	putUint(&buf, len(program.Structs))
+	for _, st := range program.Structs {
+		putString(&buf, st.Name)
+		putUint(&buf, st.Constructor)
+		if st.Ref {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		putUint(&buf, len(st.Fields))
+		for _, field := range st.Fields {
+			putString(&buf, field.Name)
+			putString(&buf, field.Type)
+		}
+	}
+
+	putUint(&buf, len(program.Funcs))
+	for _, fn := range program.Funcs {
+		putString(&buf, fn.Name)
+		putUint(&buf, fn.Params)
+		putUint(&buf, fn.Locals)
+		putUint(&buf, len(fn.Code))
+		buf.Write(fn.Code)
+	}
+
+	putUint(&buf, len(program.Tables))
+	for _, table := range program.Tables {
+		putString(&buf, table.Name)
+		putUint(&buf, len(table.Funcs))
+		for _, index := range table.Funcs {
+			putUint(&buf, index)
+		}
+	}
+
+	putUint(&buf, len(program.Builtins))
+	for _, builtin := range program.Builtins {
+		putString(&buf, builtin)
+	}
+
+	putUint(&buf, program.Main)
+	return buf.Bytes()
+}
+
+func Decode(data []byte) (*Program, error) {
+	dec := decoder{reader: bufio.NewReader(bytes.NewReader(data)), size: len(data)}
+
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(dec.reader, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a bipc file")
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported bipc version %d", header[len(magic)])
+	}
+
+	program := &Program{}
+	program.Constants = make([]Constant, dec.length())
+	for i := range program.Constants {
+		constant := Constant{Kind: ConstantKind(dec.byte())}
+		switch constant.Kind {
+		case ConstantInt, ConstantBool:
+			constant.Int = int32(dec.int())
+		case ConstantFloat:
+			constant.Float = math.Float32frombits(binary.BigEndian.Uint32(dec.bytes(4)))
+		case ConstantString:
+			constant.String = dec.string()
+		default:
+			dec.fail(fmt.Errorf("unknown constant kind %d", constant.Kind))
+		}
+		program.Constants[i] = constant
+	}
+
+	program.Structs = make([]Struct, dec.length())
+	for i := range program.Structs {
+		st := Struct{Name: dec.string(), Constructor: dec.uint(), Ref: dec.byte() != 0}
+		st.Fields = make([]Field, dec.length())
+		for j := range st.Fields {
+			st.Fields[j] = Field{Name: dec.string(), Type: dec.string()}
+		}
+		program.Structs[i] = st
+	}
+
+	program.Funcs = make([]Func, dec.length())
+	for i := range program.Funcs {
+		fn := Func{Name: dec.string(), Params: dec.length(), Locals: dec.length()}
+		fn.Code = dec.bytes(dec.length())
+		program.Funcs[i] = fn
+	}
+
+	program.Tables = make([]Table, dec.length())
+	for i := range program.Tables {
+		table := Table{Name: dec.string()}
+		table.Funcs = make([]int, dec.length())
+		for j := range table.Funcs {
+			table.Funcs[j] = dec.uint()
+		}
+		program.Tables[i] = table
+	}
+
+	program.Builtins = make([]string, dec.length())
+	for i := range program.Builtins {
+		program.Builtins[i] = dec.string()
+	}
+
+	program.Main = dec.uint()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return program, Verify(program)
+}
+
+// Verify checks that every instruction is complete, every index is in range
+// and every builtin exists, so the VM never reads outside the program.
+func Verify(program *Program) error {
+	if program.Main >= len(program.Funcs) {
+		return fmt.Errorf("main %d out of range", program.Main)
+	}
+	for _, st := range program.Structs {
+		if st.Constructor >= len(program.Funcs) {
+			return fmt.Errorf("constructor of %s out of range", st.Name)
+		}
+	}
+	for _, table := range program.Tables {
+		if len(table.Funcs) == 0 {
+			return fmt.Errorf("table %s is empty", table.Name)
+		}
+		for _, index := range table.Funcs {
+			if index >= len(program.Funcs) {
+				return fmt.Errorf("function of table %s out of range", table.Name)
+			}
+			if program.Funcs[index].Params != program.Funcs[table.Funcs[0]].Params {
+				return fmt.Errorf("functions of table %s take different parameters", table.Name)
+			}
+		}
+	}
+	for _, builtin := range program.Builtins {
+		if _, ok := ir.GetBuiltin(builtin); !ok {
+			return fmt.Errorf("unknown builtin %s", builtin)
+		}
+	}
+	for _, fn := range program.Funcs {
+		if fn.Params > fn.Locals {
+			return fmt.Errorf("%s: more params than locals", fn.Name)
+		}
+		for pc := 0; pc < len(fn.Code); {
+			op := Opcode(fn.Code[pc])
+			size := op.Size()
+			if size == 0 || pc+size > len(fn.Code) {
+				return fmt.Errorf("%s: invalid instruction at %d", fn.Name, pc)
+			}
+			var limit int
+			switch op {
+			case OpConst:
+				limit = len(program.Constants)
+			case OpLoad, OpStore:
+				limit = fn.Locals
+			case OpJump, OpJumpIf:
+				limit = len(fn.Code) + 1
+			case OpNew:
+				limit = len(program.Structs)
+			case OpCall:
+				limit = len(program.Funcs)
+			case OpDispatch:
+				limit = len(program.Tables)
+			case OpBuiltin:
+				limit = len(program.Builtins)
+			default:
+				limit = -1
+			}
+			if operands := Operands(fn.Code, pc); limit >= 0 && operands[0] >= limit {
+				return fmt.Errorf("%s: operand of %s at %d out of range", fn.Name, op, pc)
+			}
+			pc += size
+		}
+	}
+	return nil
+}
+
+func putUint(buf *bytes.Buffer, value int) {
+	buf.Write(binary.AppendUvarint(nil, uint64(value)))
+}
+
+func putInt(buf *bytes.Buffer, value int) {
+	buf.Write(binary.AppendVarint(nil, int64(value)))
+}
+
+func putString(buf *bytes.Buffer, text string) {
+	putUint(buf, len(text))
+	buf.WriteString(text)
+}
+
+// decoder remembers the first error, after which every read returns zero.
+type decoder struct {
+	reader *bufio.Reader
+	size   int
+	err    error
+}
+
+func (dec *decoder) fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
+
+func (dec *decoder) uint() int {
+	if dec.err != nil {
+		return 0
+	}
+	value, err := binary.ReadUvarint(dec.reader)
+	if err != nil || value > math.MaxInt32 {
+		dec.fail(errors.New("truncated or corrupt bipc file"))
+		return 0
+	}
+	return int(value)
+}
+
+// length reads a count or length, which can never exceed the file size.
+func (dec *decoder) length() int {
+	value := dec.uint()
+	if value > dec.size {
+		dec.fail(errors.New("corrupt bipc file"))
+		return 0
+	}
+	return value
+}
+
+func (dec *decoder) int() int {
+	if dec.err != nil {
+		return 0
+	}
+	value, err := binary.ReadVarint(dec.reader)
+	if err != nil {
+		dec.fail(errors.New("truncated or corrupt bipc file"))
+		return 0
+	}
+	return int(value)
+}
+
+func (dec *decoder) byte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	value, err := dec.reader.ReadByte()
+	if err != nil {
+		dec.fail(errors.New("truncated bipc file"))
+	}
+	return value
+}
+
+func (dec *decoder) bytes(length int) []byte {
+	data := make([]byte, length)
+	if dec.err != nil {
+		return data
+	}
+	if _, err := io.ReadFull(dec.reader, data); err != nil {
+		dec.fail(errors.New("truncated bipc file"))
+	}
+	return data
+}
+
+func (dec *decoder) string() string {
+	return string(dec.bytes(dec.length()))
+}
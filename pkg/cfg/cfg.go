@@ -0,0 +1,184 @@
+package cfg
+
+import (
+	"fmt"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Partitions three-address code into basic blocks and
+	connects them in a control-flow graph.
+*/
+
+type Block struct {
+	Index  int
+	Instrs []ir.Instr
+	Preds  []*Block
+	Succs  []*Block
+
+	// Set by ComputeDominators
+	IDom      *Block
+	Dominated []*Block
+}
+
+func (block *Block) Name() string {
+	return fmt.Sprintf("B%d", block.Index)
+}
+
+// Label returns the label the block starts with, if any.
+func (block *Block) Label() (string, bool) {
+	if len(block.Instrs) > 0 && block.Instrs[0].Op == ir.OpLabel {
+		return block.Instrs[0].Label, true
+	}
+	return "", false
+}
+
+// Last returns the final instruction of the block, if any.
+func (block *Block) Last() (ir.Instr, bool) {
+	if len(block.Instrs) == 0 {
+		return ir.Instr{}, false
+	}
+	return block.Instrs[len(block.Instrs)-1], true
+}
+
+type Graph struct {
+	Func   *ir.Func
+	Entry  *Block
+	Exit   *Block // An empty block every path ends in
+	Blocks []*Block
+}
+
+func Build(fn *ir.Func) *Graph {
+	graph := &Graph{Func: fn}
+
+	block := graph.newBlock()
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpLabel && len(block.Instrs) > 0 {
+			block = graph.newBlock()
+		}
+		block.Instrs = append(block.Instrs, instr)
+		if instr.IsJump() {
+			block = graph.newBlock()
+		}
+	}
+	if len(block.Instrs) > 0 || len(graph.Blocks) == 1 {
+		block = graph.newBlock()
+	}
+	graph.Entry = graph.Blocks[0]
+	graph.Exit = block
+
+	graph.connect()
+	return graph
+}
+
+func (graph *Graph) newBlock() *Block {
+	block := &Block{Index: len(graph.Blocks)}
+	graph.Blocks = append(graph.Blocks, block)
+	return block
+}
+
+func (graph *Graph) connect() {
+	labels := make(map[string]*Block)
+	for _, block := range graph.Blocks {
+		if label, ok := block.Label(); ok {
+			labels[label] = block
+		}
+	}
+
+	for i, block := range graph.Blocks {
+		if block == graph.Exit {
+			break
+		}
+		last, ok := block.Last()
+		if ok && last.IsJump() {
+			target, exists := labels[last.Label]
+			if !exists {
+				panic(fmt.Sprintf("jump to unknown label %s", last.Label))
+			}
+			addEdge(block, target)
+			if last.Op == ir.OpJump {
+				continue
+			}
+		}
+		addEdge(block, graph.Blocks[i+1])
+	}
+}
+
+func addEdge(from *Block, to *Block) {
+	for _, succ := range from.Succs {
+		if succ == to {
+			return
+		}
+	}
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// Reachable returns the blocks that can be reached from the entry.
+func (graph *Graph) Reachable() map[*Block]bool {
+	reachable := make(map[*Block]bool)
+	stack := []*Block{graph.Entry}
+	for len(stack) > 0 {
+		block := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[block] {
+			continue
+		}
+		reachable[block] = true
+		stack = append(stack, block.Succs...)
+	}
+	return reachable
+}
+
+// Unreachable returns the non-empty blocks that can never execute,
+// ignoring blocks that consist of a lone label.
+func (graph *Graph) Unreachable() []*Block {
+	reachable := graph.Reachable()
+	var blocks []*Block
+	for _, block := range graph.Blocks {
+		if reachable[block] {
+			continue
+		}
+		for _, instr := range block.Instrs {
+			if instr.Op != ir.OpLabel {
+				blocks = append(blocks, block)
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// ReversePostorder orders the reachable blocks so that every block comes
+// before its successors, except along back edges.
+func (graph *Graph) ReversePostorder() []*Block {
+	visited := make(map[*Block]bool)
+	var postorder []*Block
+	var visit func(block *Block)
+	visit = func(block *Block) {
+		visited[block] = true
+		for _, succ := range block.Succs {
+			if !visited[succ] {
+				visit(succ)
+			}
+		}
+		postorder = append(postorder, block)
+	}
+	visit(graph.Entry)
+
+	order := make([]*Block, len(postorder))
+	for i, block := range postorder {
+		order[len(postorder)-1-i] = block
+	}
+	return order
+}
+
+// Code flattens the blocks back into a linear instruction sequence.
+func (graph *Graph) Code() []ir.Instr {
+	var code []ir.Instr
+	for _, block := range graph.Blocks {
+		code = append(code, block.Instrs...)
+	}
+	return code
+}
@@ -0,0 +1,164 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+var (
+	x = ir.Operand{Kind: ir.OperandVar, Lexeme: "x", Type: "Int"}
+	c = ir.Operand{Kind: ir.OperandVar, Lexeme: "c", Type: "Bool"}
+)
+
+func label(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpLabel, Label: name}
+}
+
+func jump(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJump, Label: name}
+}
+
+func jumpIf(condition ir.Operand, name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJumpIf, Arg1: condition, Label: name}
+}
+
+func assign(dst ir.Operand, value int) ir.Instr {
+	return ir.Instr{Op: ir.OpCopy, Dst: dst, Arg1: ir.NewInt(value)}
+}
+
+func print(operand ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpPrint, Arg1: operand}
+}
+
+func build(code ...ir.Instr) *Graph {
+	return Build(&ir.Func{Name: "main", Code: code})
+}
+
+// The blocks of an if and an else joining again
+func diamond() *Graph {
+	return build(
+		assign(x, 1),
+		jumpIf(c, "Else"),
+		assign(x, 2),
+		jump("End"),
+		label("Else"),
+		assign(x, 3),
+		label("End"),
+		print(x),
+	)
+}
+
+// A loop, which the language cannot express but the graph can hold
+func loop() *Graph {
+	return build(
+		assign(x, 0),
+		label("Top"),
+		jumpIf(c, "Body"),
+		jump("End"),
+		label("Body"),
+		assign(x, 1),
+		jump("Top"),
+		label("End"),
+		print(x),
+	)
+}
+
+// edges returns the successors of each block by index.
+func edges(graph *Graph) [][]int {
+	result := make([][]int, len(graph.Blocks))
+	for i, block := range graph.Blocks {
+		result[i] = indexes(block.Succs)
+	}
+	return result
+}
+
+func indexes(blocks []*Block) []int {
+	result := []int{}
+	for _, block := range blocks {
+		result = append(result, block.Index)
+	}
+	return result
+}
+
+func equal(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph *Graph
+		succs [][]int
+	}{
+		{"empty", build(), [][]int{{1}, {}}},
+		{"straight line", build(assign(x, 1), print(x)), [][]int{{1}, {}}},
+		{"diamond", diamond(), [][]int{{2, 1}, {3}, {3}, {4}, {}}},
+		{"loop", loop(), [][]int{{1}, {3, 2}, {4}, {1}, {5}, {}}},
+		{"skip", build(jump("End"), print(x), label("End")), [][]int{{2}, {2}, {3}, {}}},
+	}
+	for _, test := range tests {
+		succs := edges(test.graph)
+		if len(succs) != len(test.succs) {
+			t.Errorf("%s: %d blocks, want %d", test.name, len(succs), len(test.succs))
+			continue
+		}
+		for i := range succs {
+			if !equal(succs[i], test.succs[i]) {
+				t.Errorf("%s: B%d goes to %v, want %v", test.name, i, succs[i], test.succs[i])
+			}
+		}
+		if test.graph.Exit != test.graph.Blocks[len(test.graph.Blocks)-1] || len(test.graph.Exit.Instrs) > 0 {
+			t.Errorf("%s: the exit is not the last, empty block", test.name)
+		}
+	}
+}
+
+func TestBuildRejectsUnknownLabels(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a jump to an unknown label was accepted")
+		}
+	}()
+	build(jump("Missing"))
+}
+
+func TestUnreachable(t *testing.T) {
+	graph := build(jump("End"), print(x), label("Dead"), label("End"), print(x))
+	if got := indexes(graph.Unreachable()); !equal(got, []int{1}) {
+		t.Errorf("unreachable blocks %v, want [1]", got)
+	}
+	if got := indexes(diamond().Unreachable()); len(got) > 0 {
+		t.Errorf("unreachable blocks %v in a diamond", got)
+	}
+}
+
+func TestReversePostorder(t *testing.T) {
+	for _, graph := range []*Graph{diamond(), loop()} {
+		order := graph.ReversePostorder()
+		position := make(map[*Block]int)
+		for i, block := range order {
+			position[block] = i
+		}
+		if order[0] != graph.Entry || len(order) != len(graph.Blocks) {
+			t.Errorf("order %v does not start at the entry and cover every block", indexes(order))
+		}
+		graph.ComputeDominators()
+		for _, block := range order {
+			for _, succ := range block.Succs {
+				// Only back edges, whose target dominates their source, go up
+				if position[succ] <= position[block] && !graph.Dominates(succ, block) {
+					t.Errorf("B%d comes after its successor B%d", block.Index, succ.Index)
+				}
+			}
+		}
+	}
+}
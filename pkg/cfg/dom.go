@@ -0,0 +1,102 @@
+package cfg
+
+/*
+	Dominators and dominance frontiers.
+	Immediate dominators are computed with the iterative algorithm of
+	Cooper, Harvey and Kennedy over the reverse postorder.
+*/
+
+func (graph *Graph) ComputeDominators() {
+	order := graph.ReversePostorder()
+	position := make(map[*Block]int)
+	for i, block := range order {
+		position[block] = i
+	}
+	for _, block := range graph.Blocks {
+		block.IDom = nil
+		block.Dominated = nil
+	}
+
+	intersect := func(a *Block, b *Block) *Block {
+		for a != b {
+			for position[a] > position[b] {
+				a = a.IDom
+			}
+			for position[b] > position[a] {
+				b = b.IDom
+			}
+		}
+		return a
+	}
+
+	graph.Entry.IDom = graph.Entry
+	for changed := true; changed; {
+		changed = false
+		for _, block := range order[1:] {
+			var idom *Block
+			for _, pred := range block.Preds {
+				if pred.IDom == nil {
+					continue
+				}
+				if idom == nil {
+					idom = pred
+				} else {
+					idom = intersect(pred, idom)
+				}
+			}
+			if block.IDom != idom {
+				block.IDom = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, block := range order[1:] {
+		block.IDom.Dominated = append(block.IDom.Dominated, block)
+	}
+	graph.Entry.IDom = nil
+}
+
+// Dominates reports whether every path from the entry to b goes through a.
+// Requires ComputeDominators.
+func (graph *Graph) Dominates(a *Block, b *Block) bool {
+	for block := b; block != nil; block = block.IDom {
+		if block == a {
+			return true
+		}
+	}
+	return false
+}
+
+// DominanceFrontiers returns, for each block, the blocks where its
+// dominance ends. Requires ComputeDominators.
+func (graph *Graph) DominanceFrontiers() map[*Block][]*Block {
+	frontiers := make(map[*Block][]*Block)
+	reachable := graph.Reachable()
+	for _, block := range graph.Blocks {
+		// The entry has an implicit edge from outside the function
+		if !reachable[block] || (len(block.Preds) < 2 && block != graph.Entry) {
+			continue
+		}
+		for _, pred := range block.Preds {
+			if !reachable[pred] {
+				continue
+			}
+			for runner := pred; runner != nil && runner != block.IDom; runner = runner.IDom {
+				if !containsBlock(frontiers[runner], block) {
+					frontiers[runner] = append(frontiers[runner], block)
+				}
+			}
+		}
+	}
+	return frontiers
+}
+
+func containsBlock(blocks []*Block, block *Block) bool {
+	for _, b := range blocks {
+		if b == block {
+			return true
+		}
+	}
+	return false
+}
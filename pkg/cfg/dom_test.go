@@ -0,0 +1,86 @@
+package cfg
+
+import (
+	"testing"
+)
+
+func TestDominators(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph *Graph
+		idoms []int // The immediate dominator of each block, -1 for none
+	}{
+		{"straight line", build(assign(x, 1), print(x)), []int{-1, 0}},
+		{"diamond", diamond(), []int{-1, 0, 0, 0, 3}},
+		{"loop", loop(), []int{-1, 0, 1, 1, 2, 4}},
+		{"skip", build(jump("End"), print(x), label("End")), []int{-1, -1, 0, 2}},
+	}
+	for _, test := range tests {
+		test.graph.ComputeDominators()
+		for i, block := range test.graph.Blocks {
+			idom := -1
+			if block.IDom != nil {
+				idom = block.IDom.Index
+			}
+			if idom != test.idoms[i] {
+				t.Errorf("%s: B%d is dominated by B%d, want B%d", test.name, i, idom, test.idoms[i])
+			}
+			if block.IDom != nil && !containsBlock(block.IDom.Dominated, block) {
+				t.Errorf("%s: B%d is missing from what B%d dominates", test.name, i, idom)
+			}
+		}
+	}
+}
+
+func TestDominates(t *testing.T) {
+	graph := loop()
+	graph.ComputeDominators()
+	blocks := graph.Blocks
+	tests := []struct {
+		a, b int
+		want bool
+	}{
+		{0, 5, true},
+		{1, 3, true},
+		{3, 3, true},
+		{3, 1, false},
+		{2, 3, false},
+		{3, 4, false},
+		{2, 5, true},
+	}
+	for _, test := range tests {
+		if got := graph.Dominates(blocks[test.a], blocks[test.b]); got != test.want {
+			t.Errorf("B%d dominates B%d is %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestBackEdges checks that a back edge, whose target dominates its
+// source, leaves the dominators alone and puts the loop header in the
+// frontier of the blocks of the loop.
+func TestBackEdges(t *testing.T) {
+	graph := loop()
+	graph.ComputeDominators()
+	header, body := graph.Blocks[1], graph.Blocks[3]
+	if !containsBlock(body.Succs, header) || !graph.Dominates(header, body) {
+		t.Fatal("the jump to Top is not a back edge")
+	}
+	frontiers := graph.DominanceFrontiers()
+	for _, block := range []*Block{header, body} {
+		if got := indexes(frontiers[block]); !equal(got, []int{1}) {
+			t.Errorf("the frontier of B%d is %v, want [1]", block.Index, got)
+		}
+	}
+}
+
+func TestDominanceFrontiers(t *testing.T) {
+	graph := diamond()
+	graph.ComputeDominators()
+	frontiers := graph.DominanceFrontiers()
+	want := [][]int{{}, {3}, {3}, {}, {}}
+	for i, block := range graph.Blocks {
+		if got := indexes(frontiers[block]); !equal(got, want[i]) {
+			t.Errorf("the frontier of B%d is %v, want %v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dot renders the graphs as one Graphviz digraph with a cluster per
+// function. Unreachable blocks are drawn dashed.
+func Dot(graphs ...*Graph) string {
+	var sb strings.Builder
+	sb.WriteString("digraph cfg {\n")
+	sb.WriteString("\tnode [shape=box fontname=\"monospace\"];\n")
+	for _, graph := range graphs {
+		name := graph.Func.Name
+		reachable := graph.Reachable()
+		sb.WriteString(fmt.Sprintf("\tsubgraph \"cluster_%s\" {\n", name))
+		sb.WriteString(fmt.Sprintf("\t\tlabel=%s;\n", quote(name)))
+		for _, block := range graph.Blocks {
+			var label strings.Builder
+			label.WriteString(block.Name())
+			if block == graph.Entry {
+				label.WriteString(" (entry)")
+			}
+			if block == graph.Exit {
+				label.WriteString(" (exit)")
+			}
+			label.WriteString("\\l")
+			for _, instr := range block.Instrs {
+				label.WriteString(escape(instr.String()))
+				label.WriteString("\\l")
+			}
+			style := ""
+			if !reachable[block] {
+				style = " style=dashed"
+			}
+			sb.WriteString(fmt.Sprintf("\t\t%s [label=\"%s\"%s];\n",
+				quote(name+"."+block.Name()), label.String(), style))
+		}
+		for _, block := range graph.Blocks {
+			for _, succ := range block.Succs {
+				sb.WriteString(fmt.Sprintf("\t\t%s -> %s;\n",
+					quote(name+"."+block.Name()),
+					quote(name+"."+succ.Name())))
+			}
+		}
+		sb.WriteString("\t}\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func quote(id string) string {
+	return fmt.Sprintf("\"%s\"", escape(id))
+}
+
+func escape(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	return strings.ReplaceAll(text, "\"", "\\\"")
+}
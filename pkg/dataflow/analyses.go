@@ -0,0 +1,254 @@
+package dataflow
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+// Liveness finds the variables that may be read before they are
+// written again. Backward, with union as meet.
+func Liveness(graph *cfg.Graph) Result[Set[string]] {
+	return Solve(graph, Analysis[Set[string]]{
+		Direction: Backward,
+		Boundary:  NewSet[string](),
+		Init:      func() Set[string] { return NewSet[string]() },
+		Meet:      Union[string],
+		Transfer: func(block *cfg.Block, out Set[string]) Set[string] {
+			live := out.Copy()
+			for i := len(block.Instrs) - 1; i >= 0; i-- {
+				TransferLive(block.Instrs[i], live)
+			}
+			return live
+		},
+		Equal: Equal[string],
+	})
+}
+
+// WalkLive calls visit for each instruction of the block, from the last,
+// with the variables live after it. One set is updated as the walk goes,
+// so visit must not keep it.
+func WalkLive(block *cfg.Block, out Set[string], visit func(i int, live Set[string])) {
+	live := out.Copy()
+	for i := len(block.Instrs) - 1; i >= 0; i-- {
+		visit(i, live)
+		TransferLive(block.Instrs[i], live)
+	}
+}
+
+// TransferLive updates the live variables backwards across an instruction.
+func TransferLive(instr ir.Instr, live Set[string]) {
+	if def, ok := instr.Def(); ok {
+		delete(live, def.String())
+	}
+	for _, use := range instr.Uses() {
+		if use.IsVariable() {
+			live[use.String()] = true
+		}
+	}
+}
+
+type Definition struct {
+	Variable string
+	Block    int // -1 for the implicit definition on entry
+	Index    int
+}
+
+func (definition Definition) IsEntry() bool {
+	return definition.Block < 0
+}
+
+// Reaching holds the definitions that may reach each block, as a bit per
+// definition numbered in Definitions. A temporary defined only once is left
+// out, since that definition is the one every read of it sees.
+type Reaching struct {
+	Result[Bits]
+	Definitions []Definition
+	variables   map[string][]int // The numbers of the definitions of each variable
+	single      map[string]Definition
+	numbers     map[*cfg.Block][]int // The number of the definition at each instruction, or -1
+}
+
+// ReachingDefinitions finds the definitions that may reach each block.
+// Every variable has an implicit definition on entry, so a read reached by
+// it may read an unassigned variable. Forward, with union as meet.
+func ReachingDefinitions(graph *cfg.Graph) *Reaching {
+	counts := make(map[string]int)
+	for _, block := range graph.Blocks {
+		for _, instr := range block.Instrs {
+			if def, ok := instr.Def(); ok {
+				counts[def.String()] += 1
+			}
+		}
+	}
+	reaching := &Reaching{
+		variables: make(map[string][]int),
+		single:    make(map[string]Definition),
+		numbers:   make(map[*cfg.Block][]int),
+	}
+	add := func(definition Definition) int {
+		number := len(reaching.Definitions)
+		reaching.Definitions = append(reaching.Definitions, definition)
+		reaching.variables[definition.Variable] = append(reaching.variables[definition.Variable], number)
+		return number
+	}
+
+	for _, local := range graph.Func.Locals {
+		if local.Kind == ir.OperandVar || counts[local.String()] > 1 {
+			add(Definition{Variable: local.String(), Block: -1, Index: -1})
+		}
+	}
+	entries := len(reaching.Definitions)
+	for _, block := range graph.Blocks {
+		numbers := make([]int, len(block.Instrs))
+		for i, instr := range block.Instrs {
+			numbers[i] = -1
+			def, ok := instr.Def()
+			if !ok {
+				continue
+			}
+			definition := Definition{Variable: def.String(), Block: block.Index, Index: i}
+			if def.Kind == ir.OperandTemp && counts[definition.Variable] == 1 {
+				reaching.single[definition.Variable] = definition
+				continue
+			}
+			numbers[i] = add(definition)
+		}
+		reaching.numbers[block] = numbers
+	}
+
+	size := len(reaching.Definitions)
+	boundary := NewBits(size)
+	for number := 0; number < entries; number++ {
+		boundary.Add(number)
+	}
+	// Each block kills every other definition of the variables it defines
+	// and generates the last definition of each
+	gen := make(map[*cfg.Block]Bits)
+	kill := make(map[*cfg.Block]Bits)
+	for _, block := range graph.Blocks {
+		gen[block], kill[block] = NewBits(size), NewBits(size)
+		for _, number := range reaching.numbers[block] {
+			if number < 0 {
+				continue
+			}
+			for _, other := range reaching.variables[reaching.Definitions[number].Variable] {
+				gen[block].Remove(other)
+				kill[block].Add(other)
+			}
+			gen[block].Add(number)
+		}
+	}
+
+	reaching.Result = Solve(graph, Analysis[Bits]{
+		Direction: Forward,
+		Boundary:  boundary,
+		Init:      func() Bits { return NewBits(size) },
+		Meet:      UnionBits,
+		Transfer: func(block *cfg.Block, in Bits) Bits {
+			out := in.Copy()
+			for i := range out {
+				out[i] = out[i]&^kill[block][i] | gen[block][i]
+			}
+			return out
+		},
+		Equal: EqualBits,
+	})
+	return reaching
+}
+
+// Walk calls visit for each instruction of the block with the definitions
+// reaching it. One set is updated as the walk goes, so visit must not keep
+// it.
+func (reaching *Reaching) Walk(block *cfg.Block, visit func(i int, before Bits)) {
+	before := reaching.In[block].Copy()
+	for i, number := range reaching.numbers[block] {
+		visit(i, before)
+		if number < 0 {
+			continue
+		}
+		for _, other := range reaching.variables[reaching.Definitions[number].Variable] {
+			before.Remove(other)
+		}
+		before.Add(number)
+	}
+}
+
+// Of returns the definitions of a variable in a set from Walk. The only
+// definition of a temporary defined once is returned whatever the set.
+func (reaching *Reaching) Of(set Bits, variable string) []Definition {
+	if definition, ok := reaching.single[variable]; ok {
+		return []Definition{definition}
+	}
+	var definitions []Definition
+	for _, number := range reaching.variables[variable] {
+		if set.Has(number) {
+			definitions = append(definitions, reaching.Definitions[number])
+		}
+	}
+	return definitions
+}
+
+type Expression struct {
+	Operator string
+	Arg1     string
+	Arg2     string
+}
+
+// ExpressionOf returns the expression computed by the instruction, if any.
+func ExpressionOf(instr ir.Instr) (Expression, bool) {
+	switch instr.Op {
+	case ir.OpBinary:
+		return Expression{
+			Operator: instr.Operator,
+			Arg1:     instr.Arg1.String(),
+			Arg2:     instr.Arg2.String(),
+		}, true
+	case ir.OpNot:
+		return Expression{Operator: "!", Arg1: instr.Arg1.String()}, true
+	default:
+		return Expression{}, false
+	}
+}
+
+// AvailableExpressions finds the expressions computed on every path to
+// each block and not invalidated since. Forward, with intersection as meet.
+func AvailableExpressions(graph *cfg.Graph) Result[Set[Expression]] {
+	universe := NewSet[Expression]()
+	for _, instr := range graph.Func.Code {
+		if expression, ok := ExpressionOf(instr); ok {
+			universe[expression] = true
+		}
+	}
+
+	return Solve(graph, Analysis[Set[Expression]]{
+		Direction: Forward,
+		Boundary:  NewSet[Expression](),
+		Init:      universe.Copy,
+		Meet:      Intersection[Expression],
+		Transfer: func(block *cfg.Block, in Set[Expression]) Set[Expression] {
+			available := in.Copy()
+			for _, instr := range block.Instrs {
+				TransferAvailable(instr, available)
+			}
+			return available
+		},
+		Equal: Equal[Expression],
+	})
+}
+
+// TransferAvailable updates the available expressions across an instruction.
+func TransferAvailable(instr ir.Instr, available Set[Expression]) {
+	expression, computes := ExpressionOf(instr)
+	def, ok := instr.Def()
+	if ok {
+		variable := def.String()
+		for other := range available {
+			if other.Arg1 == variable || other.Arg2 == variable {
+				delete(available, other)
+			}
+		}
+		if computes && expression.Arg1 != variable && expression.Arg2 != variable {
+			available[expression] = true
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package dataflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+var (
+	x  = ir.Operand{Kind: ir.OperandVar, Lexeme: "x", Type: "Int"}
+	y  = ir.Operand{Kind: ir.OperandVar, Lexeme: "y", Type: "Int"}
+	c  = ir.Operand{Kind: ir.OperandVar, Lexeme: "c", Type: "Bool"}
+	t1 = ir.Operand{Kind: ir.OperandTemp, Number: 1, Type: "Int"}
+	t2 = ir.Operand{Kind: ir.OperandTemp, Number: 2, Type: "Int"}
+)
+
+func label(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpLabel, Label: name}
+}
+
+func jump(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJump, Label: name}
+}
+
+func jumpIf(condition ir.Operand, name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJumpIf, Arg1: condition, Label: name}
+}
+
+func assign(dst ir.Operand, src ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpCopy, Dst: dst, Arg1: src}
+}
+
+func add(dst ir.Operand, a ir.Operand, b ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpBinary, Operator: "+", Dst: dst, Arg1: a, Arg2: b}
+}
+
+func print(operand ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpPrint, Arg1: operand}
+}
+
+// build makes the graph of main with the code, numbering the lines from 1.
+func build(code ...ir.Instr) *cfg.Graph {
+	for i := range code {
+		code[i].Line = i + 1
+	}
+	return cfg.Build(&ir.Func{Name: "main", Code: code, Locals: []ir.Operand{x, y, c, t1, t2}})
+}
+
+// The blocks of an if assigning x and an else reading c, joining again
+func diamond() *cfg.Graph {
+	return build(
+		assign(x, ir.NewInt(1)),
+		jumpIf(c, "Else"),
+		assign(x, ir.NewInt(2)),
+		jump("End"),
+		label("Else"),
+		print(c),
+		label("End"),
+		print(x),
+	)
+}
+
+func format[K comparable](set Set[K]) string {
+	var items []string
+	for item := range set {
+		items = append(items, fmt.Sprint(item))
+	}
+	sort.Strings(items)
+	return strings.Join(items, " ")
+}
+
+func TestWalkLive(t *testing.T) {
+	graph := diamond()
+	liveness := Liveness(graph)
+	// The variables live after each instruction of each block
+	want := [][]string{
+		{"c x", "c x"},
+		{"x", "x"},
+		{"c x", "x"},
+		{"x", ""},
+		{},
+	}
+	for i, block := range graph.Blocks {
+		got := make([]string, len(block.Instrs))
+		WalkLive(block, liveness.Out[block], func(i int, live Set[string]) {
+			got[i] = format(live)
+		})
+		if strings.Join(got, ", ") != strings.Join(want[i], ", ") {
+			t.Errorf("B%d: live after %q, want %q", i, got, want[i])
+		}
+	}
+	if got := format(liveness.In[graph.Entry]); got != "c" {
+		t.Errorf("live on entry %q, want \"c\"", got)
+	}
+}
+
+func TestReachingDefinitions(t *testing.T) {
+	graph := build(
+		add(t1, x, ir.NewInt(1)), // t1 is defined once, so left out
+		jumpIf(c, "Else"),
+		assign(x, t1),
+		assign(t2, x),
+		jump("End"),
+		label("Else"),
+		assign(t2, y),
+		label("End"),
+		print(x),
+		print(t2),
+		print(t1),
+	)
+	reaching := ReachingDefinitions(graph)
+	for _, definition := range reaching.Definitions {
+		if definition.Variable == t1.String() {
+			t.Errorf("the temporary defined once has definition %v", definition)
+		}
+	}
+
+	// The definitions of each operand reaching each print at the end
+	end := graph.Blocks[3]
+	want := map[string][]Definition{
+		x.String(): {{"x", -1, -1}, {"x", 1, 0}},
+		"t2":       {{"t2", 1, 1}, {"t2", 2, 1}},
+		"t1":       {{"t1", 0, 0}},
+		y.String(): {{"y", -1, -1}},
+	}
+	reaching.Walk(end, func(i int, before Bits) {
+		if end.Instrs[i].Op != ir.OpPrint {
+			return
+		}
+		for _, operand := range []ir.Operand{x, y, t1, t2} {
+			got := reaching.Of(before, operand.String())
+			if fmt.Sprint(got) != fmt.Sprint(want[operand.String()]) {
+				t.Errorf("%s is defined by %v, want %v", operand, got, want[operand.String()])
+			}
+		}
+	})
+
+	// A definition kills the others as the walk goes
+	reaching.Walk(graph.Blocks[1], func(i int, before Bits) {
+		got := reaching.Of(before, "x")
+		if i == 1 && fmt.Sprint(got) != fmt.Sprint([]Definition{{"x", 1, 0}}) {
+			t.Errorf("x is defined by %v after x = t1", got)
+		}
+	})
+}
+
+func TestAvailableExpressions(t *testing.T) {
+	graph := build(
+		add(t1, x, y),
+		jumpIf(c, "Else"),
+		assign(x, ir.NewInt(2)),
+		add(t2, c, y),
+		jump("End"),
+		label("Else"),
+		add(t2, c, y),
+		label("End"),
+		print(t2),
+	)
+	available := AvailableExpressions(graph)
+	want := []struct {
+		block int
+		items string
+	}{
+		{0, ""},
+		{1, "{+ x y}"},
+		{2, "{+ x y}"},
+		{3, "{+ c y}"}, // x + y is lost on the path assigning x
+	}
+	for _, test := range want {
+		if got := format(available.In[graph.Blocks[test.block]]); got != test.items {
+			t.Errorf("available at B%d: %q, want %q", test.block, got, test.items)
+		}
+	}
+}
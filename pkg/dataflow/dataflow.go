@@ -0,0 +1,170 @@
+package dataflow
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+)
+
+/*
+	A generic iterative data-flow solver over basic blocks.
+	Blocks are visited round-robin until no value changes.
+*/
+
+type Direction int
+
+const (
+	Forward Direction = iota
+	Backward
+)
+
+type Analysis[T any] struct {
+	Direction Direction
+	Boundary  T                              // In of the entry, or out of the exit
+	Init      func() T                       // The starting value of every other block
+	Meet      func(a T, b T) T               // Combines values where paths join
+	Transfer  func(block *cfg.Block, in T) T // In to out, or out to in when backward
+	Equal     func(a T, b T) bool
+}
+
+type Result[T any] struct {
+	In  map[*cfg.Block]T
+	Out map[*cfg.Block]T
+}
+
+func Solve[T any](graph *cfg.Graph, analysis Analysis[T]) Result[T] {
+	result := Result[T]{
+		In:  make(map[*cfg.Block]T),
+		Out: make(map[*cfg.Block]T),
+	}
+
+	order := graph.Blocks
+	before, after := result.In, result.Out
+	boundary := graph.Entry
+	edges := func(block *cfg.Block) []*cfg.Block { return block.Preds }
+	if analysis.Direction == Backward {
+		order = make([]*cfg.Block, len(graph.Blocks))
+		for i, block := range graph.Blocks {
+			order[len(graph.Blocks)-1-i] = block
+		}
+		before, after = result.Out, result.In
+		boundary = graph.Exit
+		edges = func(block *cfg.Block) []*cfg.Block { return block.Succs }
+	}
+
+	for _, block := range order {
+		before[block] = analysis.Init()
+		after[block] = analysis.Init()
+	}
+	before[boundary] = analysis.Boundary
+
+	for changed := true; changed; {
+		changed = false
+		for _, block := range order {
+			if block != boundary {
+				neighbours := edges(block)
+				if len(neighbours) > 0 {
+					value := after[neighbours[0]]
+					for _, neighbour := range neighbours[1:] {
+						value = analysis.Meet(value, after[neighbour])
+					}
+					before[block] = value
+				}
+			}
+			value := analysis.Transfer(block, before[block])
+			if !analysis.Equal(value, after[block]) {
+				after[block] = value
+				changed = true
+			}
+		}
+	}
+
+	return result
+}
+
+type Set[K comparable] map[K]bool
+
+func NewSet[K comparable](keys ...K) Set[K] {
+	set := make(Set[K])
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+func (set Set[K]) Copy() Set[K] {
+	copied := make(Set[K], len(set))
+	for key := range set {
+		copied[key] = true
+	}
+	return copied
+}
+
+func Union[K comparable](a Set[K], b Set[K]) Set[K] {
+	union := a.Copy()
+	for key := range b {
+		union[key] = true
+	}
+	return union
+}
+
+func Intersection[K comparable](a Set[K], b Set[K]) Set[K] {
+	intersection := make(Set[K])
+	for key := range a {
+		if b[key] {
+			intersection[key] = true
+		}
+	}
+	return intersection
+}
+
+func Equal[K comparable](a Set[K], b Set[K]) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if !b[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// Bits is a set of small numbers, like the definitions of a function, as
+// one bit each.
+type Bits []uint64
+
+func NewBits(size int) Bits {
+	return make(Bits, (size+63)/64)
+}
+
+func (bits Bits) Has(i int) bool {
+	return bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (bits Bits) Add(i int) {
+	bits[i/64] |= 1 << (i % 64)
+}
+
+func (bits Bits) Remove(i int) {
+	bits[i/64] &^= 1 << (i % 64)
+}
+
+func (bits Bits) Copy() Bits {
+	return append(Bits(nil), bits...)
+}
+
+func UnionBits(a Bits, b Bits) Bits {
+	union := a.Copy()
+	for i := range b {
+		union[i] |= b[i]
+	}
+	return union
+}
+
+func EqualBits(a Bits, b Bits) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package dataflow
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+type Warning struct {
+	Line    int
+	Message string
+}
+
+func (warning Warning) String() string {
+	return fmt.Sprintf("warning at line %d: %s", warning.Line, warning.Message)
+}
+
+// Check reports unreachable code, variables that are assigned but never
+// read, reads of possibly unassigned variables and dead stores.
+func Check(graph *cfg.Graph) []Warning {
+	var warnings []Warning
+	warn := func(line int, format string, args ...interface{}) {
+		warnings = append(warnings, Warning{
+			Line:    line,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, block := range graph.Unreachable() {
+		for _, instr := range block.Instrs {
+			if instr.Op != ir.OpLabel {
+				warn(instr.Line, "unreachable code")
+				break
+			}
+		}
+	}
+
+	reachable := graph.Reachable()
+	read := NewSet[string]()
+	assigned := make(map[string]int)
+	for _, block := range graph.Blocks {
+		if !reachable[block] {
+			continue
+		}
+		for _, instr := range block.Instrs {
+			for _, use := range instr.Uses() {
+				read[use.String()] = true
+			}
+			def, ok := instr.Def()
+			if ok && def.Kind == ir.OperandVar {
+				if _, exists := assigned[def.Lexeme]; !exists {
+					assigned[def.Lexeme] = instr.Line
+				}
+			}
+		}
+	}
+	for _, local := range graph.Func.Locals {
+		line, exists := assigned[local.Lexeme]
+		if local.Kind == ir.OperandVar && exists && !read[local.Lexeme] {
+			warn(line, "%s is assigned but never read", local.Lexeme)
+		}
+	}
+
+	liveness := Liveness(graph)
+	reaching := ReachingDefinitions(graph)
+	for _, block := range graph.Blocks {
+		if !reachable[block] {
+			continue
+		}
+		dead := make([]bool, len(block.Instrs))
+		WalkLive(block, liveness.Out[block], func(i int, live Set[string]) {
+			def, ok := block.Instrs[i].Def()
+			dead[i] = ok && def.Kind == ir.OperandVar && read[def.Lexeme] && !live[def.Lexeme]
+		})
+		reaching.Walk(block, func(i int, before Bits) {
+			instr := block.Instrs[i]
+			for _, use := range instr.Uses() {
+				if use.Kind != ir.OperandVar {
+					continue
+				}
+				for _, definition := range reaching.Of(before, use.Lexeme) {
+					if definition.IsEntry() {
+						warn(instr.Line, "%s may be read before it is assigned", use.Lexeme)
+					}
+				}
+			}
+			if dead[i] {
+				warn(instr.Line, "value assigned to %s is never read", instr.Dst.Lexeme)
+			}
+		})
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Line < warnings[j].Line
+	})
+	return warnings
+}
@@ -0,0 +1,36 @@
+package dataflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+func TestCheck(t *testing.T) {
+	graph := build(
+		assign(x, ir.NewInt(1)),
+		assign(x, ir.NewInt(2)),
+		jumpIf(c, "Else"),
+		assign(y, x),
+		jump("End"),
+		print(x),
+		label("Else"),
+		add(t1, x, ir.NewInt(1)),
+		label("End"),
+		print(x),
+	)
+	want := []string{
+		"warning at line 1: value assigned to x is never read",
+		"warning at line 3: c may be read before it is assigned",
+		"warning at line 4: y is assigned but never read",
+		"warning at line 6: unreachable code",
+	}
+	var got []string
+	for _, warning := range Check(graph) {
+		got = append(got, warning.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warned\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
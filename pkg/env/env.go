@@ -7,6 +7,9 @@ import (
 type Symbol struct {
 	Lexeme     string
 	SymbolType ast.NodeType
+	TypeHint   string
+	Name       string // The name of a variable in the IR, if not the lexeme
+	Readonly   bool   // Bound with val, so it is never assigned again
 }
 
 type Env struct {
@@ -0,0 +1,801 @@
+package amd64
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	Text "github.com/linkdotnet/golang-stringbuilder"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Generates GNU assembler for Linux x86-64 from the three-address code,
+	following the System V ABI.
+
+	Int and Bool are 32-bit, String is a pointer and Float is a single
+	precision float. Scalar variables live in registers given out by a
+	linear scan allocator, or in a stack slot when it runs out. Structs
+	always live in the stack frame, laid out like in C, and constructors
+	take a pointer to the struct like __Construct_X__ in C. Assigning a
+	struct copies it.
+
+	Methods take a pointer to their receiver in rdi, followed by a pointer
+	to the struct to return into, if they return a struct, and their
+	parameters. Integers, strings and pointers to struct arguments go in the
+	remaining integer argument registers and floats in xmm0 to xmm7. The
+	arguments left over are pushed on the stack by the caller, 8 bytes each,
+	and read by the callee above its return address. Other results are
+	returned in eax, rax or xmm0.
+
+	A call on an interface value jumps through a table for the method,
+	indexed by the tag, to a stub that moves rdi to the field holding the
+	struct and jumps on to the method of the struct.
+
+	Instructions load their operands into scratch registers, so an operand
+	is never needed in a particular register. print calls printf from libc,
+	and builtins call the functions of the C runtime, which is linked in.
+*/
+
+type Context struct {
+	tabs      int
+	sb        *Text.StringBuilder
+	program   *ir.Program
+	layouts   map[string]*ir.Layout
+	strings   map[string]string
+	fn        string            // The name of the current function
+	alloc     allocation        // Registers of the current function
+	slots     map[string]string // Stack slots of the current function
+	pointers  map[string]string // Stack slots of pointers to struct parameters
+	selfSlot  string
+	result    string // The stack slot of the pointer to return a struct into
+	frameSize int
+}
+
+// Argument registers after rdi, which holds self
+var integerArguments = []register{
+	{"%rsi", "%esi"},
+	{"%rdx", "%edx"},
+	{"%rcx", "%ecx"},
+	{"%r8", "%r8d"},
+	{"%r9", "%r9d"},
+}
+
+var floatArguments = []string{
+	"%xmm0", "%xmm1", "%xmm2", "%xmm3",
+	"%xmm4", "%xmm5", "%xmm6", "%xmm7",
+}
+
+func Generate(program *ir.Program) string {
+	sb := Text.StringBuilder{}
+	ctx := Context{
+		sb:      &sb,
+		program: program,
+		layouts: make(map[string]*ir.Layout),
+		strings: make(map[string]string),
+	}
+
+	ctx.line("\t.section .rodata")
+	ctx.line(".Lfmt.int:")
+	ctx.line("\t.string \"%d\\n\"")
+	ctx.line(".Lfmt.float:")
+	ctx.line("\t.string \"%f\\n\"")
+	ctx.line(".Lfmt.string:")
+	ctx.line("\t.string \"%s\\n\"")
+	ctx.stringConstant("true")
+	ctx.stringConstant("false")
+	ctx.generateStrings(program.Main)
+	for _, st := range program.Structs {
+		ctx.generateStrings(st.Constructor)
+	}
+	for _, method := range program.Methods {
+		ctx.generateStrings(method)
+	}
+
+	ctx.line("")
+	ctx.line("\t.text")
+	for _, st := range program.Structs {
+		ctx.generateFunc(st.Constructor, constructorName(st.Name))
+	}
+	for _, method := range program.Methods {
+		ctx.generateFunc(method, method.Name)
+	}
+	ctx.generateFunc(program.Main, "main")
+	for _, st := range program.Structs {
+		if st.Interface && len(st.Variants) > 0 {
+			ctx.generateVTables(st)
+		}
+	}
+
+	ctx.line("")
+	ctx.line("\t.section .note.GNU-stack,\"\",@progbits")
+	return ctx.sb.ToString()
+}
+
+func (ctx *Context) generateStrings(fn *ir.Func) {
+	for _, instr := range fn.Code {
+		for _, operand := range append([]ir.Operand{instr.Arg1, instr.Arg2}, instr.Args...) {
+			if operand.Kind == ir.OperandString {
+				ctx.stringConstant(operand.Lexeme)
+			}
+		}
+	}
+}
+
+// stringConstant declares a label for a string the first time it is seen.
+func (ctx *Context) stringConstant(text string) {
+	if _, exists := ctx.strings[text]; exists {
+		return
+	}
+	name := fmt.Sprintf(".Lstr.%d", len(ctx.strings))
+	ctx.strings[text] = name
+	ctx.line(name + ":")
+	ctx.line(fmt.Sprintf("\t.string \"%s\"", escape(text)))
+}
+
+func (ctx *Context) generateFunc(fn *ir.Func, name string) {
+	ctx.fn = name
+	ctx.alloc = allocate(fn)
+	ctx.layoutFrame(fn)
+
+	ctx.line("")
+	if name == "main" {
+		ctx.line("\t.globl main")
+	}
+	ctx.line(fmt.Sprintf("\t.type %s, @function", name))
+	ctx.line(name + ":")
+	ctx.tabs += 1
+	ctx.line("pushq %rbp")
+	ctx.line("movq %rsp, %rbp")
+	if ctx.frameSize > 0 {
+		ctx.line(fmt.Sprintf("subq $%d, %%rsp", ctx.frameSize))
+	}
+	for i, reg := range ctx.alloc.used {
+		ctx.line(fmt.Sprintf("movq %s, %d(%%rbp)", reg.q, -8*(i+1)))
+	}
+	if len(fn.Receiver) > 0 {
+		ctx.line(fmt.Sprintf("movq %%rdi, %s", ctx.selfSlot))
+	}
+	ctx.moveParams(fn)
+	if name == "main" && len(ctx.program.UsesBuiltins()) > 0 {
+		// argc and argv are still in edi and rsi
+		ctx.line("call __Builtin_Process_init__@PLT")
+	}
+
+	for _, instr := range fn.Code {
+		ctx.generate(instr)
+	}
+
+	for i, reg := range ctx.alloc.used {
+		ctx.line(fmt.Sprintf("movq %d(%%rbp), %s", -8*(i+1), reg.q))
+	}
+	if name == "main" {
+		ctx.line("xorl %eax, %eax")
+	}
+	ctx.line("leave")
+	ctx.line("ret")
+	ctx.tabs -= 1
+	ctx.line(fmt.Sprintf("\t.size %s, .-%s", name, name))
+}
+
+// generateVTables generates the stubs of the structs implementing an
+// interface, and the table of each method. The tables hold absolute
+// addresses, so they go in .data.rel.ro for position independent code.
+func (ctx *Context) generateVTables(st *ir.Struct) {
+	layout := ctx.layout(st.Name)
+	for _, variant := range st.Variants {
+		for _, signature := range st.Methods {
+			_, lexeme, _ := strings.Cut(signature.Name, ".")
+			name := dispatchName(st.Name, variant+"."+lexeme)
+			ctx.line("")
+			ctx.line(fmt.Sprintf("\t.type %s, @function", name))
+			ctx.line(name + ":")
+			ctx.line(fmt.Sprintf("\tleaq %d(%%rdi), %%rdi", layout.Offsets[variant]))
+			ctx.line(fmt.Sprintf("\tjmp %s", variant+"."+lexeme))
+			ctx.line(fmt.Sprintf("\t.size %s, .-%s", name, name))
+		}
+	}
+	ctx.line("")
+	ctx.line("\t.section .data.rel.ro")
+	ctx.line("\t.align 8")
+	for _, signature := range st.Methods {
+		_, lexeme, _ := strings.Cut(signature.Name, ".")
+		ctx.line(vtableName(signature.Name) + ":")
+		for _, variant := range st.Variants {
+			ctx.line("\t.quad " + dispatchName(st.Name, variant+"."+lexeme))
+		}
+	}
+	ctx.line("\t.text")
+}
+
+// moveParams moves the arguments of a method from the registers or stack
+// slots they are passed in to where the method keeps them.
+func (ctx *Context) moveParams(fn *ir.Func) {
+	arguments, _ := argumentLocations(fn)
+	if ctx.result != "" {
+		ctx.line(fmt.Sprintf("movq %s, %s", integerArguments[0].q, ctx.result))
+	}
+	for i, param := range fn.Params {
+		integer, float := arguments[i].integer, arguments[i].float
+		if arguments[i].slot >= 0 {
+			// A float is only passed on the stack once xmm0 to xmm7 are
+			// used up, so xmm0 is free by then
+			from := fmt.Sprintf("%d(%%rbp)", 16+8*arguments[i].slot)
+			integer, float = register{"%rax", "%eax"}, "%xmm0"
+			if param.Type == "Float" {
+				ctx.line(fmt.Sprintf("movss %s, %%xmm0", from))
+			} else {
+				ctx.line(fmt.Sprintf("movq %s, %%rax", from))
+			}
+		}
+		switch {
+		case param.Type == "Float":
+			ctx.line(fmt.Sprintf("movss %s, %s", float, ctx.location(param)))
+		case !isScalar(param.Type):
+			ctx.line(fmt.Sprintf("movq %s, %s", integer.q, ctx.pointers[param.String()]))
+		case param.Type == "String":
+			ctx.line(fmt.Sprintf("movq %s, %s", integer.q, ctx.location(param)))
+		default:
+			ctx.line(fmt.Sprintf("movl %s, %s", integer.l, ctx.location(param)))
+		}
+	}
+}
+
+// argument is where an argument of a method after self is passed: in an
+// integer or float register, or in a stack slot, counted up from the
+// return address. slot is -1 for a register.
+type argument struct {
+	integer register
+	float   string
+	slot    int
+}
+
+// argumentLocations returns where each parameter of a method is passed,
+// along with the number of stack slots. The pointer to return a struct
+// into takes the first integer register.
+func argumentLocations(fn *ir.Func) ([]argument, int) {
+	integers, floats, slots := 0, 0, 0
+	if fn.Result != "" && !isScalar(fn.Result) {
+		integers += 1
+	}
+	result := make([]argument, len(fn.Params))
+	for i, param := range fn.Params {
+		switch {
+		case param.Type == "Float" && floats < len(floatArguments):
+			result[i] = argument{float: floatArguments[floats], slot: -1}
+			floats += 1
+		case param.Type != "Float" && integers < len(integerArguments):
+			result[i] = argument{integer: integerArguments[integers], slot: -1}
+			integers += 1
+		default:
+			result[i] = argument{slot: slots}
+			slots += 1
+		}
+	}
+	return result, slots
+}
+
+// layoutFrame gives a stack slot to the saved registers, self, the pointer
+// to return a struct into, every scalar without a register, every pointer
+// to a struct parameter and every struct, keeping the stack aligned to 16
+// bytes for calls.
+func (ctx *Context) layoutFrame(fn *ir.Func) {
+	ctx.slots = make(map[string]string)
+	ctx.pointers = make(map[string]string)
+	ctx.result = ""
+	offset := 8 * len(ctx.alloc.used)
+	if len(fn.Receiver) > 0 {
+		offset += 8
+		ctx.selfSlot = fmt.Sprintf("%d(%%rbp)", -offset)
+	}
+	if fn.Result != "" && !isScalar(fn.Result) {
+		offset += 8
+		ctx.result = fmt.Sprintf("%d(%%rbp)", -offset)
+	}
+	for _, param := range fn.Params {
+		if !isScalar(param.Type) {
+			offset += 8
+			ctx.pointers[param.String()] = fmt.Sprintf("%d(%%rbp)", -offset)
+		}
+	}
+	for _, local := range append(append([]ir.Operand{}, fn.Params...), fn.Locals...) {
+		if _, pointer := ctx.pointers[local.String()]; pointer {
+			continue
+		}
+		key := local.String()
+		if _, exists := ctx.slots[key]; exists {
+			continue
+		}
+		if isScalar(local.Type) {
+			if _, ok := ctx.alloc.integers[key]; ok {
+				continue
+			}
+			if _, ok := ctx.alloc.floats[key]; ok {
+				continue
+			}
+			offset += 8
+		} else {
+			layout := ctx.layout(local.Type)
+			offset = alignTo(offset+layout.Size, 8)
+		}
+		ctx.slots[key] = fmt.Sprintf("%d(%%rbp)", -offset)
+	}
+	ctx.frameSize = alignTo(offset, 16)
+}
+
+func (ctx *Context) generate(instr ir.Instr) {
+
+	switch instr.Op {
+
+	case ir.OpCopy:
+		if !isScalar(instr.Dst.Type) {
+			ctx.address(instr.Dst, "%rdi")
+			ctx.address(instr.Arg1, "%rsi")
+			ctx.copyStruct(instr.Dst.Type)
+			return
+		}
+		ctx.load(instr.Arg1, 0)
+		ctx.store(instr.Dst, 0)
+
+	case ir.OpBinary:
+		ctx.load(instr.Arg1, 0)
+		ctx.load(instr.Arg2, 1)
+		if instr.Arg1.Type == "Float" {
+			ctx.floatBinary(instr.Operator)
+		} else {
+			ctx.integerBinary(instr.Operator)
+		}
+		ctx.store(instr.Dst, 0)
+
+	case ir.OpNot:
+		ctx.load(instr.Arg1, 0)
+		ctx.line("xorl $1, %eax")
+		ctx.store(instr.Dst, 0)
+
+	case ir.OpLabel:
+		ctx.tabs -= 1
+		ctx.line(ctx.label(instr.Label) + ":")
+		ctx.tabs += 1
+
+	case ir.OpJump:
+		ctx.line(fmt.Sprintf("jmp %s", ctx.label(instr.Label)))
+
+	case ir.OpJumpIf:
+		ctx.load(instr.Arg1, 0)
+		ctx.line("testl %eax, %eax")
+		ctx.line(fmt.Sprintf("jne %s", ctx.label(instr.Label)))
+
+	case ir.OpAlloc:
+		ctx.address(instr.Dst, "%rdi")
+		ctx.line(fmt.Sprintf("call %s", constructorName(instr.Dst.Type)))
+
+	case ir.OpLoad:
+		offset, typeHint := ir.FieldPath(instr.Arg1.Type, instr.Field, ctx.layout)
+		ctx.address(instr.Arg1, "%rsi")
+		if !isScalar(typeHint) {
+			ctx.line(fmt.Sprintf("leaq %d(%%rsi), %%rsi", offset))
+			ctx.address(instr.Dst, "%rdi")
+			ctx.copyStruct(typeHint)
+			return
+		}
+		field := fmt.Sprintf("%d(%%rsi)", offset)
+		switch typeHint {
+		case "Float":
+			ctx.line(fmt.Sprintf("movss %s, %%xmm0", field))
+		case "String":
+			ctx.line(fmt.Sprintf("movq %s, %%rax", field))
+		default:
+			ctx.line(fmt.Sprintf("movl %s, %%eax", field))
+		}
+		ctx.store(instr.Dst, 0)
+
+	case ir.OpStore:
+		offset, typeHint := ir.FieldPath(instr.Dst.Type, instr.Field, ctx.layout)
+		ctx.address(instr.Dst, "%rdi")
+		if !isScalar(typeHint) {
+			ctx.line(fmt.Sprintf("leaq %d(%%rdi), %%rdi", offset))
+			ctx.address(instr.Arg1, "%rsi")
+			ctx.copyStruct(typeHint)
+			return
+		}
+		ctx.load(instr.Arg1, 0)
+		field := fmt.Sprintf("%d(%%rdi)", offset)
+		switch typeHint {
+		case "Float":
+			ctx.line(fmt.Sprintf("movss %%xmm0, %s", field))
+		case "String":
+			ctx.line(fmt.Sprintf("movq %%rax, %s", field))
+		default:
+			ctx.line(fmt.Sprintf("movl %%eax, %s", field))
+		}
+
+	case ir.OpPrint:
+		ctx.generatePrint(instr.Arg1)
+
+	case ir.OpCall:
+		ctx.generateCall(instr)
+
+	case ir.OpBuiltin:
+		ctx.generateBuiltin(instr)
+
+	case ir.OpReturn:
+		if !isScalar(instr.Arg1.Type) {
+			ctx.line(fmt.Sprintf("movq %s, %%rdi", ctx.result))
+			ctx.address(instr.Arg1, "%rsi")
+			ctx.copyStruct(instr.Arg1.Type)
+			return
+		}
+		ctx.load(instr.Arg1, 0)
+
+	default:
+		panic(fmt.Sprintf("cannot generate %s", instr))
+	}
+}
+
+func (ctx *Context) integerBinary(operator string) {
+	switch operator {
+	case "+":
+		ctx.line("addl %ecx, %eax")
+	case "-":
+		ctx.line("subl %ecx, %eax")
+	case "*":
+		ctx.line("imull %ecx, %eax")
+	case "/":
+		ctx.line("cltd")
+		ctx.line("idivl %ecx")
+	case "<":
+		ctx.line("cmpl %ecx, %eax")
+		ctx.line("setl %al")
+		ctx.line("movzbl %al, %eax")
+	case ">":
+		ctx.line("cmpl %ecx, %eax")
+		ctx.line("setg %al")
+		ctx.line("movzbl %al, %eax")
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
+
+// floatBinary leaves arithmetic results in xmm0 and comparisons in eax.
+// Comparisons use seta, which is false when either side is NaN.
+func (ctx *Context) floatBinary(operator string) {
+	switch operator {
+	case "+":
+		ctx.line("addss %xmm1, %xmm0")
+	case "-":
+		ctx.line("subss %xmm1, %xmm0")
+	case "*":
+		ctx.line("mulss %xmm1, %xmm0")
+	case "/":
+		ctx.line("divss %xmm1, %xmm0")
+	case "<":
+		ctx.line("ucomiss %xmm0, %xmm1")
+		ctx.line("seta %al")
+		ctx.line("movzbl %al, %eax")
+	case ">":
+		ctx.line("ucomiss %xmm1, %xmm0")
+		ctx.line("seta %al")
+		ctx.line("movzbl %al, %eax")
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
+
+func (ctx *Context) generatePrint(operand ir.Operand) {
+	ctx.load(operand, 0)
+	format := ".Lfmt.string"
+
+	switch operand.Type {
+	case "Int":
+		format = ".Lfmt.int"
+		ctx.line("movl %eax, %esi")
+	case "Float":
+		format = ".Lfmt.float"
+		ctx.line("cvtss2sd %xmm0, %xmm0")
+	case "Bool":
+		ctx.line(fmt.Sprintf("leaq %s(%%rip), %%rsi", ctx.strings["true"]))
+		ctx.line(fmt.Sprintf("leaq %s(%%rip), %%rcx", ctx.strings["false"]))
+		ctx.line("testl %eax, %eax")
+		ctx.line("cmove %rcx, %rsi")
+	case "String":
+		ctx.line("movq %rax, %rsi")
+	default:
+		panic(fmt.Sprintf("cannot print value of type %s", operand.Type))
+	}
+
+	ctx.line(fmt.Sprintf("leaq %s(%%rip), %%rdi", format))
+	if operand.Type == "Float" {
+		ctx.line("movl $1, %eax") // The number of vector registers used
+	} else {
+		ctx.line("xorl %eax, %eax")
+	}
+	ctx.line("call printf@PLT")
+}
+
+// generateCall passes the arguments of a method in registers, pushing
+// those left over on the stack first, last to first, with padding to keep
+// the stack aligned to 16 bytes for the call. Floats are loaded into their
+// registers before the rest, last to first, since loading goes through
+// xmm0 and float constants go through edx. The other arguments are loaded
+// through rax. The table of a method of an interface is read through r10
+// and r11, which are never arguments.
+func (ctx *Context) generateCall(instr ir.Instr) {
+	receiver, lexeme, _ := strings.Cut(instr.Func, ".")
+	method, _ := ctx.program.GetMethod(receiver, lexeme)
+	arguments, slots := argumentLocations(method)
+
+	if slots%2 == 1 {
+		ctx.line("subq $8, %rsp")
+	}
+	for i := len(instr.Args) - 1; i >= 0; i-- {
+		if arguments[i].slot >= 0 {
+			ctx.push(instr.Args[i])
+		}
+	}
+	for i := len(instr.Args) - 1; i >= 0; i-- {
+		if instr.Args[i].Type != "Float" || arguments[i].slot >= 0 {
+			continue
+		}
+		ctx.load(instr.Args[i], 0)
+		if arguments[i].float != "%xmm0" {
+			ctx.line(fmt.Sprintf("movss %%xmm0, %s", arguments[i].float))
+		}
+	}
+	if instr.Dst.Kind != ir.OperandZero && !isScalar(instr.Dst.Type) {
+		ctx.address(instr.Dst, integerArguments[0].q)
+	}
+	for i, arg := range instr.Args {
+		if arg.Type == "Float" || arguments[i].slot >= 0 {
+			continue
+		}
+		integer := arguments[i].integer
+		switch {
+		case !isScalar(arg.Type):
+			ctx.address(arg, integer.q)
+		case arg.Type == "String":
+			ctx.load(arg, 0)
+			ctx.line(fmt.Sprintf("movq %%rax, %s", integer.q))
+		default:
+			ctx.load(arg, 0)
+			ctx.line(fmt.Sprintf("movl %%eax, %s", integer.l))
+		}
+	}
+	ctx.address(instr.Arg1, "%rdi")
+	if ctx.program.IsInterface(instr.Arg1.Type) {
+		offset, _ := ir.FieldPath(instr.Arg1.Type, "tag", ctx.layout)
+		ctx.line(fmt.Sprintf("movslq %d(%%rdi), %%r11", offset))
+		ctx.line(fmt.Sprintf("leaq %s(%%rip), %%r10", vtableName(instr.Func)))
+		ctx.line("call *(%r10,%r11,8)")
+	} else {
+		ctx.line(fmt.Sprintf("call %s", instr.Func))
+	}
+	if slots > 0 {
+		ctx.line(fmt.Sprintf("addq $%d, %%rsp", 8*(slots+slots%2)))
+	}
+
+	if instr.Dst.Kind != ir.OperandZero && isScalar(instr.Dst.Type) {
+		ctx.store(instr.Dst, 0)
+	}
+}
+
+// push pushes an argument on the stack in an 8 byte slot, through rax or
+// xmm0.
+func (ctx *Context) push(arg ir.Operand) {
+	switch {
+	case !isScalar(arg.Type):
+		ctx.address(arg, "%rax")
+	case arg.Type == "Float":
+		ctx.load(arg, 0)
+		ctx.line("subq $8, %rsp")
+		ctx.line("movss %xmm0, (%rsp)")
+		return
+	default:
+		ctx.load(arg, 0)
+	}
+	ctx.line("pushq %rax")
+}
+
+// generateBuiltin calls a function of the C runtime, passing the arguments
+// like generateCall but starting at rdi, since there is no self. A bool
+// returned from C is only defined in al, so it is widened to eax.
+func (ctx *Context) generateBuiltin(instr ir.Instr) {
+	integers := append([]register{{"%rdi", "%edi"}}, integerArguments...)
+
+	var integerArgs, floatArgs []ir.Operand
+	for _, arg := range instr.Args {
+		if arg.Type == "Float" {
+			floatArgs = append(floatArgs, arg)
+		} else {
+			integerArgs = append(integerArgs, arg)
+		}
+	}
+	for i := len(floatArgs) - 1; i >= 0; i-- {
+		ctx.load(floatArgs[i], 0)
+		if floatArguments[i] != "%xmm0" {
+			ctx.line(fmt.Sprintf("movss %%xmm0, %s", floatArguments[i]))
+		}
+	}
+	for i, arg := range integerArgs {
+		ctx.load(arg, 0)
+		if arg.Type == "String" {
+			ctx.line(fmt.Sprintf("movq %%rax, %s", integers[i].q))
+		} else {
+			ctx.line(fmt.Sprintf("movl %%eax, %s", integers[i].l))
+		}
+	}
+	ctx.line(fmt.Sprintf("call %s@PLT", ir.BuiltinName(instr.Func)))
+
+	if instr.Dst.Kind != ir.OperandZero {
+		if instr.Dst.Type == "Bool" {
+			ctx.line("movzbl %al, %eax")
+		}
+		ctx.store(instr.Dst, 0)
+	}
+}
+
+// load moves a scalar operand into scratch register n, which is eax/rax or
+// ecx/rcx for integers and xmm0 or xmm1 for floats.
+func (ctx *Context) load(operand ir.Operand, n int) {
+	integer := []register{{"%rax", "%eax"}, {"%rcx", "%ecx"}}[n]
+	float := []string{"%xmm0", "%xmm1"}[n]
+
+	switch operand.Kind {
+	case ir.OperandTemp, ir.OperandVar:
+		location := ctx.location(operand)
+		switch operand.Type {
+		case "Float":
+			ctx.line(fmt.Sprintf("movss %s, %s", location, float))
+		case "String":
+			ctx.line(fmt.Sprintf("movq %s, %s", location, integer.q))
+		default:
+			ctx.line(fmt.Sprintf("movl %s, %s", location, integer.l))
+		}
+	case ir.OperandInt, ir.OperandBool:
+		ctx.line(fmt.Sprintf("movl $%d, %s", int32(operand.Number), integer.l))
+	case ir.OperandFloat:
+		bits := math.Float32bits(float32(operand.Float))
+		ctx.line(fmt.Sprintf("movl $%d, %%edx", int32(bits)))
+		ctx.line(fmt.Sprintf("movd %%edx, %s", float))
+	case ir.OperandString:
+		ctx.line(fmt.Sprintf("leaq %s(%%rip), %s", ctx.strings[operand.Lexeme], integer.q))
+	default:
+		panic(fmt.Sprintf("cannot generate operand %s", operand))
+	}
+}
+
+// store moves scratch register n into a scalar variable.
+func (ctx *Context) store(dst ir.Operand, n int) {
+	integer := []register{{"%rax", "%eax"}, {"%rcx", "%ecx"}}[n]
+	float := []string{"%xmm0", "%xmm1"}[n]
+
+	location := ctx.location(dst)
+	switch dst.Type {
+	case "Float":
+		ctx.line(fmt.Sprintf("movss %s, %s", float, location))
+	case "String":
+		ctx.line(fmt.Sprintf("movq %s, %s", integer.q, location))
+	default:
+		ctx.line(fmt.Sprintf("movl %s, %s", integer.l, location))
+	}
+}
+
+// location returns the register or stack slot of a scalar variable.
+func (ctx *Context) location(operand ir.Operand) string {
+	key := operand.String()
+	if reg, ok := ctx.alloc.integers[key]; ok {
+		if operand.Type == "String" {
+			return reg.q
+		}
+		return reg.l
+	}
+	if reg, ok := ctx.alloc.floats[key]; ok {
+		return reg
+	}
+	if slot, ok := ctx.slots[key]; ok {
+		return slot
+	}
+	panic(fmt.Sprintf("no location for %s", operand))
+}
+
+// address moves the address of a struct operand into a register.
+func (ctx *Context) address(operand ir.Operand, reg string) {
+	if operand.Kind == ir.OperandSelf {
+		ctx.line(fmt.Sprintf("movq %s, %s", ctx.selfSlot, reg))
+		return
+	}
+	if slot, ok := ctx.pointers[operand.String()]; ok {
+		ctx.line(fmt.Sprintf("movq %s, %s", slot, reg))
+		return
+	}
+	ctx.line(fmt.Sprintf("leaq %s, %s", ctx.location(operand), reg))
+}
+
+// copyStruct copies a struct from the address in rsi to the address in rdi.
+func (ctx *Context) copyStruct(typeHint string) {
+	ctx.line(fmt.Sprintf("movl $%d, %%ecx", ctx.layout(typeHint).Size))
+	ctx.line("rep movsb")
+}
+
+// layout places the fields of a struct like a C compiler would, aligning
+// each field to its size.
+func (ctx *Context) layout(name string) *ir.Layout {
+	if existing, ok := ctx.layouts[name]; ok {
+		return existing
+	}
+	st, ok := ctx.program.GetStruct(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown struct %s", name))
+	}
+	result := &ir.Layout{
+		Align:   1,
+		Offsets: make(map[string]int),
+		Types:   make(map[string]string),
+	}
+	for _, field := range st.Fields {
+		size, align := 4, 4
+		switch {
+		case field.Type == "String":
+			size, align = 8, 8
+		case !isScalar(field.Type):
+			nested := ctx.layout(field.Type)
+			size, align = nested.Size, nested.Align
+		}
+		result.Size = alignTo(result.Size, align)
+		result.Offsets[field.Lexeme] = result.Size
+		result.Types[field.Lexeme] = field.Type
+		result.Size += size
+		if align > result.Align {
+			result.Align = align
+		}
+	}
+	result.Size = alignTo(result.Size, result.Align)
+	ctx.layouts[name] = result
+	return result
+}
+
+func (ctx *Context) label(lexeme string) string {
+	return fmt.Sprintf(".L%s.%s", ctx.fn, lexeme)
+}
+
+func constructorName(structName string) string {
+	return fmt.Sprintf("__Construct_%s__", structName)
+}
+
+func dispatchName(iface string, method string) string {
+	return fmt.Sprintf("__Dispatch_%s__%s", iface, method)
+}
+
+func vtableName(signature string) string {
+	return fmt.Sprintf("__VTable_%s", signature)
+}
+
+func isScalar(typeHint string) bool {
+	return typeHint == "Int" ||
+		typeHint == "Float" ||
+		typeHint == "Bool" ||
+		typeHint == "String"
+}
+
+func alignTo(value int, align int) int {
+	return (value + align - 1) / align * align
+}
+
+func escape(text string) string {
+	var sb strings.Builder
+	for _, b := range []byte(text) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			sb.WriteString(fmt.Sprintf("\\%03o", b))
+			continue
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+func (ctx *Context) line(text string) {
+	for i := 0; i < ctx.tabs; i++ {
+		ctx.sb.AppendRune('\t')
+	}
+	ctx.sb.Append(text)
+	ctx.sb.AppendRune('\n')
+}
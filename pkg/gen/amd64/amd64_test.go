@@ -0,0 +1,110 @@
+package amd64
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/gen/c"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
+)
+
+// lower lowers the program in source.
+func lower(source string) *ir.Program {
+	lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(source)))
+	parser := parser.NewParser(lexer.ScanAll())
+	return ir.Lower(parser.Parse())
+}
+
+// run assembles the program and links it with the C runtime, skipping the
+// test without a C compiler, and returns what it prints along with what
+// the VM prints.
+func run(t *testing.T, program *ir.Program) (string, string) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc is not installed")
+	}
+	var want strings.Builder
+	if err := vm.New(bytecode.Compile(program), &want).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	assembly := filepath.Join(dir, "program.s")
+	runtime := filepath.Join(dir, "runtime.c")
+	binary := filepath.Join(dir, "program")
+	if err := os.WriteFile(assembly, []byte(Generate(program)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(runtime, []byte(c.Runtime()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command(cc, "-o", binary, assembly, runtime, "-lm").CombinedOutput(); err != nil {
+		t.Fatalf("cc: %s\n%s", err, output)
+	}
+	output, err := exec.Command(binary).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), want.String()
+}
+
+// TestStackArguments calls methods with more arguments than registers, of
+// every kind, directly and through an interface, returning scalars and
+// structs.
+func TestStackArguments(t *testing.T) {
+	program := lower(`interface Mixer {
+    fn mix(a Int b String c Int d Float e Int f Int g Int h Int) Int
+}
+
+struct Box {
+    size Int = 1
+}
+
+struct Mixing {
+    base Int = 100
+
+    fn mix(a Int b String c Int d Float e Int f Int g Int h Int) Int {
+        print b
+        print d
+        return self.base + a + 2 * c + 3 * e + 4 * f + 5 * g + 6 * h
+    }
+
+    fn grow(box Box a Int b Int c Int d Int e Box f String) Box {
+        print f
+        return Box(size self.base + box.size + a + 2 * b + 3 * c + 4 * d + 5 * e.size)
+    }
+
+    fn scale(a Float b Float c Float d Float e Float f Float g Float h Float i Float j Float k Int) Float {
+        print i
+        print k
+        return a + 2.toFloat() * h + 3.toFloat() * j
+    }
+}
+
+impl Mixer for Mixing
+
+struct Holder {
+    mixer Mixer
+}
+
+n = 7
+m = Mixing()
+print m.mix(a 1 b "two" c 3 d n.toFloat() e 5 f 6 g 7 h 8)
+holder = Holder(mixer m)
+print holder.mixer.mix(a 8 b "seven" c 6 d 5.toFloat() e 4 f 3 g 2 h 1)
+print m.grow(box Box(size 2) a 3 b 4 c 5 d 6 e Box(size 7) f "grown").size
+print m.scale(a 1.toFloat() b 2.toFloat() c 3.toFloat() d 4.toFloat() e 5.toFloat() f 6.toFloat() g 7.toFloat() h 8.toFloat() i 9.toFloat() j 10.toFloat() k 11)
+`)
+	got, want := run(t, program)
+	if got != want {
+		t.Errorf("printed %q, the VM printed %q", got, want)
+	}
+}
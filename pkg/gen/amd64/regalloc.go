@@ -0,0 +1,226 @@
+package amd64
+
+import (
+	"sort"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Linear scan register allocation over live intervals.
+
+	Instructions are numbered in code order, and the interval of a variable
+	spans every position where it is defined, used or live across a block
+	boundary. Holes in the interval are ignored. Intervals are visited by
+	start, and when no register is free the interval ending last is spilled.
+*/
+
+type register struct {
+	q string // 64-bit name
+	l string // 32-bit name
+}
+
+// Callee-saved, so they survive calls to printf, constructors, methods and
+// the runtime
+var integerRegisters = []register{
+	{"%rbx", "%ebx"},
+	{"%r12", "%r12d"},
+	{"%r13", "%r13d"},
+	{"%r14", "%r14d"},
+	{"%r15", "%r15d"},
+}
+
+// Caller-saved, so only given to intervals that do not span a call
+var floatRegisters = []string{
+	"%xmm8", "%xmm9", "%xmm10", "%xmm11",
+	"%xmm12", "%xmm13", "%xmm14", "%xmm15",
+}
+
+type interval struct {
+	variable ir.Operand
+	start    int
+	end      int
+}
+
+type allocation struct {
+	integers map[string]register
+	floats   map[string]string
+	used     []register // The callee-saved registers to save in the prologue
+}
+
+func allocate(fn *ir.Func) allocation {
+	intervals := liveIntervals(fn)
+	calls := callPositions(fn)
+
+	var integers, floats []*interval
+	for _, iv := range intervals {
+		if iv.variable.Type == "Float" {
+			floats = append(floats, iv)
+		} else {
+			integers = append(integers, iv)
+		}
+	}
+
+	result := allocation{
+		integers: make(map[string]register),
+		floats:   make(map[string]string),
+	}
+	for variable, index := range linearScan(integers, len(integerRegisters)) {
+		result.integers[variable] = integerRegisters[index]
+	}
+	var callFree []*interval
+	for _, iv := range floats {
+		if !spansCall(iv, calls) {
+			callFree = append(callFree, iv)
+		}
+	}
+	for variable, index := range linearScan(callFree, len(floatRegisters)) {
+		result.floats[variable] = floatRegisters[index]
+	}
+
+	for _, reg := range integerRegisters {
+		for _, assigned := range result.integers {
+			if assigned == reg {
+				result.used = append(result.used, reg)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// liveIntervals returns the interval of every scalar variable of the
+// function, ordered by start.
+func liveIntervals(fn *ir.Func) []*interval {
+	graph := cfg.Build(fn)
+	live := dataflow.Liveness(graph)
+
+	intervals := make(map[string]*interval)
+	extend := func(operand ir.Operand, position int) {
+		if !operand.IsVariable() || !isScalar(operand.Type) {
+			return
+		}
+		key := operand.String()
+		iv, exists := intervals[key]
+		if !exists {
+			intervals[key] = &interval{variable: operand, start: position, end: position}
+			return
+		}
+		if position < iv.start {
+			iv.start = position
+		}
+		if position > iv.end {
+			iv.end = position
+		}
+	}
+
+	// Parameters are live on entry, so their intervals start there
+	types := make(map[string]ir.Operand)
+	for _, local := range append(append([]ir.Operand{}, fn.Params...), fn.Locals...) {
+		types[local.String()] = local
+	}
+
+	position := 0
+	for _, block := range graph.Blocks {
+		first, last := position, position+len(block.Instrs)-1
+		for variable := range live.In[block] {
+			extend(types[variable], first)
+		}
+		for _, instr := range block.Instrs {
+			if def, ok := instr.Def(); ok {
+				extend(def, position)
+			}
+			for _, use := range instr.Uses() {
+				extend(use, position)
+			}
+			position += 1
+		}
+		if len(block.Instrs) > 0 {
+			for variable := range live.Out[block] {
+				extend(types[variable], last)
+			}
+		}
+	}
+
+	var sorted []*interval
+	for _, iv := range intervals {
+		sorted = append(sorted, iv)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].start != sorted[j].start {
+			return sorted[i].start < sorted[j].start
+		}
+		return sorted[i].variable.String() < sorted[j].variable.String()
+	})
+	return sorted
+}
+
+// linearScan assigns one of count registers to as many intervals as it
+// can, returning the index of the register given to each variable.
+func linearScan(intervals []*interval, count int) map[string]int {
+	assigned := make(map[string]int)
+	var active []*interval // Ordered by end
+	free := make([]bool, count)
+	for i := range free {
+		free[i] = true
+	}
+
+	for _, current := range intervals {
+		for len(active) > 0 && active[0].end < current.start {
+			free[assigned[active[0].variable.String()]] = true
+			active = active[1:]
+		}
+
+		index := -1
+		for i, isFree := range free {
+			if isFree {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			if len(active) == 0 {
+				continue
+			}
+			last := active[len(active)-1]
+			if last.end <= current.end {
+				continue // Spill the current interval
+			}
+			index = assigned[last.variable.String()]
+			delete(assigned, last.variable.String())
+			active = active[:len(active)-1]
+		}
+
+		free[index] = false
+		assigned[current.variable.String()] = index
+		at := sort.Search(len(active), func(i int) bool {
+			return active[i].end > current.end
+		})
+		active = append(active, nil)
+		copy(active[at+1:], active[at:])
+		active[at] = current
+	}
+	return assigned
+}
+
+func callPositions(fn *ir.Func) []int {
+	var calls []int
+	for i, instr := range fn.Code {
+		if instr.Op == ir.OpPrint || instr.Op == ir.OpAlloc || instr.Op == ir.OpCall ||
+			instr.Op == ir.OpBuiltin {
+			calls = append(calls, i)
+		}
+	}
+	return calls
+}
+
+func spansCall(iv *interval, calls []int) bool {
+	for _, call := range calls {
+		if iv.start < call && call < iv.end {
+			return true
+		}
+	}
+	return false
+}
@@ -1,226 +1,708 @@
 package c
 
 import (
+	_ "embed"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	Text "github.com/linkdotnet/golang-stringbuilder"
-	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
 )
 
+// The runtime of the standard library, declaring its functions, and
+// defining them where DRAGON_RUNTIME_IMPLEMENTATION is defined
+//
+//go:embed runtime.h
+var runtime string
+
 type Context struct {
-	tabs            int
-	block           int
-	uniqueIndex     int
-	instancesToFree map[int][]string
-	sb              *Text.StringBuilder
+	tabs    int
+	sb      *Text.StringBuilder
+	program *ir.Program
+	source  string              // The .bip file for #line directives, if any
+	file    string              // The .bip file of the function being generated
+	line    int                 // The last line given in a #line directive
+	vals    map[ir.Operand]bool // Locals declared const where they are bound
+	self    string              // The pointer to the struct self refers to
+	structs []*ir.Struct        // The structs in the order C needs them
 }
 
-func Generate(root *ast.RootNode) string {
+// Generate generates a single translation unit. If source is not empty,
+// every statement is preceded by a #line directive pointing into it, so
+// compiler errors and debuggers refer to the .bip file.
+func Generate(program *ir.Program, source string) string {
 	sb := Text.StringBuilder{}
 	ctx := Context{
-		sb:              &sb,
-		instancesToFree: make(map[int][]string),
+		sb:      &sb,
+		program: program,
+		source:  source,
+		structs: sortStructs(program),
 	}
-	ctx.sb.Append("#include <stdio.h>\n\n")
-	for _, declaration := range root.Declarations {
-		generate(declaration, &ctx)
+	ctx.sb.Append("#include <stdio.h>\n")
+	if hasRefs(program) {
+		ctx.sb.Append("#include <stdlib.h>\n")
 	}
-	ctx.sb.Append("\nint main(int argc, char *argv[]) {;\n")
-	ctx.tabs += 1
-	for _, child := range root.Children {
-		generate(child, &ctx)
+	ctx.sb.Append("#include <stdbool.h>\n\n")
+	if usesBuiltins(program) {
+		ctx.sb.Append("#define DRAGON_RUNTIME_IMPLEMENTATION\n")
+		ctx.sb.Append(runtime + "\n")
 	}
-	writeTabs(ctx.sb, ctx.tabs)
-	ctx.sb.Append("return 0;\n")
-	ctx.tabs -= 1
-	ctx.sb.Append("}\n")
+	renamedComment(program, &ctx)
+	generateRefDeclarations(program, &ctx)
+	for _, st := range ctx.structs {
+		generateStruct(st, &ctx)
+		generateMethodDeclarations(st, &ctx)
+	}
+	generateVTables(&ctx)
+	for _, method := range program.Methods {
+		generateMethod(method, &ctx)
+	}
+	generateMain(program.Main, &ctx)
 	return ctx.sb.ToString()
 }
 
-func generate(node *ast.Node, ctx *Context) {
+// GenerateSplit generates base.h with the struct declarations and the
+// prototypes of constructors, methods, reference counting and the runtime,
+// and base.c including it with the constructors, the methods, the
+// definitions of the runtime and, if there are any top-level statements,
+// main. The header can be used from hand-written C.
+// source is used like in Generate.
+func GenerateSplit(program *ir.Program, base string, source string) (string, string) {
+	ctx := Context{
+		program: program,
+		source:  source,
+		structs: sortStructs(program),
+	}
+	header := generateHeader(base, &ctx)
+	implementation := generateImplementation(base, &ctx, func(*ir.Func) bool { return true })
+	return header, implementation
+}
 
-	switch node.Type {
+// GenerateModules generates a header like GenerateSplit, and a translation
+// unit including it for the main file and for each imported module, keyed
+// by the source of the module, or "" for the main file. A module gets the
+// constructors and the methods of the structs it declares, and the main
+// file gets the rest, with the tables of the interfaces, the definitions of
+// the runtime and main.
+func GenerateModules(program *ir.Program, base string, source string) (string, map[string]string) {
+	ctx := Context{
+		program: program,
+		source:  source,
+		structs: sortStructs(program),
+	}
+	header := generateHeader(base, &ctx)
+	units := map[string]string{"": ""}
+	for _, st := range ctx.structs {
+		units[st.Constructor.Source] = ""
+	}
+	for _, method := range program.Methods {
+		units[method.Source] = ""
+	}
+	for module := range units {
+		units[module] = generateImplementation(base, &ctx, func(fn *ir.Func) bool {
+			return fn.Source == module
+		})
+	}
+	return header, units
+}
 
-	case ast.TypeBlock:
-		ctx.block += 1
-		block := ctx.block
-		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(fmt.Sprintf("__StartBlock_%d__: {;\n", block))
-		ctx.tabs += 1
-		for _, child := range node.Children {
-			generate(child, ctx)
-		}
-		instancesToFree, exist := ctx.instancesToFree[block]
-		if exist {
-			for _, id := range instancesToFree {
-				writeTabs(ctx.sb, ctx.tabs)
-				ctx.sb.Append(fmt.Sprintf("free(%s);\n", id))
-			}
-		}
-		ctx.tabs -= 1
-		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append("}\n")
-		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(fmt.Sprintf("__EndBlock_%d__: {}\n", block))
+// Runtime returns a translation unit defining the functions of the
+// runtime, for linking them into a program from another backend.
+func Runtime() string {
+	return "#define DRAGON_RUNTIME_IMPLEMENTATION\n" + runtime
+}
 
-	case ast.TypeBlocks:
-		fallthrough
-	case ast.TypeStatements:
-		fallthrough
-	case ast.TypeStatement:
-		for _, child := range node.Children {
-			generate(child, ctx)
+func usesBuiltins(program *ir.Program) bool {
+	return len(program.UsesBuiltins()) > 0
+}
+
+func prints(fn *ir.Func) bool {
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpPrint {
+			return true
 		}
+	}
+	return false
+}
 
-	case ast.TypePrintStatement:
-		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append("printf(")
-		generate(node.Children[0], ctx)
-		ctx.sb.Append(");\n")
+// generateHeader generates base.h for GenerateSplit and GenerateModules.
+func generateHeader(base string, ctx *Context) string {
+	guard := includeGuard(base)
+	header := Text.StringBuilder{}
+	ctx.sb = &header
+	ctx.sb.Append(fmt.Sprintf("#ifndef %s\n", guard))
+	ctx.sb.Append(fmt.Sprintf("#define %s\n\n", guard))
+	ctx.sb.Append("#include <stdbool.h>\n\n")
+	if usesBuiltins(ctx.program) {
+		ctx.sb.Append(runtime + "\n")
+	}
+	renamedComment(ctx.program, ctx)
+	generateRefDeclarations(ctx.program, ctx)
+	for _, st := range ctx.structs {
+		generateTypedef(st, ctx)
+		ctx.sb.Append(fmt.Sprintf(
+			"void %s(%s *o);\n", constructorName(st.Name), name(st.Name)))
+		generateMethodDeclarations(st, ctx)
+	}
+	ctx.sb.Append(fmt.Sprintf("\n#endif // %s\n", guard))
+	return header.ToString()
+}
 
-	case ast.TypeAssignmentStatement:
-		writeTabs(ctx.sb, ctx.tabs) // TODO: handle identifiers and types
-		typeHint := "int"
-		if node.Children[1].Children[0].Type == ast.TypeConstructor {
-			typeHint = node.Children[1].Children[0].Lexeme
+// generateImplementation generates an implementation including base.h,
+// with the constructors and the methods it is given. The one given main
+// also gets the tables of the interfaces and the definitions of the
+// runtime.
+func generateImplementation(base string, ctx *Context, given func(*ir.Func) bool) string {
+	program := ctx.program
+	hasMain := given(program.Main) && len(program.Main.Code) > 0
+	funcs := []*ir.Func{}
+	for _, st := range ctx.structs {
+		funcs = append(funcs, st.Constructor)
+	}
+	funcs = append(funcs, program.Methods...)
+	printing := false
+	for _, fn := range funcs {
+		printing = printing || given(fn) && prints(fn)
+	}
+	implementation := Text.StringBuilder{}
+	ctx.sb = &implementation
+	if given(program.Main) && usesBuiltins(program) {
+		ctx.sb.Append("#define DRAGON_RUNTIME_IMPLEMENTATION\n")
+	}
+	ctx.sb.Append(fmt.Sprintf("#include \"%s.h\"\n", base))
+	if hasMain || printing {
+		ctx.sb.Append("#include <stdio.h>\n")
+	}
+	if hasRefs(program) {
+		ctx.sb.Append("#include <stdlib.h>\n")
+	}
+	ctx.sb.Append("\n")
+	for _, st := range ctx.structs {
+		if given(st.Constructor) {
+			generateConstructor(st, ctx)
+			generateRefFunctions(st, ctx)
 		}
-		ctx.sb.Append(fmt.Sprintf(
-			"%s %s = ", typeHint, node.Children[0].Lexeme))
+	}
+	if given(program.Main) {
+		generateVTables(ctx)
+	}
+	for _, method := range program.Methods {
+		if given(method) {
+			generateMethod(method, ctx)
+		}
+	}
+	if hasMain {
+		generateMain(program.Main, ctx)
+	}
+	return implementation.ToString()
+}
 
-		generate(node.Children[1], ctx)
-		ctx.sb.Append(";\n")
+func generateStruct(st *ir.Struct, ctx *Context) {
+	generateTypedef(st, ctx)
+	generateConstructor(st, ctx)
+	generateRefFunctions(st, ctx)
+}
 
-	case ast.TypeSkipStatement:
+// generateTypedef defines a value struct as an anonymous struct type. A ref
+// struct is already declared by generateRefDeclarations and gets a
+// reference count before its fields.
+func generateTypedef(st *ir.Struct, ctx *Context) {
+	if st.IsEnum() {
+		generateEnumTypedef(st, ctx)
+		return
+	}
+	writeTabs(ctx.sb, ctx.tabs)
+	if st.Ref {
+		ctx.sb.Append(fmt.Sprintf("struct %s {\n", name(st.Name)))
+	} else {
+		ctx.sb.Append("typedef struct {\n")
+	}
+	ctx.tabs += 1
+	if st.Ref {
+		writeTabs(ctx.sb, ctx.tabs)
+		ctx.sb.Append("int __refs;\n")
+	}
+	for _, field := range st.Fields {
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(fmt.Sprintf("goto __EndBlock_%d__;\n", ctx.block))
+		ctx.sb.Append(fmt.Sprintf("%s %s;\n",
+			cType(field.Type, ctx), name(field.Lexeme)))
+	}
+	ctx.tabs -= 1
+	writeTabs(ctx.sb, ctx.tabs)
+	if st.Ref {
+		ctx.sb.Append("};\n")
+	} else {
+		ctx.sb.Append(fmt.Sprintf("} %s;\n", name(st.Name)))
+	}
+}
 
-	case ast.TypeSkipIfStatement:
+// generateEnumTypedef defines an enum as its tag and an anonymous union of
+// the structs of the variants with fields.
+func generateEnumTypedef(st *ir.Struct, ctx *Context) {
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append("typedef struct {\n")
+	ctx.tabs += 1
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append(fmt.Sprintf("int %s;\n", name(st.Fields[0].Lexeme)))
+	if len(st.Fields) > 1 {
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append("if (")
-		generate(node.Children[0], ctx)
-		ctx.sb.Append(fmt.Sprintf(") goto __EndBlock_%d__;\n", ctx.block))
+		ctx.sb.Append("union {\n")
+		ctx.tabs += 1
+		for _, field := range st.Fields[1:] {
+			writeTabs(ctx.sb, ctx.tabs)
+			ctx.sb.Append(fmt.Sprintf("%s %s;\n",
+				cType(field.Type, ctx), name(field.Lexeme)))
+		}
+		ctx.tabs -= 1
+		writeTabs(ctx.sb, ctx.tabs)
+		ctx.sb.Append("};\n")
+	}
+	ctx.tabs -= 1
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append(fmt.Sprintf("} %s;\n", name(st.Name)))
+}
 
-	case ast.TypeExpression:
-		generate(node.Children[0], ctx)
+func generateConstructor(st *ir.Struct, ctx *Context) {
+	ctx.self = "o"
+	ctx.file = sourceOf(st.Constructor, ctx)
+	lineDirective(firstLine(st.Constructor), ctx)
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append(fmt.Sprintf(
+		"void %s(%s *o) {\n", constructorName(st.Name), name(st.Name)))
+	ctx.tabs += 1
+	generateBody(st.Constructor, ctx)
+	ctx.tabs -= 1
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append("}\n")
+}
 
-	case ast.TypeOperator:
-		ctx.sb.Append("(")
-		generate(node.Children[0], ctx)
-		ctx.sb.Append(node.Lexeme)
-		generate(node.Children[1], ctx)
-		ctx.sb.Append(")")
+// generateMethodDeclarations declares the methods whose signatures mention
+// no struct declared after st, so they can be called from any constructor
+// or method that can use all of those structs.
+func generateMethodDeclarations(st *ir.Struct, ctx *Context) {
+	for _, method := range ctx.program.Methods {
+		if lastStruct(funcTypes(method), ctx) == st {
+			ctx.sb.Append(methodSignature(method, ctx) + ";\n")
+		}
+	}
+	generateVTableDeclarations(st, ctx)
+}
 
-	case ast.TypeLiteral:
-		ctx.sb.Append(fmt.Sprintf("\"%s\"", node.Lexeme))
+// funcTypes returns the types in the signature of a method.
+func funcTypes(fn *ir.Func) []string {
+	types := []string{fn.Receiver, fn.Result}
+	for _, param := range fn.Params {
+		types = append(types, param.Type)
+	}
+	return types
+}
 
-	case ast.TypeNumber:
-		ctx.sb.Append(fmt.Sprintf("%d", node.Number))
+func lastStruct(types []string, ctx *Context) *ir.Struct {
+	var last *ir.Struct
+	for _, st := range ctx.structs {
+		for _, typeHint := range types {
+			if st.Name == typeHint {
+				last = st
+			}
+		}
+	}
+	return last
+}
 
-	case ast.TypeBoolean:
-		ctx.sb.Append(fmt.Sprintf("%d", node.Number))
+// generateMethod defines a method as a function taking a pointer to its
+// receiver, like a constructor, and its parameters in order. Structs are
+// passed and returned by value, and ref structs are borrowed from the
+// caller, except for a returned reference, which the caller adopts.
+func generateMethod(fn *ir.Func, ctx *Context) {
+	ctx.self = "self"
+	ctx.file = sourceOf(fn, ctx)
+	ctx.sb.Append("\n")
+	lineDirective(firstLine(fn), ctx)
+	ctx.sb.Append(methodSignature(fn, ctx) + " {\n")
+	ctx.tabs += 1
+	generateBody(fn, ctx)
+	ctx.tabs -= 1
+	ctx.sb.Append("}\n")
+}
 
-	case ast.TypeIdentifier:
-		ctx.sb.Append(node.Lexeme) // TODO: handle identifiers
+func methodSignature(fn *ir.Func, ctx *Context) string {
+	return declaration(fn, methodName(fn.Name, ctx), ctx)
+}
 
-	case ast.TypeNot:
-		ctx.sb.Append("!(")
-		generate(node.Children[0], ctx)
-		ctx.sb.Append(")")
+// declaration declares a function with the parameters and the result of a
+// method, also used for the methods of interfaces.
+func declaration(fn *ir.Func, declarator string, ctx *Context) string {
+	result := "void"
+	if fn.Result != "" {
+		result = cType(fn.Result, ctx)
+	}
+	params := []string{fmt.Sprintf("%s *self", name(fn.Receiver))}
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("%s %s",
+			cType(param.Type, ctx), operand(param, ctx)))
+	}
+	return fmt.Sprintf("%s %s(%s)", result, declarator, strings.Join(params, ", "))
+}
 
-	case ast.TypeStructDeclaration:
+func generateMain(fn *ir.Func, ctx *Context) {
+	ctx.file = sourceOf(fn, ctx)
+	ctx.sb.Append("\n")
+	lineDirective(firstLine(fn), ctx)
+	ctx.sb.Append("int main(int argc, char *argv[]) {\n")
+	ctx.tabs += 1
+	if usesBuiltins(ctx.program) {
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append("typedef struct {\n")
-		ctx.tabs += 1
-		for _, child := range node.Children {
-			generate(child, ctx)
+		ctx.sb.Append("__Builtin_Process_init__(argc, argv);\n")
+	}
+	generateBody(fn, ctx)
+	writeTabs(ctx.sb, ctx.tabs)
+	ctx.sb.Append("return 0;\n")
+	ctx.tabs -= 1
+	ctx.sb.Append("}\n")
+}
+
+// generateBody declares the locals and generates the code of a function.
+// References start out as NULL and are released as described in ref.go.
+// Locals bound with val are declared const where they are bound instead.
+// A method returns after the releases, retaining a returned reference for
+// the caller first.
+func generateBody(fn *ir.Func, ctx *Context) {
+	ctx.vals = vals(fn, ctx)
+	for _, local := range fn.Locals {
+		if ctx.vals[local] {
+			continue
 		}
-		ctx.tabs -= 1
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(fmt.Sprintf("} %s;\n", node.Lexeme))
+		if ctx.program.IsRef(local.Type) {
+			ctx.sb.Append(fmt.Sprintf("%s %s = NULL;\n",
+				cType(local.Type, ctx), operand(local, ctx)))
+			continue
+		}
+		ctx.sb.Append(fmt.Sprintf("%s %s;\n",
+			cType(local.Type, ctx), operand(local, ctx)))
+	}
+	code := fn.Code
+	var result ir.Operand
+	if last := len(code) - 1; last >= 0 && code[last].Op == ir.OpReturn {
+		code, result = code[:last], code[last].Arg1
+	}
+	released := releases(fn, code, result, ctx)
+	for i, instr := range code {
+		generate(instr, ctx)
+		generateReleases(released[i], ctx)
+	}
+	lineDirective(ctx.line, ctx)
+	if ctx.program.IsRef(result.Type) {
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(fmt.Sprintf(
-			"void __Construct_%s__(%s *o) {\n", node.Lexeme, node.Lexeme))
-		ctx.tabs += 1
-		for _, child := range node.Children {
+		ctx.sb.Append(fmt.Sprintf("%s(%s);\n",
+			retainName(result.Type), operand(result, ctx)))
+	}
+	for _, local := range fn.Locals {
+		if ctx.program.IsRef(local.Type) {
 			writeTabs(ctx.sb, ctx.tabs)
-			if len(child.Children) > 0 {
-				ctx.sb.Append(fmt.Sprintf("o->%s = ", child.Lexeme))
-				generate(child.Children[0], ctx)
-			} else {
-				defaultValue := getDefaultValue(child)
-				if len(defaultValue) == 0 {
-					ctx.sb.Append(fmt.Sprintf(
-						"__Construct_%s__(&o->%s)", child.TypeHint, child.Lexeme))
-				} else {
-					ctx.sb.Append(fmt.Sprintf("o->%s = ", child.Lexeme))
-					ctx.sb.Append(getDefaultValue(child))
-				}
-			}
-			ctx.sb.Append(";\n")
+			ctx.sb.Append(fmt.Sprintf("%s(%s);\n",
+				releaseName(local.Type), operand(local, ctx)))
 		}
-		ctx.tabs -= 1
+	}
+	if result.Kind != ir.OperandZero {
 		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append("}\n")
+		ctx.sb.Append(fmt.Sprintf("return %s;\n", operand(result, ctx)))
+	}
+}
 
-	case ast.TypeStructField:
-		writeTabs(ctx.sb, ctx.tabs)
-		ctx.sb.Append(
-			fmt.Sprintf("%s %s;\n",
-				typeHintToString(node.TypeHint), node.Lexeme))
-
-	case ast.TypeConstructor:
-		sb := Text.StringBuilder{}
-		ctx.uniqueIndex += 1
-		uniqueIndex := ctx.uniqueIndex
-		sb.AppendRune('\n')
-		instanceId := fmt.Sprintf("__Instance_%d__", uniqueIndex)
-		writeTabs(&sb, ctx.tabs)
-		sb.Append(fmt.Sprintf(
-			"%s %s;\n", node.Lexeme, instanceId))
-		writeTabs(&sb, ctx.tabs)
-		sb.Append(fmt.Sprintf(
-			"__Construct_%s__(&%s);\n", node.Lexeme, instanceId))
-		sbPrev := ctx.sb
-		ctx.sb = &sb
-		for _, child := range node.Children {
-			generate(child, ctx)
-		}
-		ctx.sb = sbPrev
-		index := ctx.sb.FindLast(";")
-		sb.TrimEnd('\n')
-		ctx.sb.Insert(index+1, sb.ToString())
-		ctx.sb.Append(instanceId)
-		// list, exist := ctx.instancesToFree[ctx.block]
-		// if !exist {
-		// 	list = make([]string, 0)
-		// 	ctx.instancesToFree[ctx.block] = list
-		// }
-		// list = append(list, instanceIdPointer)
-		// ctx.instancesToFree[ctx.block] = list
-
-	case ast.TypeStructArgument:
-		writeTabs(ctx.sb, ctx.tabs)
-		instanceId := fmt.Sprintf("__Instance_%d__",
-			ctx.uniqueIndex)
-		ctx.sb.Append(fmt.Sprintf("%s.%s = ", instanceId, node.Lexeme))
-		generate(node.Children[0], ctx)
-		ctx.sb.Append(";\n")
+func generate(instr ir.Instr, ctx *Context) {
+	lineDirective(instr.Line, ctx)
+	writeTabs(ctx.sb, ctx.tabs)
+
+	switch instr.Op {
+
+	case ir.OpCopy:
+		if ctx.vals[instr.Dst] {
+			ctx.sb.Append(fmt.Sprintf("%s %s = %s;\n",
+				constType(instr.Dst.Type, ctx), operand(instr.Dst, ctx), operand(instr.Arg1, ctx)))
+			break
+		}
+		if ctx.program.IsRef(instr.Dst.Type) {
+			ctx.sb.Append(fmt.Sprintf("%s(&%s, %s);\n", assignName(instr.Dst.Type),
+				operand(instr.Dst, ctx), operand(instr.Arg1, ctx)))
+			break
+		}
+		ctx.sb.Append(fmt.Sprintf("%s = %s;\n",
+			operand(instr.Dst, ctx), operand(instr.Arg1, ctx)))
+
+	case ir.OpBinary:
+		ctx.sb.Append(fmt.Sprintf("%s = %s %s %s;\n",
+			operand(instr.Dst, ctx),
+			operand(instr.Arg1, ctx),
+			instr.Operator,
+			operand(instr.Arg2, ctx)))
+
+	case ir.OpNot:
+		ctx.sb.Append(fmt.Sprintf("%s = !%s;\n",
+			operand(instr.Dst, ctx), operand(instr.Arg1, ctx)))
+
+	case ir.OpLabel:
+		ctx.sb.Append(fmt.Sprintf("%s:;\n", label(instr.Label)))
+
+	case ir.OpJump:
+		ctx.sb.Append(fmt.Sprintf("goto %s;\n", label(instr.Label)))
+
+	case ir.OpJumpIf:
+		ctx.sb.Append(fmt.Sprintf("if (%s) goto %s;\n",
+			operand(instr.Arg1, ctx), label(instr.Label)))
+
+	case ir.OpAlloc:
+		if ctx.program.IsRef(instr.Dst.Type) {
+			ctx.sb.Append(fmt.Sprintf("%s(%s); %s = %s();\n",
+				releaseName(instr.Dst.Type), operand(instr.Dst, ctx),
+				operand(instr.Dst, ctx), newName(instr.Dst.Type)))
+			break
+		}
+		ctx.sb.Append(fmt.Sprintf("%s(&%s);\n",
+			constructorName(instr.Dst.Type), operand(instr.Dst, ctx)))
+
+	case ir.OpLoad:
+		if ctx.program.IsRef(instr.Dst.Type) {
+			ctx.sb.Append(fmt.Sprintf("%s(&%s, %s);\n", assignName(instr.Dst.Type),
+				operand(instr.Dst, ctx), fieldAccess(instr.Arg1, instr.Field, ctx)))
+			break
+		}
+		ctx.sb.Append(fmt.Sprintf("%s = %s;\n",
+			operand(instr.Dst, ctx), fieldAccess(instr.Arg1, instr.Field, ctx)))
+
+	case ir.OpStore:
+		if ctx.program.IsRef(instr.Arg1.Type) {
+			ctx.sb.Append(fmt.Sprintf("%s(&%s, %s);\n", assignName(instr.Arg1.Type),
+				fieldAccess(instr.Dst, instr.Field, ctx), operand(instr.Arg1, ctx)))
+			break
+		}
+		ctx.sb.Append(fmt.Sprintf("%s = %s;\n",
+			fieldAccess(instr.Dst, instr.Field, ctx), operand(instr.Arg1, ctx)))
+
+	case ir.OpPrint:
+		ctx.sb.Append(printStatement(instr.Arg1, ctx))
+
+	case ir.OpCall:
+		args := []string{receiver(instr.Arg1, ctx)}
+		for _, arg := range instr.Args {
+			args = append(args, operand(arg, ctx))
+		}
+		call := fmt.Sprintf("%s(%s)", methodName(instr.Func, ctx), strings.Join(args, ", "))
+		if ctx.program.IsInterface(instr.Arg1.Type) {
+			call = dispatchCall(instr, ctx)
+		}
+		switch {
+		case instr.Dst.Kind == ir.OperandZero:
+			ctx.sb.Append(call + ";\n")
+		case ctx.program.IsRef(instr.Dst.Type):
+			ctx.sb.Append(fmt.Sprintf("%s(%s); %s = %s;\n",
+				releaseName(instr.Dst.Type), operand(instr.Dst, ctx),
+				operand(instr.Dst, ctx), call))
+		default:
+			ctx.sb.Append(fmt.Sprintf("%s = %s;\n", operand(instr.Dst, ctx), call))
+		}
+
+	case ir.OpBuiltin:
+		var args []string
+		for _, arg := range instr.Args {
+			args = append(args, operand(arg, ctx))
+		}
+		call := fmt.Sprintf("%s(%s)", ir.BuiltinName(instr.Func), strings.Join(args, ", "))
+		if instr.Dst.Kind == ir.OperandZero {
+			ctx.sb.Append(call + ";\n")
+			break
+		}
+		ctx.sb.Append(fmt.Sprintf("%s = %s;\n", operand(instr.Dst, ctx), call))
+
+	default:
+		panic(fmt.Sprintf("cannot generate %s", instr))
+	}
+}
+
+// vals returns the locals bound with val that can be declared const. The
+// optimizer may have merged a val with the temporary holding its value, so
+// only locals written by nothing but their binding are included. References
+// are assigned through their address and are never const, and neither are
+// the structs methods are called on, which are passed by address.
+func vals(fn *ir.Func, ctx *Context) map[ir.Operand]bool {
+	writes := make(map[ir.Operand]int)
+	for _, instr := range fn.Code {
+		if def, ok := instr.Def(); ok {
+			writes[def] += 1
+		} else if instr.Op == ir.OpStore {
+			writes[instr.Dst] += 1
+		}
+		if instr.Op == ir.OpCall {
+			writes[instr.Arg1] += 1
+		}
+	}
+	result := make(map[ir.Operand]bool)
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpCopy && instr.Val && writes[instr.Dst] == 1 &&
+			!ctx.program.IsRef(instr.Dst.Type) {
+			result[instr.Dst] = true
+		}
+	}
+	return result
+}
+
+// lineDirective makes the next line of C count as the given line of the
+// source. It is needed before every statement, since the line count keeps
+// increasing after the directive.
+func lineDirective(line int, ctx *Context) {
+	if ctx.source == "" || line == 0 {
+		return
+	}
+	ctx.line = line
+	ctx.sb.Append(fmt.Sprintf("#line %d %s\n", line, strconv.Quote(ctx.file)))
+}
+
+// sourceOf returns the .bip file a function comes from, which is source
+// unless it comes from an imported module.
+func sourceOf(fn *ir.Func, ctx *Context) string {
+	if fn.Source != "" {
+		return fn.Source
 	}
+	return ctx.source
 }
 
-func getDefaultValue(node *ast.Node) string {
-	switch node.TypeHint {
+func firstLine(fn *ir.Func) int {
+	for _, instr := range fn.Code {
+		if instr.Line != 0 {
+			return instr.Line
+		}
+	}
+	return 0
+}
+
+func printStatement(value ir.Operand, ctx *Context) string {
+	switch value.Type {
 	case "Int":
-		return "0"
+		return fmt.Sprintf("printf(\"%%d\\n\", %s);\n", operand(value, ctx))
 	case "Float":
-		return "0.0"
+		return fmt.Sprintf("printf(\"%%f\\n\", %s);\n", operand(value, ctx))
 	case "Bool":
-		return "false"
+		return fmt.Sprintf(
+			"printf(\"%%s\\n\", %s ? \"true\" : \"false\");\n", operand(value, ctx))
 	case "String":
-		return "\"\""
+		return fmt.Sprintf("printf(\"%%s\\n\", %s);\n", operand(value, ctx))
 	default:
-		return ""
+		panic(fmt.Sprintf("cannot print value of type %s", value.Type))
+	}
+}
+
+func operand(op ir.Operand, ctx *Context) string {
+	switch op.Kind {
+	case ir.OperandTemp:
+		if op.Version > 0 {
+			return fmt.Sprintf("__Temp_%d_%d__", op.Number, op.Version)
+		}
+		return fmt.Sprintf("__Temp_%d__", op.Number)
+	case ir.OperandVar:
+		return variable(op.Lexeme, op.Version)
+	case ir.OperandSelf:
+		if ctx.program.IsRef(op.Type) {
+			return ctx.self
+		}
+		return fmt.Sprintf("(*%s)", ctx.self)
+	case ir.OperandInt:
+		if op.Number == math.MinInt32 {
+			// 2147483648 does not fit in an int, so it cannot be negated
+			return "(-2147483647 - 1)"
+		}
+		return strconv.Itoa(op.Number)
+	case ir.OperandFloat:
+		return strconv.FormatFloat(op.Float, 'g', -1, 64)
+	case ir.OperandBool:
+		if op.Number != 0 {
+			return "true"
+		}
+		return "false"
+	case ir.OperandString:
+		return fmt.Sprintf("\"%s\"", escape(op.Lexeme))
+	default:
+		panic(fmt.Sprintf("cannot generate operand %s", op))
+	}
+}
+
+// escape writes the bytes C would not read back as themselves in a string
+// literal as octal escapes, which unlike hex escapes end after three
+// digits.
+func escape(text string) string {
+	var sb strings.Builder
+	for _, b := range []byte(text) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			sb.WriteString(fmt.Sprintf("\\%03o", b))
+			continue
+		}
+		sb.WriteByte(b)
 	}
+	return sb.String()
+}
+
+// fieldAccess follows a dotted path of fields, through pointers for self
+// and references.
+func fieldAccess(op ir.Operand, path string, ctx *Context) string {
+	access := operand(op, ctx)
+	pointer := ctx.program.IsRef(op.Type)
+	if op.Kind == ir.OperandSelf {
+		access, pointer = ctx.self, true
+	}
+	typeHint := op.Type
+	for _, lexeme := range strings.Split(path, ".") {
+		if pointer {
+			access = fmt.Sprintf("%s->%s", access, name(lexeme))
+		} else {
+			access = fmt.Sprintf("%s.%s", access, name(lexeme))
+		}
+		st, ok := ctx.program.GetStruct(typeHint)
+		if !ok {
+			panic(fmt.Sprintf("%s is not a struct", typeHint))
+		}
+		field, _ := st.GetField(lexeme)
+		typeHint = field.Type
+		pointer = ctx.program.IsRef(typeHint)
+	}
+	return access
+}
+
+// receiver returns the pointer a method is called with.
+func receiver(op ir.Operand, ctx *Context) string {
+	if op.Kind == ir.OperandSelf {
+		return ctx.self
+	}
+	if ctx.program.IsRef(op.Type) {
+		return operand(op, ctx)
+	}
+	return "&" + operand(op, ctx)
+}
+
+func label(lexeme string) string {
+	return fmt.Sprintf("__%s__", lexeme)
+}
+
+func constructorName(structName string) string {
+	return fmt.Sprintf("__Construct_%s__", structName)
+}
+
+// cType is the C type of values of a type, which is a pointer for ref
+// structs.
+func cType(typeHint string, ctx *Context) string {
+	if ctx.program.IsRef(typeHint) {
+		return typeHintToString(typeHint) + "*"
+	}
+	return typeHintToString(typeHint)
+}
+
+// constType qualifies a type for a local that is never assigned again. For
+// a string it is the pointer that is const, not the characters.
+func constType(typeHint string, ctx *Context) string {
+	if typeHint == "String" {
+		return cType(typeHint, ctx) + " const"
+	}
+	return "const " + cType(typeHint, ctx)
 }
 
 func typeHintToString(lexeme string) string {
@@ -234,8 +716,29 @@ func typeHintToString(lexeme string) string {
 	case "String":
 		return "char*"
 	default:
-		return lexeme
+		return name(lexeme)
+	}
+}
+
+// includeGuard turns a file name into a macro name, like readme.h to
+// README_H. A name not starting with a letter gets the prefix DRAGON_, since
+// a macro cannot start with a digit and those starting with _ and a capital
+// are reserved.
+func includeGuard(name string) string {
+	var sb strings.Builder
+	name = strings.ToUpper(name)
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		sb.WriteString("DRAGON_")
+	}
+	for _, r := range name {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('_')
+		}
 	}
+	sb.WriteString("_H")
+	return sb.String()
 }
 
 func writeTabs(sb *Text.StringBuilder, tabs int) {
@@ -0,0 +1,257 @@
+package c
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
+)
+
+// A program whose statements are easy to find in the C, with a module, so
+// the lines of constructors, methods, blocks and imported code are tested
+const linesProgram = `struct Point {
+    x Int = 1
+    y Int = 2
+}
+
+fn Point.sum() Int {
+    print 7
+    return self.x + self.y
+}
+
+p = Point(x 3)
+print 12
+{
+    skip_if p.x > 2
+    print 15
+}
+print p.sum()
+print 18
+shapes.Box().show()
+`
+
+const linesModule = `struct Box {
+    size Int = 4
+
+    fn show() {
+        print 5
+    }
+}
+`
+
+// writeLines writes the program and its module to a temporary directory
+// and returns the paths of both.
+func writeLines(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "lines.bip")
+	imported := filepath.Join(dir, "shapes.bip")
+	if err := os.WriteFile(source, []byte("import \"shapes\"\n\n"+linesProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(imported, []byte(linesModule), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return source, imported
+}
+
+func TestLineDirectives(t *testing.T) {
+	source, imported := writeLines(t)
+	code := Generate(ir.Lower(module.Load(source, nil)), source)
+
+	// The import shifts the program down two lines
+	expected := []struct {
+		code string
+		file string
+		line int
+	}{
+		{"o->x = 1;", source, 4},
+		{"o->y = 2;", source, 5},
+		{`printf("%d\n", 7);`, source, 9},
+		{"= self->x;", source, 10},
+		{".x = 3;", source, 13},
+		{`printf("%d\n", 12);`, source, 14},
+		{"= p.x;", source, 16},
+		{`printf("%d\n", 15);`, source, 17},
+		{"Point_sum(&p);", source, 19},
+		{`printf("%d\n", 18);`, source, 20},
+		{"o->size = 4;", imported, 2},
+		{`printf("%d\n", 5);`, imported, 5},
+	}
+
+	file, line := "", 0
+	found := make([]bool, len(expected))
+	for i, text := range strings.Split(code, "\n") {
+		if directive, ok := strings.CutPrefix(text, "#line "); ok {
+			number, quoted, _ := strings.Cut(directive, " ")
+			var err error
+			if line, err = strconv.Atoi(number); err != nil {
+				t.Fatalf("line %d of the C: bad directive %s", i+1, text)
+			}
+			if file, err = strconv.Unquote(quoted); err != nil {
+				t.Fatalf("line %d of the C: bad directive %s", i+1, text)
+			}
+			if file != source && file != imported {
+				t.Errorf("line %d of the C: directive points into %s", i+1, file)
+			}
+			continue
+		}
+		for j, want := range expected {
+			if !strings.Contains(text, want.code) {
+				continue
+			}
+			found[j] = true
+			if file != want.file || line != want.line {
+				t.Errorf("%s is at %s:%d, want %s:%d", want.code, file, line, want.file, want.line)
+			}
+		}
+	}
+	for j, want := range expected {
+		if !found[j] {
+			t.Errorf("%s was not generated", want.code)
+		}
+	}
+}
+
+// TestDebuggerLines stops gdb at lines of the program and its module, in
+// a build with debug information.
+func TestDebuggerLines(t *testing.T) {
+	gdb, err := exec.LookPath("gdb")
+	if err != nil {
+		t.Skip("gdb is not installed")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc is not installed")
+	}
+	source, _ := writeLines(t)
+	unit := strings.TrimSuffix(source, ".bip") + ".c"
+	binary := strings.TrimSuffix(source, ".bip")
+	if err := os.WriteFile(unit, []byte(Generate(ir.Lower(module.Load(source, nil)), source)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command(cc, "-g", "-O0", "-o", binary, unit).CombinedOutput(); err != nil {
+		t.Fatalf("cc: %s\n%s", err, output)
+	}
+
+	output, err := exec.Command(gdb, "-batch", "-nx",
+		"-ex", "break lines.bip:9",
+		"-ex", "break shapes.bip:5",
+		"-ex", "run",
+		"-ex", "continue",
+		binary).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gdb: %s\n%s", err, output)
+	}
+	for _, want := range []string{"lines.bip:9", "shapes.bip:5"} {
+		if !strings.Contains(string(output), "at "+want) && !strings.Contains(string(output), "/"+want) {
+			t.Errorf("gdb did not stop at %s:\n%s", want, output)
+		}
+	}
+}
+
+// lower lowers the program in source.
+func lower(source string) *ir.Program {
+	lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(source)))
+	parser := parser.NewParser(lexer.ScanAll())
+	return ir.Lower(parser.Parse())
+}
+
+// runC builds the C of program and runs it, skipping the test without a C
+// compiler, and returns what it prints along with what the VM prints.
+func runC(t *testing.T, program *ir.Program) (string, string) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc is not installed")
+	}
+	var want strings.Builder
+	if err := vm.New(bytecode.Compile(program), &want).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	unit := filepath.Join(dir, "program.c")
+	binary := filepath.Join(dir, "program")
+	if err := os.WriteFile(unit, []byte(Generate(program, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command(cc, "-fwrapv", "-o", binary, unit, "-lm").CombinedOutput(); err != nil {
+		t.Fatalf("cc: %s\n%s", err, output)
+	}
+	output, err := exec.Command(binary).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), want.String()
+}
+
+func TestStringLiterals(t *testing.T) {
+	program := lower(`print "end\"
+print "a\\".length()
+print "q?? \n \t é` + "\x7f\t" + `"
+`)
+	got, want := runC(t, program)
+	if got != want {
+		t.Errorf("printed %q, the VM printed %q", got, want)
+	}
+}
+
+func TestIncludeGuard(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"readme", "README_H"},
+		{"my-file.v2", "MY_FILE_V2_H"},
+		{"2d", "DRAGON_2D_H"},
+		{"_shapes", "DRAGON__SHAPES_H"},
+		{"été", "DRAGON__T__H"},
+	}
+	for _, test := range tests {
+		if got := includeGuard(test.name); got != test.want {
+			t.Errorf("the guard of %s is %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// TestReservedNames uses names from the headers the generated C and the
+// runtime include, as structs, fields, methods and variables.
+func TestReservedNames(t *testing.T) {
+	program := lower(`struct INT_MAX {
+    strlen Int = 1
+    index String = "i"
+
+    fn abs() Int {
+        return self.strlen
+    }
+}
+
+ref struct HUGE_VAL {
+    malloc Int = 2
+}
+
+round = INT_MAX(strlen 3)
+floor = HUGE_VAL()
+sqrtf = round.abs().toFloat().sqrt()
+exit = "exit".length()
+print round.strlen
+print round.index
+print round.abs()
+print floor.malloc
+print sqrtf
+print exit
+`)
+	got, want := runC(t, program)
+	if got != want {
+		t.Errorf("printed %q, the VM printed %q", got, want)
+	}
+}
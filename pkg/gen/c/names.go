@@ -0,0 +1,238 @@
+package c
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Names in the generated C.
+
+	Identifiers, field names and struct names from the source are used as
+	they are, unless they are reserved in the generated C, in which case
+	they are renamed to __Name_x__. Source identifiers start with a letter,
+	so they never collide with names starting with an underscore, which is
+	why every name made up by the compiler does, like __Temp_1__,
+	__Construct_Color__ and __EndBlock_1__. Methods are the exception,
+	named like House_describe, which only a struct name with an underscore
+	can collide with.
+*/
+
+var reserved = map[string]bool{}
+
+func init() {
+	keywords := []string{
+		"auto", "break", "case", "char", "const", "continue", "default",
+		"do", "double", "else", "enum", "extern", "float", "for", "goto",
+		"if", "inline", "int", "long", "register", "restrict", "return",
+		"short", "signed", "sizeof", "static", "struct", "switch",
+		"typedef", "union", "unsigned", "void", "volatile", "while",
+		"asm", "typeof", "alignas", "alignof", "constexpr", "nullptr",
+		"static_assert", "thread_local",
+	}
+	// Names from stdio.h and stdbool.h, which the generated C includes,
+	// many of which may be macros. Names with digits, like log10, are left
+	// out of these lists, since identifiers cannot contain digits.
+	headers := []string{
+		"bool", "true", "false",
+		"FILE", "EOF", "NULL", "BUFSIZ", "FILENAME_MAX", "FOPEN_MAX",
+		"L_tmpnam", "SEEK_SET", "SEEK_CUR", "SEEK_END", "TMP_MAX",
+		"fpos_t", "size_t", "va_list", "stdin", "stdout", "stderr",
+		"printf", "fprintf", "sprintf", "snprintf", "vprintf", "vfprintf",
+		"vsprintf", "vsnprintf", "scanf", "fscanf", "sscanf", "vscanf",
+		"vfscanf", "vsscanf", "puts", "fputs", "gets", "fgets", "putc",
+		"fputc", "putchar", "getc", "fgetc", "getchar", "ungetc", "fopen",
+		"freopen", "fclose", "fflush", "fread", "fwrite", "fseek", "ftell",
+		"rewind", "fgetpos", "fsetpos", "feof", "ferror", "clearerr",
+		"perror", "remove", "rename", "tmpfile", "tmpnam", "setbuf",
+		"setvbuf", "getline", "getdelim", "dprintf", "fileno", "popen",
+		"pclose",
+	}
+	// Names from stdlib.h, which the generated C includes for ref structs
+	// and the runtime includes, along with what glibc declares in it
+	stdlibNames := []string{
+		"EXIT_SUCCESS", "EXIT_FAILURE", "RAND_MAX", "MB_CUR_MAX",
+		"div_t", "ldiv_t", "lldiv_t", "wchar_t",
+		"atof", "atoi", "atol", "atoll", "strtod", "strtof", "strtold",
+		"strtol", "strtoll", "strtoul", "strtoull", "rand", "srand",
+		"random", "srandom", "calloc", "malloc", "realloc", "reallocarray",
+		"free", "aligned_alloc", "posix_memalign", "alloca", "abort",
+		"atexit", "at_quick_exit", "on_exit", "exit", "quick_exit",
+		"getenv", "secure_getenv", "setenv", "unsetenv", "putenv",
+		"clearenv", "system", "bsearch", "qsort", "abs", "labs", "llabs",
+		"div", "ldiv", "lldiv", "mblen", "mbtowc", "wctomb", "mbstowcs",
+		"wcstombs", "mktemp", "mkstemp", "mkdtemp", "realpath",
+		"getsubopt", "WEXITSTATUS", "WTERMSIG", "WSTOPSIG", "WIFEXITED",
+		"WIFSIGNALED", "WIFSTOPPED", "WNOHANG", "WUNTRACED",
+	}
+	// Names from string.h, which the runtime includes, and strings.h,
+	// which glibc includes with it
+	stringNames := []string{
+		"memcpy", "memmove", "memset", "memcmp", "memchr", "memrchr",
+		"memccpy", "mempcpy", "rawmemchr", "strcpy", "strncpy", "stpcpy",
+		"stpncpy", "strcat", "strncat", "strlcpy", "strlcat", "strcmp",
+		"strncmp", "strcoll", "strxfrm", "strchr", "strrchr", "strchrnul",
+		"strspn", "strcspn", "strpbrk", "strstr", "strcasestr", "strtok",
+		"strtok_r", "strsep", "strlen", "strnlen", "strerror",
+		"strerror_r", "strsignal", "strdup", "strndup", "strdupa",
+		"strndupa", "explicit_bzero", "bzero", "bcopy", "bcmp", "index",
+		"rindex", "ffs", "strcasecmp", "strncasecmp",
+	}
+	// Names from limits.h, which the runtime includes, along with the
+	// POSIX limits glibc defines in it
+	limitNames := []string{
+		"CHAR_BIT", "CHAR_MIN", "CHAR_MAX", "SCHAR_MIN", "SCHAR_MAX",
+		"UCHAR_MAX", "MB_LEN_MAX", "SHRT_MIN", "SHRT_MAX", "USHRT_MAX",
+		"INT_MIN", "INT_MAX", "UINT_MAX", "LONG_MIN", "LONG_MAX",
+		"ULONG_MAX", "LLONG_MIN", "LLONG_MAX", "ULLONG_MAX", "CHAR_WIDTH",
+		"SCHAR_WIDTH", "UCHAR_WIDTH", "SHRT_WIDTH", "USHRT_WIDTH",
+		"INT_WIDTH", "UINT_WIDTH", "LONG_WIDTH", "ULONG_WIDTH",
+		"LLONG_WIDTH", "ULLONG_WIDTH", "BOOL_WIDTH", "SSIZE_MAX",
+		"PATH_MAX", "NAME_MAX", "PIPE_BUF", "ARG_MAX", "LINE_MAX",
+		"NGROUPS_MAX", "RE_DUP_MAX", "IOV_MAX", "HOST_NAME_MAX",
+		"LOGIN_NAME_MAX", "TTY_NAME_MAX", "PTHREAD_KEYS_MAX",
+		"PTHREAD_STACK_MIN", "PTHREAD_DESTRUCTOR_ITERATIONS",
+		"DELAYTIMER_MAX", "RTSIG_MAX", "SEM_VALUE_MAX", "MQ_PRIO_MAX",
+		"XATTR_NAME_MAX", "XATTR_SIZE_MAX", "XATTR_LIST_MAX",
+	}
+	// Names from math.h, which the runtime includes. Each function also
+	// comes with an f suffix for float and an l suffix for long double.
+	mathNames := []string{
+		"HUGE_VAL", "HUGE_VALF", "HUGE_VALL", "INFINITY", "NAN",
+		"FP_INFINITE", "FP_NAN", "FP_NORMAL", "FP_SUBNORMAL", "FP_ZERO",
+		"FP_FAST_FMA", "FP_FAST_FMAF", "FP_FAST_FMAL", "FP_ILOGB",
+		"FP_ILOGBNAN", "MATH_ERRNO", "MATH_ERREXCEPT", "math_errhandling",
+		"float_t", "double_t", "fpclassify", "isfinite", "isinf", "isnan",
+		"isnormal", "signbit", "issignaling", "iszero", "issubnormal",
+		"iscanonical", "isgreater", "isgreaterequal", "isless",
+		"islessequal", "islessgreater", "isunordered", "M_E", "M_PI",
+		"signgam",
+	}
+	mathFunctions := []string{
+		"acos", "asin", "atan", "cos", "sin", "tan", "acosh", "asinh",
+		"atanh", "cosh", "sinh", "tanh", "exp", "frexp", "ldexp", "log",
+		"logb", "modf", "scalbn", "scalbln", "ilogb", "cbrt", "fabs",
+		"hypot", "pow", "sqrt", "erf", "erfc", "lgamma", "tgamma", "gamma",
+		"ceil", "floor", "nearbyint", "rint", "lrint", "llrint", "round",
+		"lround", "llround", "trunc", "fmod", "remainder", "remquo",
+		"copysign", "nan", "nextafter", "nexttoward", "fdim", "fmax",
+		"fmin", "fma", "drem", "finite", "significand", "sincos",
+	}
+	for _, function := range mathFunctions {
+		mathNames = append(mathNames, function, function+"f", function+"l")
+	}
+	// Names used by the generated code itself
+	generated := []string{"main", "argc", "argv", "o"}
+
+	for _, names := range [][]string{keywords, headers, stdlibNames, stringNames, limitNames, mathNames, generated} {
+		for _, name := range names {
+			reserved[name] = true
+		}
+	}
+}
+
+// name returns the C name of an identifier, field or struct.
+func name(lexeme string) string {
+	if reserved[lexeme] {
+		return fmt.Sprintf("__Name_%s__", lexeme)
+	}
+	return lexeme
+}
+
+// methodName returns the C name of a method. It is made up like the other
+// generated names when the receiver has an underscore, so that A_b.c and
+// A.b_c do not collide, or when a struct already has the name.
+func methodName(qualified string, ctx *Context) string {
+	receiver, lexeme, _ := strings.Cut(qualified, ".")
+	_, taken := ctx.program.GetStruct(receiver + "_" + lexeme)
+	if taken || strings.Contains(receiver, "_") {
+		return fmt.Sprintf("__Method_%s__%s__", receiver, lexeme)
+	}
+	return receiver + "_" + lexeme
+}
+
+// variable returns the C name of a version of a variable. Identifiers cannot
+// contain digits, so versions never collide with other variables.
+func variable(lexeme string, version int) string {
+	if version == 0 {
+		return name(lexeme)
+	}
+	if reserved[lexeme] {
+		return fmt.Sprintf("__Name_%s_%d__", lexeme, version)
+	}
+	return fmt.Sprintf("%s_%d", lexeme, version)
+}
+
+// Renamed returns the names in the program that are renamed in the
+// generated C, mapped to their C names.
+func Renamed(program *ir.Program) map[string]string {
+	renamed := map[string]string{}
+	add := func(lexeme string) {
+		if reserved[lexeme] {
+			renamed[lexeme] = name(lexeme)
+		}
+	}
+	addOperand := func(op ir.Operand) {
+		if op.Kind == ir.OperandVar {
+			add(op.Lexeme)
+		}
+	}
+	addFunc := func(fn *ir.Func) {
+		for _, param := range fn.Params {
+			addOperand(param)
+		}
+		for _, local := range fn.Locals {
+			addOperand(local)
+		}
+		for _, instr := range fn.Code {
+			addOperand(instr.Dst)
+			addOperand(instr.Arg1)
+			addOperand(instr.Arg2)
+			for _, arg := range instr.Args {
+				addOperand(arg)
+			}
+			if instr.Field != "" {
+				for _, field := range strings.Split(instr.Field, ".") {
+					add(field)
+				}
+			}
+		}
+	}
+	for _, st := range program.Structs {
+		add(st.Name)
+		for _, field := range st.Fields {
+			add(field.Lexeme)
+		}
+		for _, signature := range st.Methods {
+			addFunc(signature)
+		}
+		addFunc(st.Constructor)
+	}
+	for _, method := range program.Methods {
+		addFunc(method)
+	}
+	addFunc(program.Main)
+	return renamed
+}
+
+// renamedComment lists the renamed names, to make the generated C easier
+// to read and debug.
+func renamedComment(program *ir.Program, ctx *Context) {
+	renamed := Renamed(program)
+	if len(renamed) == 0 {
+		return
+	}
+	var lexemes []string
+	for lexeme := range renamed {
+		lexemes = append(lexemes, lexeme)
+	}
+	sort.Strings(lexemes)
+	ctx.sb.Append("// Renamed:\n")
+	for _, lexeme := range lexemes {
+		ctx.sb.Append(fmt.Sprintf("// %s is %s\n", lexeme, renamed[lexeme]))
+	}
+	ctx.sb.Append("\n")
+}
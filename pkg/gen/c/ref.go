@@ -0,0 +1,185 @@
+package c
+
+import (
+	"fmt"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Reference counting for ref structs.
+
+	Instances of ref structs live on the heap and start with a count of the
+	references to them. Every local and every field of a ref type holds one
+	reference, so assigning retains the new instance and releases the old
+	one. An instance is freed with the references in its fields when its
+	count reaches zero.
+
+	Locals are released with the block structure: a variable declared in a
+	block at the label ending it, which both skip and falling through
+	reach, and a temporary right after the last instruction mentioning it.
+	Released locals are set to NULL, and every local is released once more
+	when the function returns, for the paths that jumped past a release or
+	the variables the optimizer kept alive past their block.
+
+	Fields are only set by constructors, so an instance can only refer to
+	instances that existed before it, and there are never any cycles.
+*/
+
+func hasRefs(program *ir.Program) bool {
+	for _, st := range program.Structs {
+		if st.Ref {
+			return true
+		}
+	}
+	return false
+}
+
+// generateRefDeclarations declares every ref struct and its functions up
+// front, so they can refer to each other in any order.
+func generateRefDeclarations(program *ir.Program, ctx *Context) {
+	if !hasRefs(program) {
+		return
+	}
+	for _, st := range program.Structs {
+		if !st.Ref {
+			continue
+		}
+		typeName := name(st.Name)
+		ctx.sb.Append(fmt.Sprintf("typedef struct %s %s;\n", typeName, typeName))
+		ctx.sb.Append(fmt.Sprintf("%s *%s(void);\n", typeName, newName(st.Name)))
+		ctx.sb.Append(fmt.Sprintf("void %s(%s *o);\n", retainName(st.Name), typeName))
+		ctx.sb.Append(fmt.Sprintf("void %s(%s *o);\n", releaseName(st.Name), typeName))
+		ctx.sb.Append(fmt.Sprintf("void %s(%s **target, %s *value);\n",
+			assignName(st.Name), typeName, typeName))
+	}
+	ctx.sb.Append("\n")
+}
+
+func generateRefFunctions(st *ir.Struct, ctx *Context) {
+	if !st.Ref {
+		return
+	}
+	typeName := name(st.Name)
+
+	ctx.sb.Append(fmt.Sprintf("%s *%s(void) {\n", typeName, newName(st.Name)))
+	ctx.sb.Append(fmt.Sprintf("\t%s *o = calloc(1, sizeof(%s));\n", typeName, typeName))
+	ctx.sb.Append("\tif (o == NULL) {\n")
+	ctx.sb.Append("\t\tabort();\n")
+	ctx.sb.Append("\t}\n")
+	ctx.sb.Append("\to->__refs = 1;\n")
+	ctx.sb.Append(fmt.Sprintf("\t%s(o);\n", constructorName(st.Name)))
+	ctx.sb.Append("\treturn o;\n")
+	ctx.sb.Append("}\n")
+
+	ctx.sb.Append(fmt.Sprintf("void %s(%s *o) {\n", retainName(st.Name), typeName))
+	ctx.sb.Append("\tif (o != NULL) {\n")
+	ctx.sb.Append("\t\to->__refs += 1;\n")
+	ctx.sb.Append("\t}\n")
+	ctx.sb.Append("}\n")
+
+	ctx.sb.Append(fmt.Sprintf("void %s(%s *o) {\n", releaseName(st.Name), typeName))
+	ctx.sb.Append("\tif (o == NULL || --o->__refs > 0) {\n")
+	ctx.sb.Append("\t\treturn;\n")
+	ctx.sb.Append("\t}\n")
+	for _, field := range st.Fields {
+		if ctx.program.IsRef(field.Type) {
+			ctx.sb.Append(fmt.Sprintf("\t%s(o->%s);\n",
+				releaseName(field.Type), name(field.Lexeme)))
+		}
+	}
+	ctx.sb.Append("\tfree(o);\n")
+	ctx.sb.Append("}\n")
+
+	// The new value is retained first, in case it is only kept alive by
+	// the old one
+	ctx.sb.Append(fmt.Sprintf("void %s(%s **target, %s *value) {\n",
+		assignName(st.Name), typeName, typeName))
+	ctx.sb.Append(fmt.Sprintf("\t%s(value);\n", retainName(st.Name)))
+	ctx.sb.Append(fmt.Sprintf("\t%s(*target);\n", releaseName(st.Name)))
+	ctx.sb.Append("\t*target = value;\n")
+	ctx.sb.Append("}\n")
+}
+
+// releases returns the references to release after each instruction of
+// the code of a function, leaving out the result it returns.
+func releases(fn *ir.Func, code []ir.Instr, result ir.Operand, ctx *Context) map[int][]ir.Operand {
+	after := make(map[int][]ir.Operand)
+	if !hasRefs(ctx.program) {
+		return after
+	}
+
+	last := make(map[ir.Operand]int)
+	for i, instr := range code {
+		mentioned := instr.Uses()
+		if def, ok := instr.Def(); ok {
+			mentioned = append(mentioned, def)
+		}
+		for _, operand := range mentioned {
+			if operand.Kind == ir.OperandTemp && ctx.program.IsRef(operand.Type) {
+				last[operand] = i
+			}
+		}
+	}
+	delete(last, result)
+	for _, local := range fn.Locals {
+		if i, ok := last[local]; ok {
+			after[i] = append(after[i], local)
+		}
+	}
+
+	graph := cfg.Build(fn)
+	live := dataflow.Liveness(graph)
+	blocks := make(map[string]*cfg.Block)
+	for _, block := range graph.Blocks {
+		if label, ok := block.Label(); ok {
+			blocks[label] = block
+		}
+	}
+	for i, instr := range code {
+		if instr.Op != ir.OpLabel || len(fn.Scopes[instr.Label]) == 0 {
+			continue
+		}
+		declared := make(map[ir.Operand]bool)
+		for _, variable := range fn.Scopes[instr.Label] {
+			declared[variable] = true
+		}
+		for _, local := range fn.Locals {
+			base := local
+			base.Version = 0
+			if declared[base] && ctx.program.IsRef(local.Type) &&
+				!live.In[blocks[instr.Label]][local.String()] {
+				after[i] = append(after[i], local)
+			}
+		}
+	}
+	return after
+}
+
+// generateReleases releases references that are no longer used, setting
+// them to NULL.
+func generateReleases(locals []ir.Operand, ctx *Context) {
+	for _, local := range locals {
+		writeTabs(ctx.sb, ctx.tabs)
+		ctx.sb.Append(fmt.Sprintf("%s(%s); %s = NULL;\n",
+			releaseName(local.Type), operand(local, ctx), operand(local, ctx)))
+	}
+}
+
+func newName(structName string) string {
+	return fmt.Sprintf("__New_%s__", structName)
+}
+
+func retainName(structName string) string {
+	return fmt.Sprintf("__Retain_%s__", structName)
+}
+
+func releaseName(structName string) string {
+	return fmt.Sprintf("__Release_%s__", structName)
+}
+
+func assignName(structName string) string {
+	return fmt.Sprintf("__Assign_%s__", structName)
+}
@@ -0,0 +1,121 @@
+package c
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+	"github.com/magnetenstad/dragon-compiler/pkg/opt"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
+)
+
+// Refs released in nested blocks, after skips, by returns from blocks in
+// methods, and held by fields and by variables assigned in a block
+const refsProgram = `ref struct Leaf {
+    value Int = 1
+}
+
+ref struct Pair {
+    left Leaf
+    right Leaf = Leaf(value 2)
+
+    fn swap() Pair {
+        {
+            tmp = Leaf(value self.right.value)
+            skip_if tmp.value > 100
+            return Pair(left tmp right self.left)
+        }
+        return self
+    }
+
+    fn sum() Int {
+        return self.left.value + self.right.value
+    }
+}
+
+p = Pair(left Leaf(value 5))
+{
+    q = p.swap()
+    print q.sum()
+    {
+        inner = q.swap().swap()
+        skip_if inner.sum() > 3
+        print "never"
+    }
+    r = Pair(left q.left right q.right)
+    print r.left.value
+}
+{
+    q = Pair(left Leaf(value 8))
+    skip
+    print q.left.value
+}
+{
+    last = Pair(left p.left).swap()
+    p = last
+}
+print p.sum()
+print p.left.value
+`
+
+// TestRefsUnderAddressSanitizer builds the programs using refs with
+// AddressSanitizer at every level, which fails them on a use after free, a
+// double free or a leak, and checks that they print what the VM prints.
+func TestRefsUnderAddressSanitizer(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc is not installed")
+	}
+	dir := t.TempDir()
+	probe := filepath.Join(dir, "probe.c")
+	if err := os.WriteFile(probe, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(cc, "-fsanitize=address", "-o", filepath.Join(dir, "probe"), probe).Run(); err != nil {
+		t.Skip("cc cannot build with AddressSanitizer")
+	}
+
+	refs := filepath.Join(dir, "refs.bip")
+	if err := os.WriteFile(refs, []byte(refsProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"../../../examples/ref.bip", "../../../examples/methods.bip", refs} {
+		name := strings.TrimSuffix(filepath.Base(source), ".bip")
+		for level := 0; level <= 2; level++ {
+			program := ir.Lower(module.Load(source, nil))
+			opt.Optimize(program, level)
+
+			var want strings.Builder
+			if err := vm.New(bytecode.Compile(program), &want).Run(); err != nil {
+				t.Fatalf("%s at -O%d: %s", name, level, err)
+			}
+
+			unit := filepath.Join(dir, name+".c")
+			binary := filepath.Join(dir, name)
+			if err := os.WriteFile(unit, []byte(Generate(program, "")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			build := exec.Command(cc, "-fsanitize=address", "-fwrapv", "-g", "-o", binary, unit, "-lm")
+			if output, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("%s at -O%d: cc: %s\n%s", name, level, err, output)
+			}
+
+			var stdout, stderr strings.Builder
+			run := exec.Command(binary)
+			run.Env = append(os.Environ(), "ASAN_OPTIONS=detect_leaks=1")
+			run.Stdout, run.Stderr = &stdout, &stderr
+			if err := run.Run(); err != nil {
+				t.Errorf("%s at -O%d: %s\n%s", name, level, err, stderr.String())
+				continue
+			}
+			if stdout.String() != want.String() {
+				t.Errorf("%s at -O%d printed %q, the VM printed %q", name, level, stdout.String(), want.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+/*
+	The runtime of the standard library of dragon.
+
+	Declares a function for each builtin, named after it, like
+	__Builtin_String_length__ for String.length. The functions are defined
+	where DRAGON_RUNTIME_IMPLEMENTATION is defined before this is included,
+	which must be in exactly one translation unit. main calls
+	__Builtin_Process_init__ with its arguments first.
+
+	Strings are char pointers, like string literals. Those made by the
+	runtime are never freed while the program runs, since nothing tells
+	when they are no longer used, and are all freed when it exits. The math
+	functions need the program to be linked with -lm.
+*/
+
+#ifndef DRAGON_RUNTIME_H
+#define DRAGON_RUNTIME_H
+
+#include <stdbool.h>
+
+int __Builtin_String_length__(char *text);
+char *__Builtin_String_concat__(char *text, char *other);
+char *__Builtin_String_substring__(char *text, int start, int end);
+int __Builtin_String_compare__(char *text, char *other);
+int __Builtin_String_parseInt__(char *text);
+bool __Builtin_String_isInt__(char *text);
+
+int __Builtin_Int_abs__(int x);
+int __Builtin_Int_min__(int x, int other);
+int __Builtin_Int_max__(int x, int other);
+float __Builtin_Int_toFloat__(int x);
+char *__Builtin_Int_toString__(int x);
+
+float __Builtin_Float_abs__(float x);
+float __Builtin_Float_min__(float x, float other);
+float __Builtin_Float_max__(float x, float other);
+float __Builtin_Float_sqrt__(float x);
+float __Builtin_Float_pow__(float x, float exponent);
+int __Builtin_Float_toInt__(float x);
+char *__Builtin_Float_toString__(float x);
+
+char *__Builtin_Bool_toString__(bool x);
+
+char *__Builtin_Process_readLine__(void);
+bool __Builtin_Process_hasLine__(void);
+int __Builtin_Process_argCount__(void);
+char *__Builtin_Process_arg__(int index);
+bool __Builtin_Process_hasArg__(int index);
+void __Builtin_Process_exit__(int code);
+void __Builtin_Process_init__(int argc, char *argv[]);
+
+#endif // DRAGON_RUNTIME_H
+
+#ifdef DRAGON_RUNTIME_IMPLEMENTATION
+#undef DRAGON_RUNTIME_IMPLEMENTATION
+
+#include <limits.h>
+#include <math.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The strings made by the runtime, each after a pointer to the one before
+static void **__Builtin_strings__ = NULL;
+// The line read by hasLine, which readLine returns
+static char *__Builtin_line__ = NULL;
+static size_t __Builtin_lineCapacity__ = 0;
+static int __Builtin_argc__ = 0;
+static char **__Builtin_argv__ = NULL;
+
+static void __Builtin_free__(void) {
+	while (__Builtin_strings__ != NULL) {
+		void **previous = *__Builtin_strings__;
+		free(__Builtin_strings__);
+		__Builtin_strings__ = previous;
+	}
+	free(__Builtin_line__);
+	__Builtin_line__ = NULL;
+}
+
+// __Builtin_allocate__ resizes memory of the runtime, which is freed when
+// the program exits.
+static void *__Builtin_allocate__(void *memory, size_t size) {
+	static bool registered = false;
+	if (!registered) {
+		registered = true;
+		atexit(__Builtin_free__);
+	}
+	memory = realloc(memory, size);
+	if (memory == NULL) {
+		fputs("out of memory\n", stderr);
+		exit(1);
+	}
+	return memory;
+}
+
+// __Builtin_string__ allocates a string with room for length characters
+// and the terminating zero.
+static char *__Builtin_string__(size_t length) {
+	void **block = __Builtin_allocate__(NULL, sizeof(void *) + length + 1);
+	*block = __Builtin_strings__;
+	__Builtin_strings__ = block;
+	return (char *)(block + 1);
+}
+
+static char *__Builtin_copy__(const char *text, size_t length) {
+	char *copy = __Builtin_string__(length);
+	memcpy(copy, text, length);
+	copy[length] = '\0';
+	return copy;
+}
+
+int __Builtin_String_length__(char *text) {
+	return (int)strlen(text);
+}
+
+char *__Builtin_String_concat__(char *text, char *other) {
+	size_t length = strlen(text), otherLength = strlen(other);
+	char *result = __Builtin_string__(length + otherLength);
+	memcpy(result, text, length);
+	memcpy(result + length, other, otherLength + 1);
+	return result;
+}
+
+char *__Builtin_String_substring__(char *text, int start, int end) {
+	int length = (int)strlen(text);
+	start = start < 0 ? 0 : start > length ? length : start;
+	end = end < start ? start : end > length ? length : end;
+	return __Builtin_copy__(text + start, (size_t)(end - start));
+}
+
+int __Builtin_String_compare__(char *text, char *other) {
+	int order = strcmp(text, other);
+	return (order > 0) - (order < 0);
+}
+
+// __Builtin_parse__ parses an optional - and decimal digits, and nothing
+// else, into an int, and reports whether it could.
+static bool __Builtin_parse__(const char *text, int *value) {
+	bool negative = text[0] == '-';
+	const char *digit = text + negative;
+	long long number = 0;
+	if (*digit == '\0') {
+		return false;
+	}
+	for (; *digit != '\0'; digit++) {
+		if (*digit < '0' || *digit > '9') {
+			return false;
+		}
+		number = number * 10 + (*digit - '0');
+		if (number > (long long)INT_MAX + negative) {
+			return false;
+		}
+	}
+	*value = (int)(negative ? -number : number);
+	return true;
+}
+
+int __Builtin_String_parseInt__(char *text) {
+	int value = 0;
+	__Builtin_parse__(text, &value);
+	return value;
+}
+
+bool __Builtin_String_isInt__(char *text) {
+	int value;
+	return __Builtin_parse__(text, &value);
+}
+
+int __Builtin_Int_abs__(int x) {
+	return x < 0 ? (int)(0u - (unsigned)x) : x;
+}
+
+int __Builtin_Int_min__(int x, int other) {
+	return x < other ? x : other;
+}
+
+int __Builtin_Int_max__(int x, int other) {
+	return x > other ? x : other;
+}
+
+float __Builtin_Int_toFloat__(int x) {
+	return (float)x;
+}
+
+char *__Builtin_Int_toString__(int x) {
+	char text[16];
+	int length = snprintf(text, sizeof(text), "%d", x);
+	return __Builtin_copy__(text, (size_t)length);
+}
+
+float __Builtin_Float_abs__(float x) {
+	return fabsf(x);
+}
+
+float __Builtin_Float_min__(float x, float other) {
+	return x < other ? x : other;
+}
+
+float __Builtin_Float_max__(float x, float other) {
+	return x > other ? x : other;
+}
+
+float __Builtin_Float_sqrt__(float x) {
+	return sqrtf(x);
+}
+
+float __Builtin_Float_pow__(float x, float exponent) {
+	return (float)pow((double)x, (double)exponent);
+}
+
+int __Builtin_Float_toInt__(float x) {
+	if (x != x) {
+		return 0;
+	}
+	if (x >= 2147483648.0f) {
+		return INT_MAX;
+	}
+	if (x <= -2147483648.0f) {
+		return INT_MIN;
+	}
+	return (int)x;
+}
+
+char *__Builtin_Float_toString__(float x) {
+	int length = snprintf(NULL, 0, "%f", (double)x);
+	char *result = __Builtin_string__((size_t)length);
+	snprintf(result, (size_t)length + 1, "%f", (double)x);
+	return result;
+}
+
+char *__Builtin_Bool_toString__(bool x) {
+	return x ? "true" : "false";
+}
+
+bool __Builtin_Process_hasLine__(void) {
+	size_t length = 0;
+	int c = getchar();
+	if (c == EOF) {
+		return false;
+	}
+	for (;; c = getchar()) {
+		if (length + 1 >= __Builtin_lineCapacity__) {
+			__Builtin_lineCapacity__ = __Builtin_lineCapacity__ == 0 ? 64 : __Builtin_lineCapacity__ * 2;
+			__Builtin_line__ = __Builtin_allocate__(__Builtin_line__, __Builtin_lineCapacity__);
+		}
+		if (c == EOF || c == '\n') {
+			break;
+		}
+		__Builtin_line__[length++] = (char)c;
+	}
+	__Builtin_line__[length] = '\0';
+	return true;
+}
+
+char *__Builtin_Process_readLine__(void) {
+	return __Builtin_copy__(__Builtin_line__, strlen(__Builtin_line__));
+}
+
+int __Builtin_Process_argCount__(void) {
+	return __Builtin_argc__ > 0 ? __Builtin_argc__ - 1 : 0;
+}
+
+bool __Builtin_Process_hasArg__(int index) {
+	return index >= 0 && index < __Builtin_Process_argCount__();
+}
+
+char *__Builtin_Process_arg__(int index) {
+	return __Builtin_argv__[index + 1];
+}
+
+void __Builtin_Process_exit__(int code) {
+	exit(code);
+}
+
+void __Builtin_Process_init__(int argc, char *argv[]) {
+	__Builtin_argc__ = argc;
+	__Builtin_argv__ = argv;
+}
+
+#endif // DRAGON_RUNTIME_IMPLEMENTATION
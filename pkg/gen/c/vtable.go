@@ -0,0 +1,147 @@
+package c
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Dynamic dispatch for interfaces.
+
+	An interface value is laid out like an enum, with the tag numbering the
+	structs implementing it. Each interface gets a table of function
+	pointers for every struct, indexed by the tag, so a call on an interface
+	value is a call through __VTables_Shape__[x.tag]. The methods of the
+	structs take a pointer to the struct rather than to the interface value,
+	so the table points at small functions passing on the field holding the
+	struct, like __Dispatch_Shape__Square_area__.
+*/
+
+// sortStructs orders the structs so that every struct comes after the
+// value structs in its fields, which C needs to know the size of. It keeps
+// the declaration order where it can, and structs never contain
+// themselves. References are pointers, which ref.go declares up front.
+func sortStructs(program *ir.Program) []*ir.Struct {
+	var sorted []*ir.Struct
+	visited := make(map[string]bool)
+	var visit func(st *ir.Struct)
+	visit = func(st *ir.Struct) {
+		if visited[st.Name] {
+			return
+		}
+		visited[st.Name] = true
+		for _, field := range st.Fields {
+			if field, ok := program.GetStruct(field.Type); ok && !field.Ref {
+				visit(field)
+			}
+		}
+		sorted = append(sorted, st)
+	}
+	for _, st := range program.Structs {
+		visit(st)
+	}
+	return sorted
+}
+
+// dispatched reports whether an interface gets tables, which it only needs
+// when a struct implements it.
+func dispatched(st *ir.Struct) bool {
+	return st.Interface && len(st.Variants) > 0
+}
+
+// generateVTableDeclarations declares the table type and the tables of the
+// interfaces whose signatures mention no struct declared after st, like
+// generateMethodDeclarations.
+func generateVTableDeclarations(st *ir.Struct, ctx *Context) {
+	for _, iface := range ctx.structs {
+		if !dispatched(iface) || lastStruct(interfaceTypes(iface), ctx) != st {
+			continue
+		}
+		ctx.sb.Append("typedef struct {\n")
+		for _, signature := range iface.Methods {
+			ctx.sb.Append(fmt.Sprintf("\t%s;\n",
+				declaration(signature, "(*"+name(methodLexeme(signature))+")", ctx)))
+		}
+		ctx.sb.Append(fmt.Sprintf("} %s;\n", vtableName(iface.Name)))
+		ctx.sb.Append(fmt.Sprintf("extern const %s %s[];\n",
+			vtableName(iface.Name), vtablesName(iface.Name)))
+	}
+}
+
+func interfaceTypes(st *ir.Struct) []string {
+	types := []string{st.Name}
+	for _, signature := range st.Methods {
+		types = append(types, funcTypes(signature)...)
+	}
+	return types
+}
+
+// generateVTables defines the tables of every interface, after the methods
+// they point at are declared.
+func generateVTables(ctx *Context) {
+	for _, iface := range ctx.structs {
+		if !dispatched(iface) {
+			continue
+		}
+		ctx.sb.Append("\n")
+		for _, variant := range iface.Variants {
+			for _, signature := range iface.Methods {
+				method, _ := ctx.program.GetMethod(variant, methodLexeme(signature))
+				ctx.sb.Append(fmt.Sprintf("static %s {\n",
+					declaration(signature, dispatchName(iface.Name, method.Name, ctx), ctx)))
+				args := []string{"&self->" + name(variant)}
+				for _, param := range signature.Params {
+					args = append(args, operand(param, ctx))
+				}
+				call := fmt.Sprintf("%s(%s)", methodName(method.Name, ctx), strings.Join(args, ", "))
+				if signature.Result == "" {
+					ctx.sb.Append(fmt.Sprintf("\t%s;\n", call))
+				} else {
+					ctx.sb.Append(fmt.Sprintf("\treturn %s;\n", call))
+				}
+				ctx.sb.Append("}\n")
+			}
+		}
+		ctx.sb.Append(fmt.Sprintf("const %s %s[] = {\n",
+			vtableName(iface.Name), vtablesName(iface.Name)))
+		for _, variant := range iface.Variants {
+			var pointers []string
+			for _, signature := range iface.Methods {
+				pointers = append(pointers, dispatchName(iface.Name, variant+"."+methodLexeme(signature), ctx))
+			}
+			ctx.sb.Append(fmt.Sprintf("\t{%s},\n", strings.Join(pointers, ", ")))
+		}
+		ctx.sb.Append("};\n")
+	}
+}
+
+// dispatchCall calls a method of an interface through the table of the
+// struct the value holds.
+func dispatchCall(instr ir.Instr, ctx *Context) string {
+	iface, lexeme, _ := strings.Cut(instr.Func, ".")
+	args := []string{receiver(instr.Arg1, ctx)}
+	for _, arg := range instr.Args {
+		args = append(args, operand(arg, ctx))
+	}
+	return fmt.Sprintf("%s[%s].%s(%s)", vtablesName(iface),
+		fieldAccess(instr.Arg1, "tag", ctx), name(lexeme), strings.Join(args, ", "))
+}
+
+func methodLexeme(fn *ir.Func) string {
+	_, lexeme, _ := strings.Cut(fn.Name, ".")
+	return lexeme
+}
+
+func vtableName(iface string) string {
+	return fmt.Sprintf("__VTable_%s__", iface)
+}
+
+func vtablesName(iface string) string {
+	return fmt.Sprintf("__VTables_%s__", iface)
+}
+
+func dispatchName(iface string, method string, ctx *Context) string {
+	return fmt.Sprintf("__Dispatch_%s__%s__", iface, methodName(method, ctx))
+}
@@ -0,0 +1,205 @@
+package golang
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	The standard library, as functions named like in C, such as
+	__Builtin_String_length__, defined at the end of the package for the
+	builtins it uses. Identifiers start with a letter, so they never clash.
+
+	Go strings are bytes already, and a function with an optional result
+	returns a pointer, which is nil for none. Process reads the standard
+	input through a bufio.Reader, takes the arguments from os.Args and ends
+	with os.Exit.
+*/
+
+type runtimeFunc struct {
+	imports []string // The packages it uses
+	code    string
+}
+
+var runtime = map[string]runtimeFunc{
+	"String.length": {code: `func __Builtin_String_length__(x string) int32 {
+	return int32(len(x))
+}`},
+	"String.concat": {code: `func __Builtin_String_concat__(x string, other string) string {
+	return x + other
+}`},
+	"String.substring": {code: `func __Builtin_String_substring__(x string, start int32, end int32) string {
+	length := int32(len(x))
+	if start < 0 {
+		start = 0
+	}
+	if start > length {
+		start = length
+	}
+	if end < start {
+		end = start
+	}
+	if end > length {
+		end = length
+	}
+	return x[start:end]
+}`},
+	"String.compare": {imports: []string{"strings"}, code: `func __Builtin_String_compare__(x string, other string) int32 {
+	return int32(strings.Compare(x, other))
+}`},
+	"String.parseInt": {imports: []string{"strconv", "strings"}, code: `func __Builtin_String_parseInt__(x string) *int32 {
+	digits := strings.TrimPrefix(x, "-")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return nil
+	}
+	value, err := strconv.ParseInt(x, 10, 32)
+	if err != nil {
+		return nil
+	}
+	result := int32(value)
+	return &result
+}`},
+	"Int.abs": {code: `func __Builtin_Int_abs__(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}`},
+	"Int.min": {code: `func __Builtin_Int_min__(x int32, other int32) int32 {
+	if x < other {
+		return x
+	}
+	return other
+}`},
+	"Int.max": {code: `func __Builtin_Int_max__(x int32, other int32) int32 {
+	if x > other {
+		return x
+	}
+	return other
+}`},
+	"Int.toFloat": {code: `func __Builtin_Int_toFloat__(x int32) float32 {
+	return float32(x)
+}`},
+	"Int.toString": {imports: []string{"strconv"}, code: `func __Builtin_Int_toString__(x int32) string {
+	return strconv.Itoa(int(x))
+}`},
+	"Float.abs": {imports: []string{"math"}, code: `func __Builtin_Float_abs__(x float32) float32 {
+	return float32(math.Abs(float64(x)))
+}`},
+	"Float.min": {code: `func __Builtin_Float_min__(x float32, other float32) float32 {
+	if x < other {
+		return x
+	}
+	return other
+}`},
+	"Float.max": {code: `func __Builtin_Float_max__(x float32, other float32) float32 {
+	if x > other {
+		return x
+	}
+	return other
+}`},
+	"Float.sqrt": {imports: []string{"math"}, code: `func __Builtin_Float_sqrt__(x float32) float32 {
+	return float32(math.Sqrt(float64(x)))
+}`},
+	"Float.pow": {imports: []string{"math"}, code: `func __Builtin_Float_pow__(x float32, exponent float32) float32 {
+	return float32(math.Pow(float64(x), float64(exponent)))
+}`},
+	"Float.toInt": {imports: []string{"math"}, code: `func __Builtin_Float_toInt__(x float32) int32 {
+	switch {
+	case x != x:
+		return 0
+	case x >= math.MaxInt32:
+		return math.MaxInt32
+	case x <= math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(x)
+}`},
+	"Float.toString": {imports: []string{"fmt"}, code: `func __Builtin_Float_toString__(x float32) string {
+	return fmt.Sprintf("%f", x)
+}`},
+	"Bool.toString": {imports: []string{"strconv"}, code: `func __Builtin_Bool_toString__(x bool) string {
+	return strconv.FormatBool(x)
+}`},
+	"Process.readLine": {imports: []string{"bufio", "os", "strings"}, code: `var __Builtin_stdin__ = bufio.NewReader(os.Stdin)
+
+func __Builtin_Process_readLine__() *string {
+	line, err := __Builtin_stdin__.ReadString('\n')
+	if line == "" && err != nil {
+		return nil
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return &line
+}`},
+	"Process.argCount": {imports: []string{"os"}, code: `func __Builtin_Process_argCount__() int32 {
+	return int32(len(os.Args) - 1)
+}`},
+	"Process.arg": {imports: []string{"os"}, code: `func __Builtin_Process_arg__(index int32) *string {
+	if index < 0 || int(index) >= len(os.Args)-1 {
+		return nil
+	}
+	arg := os.Args[index+1]
+	return &arg
+}`},
+	"Process.exit": {imports: []string{"os"}, code: `func __Builtin_Process_exit__(code int32) {
+	os.Exit(int(code))
+}`},
+}
+
+// generateBuiltin calls a function of the standard library on the
+// receiver, if it has one, passing the arguments in the order of its
+// parameters.
+func (ctx *Context) generateBuiltin(b ir.Builtin, receiver []string, children []*ast.Node) expression {
+	ctx.builtins[b.Name] = true
+	arguments := make(map[string]*ast.Node)
+	for _, child := range children {
+		arguments[child.Lexeme] = child.Children[0]
+	}
+	values := receiver
+	for _, param := range b.Params {
+		values = append(values, ctx.convert(ctx.generateExpression(arguments[param.Lexeme]), param.Type))
+	}
+	typeHint := b.Result
+	if strings.HasSuffix(typeHint, "?") {
+		typeHint = "Optional_" + strings.TrimSuffix(typeHint, "?")
+	}
+	return expression{
+		code:     fmt.Sprintf("%s(%s)", ir.BuiltinName(b.Name), strings.Join(values, ", ")),
+		typeHint: typeHint,
+	}
+}
+
+// generateRuntime defines the functions of the builtins the package uses.
+func (ctx *Context) generateRuntime() {
+	for _, b := range ir.Builtins {
+		if ctx.builtins[b.Name] {
+			ctx.line("")
+			for _, line := range strings.Split(runtime[b.Name].code, "\n") {
+				ctx.line(line)
+			}
+		}
+	}
+}
+
+// imports returns the packages the generated code uses, sorted.
+func (ctx *Context) imports() []string {
+	used := make(map[string]bool)
+	if ctx.usesFmt {
+		used["fmt"] = true
+	}
+	for name := range ctx.builtins {
+		for _, pkg := range runtime[name].imports {
+			used[pkg] = true
+		}
+	}
+	var imports []string
+	for pkg := range used {
+		imports = append(imports, pkg)
+	}
+	sort.Strings(imports)
+	return imports
+}
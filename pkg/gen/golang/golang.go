@@ -0,0 +1,1010 @@
+package golang
+
+import (
+	"fmt"
+	"go/format"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	Text "github.com/linkdotnet/golang-stringbuilder"
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/env"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Generates a Go package from the AST.
+
+	Like the JavaScript backend this works on the AST, to keep constructor
+	expressions and blocks, and takes the program from ir.Lower, which
+	reports the errors, to generate from the AST it keeps.
+
+	Structs become Go structs with exported fields and a NewX function
+	applying the declared defaults, and ref structs are used through
+	pointers, which share them instead of copying. Int is int32 and Float
+	is float32, so arithmetic wraps and rounds like in C. Blocks become Go
+	blocks, and skip jumps to a label right after the block with goto. An
+	enum becomes a struct of its tag and a field for each variant with
+	fields, and match becomes a switch on the tag. An interface becomes a
+	Go interface, which the structs implementing it satisfy, and defaults
+	to the first of them. Methods become exported Go methods with self as
+	the receiver, which is a pointer for ref structs, and calls pass every
+	argument, evaluating the defaults at the call.
+
+	An optional is a pointer, which is nil for none. The value is only read,
+	so sharing it is the same as copying it, and ref structs are already
+	pointers that are never nil. Values given where an optional is expected
+	are wrapped with some, ?? and ?. become functions called in place so
+	that what is after them is only evaluated when needed, and a match on
+	an optional becomes an if.
+
+	Builtins call the functions in builtin.go, which are only generated for
+	the builtins the package uses, along with the imports they need.
+
+	Go rejects unused variables and labels, constant expressions that
+	overflow and statements after a goto, so variables that are never read
+	are marked as used, constant operations are folded, and statements
+	after a skip or a return are left out. Go cannot tell that a method
+	returns on every path through its blocks and matches, so one that does
+	not end with a return ends with a panic that never runs.
+*/
+
+type expression struct {
+	code     string
+	typeHint string
+	constant *ir.Operand // The value if Go sees the expression as a constant
+	compound bool        // Whether it needs parentheses as an operand
+}
+
+type Context struct {
+	tabs     int
+	sb       *Text.StringBuilder
+	structs  ast.Declarations
+	methods  map[string][]*ast.Node // The methods of each struct
+	impls    map[string][]string    // The structs implementing each interface
+	env      *env.Env
+	block    int
+	blocks   int
+	matches  int
+	skipped  map[int]bool       // Blocks that are skipped out of
+	read     map[*ast.Node]bool // Assignments declaring a variable that is read
+	result   string             // The result type of the method being generated
+	usesFmt  bool
+	usesSome bool
+	builtins map[string]bool // The builtins the package calls
+}
+
+// Generate returns the source of a Go package. The top-level statements go
+// in main in package main, or in an exported Run function otherwise.
+func Generate(program *ir.Program, packageName string) string {
+	root := program.Root
+	sb := Text.StringBuilder{}
+	ctx := Context{
+		sb:       &sb,
+		structs:  make(ast.Declarations),
+		methods:  make(map[string][]*ast.Node),
+		impls:    make(map[string][]string),
+		skipped:  make(map[int]bool),
+		read:     make(map[*ast.Node]bool),
+		builtins: make(map[string]bool),
+	}
+	for _, declaration := range root.Declarations {
+		ctx.structs[declaration.Lexeme] = declaration
+	}
+	for _, method := range root.Methods {
+		receiver, _, _ := strings.Cut(method.Lexeme, ".")
+		ctx.methods[receiver] = append(ctx.methods[receiver], method)
+	}
+	for _, impl := range root.Impls {
+		ctx.impls[impl.Lexeme] = append(ctx.impls[impl.Lexeme], impl.TypeHint)
+	}
+	ctx.resolve(root)
+
+	for _, declaration := range root.Declarations {
+		if declaration.Type == ast.TypeOptionalDeclaration {
+			continue
+		}
+		ctx.line("")
+		ctx.generateStruct(declaration)
+		for _, method := range ctx.methods[declaration.Lexeme] {
+			ctx.line("")
+			ctx.generateMethod(declaration, method)
+		}
+	}
+
+	globals := env.NewEnv(nil)
+	ctx.env = &globals
+	ctx.line("")
+	if packageName == "main" {
+		ctx.line("func main() {")
+	} else {
+		ctx.line("func Run() {")
+	}
+	ctx.tabs += 1
+	ctx.generateStatements(root.Node)
+	ctx.tabs -= 1
+	ctx.line("}")
+	if ctx.usesSome {
+		ctx.line("")
+		ctx.line("func some[T any](value T) *T {")
+		ctx.line("\treturn &value")
+		ctx.line("}")
+	}
+	ctx.generateRuntime()
+
+	var header strings.Builder
+	header.WriteString("// Code generated by dragon. DO NOT EDIT.\n\n")
+	header.WriteString(fmt.Sprintf("package %s\n", packageName))
+	switch imports := ctx.imports(); len(imports) {
+	case 0:
+	case 1:
+		header.WriteString(fmt.Sprintf("\nimport %q\n", imports[0]))
+	default:
+		header.WriteString("\nimport (\n")
+		for _, pkg := range imports {
+			header.WriteString(fmt.Sprintf("\t%q\n", pkg))
+		}
+		header.WriteString(")\n")
+	}
+
+	source := []byte(header.String() + ctx.sb.ToString())
+	formatted, err := format.Source(source)
+	if err != nil {
+		panic(fmt.Sprintf("generated invalid Go: %s", err))
+	}
+	return string(formatted)
+}
+
+func (ctx *Context) generateStruct(node *ast.Node) {
+	if node.Type == ast.TypeEnumDeclaration {
+		ctx.generateEnum(node)
+		return
+	}
+	if node.Type == ast.TypeInterfaceDeclaration {
+		ctx.generateInterface(node)
+		return
+	}
+	ctx.line(fmt.Sprintf("type %s struct {", node.Lexeme))
+	ctx.tabs += 1
+	for _, field := range node.Children {
+		ctx.line(fmt.Sprintf("%s %s", fieldName(field.Lexeme), ctx.goType(field.TypeHint)))
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.line("")
+
+	empty := env.NewEnv(nil)
+	ctx.env = &empty
+	ctx.line(fmt.Sprintf("func %s() %s {", constructorName(node.Lexeme), ctx.goType(node.Lexeme)))
+	ctx.tabs += 1
+	ctx.line(fmt.Sprintf("return %s", ctx.compositeLiteral(node, nil)))
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// generateEnum generates an enum, which starts out as its first variant.
+func (ctx *Context) generateEnum(node *ast.Node) {
+	ctx.line(fmt.Sprintf("type %s struct {", node.Lexeme))
+	ctx.tabs += 1
+	ctx.line("Tag int32")
+	for _, variant := range node.Children {
+		if variant.TypeHint != "" {
+			ctx.line(fmt.Sprintf("%s %s", variant.Lexeme, variant.TypeHint))
+		}
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.line("")
+
+	ctx.line(fmt.Sprintf("func %s() %s {", constructorName(node.Lexeme), node.Lexeme))
+	ctx.tabs += 1
+	ctx.line(fmt.Sprintf("return %s", ctx.variantLiteral(node, 0, nil)))
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// generateInterface generates a Go interface of the signatures. Values
+// are structs, whose methods take them by value, so an interface value is
+// copied like the struct it holds.
+func (ctx *Context) generateInterface(node *ast.Node) {
+	ctx.line(fmt.Sprintf("type %s interface {", node.Lexeme))
+	ctx.tabs += 1
+	for _, signature := range node.Children {
+		_, lexeme, _ := strings.Cut(signature.Lexeme, ".")
+		var params []string
+		for _, param := range signature.Parameters() {
+			params = append(params, fmt.Sprintf("%s %s", variable(param.Lexeme), ctx.goType(param.TypeHint)))
+		}
+		line := fmt.Sprintf("%s(%s)", methodName(node, lexeme), strings.Join(params, ", "))
+		if signature.TypeHint != "" {
+			line += " " + ctx.goType(signature.TypeHint)
+		}
+		ctx.line(line)
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// defaultStruct builds the default of a struct, enum or interface, which
+// is the default of the first struct implementing it, or of an optional,
+// which is none.
+func (ctx *Context) defaultStruct(typeHint string) string {
+	if st := ctx.structs[typeHint]; st.Type == ast.TypeInterfaceDeclaration {
+		return constructorName(ctx.impls[typeHint][0]) + "()"
+	}
+	if _, ok := ctx.structs.Optional(typeHint); ok {
+		return "nil"
+	}
+	return constructorName(typeHint) + "()"
+}
+
+// variantLiteral builds an enum of the variant with the given tag, whose
+// fields are built from the arguments like a struct.
+func (ctx *Context) variantLiteral(enum *ast.Node, tag int, arguments map[string]*ast.Node) string {
+	var fields []string
+	if tag > 0 {
+		fields = append(fields, fmt.Sprintf("Tag: %d", tag))
+	}
+	variant := enum.Children[tag]
+	if st, ok := ctx.structs[variant.TypeHint]; ok {
+		value := constructorName(st.Lexeme) + "()"
+		if len(arguments) > 0 {
+			value = ctx.compositeLiteral(st, arguments)
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", variant.Lexeme, value))
+	}
+	return fmt.Sprintf("%s{%s}", enum.Lexeme, strings.Join(fields, ", "))
+}
+
+// compositeLiteral builds a struct from the given arguments, falling back
+// to the declared defaults. Fields without either are left at their zero
+// value, except structs, which get their own defaults.
+func (ctx *Context) compositeLiteral(st *ast.Node, arguments map[string]*ast.Node) string {
+	var fields []string
+	for _, field := range st.Children {
+		var value string
+		if argument, ok := arguments[field.Lexeme]; ok {
+			value = ctx.convert(ctx.generateExpression(argument), field.TypeHint)
+		} else if len(field.Children) > 0 {
+			value = ctx.convert(ctx.generateExpression(field.Children[0]), field.TypeHint)
+		} else if _, ok := ctx.structs.Optional(field.TypeHint); ok {
+			continue
+		} else if _, ok := ctx.structs[field.TypeHint]; ok {
+			value = ctx.defaultStruct(field.TypeHint)
+		} else {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", fieldName(field.Lexeme), value))
+	}
+	literal := fmt.Sprintf("%s{%s}", st.Lexeme, strings.Join(fields, ", "))
+	if st.Type == ast.TypeRefStructDeclaration {
+		return "&" + literal
+	}
+	return literal
+}
+
+func (ctx *Context) generateMethod(receiver *ast.Node, node *ast.Node) {
+	_, lexeme, _ := strings.Cut(node.Lexeme, ".")
+	methodEnv := env.NewEnv(nil)
+	ctx.env = &methodEnv
+	ctx.env.Put(env.Symbol{Lexeme: "self", SymbolType: ast.TypeParameter, TypeHint: receiver.Lexeme})
+	var params []string
+	for _, param := range node.Parameters() {
+		ctx.env.Put(env.Symbol{Lexeme: param.Lexeme, SymbolType: ast.TypeParameter, TypeHint: param.TypeHint})
+		params = append(params, fmt.Sprintf("%s %s", variable(param.Lexeme), ctx.goType(param.TypeHint)))
+	}
+	signature := fmt.Sprintf("func (self %s) %s(%s)",
+		ctx.goType(receiver.Lexeme), methodName(receiver, lexeme), strings.Join(params, ", "))
+	if node.TypeHint != "" {
+		signature += " " + ctx.goType(node.TypeHint)
+	}
+	ctx.result = node.TypeHint
+	ctx.line(signature + " {")
+	ctx.tabs += 1
+	body := node.Children[len(node.Children)-1]
+	ctx.generateStatements(body)
+	if body := statements(body); node.TypeHint != "" &&
+		(len(body) == 0 || body[len(body)-1].Type != ast.TypeReturnStatement) {
+		ctx.line("panic(\"unreachable\")")
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// defaultArgument generates the default of a parameter, which like the
+// default of a field cannot refer to any variables.
+func (ctx *Context) defaultArgument(param *ast.Node) string {
+	if len(param.Children) > 0 {
+		prevEnv := ctx.env
+		empty := env.NewEnv(nil)
+		ctx.env = &empty
+		value := ctx.convert(ctx.generateExpression(param.Children[0]), param.TypeHint)
+		ctx.env = prevEnv
+		return value
+	}
+	switch param.TypeHint {
+	case "Int", "Float":
+		return "0"
+	case "Bool":
+		return "false"
+	case "String":
+		return "\"\""
+	default:
+		return ctx.defaultStruct(param.TypeHint)
+	}
+}
+
+// method returns the declaration of a method of a struct, or the signature
+// of a method of an interface.
+func (ctx *Context) method(typeHint string, lexeme string) *ast.Node {
+	methods := ctx.methods[typeHint]
+	if st := ctx.structs[typeHint]; st != nil && st.Type == ast.TypeInterfaceDeclaration {
+		methods = st.Children
+	}
+	for _, method := range methods {
+		if method.Lexeme == typeHint+"."+lexeme {
+			return method
+		}
+	}
+	panic(fmt.Sprintf("%s has no method %s", typeHint, lexeme))
+}
+
+func (ctx *Context) generateStatements(node *ast.Node) {
+	for _, statement := range statements(node) {
+		ctx.generateStatement(statement)
+	}
+}
+
+func (ctx *Context) generateStatement(node *ast.Node) {
+
+	switch node.Type {
+
+	case ast.TypeBlock:
+		ctx.blocks += 1
+		prevBlock, prevEnv := ctx.block, ctx.env
+		blockEnv := env.NewEnv(ctx.env)
+		ctx.block, ctx.env = ctx.blocks, &blockEnv
+		ctx.line("{")
+		ctx.tabs += 1
+		ctx.generateStatements(node)
+		ctx.tabs -= 1
+		ctx.line("}")
+		if ctx.skipped[ctx.block] {
+			ctx.line(blockLabel(ctx.block) + ":")
+		}
+		ctx.block, ctx.env = prevBlock, prevEnv
+
+	case ast.TypePrintStatement:
+		value := ctx.generateExpression(node.Children[0])
+		ctx.usesFmt = true
+		switch value.typeHint {
+		case "Float":
+			// Like %f in C
+			ctx.line(fmt.Sprintf("fmt.Printf(\"%%f\\n\", %s)", value.code))
+		case "Int", "Bool", "String":
+			ctx.line(fmt.Sprintf("fmt.Println(%s)", value.code))
+		default:
+			panic(fmt.Sprintf("cannot print value of type %s", value.typeHint))
+		}
+
+	case ast.TypeAssignmentStatement, ast.TypeValStatement:
+		lexeme := node.Children[0].Lexeme
+		value := ctx.generateExpression(node.Children[1])
+		if strings.Contains(lexeme, ".") {
+			target := ctx.generateExpression(node.Children[0])
+			ctx.line(fmt.Sprintf("%s = %s", target.code, ctx.convert(value, target.typeHint)))
+			return
+		}
+		if symbol, exists := ctx.env.Get(lexeme); exists {
+			ctx.line(fmt.Sprintf("%s = %s", variable(lexeme), ctx.convert(value, symbol.TypeHint)))
+			return
+		}
+		ctx.env.Put(env.Symbol{
+			Lexeme:     lexeme,
+			SymbolType: ast.TypeIdentifier,
+			TypeHint:   value.typeHint,
+		})
+		code := value.code
+		if value.constant != nil && value.typeHint == "Int" {
+			code = fmt.Sprintf("int32(%s)", code) // An untyped constant would be int
+		}
+		ctx.line(fmt.Sprintf("%s := %s", variable(lexeme), code))
+		if !ctx.read[node] {
+			ctx.line(fmt.Sprintf("_ = %s", variable(lexeme)))
+		}
+
+	case ast.TypeMatchStatement:
+		ctx.generateMatch(node)
+
+	case ast.TypeCallStatement:
+		if call := node.Children[0]; call.Type == ast.TypeOptionalCall {
+			// The call is made if the receiver is not none
+			ctx.matches += 1
+			name := fmt.Sprintf("optional%d", ctx.matches)
+			receiver := ctx.generateExpression(call.Children[0])
+			inner, _ := ctx.structs.Optional(receiver.typeHint)
+			ctx.line(fmt.Sprintf("if %s := %s; %s != nil {", name, receiver.code, name))
+			ctx.tabs += 1
+			ctx.line(ctx.generateCall(expression{code: ctx.unwrap(name, inner), typeHint: inner}, call).code)
+			ctx.tabs -= 1
+			ctx.line("}")
+			return
+		}
+		ctx.line(ctx.generateExpression(node.Children[0]).code)
+
+	case ast.TypeReturnStatement:
+		value := ctx.generateExpression(node.Children[0])
+		ctx.line(fmt.Sprintf("return %s", ctx.convert(value, ctx.result)))
+
+	case ast.TypeSkipStatement:
+		ctx.line(fmt.Sprintf("goto %s", ctx.currentBlockLabel()))
+
+	case ast.TypeSkipIfStatement:
+		condition := ctx.generateExpression(node.Children[0])
+		ctx.line(fmt.Sprintf("if %s {", condition.code))
+		ctx.tabs += 1
+		ctx.line(fmt.Sprintf("goto %s", ctx.currentBlockLabel()))
+		ctx.tabs -= 1
+		ctx.line("}")
+
+	default:
+		panic(fmt.Sprintf("cannot generate statement %s", node.Name))
+	}
+}
+
+// generateMatch keeps the matched value in a variable, whose name has a
+// digit and so never clashes with another, and binds the fields of an arm
+// before its block. Go does not allow a label right before the next case,
+// so an arm whose block is skipped out of is wrapped in a block of its own.
+func (ctx *Context) generateMatch(node *ast.Node) {
+	ctx.matches += 1
+	subject := fmt.Sprintf("match%d", ctx.matches)
+	value := ctx.generateExpression(node.Children[0])
+	if inner, ok := ctx.structs.Optional(value.typeHint); ok {
+		ctx.generateOptionalMatch(node, subject, value.code, inner)
+		return
+	}
+	enum := ctx.structs[value.typeHint]
+	ctx.line(fmt.Sprintf("switch %s := %s; %s.Tag {", subject, value.code, subject))
+	for _, arm := range node.Children[1:] {
+		tag, variant := 0, (*ast.Node)(nil)
+		for i, child := range enum.Children {
+			if child.Lexeme == arm.Lexeme {
+				tag, variant = i, child
+			}
+		}
+		ctx.line(fmt.Sprintf("case %d:", tag))
+		ctx.tabs += 1
+		bindings, block := arm.Children[:len(arm.Children)-1], arm.Children[len(arm.Children)-1]
+		wrapped := ctx.skipped[ctx.blocks+1]
+		if wrapped {
+			ctx.line("{")
+			ctx.tabs += 1
+		}
+		prevEnv := ctx.env
+		armEnv := env.NewEnv(ctx.env)
+		ctx.env = &armEnv
+		for _, binding := range bindings {
+			ctx.env.Put(env.Symbol{
+				Lexeme:     binding.Lexeme,
+				SymbolType: ast.TypeIdentifier,
+				TypeHint:   ctx.structs.FieldType(variant.TypeHint, binding.Lexeme),
+			})
+			ctx.line(fmt.Sprintf("%s := %s.%s.%s",
+				variable(binding.Lexeme), subject, variant.Lexeme, fieldName(binding.Lexeme)))
+			if !ctx.read[binding] {
+				ctx.line(fmt.Sprintf("_ = %s", variable(binding.Lexeme)))
+			}
+		}
+		ctx.generateStatement(block)
+		ctx.env = prevEnv
+		if wrapped {
+			ctx.tabs -= 1
+			ctx.line("}")
+		}
+		ctx.tabs -= 1
+	}
+	ctx.line("}")
+}
+
+// generateOptionalMatch tests the matched optional for nil, binding its
+// value in the Some arm. Go does not allow a label right before the end of
+// an if either, so arms are wrapped like in generateMatch.
+func (ctx *Context) generateOptionalMatch(node *ast.Node, subject string, value string, inner string) {
+	for i, arm := range node.Children[1:] {
+		if i > 0 {
+			ctx.line("} else {")
+		} else if arm.Lexeme == "Some" {
+			ctx.line(fmt.Sprintf("if %s := %s; %s != nil {", subject, value, subject))
+		} else {
+			ctx.line(fmt.Sprintf("if %s := %s; %s == nil {", subject, value, subject))
+		}
+		ctx.tabs += 1
+		bindings, block := arm.Children[:len(arm.Children)-1], arm.Children[len(arm.Children)-1]
+		wrapped := ctx.skipped[ctx.blocks+1]
+		if wrapped {
+			ctx.line("{")
+			ctx.tabs += 1
+		}
+		prevEnv := ctx.env
+		armEnv := env.NewEnv(ctx.env)
+		ctx.env = &armEnv
+		for _, binding := range bindings {
+			ctx.env.Put(env.Symbol{
+				Lexeme:     binding.Lexeme,
+				SymbolType: ast.TypeIdentifier,
+				TypeHint:   inner,
+			})
+			ctx.line(fmt.Sprintf("%s := %s", variable(binding.Lexeme), ctx.unwrap(subject, inner)))
+			if !ctx.read[binding] {
+				ctx.line(fmt.Sprintf("_ = %s", variable(binding.Lexeme)))
+			}
+		}
+		ctx.generateStatement(block)
+		ctx.env = prevEnv
+		if wrapped {
+			ctx.tabs -= 1
+			ctx.line("}")
+		}
+		ctx.tabs -= 1
+	}
+	ctx.line("}")
+}
+
+func (ctx *Context) currentBlockLabel() string {
+	if ctx.block == 0 {
+		panic("skip outside of block")
+	}
+	return blockLabel(ctx.block)
+}
+
+func (ctx *Context) generateExpression(node *ast.Node) expression {
+
+	switch node.Type {
+
+	case ast.TypeExpression:
+		return ctx.generateExpression(node.Children[0])
+
+	case ast.TypeOperator:
+		left := ctx.generateExpression(node.Children[0])
+		right := ctx.generateExpression(node.Children[1])
+		if node.Lexeme == "??" {
+			return ctx.coalesce(left, right)
+		}
+		return binaryExpression(node.Lexeme, left, right)
+
+	case ast.TypeNot:
+		value := ctx.generateExpression(node.Children[0])
+		if value.constant != nil {
+			return constantExpression(ir.NewBool(value.constant.Number == 0))
+		}
+		return expression{code: "!" + parenthesize(value), typeHint: "Bool"}
+
+	case ast.TypeLiteral:
+		return constantExpression(ir.NewString(node.Lexeme))
+
+	case ast.TypeNumber:
+		return constantExpression(ir.NewInt(int(int32(node.Number))))
+
+	case ast.TypeBoolean:
+		return constantExpression(ir.NewBool(node.Number != 0))
+
+	case ast.TypeNone:
+		return expression{code: "nil"}
+
+	case ast.TypeIdentifier:
+		path := strings.Split(node.Lexeme, ".")
+		symbol, exists := ctx.env.Get(path[0])
+		if !exists {
+			panic(fmt.Sprintf("undeclared identifier %s", path[0]))
+		}
+		typeHint := symbol.TypeHint
+		code := variable(path[0])
+		for _, field := range path[1:] {
+			typeHint = ctx.structs.FieldType(typeHint, field)
+			code += "." + fieldName(field)
+		}
+		return expression{code: code, typeHint: typeHint}
+
+	case ast.TypeMember:
+		object := ctx.generateExpression(node.Children[0])
+		return expression{
+			code:     fmt.Sprintf("%s.%s", object.code, fieldName(node.Lexeme)),
+			typeHint: ctx.structs.FieldType(object.typeHint, node.Lexeme),
+		}
+
+	case ast.TypeOptionalMember, ast.TypeOptionalCall:
+		return ctx.optionalAccess(node)
+
+	case ast.TypeCall:
+		return ctx.generateCall(ctx.generateExpression(node.Children[0]), node)
+
+	case ast.TypeStaticCall:
+		b, _ := ir.GetBuiltin(node.Lexeme)
+		return ctx.generateBuiltin(b, nil, node.Children)
+
+	case ast.TypeConstructor:
+		arguments := make(map[string]*ast.Node)
+		for _, child := range node.Children {
+			arguments[child.Lexeme] = child.Children[0]
+		}
+		if path := strings.Split(node.Lexeme, "."); len(path) > 1 {
+			enum := ctx.structs[path[0]]
+			for tag, variant := range enum.Children {
+				if variant.Lexeme == path[1] {
+					return expression{code: ctx.variantLiteral(enum, tag, arguments), typeHint: enum.Lexeme}
+				}
+			}
+			panic(fmt.Sprintf("%s has no variant %s", path[0], path[1]))
+		}
+		st, ok := ctx.structs[node.Lexeme]
+		if !ok {
+			panic(fmt.Sprintf("unknown struct %s", node.Lexeme))
+		}
+		if len(node.Children) == 0 {
+			return expression{code: constructorName(st.Lexeme) + "()", typeHint: st.Lexeme}
+		}
+		return expression{code: ctx.compositeLiteral(st, arguments), typeHint: st.Lexeme}
+
+	default:
+		panic(fmt.Sprintf("cannot generate expression %s", node.Name))
+	}
+}
+
+// generateCall calls a method or a builtin on a receiver, passing every
+// argument.
+func (ctx *Context) generateCall(receiver expression, node *ast.Node) expression {
+	if b, ok := ir.GetBuiltinMethod(receiver.typeHint, node.Lexeme); ok {
+		return ctx.generateBuiltin(b, []string{receiver.code}, node.Children[1:])
+	}
+	method := ctx.method(receiver.typeHint, node.Lexeme)
+	arguments := make(map[string]*ast.Node)
+	for _, child := range node.Children[1:] {
+		arguments[child.Lexeme] = child.Children[0]
+	}
+	var values []string
+	for _, param := range method.Parameters() {
+		if argument, ok := arguments[param.Lexeme]; ok {
+			values = append(values, ctx.convert(ctx.generateExpression(argument), param.TypeHint))
+		} else {
+			values = append(values, ctx.defaultArgument(param))
+		}
+	}
+	return expression{
+		code: fmt.Sprintf("%s.%s(%s)", receiver.code,
+			methodName(ctx.structs[receiver.typeHint], node.Lexeme), strings.Join(values, ", ")),
+		typeHint: method.TypeHint,
+	}
+}
+
+// coalesce generates a ?? b, which is optional if b is.
+func (ctx *Context) coalesce(left expression, right expression) expression {
+	ctx.matches += 1
+	name := fmt.Sprintf("optional%d", ctx.matches)
+	inner, _ := ctx.structs.Optional(left.typeHint)
+	typeHint, value := inner, ctx.unwrap(name, inner)
+	if _, optional := ctx.structs.Optional(right.typeHint); optional || right.typeHint == "" {
+		typeHint, value = left.typeHint, name
+	}
+	return expression{
+		code: fmt.Sprintf("func() %s { if %s := %s; %s != nil { return %s }; return %s }()",
+			ctx.goType(typeHint), name, left.code, name, value, ctx.convert(right, typeHint)),
+		typeHint: typeHint,
+	}
+}
+
+// optionalAccess generates a?.b or a?.b(), which is none if a is.
+func (ctx *Context) optionalAccess(node *ast.Node) expression {
+	ctx.matches += 1
+	name := fmt.Sprintf("optional%d", ctx.matches)
+	object := ctx.generateExpression(node.Children[0])
+	inner, _ := ctx.structs.Optional(object.typeHint)
+	var value expression
+	if node.Type == ast.TypeOptionalCall {
+		value = ctx.generateCall(expression{code: ctx.unwrap(name, inner), typeHint: inner}, node)
+	} else {
+		value = expression{
+			code:     fmt.Sprintf("%s.%s", ctx.unwrap(name, inner), fieldName(node.Lexeme)),
+			typeHint: ctx.structs.FieldType(inner, node.Lexeme),
+		}
+	}
+	typeHint := value.typeHint
+	if _, optional := ctx.structs.Optional(typeHint); !optional {
+		typeHint = "Optional_" + typeHint
+	}
+	return expression{
+		code: fmt.Sprintf("func() %s { if %s := %s; %s != nil { return %s }; return nil }()",
+			ctx.goType(typeHint), name, object.code, name, ctx.convert(value, typeHint)),
+		typeHint: typeHint,
+	}
+}
+
+// convert wraps none or a value given where an optional is expected. A ref
+// struct is already a pointer.
+func (ctx *Context) convert(value expression, typeHint string) string {
+	inner, ok := ctx.structs.Optional(typeHint)
+	if !ok || value.typeHint == typeHint {
+		return value.code
+	}
+	if value.typeHint == "" {
+		return "nil"
+	}
+	if ctx.isRef(inner) {
+		return value.code
+	}
+	ctx.usesSome = true
+	return fmt.Sprintf("some[%s](%s)", ctx.goType(inner), value.code)
+}
+
+// unwrap reads the value of an optional that is not nil.
+func (ctx *Context) unwrap(code string, inner string) string {
+	if ctx.isRef(inner) {
+		return code
+	}
+	return fmt.Sprintf("(*%s)", code)
+}
+
+func (ctx *Context) isRef(typeHint string) bool {
+	st, ok := ctx.structs[typeHint]
+	return ok && st.Type == ast.TypeRefStructDeclaration
+}
+
+// binaryExpression folds operations on two constants, which Go would
+// otherwise reject if they overflow. Go also rejects dividing by a constant
+// zero, so that becomes the panic it would be at runtime.
+func binaryExpression(operator string, left expression, right expression) expression {
+	typeHint := left.typeHint
+	if operator == "<" || operator == ">" {
+		typeHint = "Bool"
+	}
+
+	if operator == "/" && right.constant != nil &&
+		right.constant.Kind == ir.OperandInt && right.constant.Number == 0 {
+		return expression{
+			code:     "func() int32 { panic(\"runtime error: integer divide by zero\") }()",
+			typeHint: "Int",
+		}
+	}
+	if left.constant != nil && right.constant != nil {
+		if folded, ok := ir.Evaluate(operator, *left.constant, *right.constant); ok {
+			return constantExpression(folded)
+		}
+		if operator == "/" {
+			// MinInt32 / -1 wraps around to MinInt32 at runtime
+			return constantExpression(ir.NewInt(math.MinInt32))
+		}
+	}
+
+	return expression{
+		code:     fmt.Sprintf("%s %s %s", parenthesize(left), operator, parenthesize(right)),
+		typeHint: typeHint,
+		compound: true,
+	}
+}
+
+func constantExpression(value ir.Operand) expression {
+	var code string
+	switch value.Kind {
+	case ir.OperandString:
+		code = strconv.Quote(value.Lexeme)
+	default:
+		code = value.String()
+	}
+	return expression{code: code, typeHint: value.Type, constant: &value}
+}
+
+// parenthesize wraps operations so they keep the grouping of the AST.
+func parenthesize(value expression) string {
+	if value.compound {
+		return "(" + value.code + ")"
+	}
+	return value.code
+}
+
+// resolve finds the assignments declaring a variable that is read later,
+// following the same scopes and order as generation.
+func (ctx *Context) resolve(root *ast.RootNode) {
+	scopes := []map[string]*ast.Node{make(map[string]*ast.Node)}
+	blocks := 0
+	var current []int // The stack of blocks being resolved
+
+	lookup := func(lexeme string) (*ast.Node, bool) {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if declaration, ok := scopes[i][lexeme]; ok {
+				return declaration, true
+			}
+		}
+		return nil, false
+	}
+
+	var readExpression func(node *ast.Node)
+	readExpression = func(node *ast.Node) {
+		if node.Type == ast.TypeIdentifier {
+			if declaration, ok := lookup(strings.Split(node.Lexeme, ".")[0]); ok {
+				ctx.read[declaration] = true
+			}
+			return
+		}
+		for _, child := range node.Children {
+			readExpression(child)
+		}
+	}
+
+	var resolveStatements func(node *ast.Node)
+	resolveBlock := func(block *ast.Node) {
+		blocks += 1
+		current = append(current, blocks)
+		scopes = append(scopes, make(map[string]*ast.Node))
+		resolveStatements(block)
+		scopes = scopes[:len(scopes)-1]
+		current = current[:len(current)-1]
+	}
+	resolveStatements = func(node *ast.Node) {
+		for _, statement := range statements(node) {
+			switch statement.Type {
+			case ast.TypeBlock:
+				resolveBlock(statement)
+			case ast.TypeMatchStatement:
+				readExpression(statement.Children[0])
+				for _, arm := range statement.Children[1:] {
+					bindings := make(map[string]*ast.Node)
+					for _, binding := range arm.Children[:len(arm.Children)-1] {
+						bindings[binding.Lexeme] = binding
+					}
+					scopes = append(scopes, bindings)
+					resolveBlock(arm.Children[len(arm.Children)-1])
+					scopes = scopes[:len(scopes)-1]
+				}
+			case ast.TypeAssignmentStatement, ast.TypeValStatement:
+				readExpression(statement.Children[1])
+				lexeme := statement.Children[0].Lexeme
+				if strings.Contains(lexeme, ".") {
+					continue // Assigning a field is neither a read nor a declaration
+				}
+				if _, exists := lookup(lexeme); !exists {
+					scopes[len(scopes)-1][lexeme] = statement
+				}
+			case ast.TypeSkipStatement, ast.TypeSkipIfStatement:
+				if len(current) > 0 {
+					ctx.skipped[current[len(current)-1]] = true
+				}
+				for _, child := range statement.Children {
+					readExpression(child)
+				}
+			default:
+				for _, child := range statement.Children {
+					readExpression(child)
+				}
+			}
+		}
+	}
+	for _, declaration := range root.Declarations {
+		for _, method := range ctx.methods[declaration.Lexeme] {
+			params := make(map[string]*ast.Node)
+			for _, param := range method.Parameters() {
+				params[param.Lexeme] = param
+			}
+			scopes = []map[string]*ast.Node{params}
+			resolveStatements(method.Children[len(method.Children)-1])
+		}
+	}
+	scopes = []map[string]*ast.Node{make(map[string]*ast.Node)}
+	resolveStatements(root.Node)
+}
+
+// statements flattens the statements of a block, leaving out those after
+// an unconditional skip or a return since they can never run.
+func statements(node *ast.Node) []*ast.Node {
+	var result []*ast.Node
+	var flatten func(node *ast.Node) bool
+	flatten = func(node *ast.Node) bool {
+		for _, child := range node.Children {
+			switch child.Type {
+			case ast.TypeBlocks, ast.TypeStatements, ast.TypeStatement:
+				if !flatten(child) {
+					return false
+				}
+			default:
+				result = append(result, child)
+				if child.Type == ast.TypeSkipStatement || child.Type == ast.TypeReturnStatement {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	flatten(node)
+	return result
+}
+
+// methodName exports a method. A struct never has a field and a method of
+// the same name, but an enum has a field named after each variant, so a
+// method clashing with one gets a digit, which no name in the language has.
+func methodName(receiver *ast.Node, lexeme string) string {
+	name := fieldName(lexeme)
+	if receiver.Type == ast.TypeEnumDeclaration {
+		for _, variant := range receiver.Children {
+			if variant.Lexeme == name {
+				return name + "0"
+			}
+		}
+	}
+	return name
+}
+
+func blockLabel(block int) string {
+	return fmt.Sprintf("endBlock%d", block)
+}
+
+func constructorName(structName string) string {
+	return "New" + structName
+}
+
+// fieldName exports a field. Field names start with a lowercase letter, so
+// two fields never get the same name.
+func fieldName(lexeme string) string {
+	runes := []rune(lexeme)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// The keywords of Go and the predeclared names the generated code uses
+var reserved = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true,
+	"default": true, "defer": true, "else": true, "fallthrough": true,
+	"for": true, "func": true, "go": true, "goto": true, "if": true,
+	"import": true, "interface": true, "map": true, "package": true,
+	"range": true, "return": true, "select": true, "struct": true,
+	"switch": true, "type": true, "var": true,
+	"fmt": true, "int32": true, "float32": true, "bool": true,
+	"string": true, "panic": true,
+}
+
+// variable renames variables that would clash with Go. Identifiers start
+// with a letter, so this never collides.
+func variable(lexeme string) string {
+	if reserved[lexeme] {
+		return "_" + lexeme
+	}
+	return lexeme
+}
+
+// goType is the Go type of values of a type, which is a pointer for ref
+// structs and optionals.
+func (ctx *Context) goType(typeHint string) string {
+	if ctx.isRef(typeHint) {
+		return "*" + typeHint
+	}
+	if inner, ok := ctx.structs.Optional(typeHint); ok {
+		if ctx.isRef(inner) {
+			return ctx.goType(inner)
+		}
+		return "*" + ctx.goType(inner)
+	}
+	return typeHintToString(typeHint)
+}
+
+func typeHintToString(lexeme string) string {
+	switch lexeme {
+	case "Int":
+		return "int32"
+	case "Float":
+		return "float32"
+	case "Bool":
+		return "bool"
+	case "String":
+		return "string"
+	default:
+		return lexeme
+	}
+}
+
+func (ctx *Context) line(text string) {
+	for i := 0; i < ctx.tabs; i++ {
+		ctx.sb.AppendRune('\t')
+	}
+	ctx.sb.Append(text)
+	ctx.sb.AppendRune('\n')
+}
@@ -0,0 +1,53 @@
+package golang
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+)
+
+// TestExamplesBuild generates every example as a main package, and one as
+// a library package, in a module of their own, which go vet and go build
+// must accept.
+func TestExamplesBuild(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+	sources, _ := filepath.Glob("../../../examples/*.bip")
+	if len(sources) == 0 {
+		t.Fatal("no examples")
+	}
+
+	dir := t.TempDir()
+	write := func(name string, text string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module examples\n\ngo 1.20\n")
+	for _, source := range sources {
+		name := strings.TrimSuffix(filepath.Base(source), ".bip")
+		write(filepath.Join(name, name+".go"), Generate(ir.Lower(module.Load(source, nil)), "main"))
+	}
+	methods := ir.Lower(module.Load("../../../examples/methods.bip", nil))
+	write(filepath.Join("methods_lib", "methods.go"), Generate(methods, "methods"))
+
+	for _, args := range [][]string{{"vet", "./..."}, {"build", "-o", os.DevNull, "./..."}} {
+		cmd := exec.Command(goTool, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=", "GOTOOLCHAIN=local")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("go %s: %s\n%s", args[0], err, output)
+		}
+	}
+}
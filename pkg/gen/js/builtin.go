@@ -0,0 +1,162 @@
+package js
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	The standard library, as functions named like in C, such as
+	__Builtin_String_length__, defined at the end of the module for the
+	builtins it uses. Identifiers start with a letter, so they never clash.
+
+	Strings are measured, cut and compared as UTF-8 bytes like on the other
+	backends. A function with an optional result returns null for none.
+	Process reads the standard input with readSync from node:fs, takes the
+	arguments after the script from process.argv and ends with
+	process.exit, so a program using it runs on Node.
+*/
+
+var runtime = map[string]string{
+	"String.length": `function __Builtin_String_length__(x) {
+	return new TextEncoder().encode(x).length;
+}`,
+	"String.concat": `function __Builtin_String_concat__(x, other) {
+	return x + other;
+}`,
+	"String.substring": `function __Builtin_String_substring__(x, start, end) {
+	const bytes = new TextEncoder().encode(x);
+	start = Math.min(Math.max(start, 0), bytes.length);
+	end = Math.min(Math.max(end, start), bytes.length);
+	return new TextDecoder().decode(bytes.subarray(start, end));
+}`,
+	"String.compare": `function __Builtin_String_compare__(x, other) {
+	const a = new TextEncoder().encode(x), b = new TextEncoder().encode(other);
+	for (let i = 0; i < a.length && i < b.length; i++) {
+		if (a[i] !== b[i]) {
+			return a[i] < b[i] ? -1 : 1;
+		}
+	}
+	return Math.sign(a.length - b.length);
+}`,
+	"String.parseInt": `function __Builtin_String_parseInt__(x) {
+	if (!/^-?[0-9]+$/.test(x) || Number(x) < -2147483648 || Number(x) > 2147483647) {
+		return null;
+	}
+	return Number(x) | 0;
+}`,
+	"Int.abs": `function __Builtin_Int_abs__(x) {
+	return Math.abs(x) | 0;
+}`,
+	"Int.min": `function __Builtin_Int_min__(x, other) {
+	return Math.min(x, other);
+}`,
+	"Int.max": `function __Builtin_Int_max__(x, other) {
+	return Math.max(x, other);
+}`,
+	"Int.toFloat": `function __Builtin_Int_toFloat__(x) {
+	return Math.fround(x);
+}`,
+	"Int.toString": `function __Builtin_Int_toString__(x) {
+	return String(x);
+}`,
+	"Float.abs": `function __Builtin_Float_abs__(x) {
+	return Math.abs(x);
+}`,
+	"Float.min": `function __Builtin_Float_min__(x, other) {
+	return x < other ? x : other;
+}`,
+	"Float.max": `function __Builtin_Float_max__(x, other) {
+	return x > other ? x : other;
+}`,
+	"Float.sqrt": `function __Builtin_Float_sqrt__(x) {
+	return Math.fround(Math.sqrt(x));
+}`,
+	"Float.pow": `function __Builtin_Float_pow__(x, exponent) {
+	return Math.fround(Math.pow(x, exponent));
+}`,
+	"Float.toInt": `function __Builtin_Float_toInt__(x) {
+	if (x !== x) {
+		return 0;
+	}
+	return x >= 2147483647 ? 2147483647 : x <= -2147483648 ? -2147483648 : x | 0;
+}`,
+	"Float.toString": `function __Builtin_Float_toString__(x) {
+	return x.toFixed(6);
+}`,
+	"Bool.toString": `function __Builtin_Bool_toString__(x) {
+	return String(x);
+}`,
+	"Process.readLine": `function __Builtin_Process_readLine__() {
+	const bytes = [], byte = new Uint8Array(1);
+	let read;
+	while ((read = readSync(0, byte)) === 1 && byte[0] !== 10) {
+		bytes.push(byte[0]);
+	}
+	if (read !== 1 && bytes.length === 0) {
+		return null;
+	}
+	return new TextDecoder().decode(new Uint8Array(bytes));
+}`,
+	"Process.argCount": `function __Builtin_Process_argCount__() {
+	return Math.max(process.argv.length - 2, 0);
+}`,
+	"Process.arg": `function __Builtin_Process_arg__(index) {
+	return index >= 0 && index < process.argv.length - 2 ? process.argv[index + 2] : null;
+}`,
+	"Process.exit": `function __Builtin_Process_exit__(code) {
+	process.exit(code);
+}`,
+}
+
+// generateBuiltin calls a function of the standard library on the
+// receiver, if it has one, passing the arguments in the order of its
+// parameters.
+func (ctx *Context) generateBuiltin(b ir.Builtin, receiver []string, children []*ast.Node) (string, string) {
+	ctx.builtins[b.Name] = true
+	arguments := make(map[string]*ast.Node)
+	for _, child := range children {
+		arguments[child.Lexeme] = child.Children[0]
+	}
+	values := receiver
+	for _, param := range b.Params {
+		value, _ := ctx.generateExpression(arguments[param.Lexeme])
+		values = append(values, value)
+	}
+	typeHint := b.Result
+	if strings.HasSuffix(typeHint, "?") {
+		typeHint = ctx.optionalOf(strings.TrimSuffix(typeHint, "?"))
+	}
+	return fmt.Sprintf("%s(%s)", ir.BuiltinName(b.Name), strings.Join(values, ", ")), typeHint
+}
+
+// divide divides integers, throwing on a zero divisor.
+const divide = `function __divide__(x, y) {
+	if (y === 0) {
+		throw new RangeError("division by zero");
+	}
+	return (x / y) | 0;
+}`
+
+// generateRuntime defines the functions of the builtins the module uses,
+// and the function dividing integers if it divides any.
+func (ctx *Context) generateRuntime() {
+	for _, b := range ir.Builtins {
+		if ctx.builtins[b.Name] {
+			ctx.function(runtime[b.Name])
+		}
+	}
+	if ctx.divides {
+		ctx.function(divide)
+	}
+}
+
+func (ctx *Context) function(code string) {
+	ctx.line("")
+	for _, line := range strings.Split(code, "\n") {
+		ctx.line(line)
+	}
+}
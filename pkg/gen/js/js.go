@@ -0,0 +1,905 @@
+package js
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	Text "github.com/linkdotnet/golang-stringbuilder"
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/env"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Generates an ES module from the AST.
+
+	Unlike the other backends this works on the AST rather than the
+	three-address code, since object creation with named arguments and
+	labeled blocks are lost in lowering. It takes the program from ir.Lower,
+	which reports the errors, and generates from the AST it keeps, where
+	generics are instantiated.
+
+	Structs become exported classes whose constructors take an object of
+	named arguments and fall back to the declared defaults. Assigning a
+	struct copies it with clone(), like in C, while ref structs are shared.
+	Blocks become labeled blocks that skip breaks out of, and the top-level
+	statements become an exported main function. An enum becomes a class
+	with the name of its variant as tag, the struct of its fields as value
+	and a static method constructing each variant, and match becomes a
+	switch on the tag.
+
+	Methods become methods of the class, with self as this, taking an
+	object of named arguments like constructors. Calls pass every argument,
+	evaluating the defaults at the call in the order of the parameters like
+	the other backends, so the defaults in the method are only for calls
+	from hand-written JavaScript.
+
+	Interfaces need no code, since a call on an interface value is a call
+	on the object of the class implementing it. The TypeScript declarations
+	declare them as interfaces, which the classes implement.
+
+	An optional needs no code either, since it is null or its value, and
+	?? and ?. are the same in JavaScript. A match on an optional becomes a
+	test for null.
+
+	Builtins call the functions in builtin.go, and ?. on a builtin calls it
+	through an arrow function testing the receiver for null.
+
+	Int stays a 32-bit integer with | 0 and Math.imul, and Float stays single
+	precision with Math.fround, so results match the C backend. Dividing an
+	Int by zero throws a RangeError, like the runtime error of the VM.
+*/
+
+type Context struct {
+	tabs     int
+	sb       *Text.StringBuilder
+	structs  ast.Declarations
+	methods  map[string][]*ast.Node // The methods of each struct
+	impls    map[string][]string    // The structs implementing each interface
+	env      *env.Env
+	block    int
+	blocks   int
+	matches  int
+	builtins map[string]bool // The builtins the module calls
+	divides  bool            // Whether the module divides integers
+}
+
+func Generate(program *ir.Program) string {
+	root := program.Root
+	sb := Text.StringBuilder{}
+	ctx := newContext(&sb, root)
+
+	for _, declaration := range root.Declarations {
+		if declaration.Type == ast.TypeInterfaceDeclaration ||
+			declaration.Type == ast.TypeOptionalDeclaration {
+			continue
+		}
+		ctx.generateClass(declaration)
+		ctx.line("")
+	}
+
+	globals := env.NewEnv(nil)
+	ctx.env = &globals
+	ctx.line("export function main() {")
+	ctx.tabs += 1
+	for _, child := range root.Children {
+		ctx.generateStatement(child)
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.generateRuntime()
+	if ctx.builtins["Process.readLine"] {
+		return "import { readSync } from \"node:fs\";\n\n" + ctx.sb.ToString()
+	}
+	return ctx.sb.ToString()
+}
+
+// GenerateTypes generates a TypeScript declaration file for the module.
+func GenerateTypes(program *ir.Program) string {
+	root := program.Root
+	sb := Text.StringBuilder{}
+	ctx := newContext(&sb, root)
+
+	for _, declaration := range root.Declarations {
+		if declaration.Type == ast.TypeEnumDeclaration {
+			ctx.generateEnumTypes(declaration)
+			continue
+		}
+		if declaration.Type == ast.TypeInterfaceDeclaration {
+			ctx.generateInterfaceTypes(declaration)
+			continue
+		}
+		if declaration.Type == ast.TypeOptionalDeclaration {
+			continue
+		}
+		var implements []string
+		for _, impl := range root.Impls {
+			if impl.TypeHint == declaration.Lexeme {
+				implements = append(implements, className(impl.Lexeme))
+			}
+		}
+		if len(implements) > 0 {
+			ctx.line(fmt.Sprintf("export declare class %s implements %s {",
+				className(declaration.Lexeme), strings.Join(implements, ", ")))
+		} else {
+			ctx.line(fmt.Sprintf("export declare class %s {", className(declaration.Lexeme)))
+		}
+		ctx.tabs += 1
+		for _, field := range declaration.Children {
+			modifier := ""
+			if field.Type == ast.TypeReadonlyStructField {
+				modifier = "readonly "
+			}
+			ctx.line(fmt.Sprintf("%s%s: %s;", modifier, field.Lexeme, ctx.typeHintToString(field.TypeHint)))
+		}
+		ctx.line(fmt.Sprintf("constructor(fields?: %s);", ctx.argumentsType(declaration.Children)))
+		if declaration.Type != ast.TypeRefStructDeclaration {
+			ctx.line(fmt.Sprintf("clone(): %s;", className(declaration.Lexeme)))
+		}
+		ctx.generateMethodTypes(declaration)
+		ctx.tabs -= 1
+		ctx.line("}")
+		ctx.line("")
+	}
+	ctx.line("export declare function main(): void;")
+	return ctx.sb.ToString()
+}
+
+func (ctx *Context) generateEnumTypes(node *ast.Node) {
+	var tags, values []string
+	for _, variant := range node.Children {
+		tags = append(tags, quote(variant.Lexeme))
+		if variant.TypeHint != "" {
+			values = append(values, className(variant.TypeHint))
+		}
+	}
+	values = append(values, "null")
+	ctx.line(fmt.Sprintf("export declare class %s {", className(node.Lexeme)))
+	ctx.tabs += 1
+	ctx.line(fmt.Sprintf("tag: %s;", strings.Join(tags, " | ")))
+	ctx.line(fmt.Sprintf("value: %s;", strings.Join(values, " | ")))
+	for _, variant := range node.Children {
+		if variant.TypeHint == "" {
+			ctx.line(fmt.Sprintf("static %s(): %s;", variant.Lexeme, className(node.Lexeme)))
+			continue
+		}
+		ctx.line(fmt.Sprintf("static %s(fields?: %s): %s;",
+			variant.Lexeme, ctx.argumentsType(ctx.structs[variant.TypeHint].Children), className(node.Lexeme)))
+	}
+	ctx.line(fmt.Sprintf("clone(): %s;", className(node.Lexeme)))
+	ctx.generateMethodTypes(node)
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.line("")
+}
+
+// generateInterfaceTypes declares an interface with its methods, and clone
+// since interface values are copied like structs.
+func (ctx *Context) generateInterfaceTypes(node *ast.Node) {
+	ctx.line(fmt.Sprintf("export interface %s {", className(node.Lexeme)))
+	ctx.tabs += 1
+	ctx.line(fmt.Sprintf("clone(): %s;", className(node.Lexeme)))
+	ctx.generateMethodTypes(node)
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.line("")
+}
+
+func (ctx *Context) generateMethodTypes(node *ast.Node) {
+	methods := ctx.methods[node.Lexeme]
+	if node.Type == ast.TypeInterfaceDeclaration {
+		methods = node.Children
+	}
+	for _, method := range methods {
+		_, lexeme, _ := strings.Cut(method.Lexeme, ".")
+		result := "void"
+		if method.TypeHint != "" {
+			result = ctx.typeHintToString(method.TypeHint)
+		}
+		params := method.Parameters()
+		if len(params) == 0 {
+			ctx.line(fmt.Sprintf("%s(): %s;", methodName(node, lexeme), result))
+			continue
+		}
+		ctx.line(fmt.Sprintf("%s(args?: %s): %s;",
+			methodName(node, lexeme), ctx.argumentsType(params), result))
+	}
+}
+
+func newContext(sb *Text.StringBuilder, root *ast.RootNode) Context {
+	ctx := Context{
+		sb:       sb,
+		structs:  make(ast.Declarations),
+		methods:  make(map[string][]*ast.Node),
+		impls:    make(map[string][]string),
+		builtins: make(map[string]bool),
+	}
+	for _, declaration := range root.Declarations {
+		ctx.structs[declaration.Lexeme] = declaration
+	}
+	for _, method := range root.Methods {
+		receiver, _, _ := strings.Cut(method.Lexeme, ".")
+		ctx.methods[receiver] = append(ctx.methods[receiver], method)
+	}
+	for _, impl := range root.Impls {
+		ctx.impls[impl.Lexeme] = append(ctx.impls[impl.Lexeme], impl.TypeHint)
+	}
+	return ctx
+}
+
+// argumentsType is the type of the named arguments of a struct or a method,
+// given its fields or parameters.
+func (ctx *Context) argumentsType(fields []*ast.Node) string {
+	var arguments []string
+	for _, field := range fields {
+		arguments = append(arguments, fmt.Sprintf("%s?: %s",
+			field.Lexeme, ctx.typeHintToString(field.TypeHint)))
+	}
+	return fmt.Sprintf("{ %s }", strings.Join(arguments, "; "))
+}
+
+func (ctx *Context) generateClass(node *ast.Node) {
+	if node.Type == ast.TypeEnumDeclaration {
+		ctx.generateEnumClass(node)
+		return
+	}
+	ctx.line(fmt.Sprintf("export class %s {", className(node.Lexeme)))
+	ctx.tabs += 1
+
+	ctx.line("constructor(fields = {}) {")
+	ctx.tabs += 1
+	empty := env.NewEnv(nil)
+	ctx.env = &empty
+	for _, field := range node.Children {
+		var value string
+		if len(field.Children) > 0 {
+			value, _ = ctx.generateExpression(field.Children[0])
+		} else {
+			value = ctx.defaultValue(field.TypeHint)
+		}
+		if _, optional := ctx.structs.Optional(field.TypeHint); optional {
+			// An optional field given as none is null, which ?? would replace
+			ctx.line(fmt.Sprintf("this.%s = %s in fields ? fields.%s : %s;",
+				field.Lexeme, quote(field.Lexeme), field.Lexeme, value))
+			continue
+		}
+		ctx.line(fmt.Sprintf("this.%s = fields.%s ?? %s;",
+			field.Lexeme, field.Lexeme, value))
+	}
+	ctx.tabs -= 1
+	ctx.line("}")
+	if node.Type == ast.TypeRefStructDeclaration {
+		ctx.generateMethods(node)
+		ctx.tabs -= 1
+		ctx.line("}")
+		return
+	}
+	ctx.line("")
+
+	ctx.line("clone() {")
+	ctx.tabs += 1
+	var fields []string
+	for _, field := range node.Children {
+		value := ctx.clone("this."+field.Lexeme, field.TypeHint)
+		fields = append(fields, fmt.Sprintf("%s: %s", field.Lexeme, value))
+	}
+	ctx.line(fmt.Sprintf("return new %s({ %s });", className(node.Lexeme), strings.Join(fields, ", ")))
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.generateMethods(node)
+
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// generateEnumClass generates an enum, which is constructed through its
+// static methods rather than its constructor.
+func (ctx *Context) generateEnumClass(node *ast.Node) {
+	ctx.line(fmt.Sprintf("export class %s {", className(node.Lexeme)))
+	ctx.tabs += 1
+
+	ctx.line("constructor(tag, value) {")
+	ctx.tabs += 1
+	ctx.line("this.tag = tag;")
+	ctx.line("this.value = value;")
+	ctx.tabs -= 1
+	ctx.line("}")
+
+	for _, variant := range node.Children {
+		ctx.line("")
+		if variant.TypeHint == "" {
+			ctx.line(fmt.Sprintf("static %s() {", variant.Lexeme))
+			ctx.tabs += 1
+			ctx.line(fmt.Sprintf("return new %s(%s, null);", className(node.Lexeme), quote(variant.Lexeme)))
+		} else {
+			ctx.line(fmt.Sprintf("static %s(fields = {}) {", variant.Lexeme))
+			ctx.tabs += 1
+			ctx.line(fmt.Sprintf("return new %s(%s, new %s(fields));",
+				className(node.Lexeme), quote(variant.Lexeme), className(variant.TypeHint)))
+		}
+		ctx.tabs -= 1
+		ctx.line("}")
+	}
+	ctx.line("")
+
+	ctx.line("clone() {")
+	ctx.tabs += 1
+	ctx.line(fmt.Sprintf("return new %s(this.tag, this.value === null ? null : this.value.clone());",
+		className(node.Lexeme)))
+	ctx.tabs -= 1
+	ctx.line("}")
+	ctx.generateMethods(node)
+
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+func (ctx *Context) generateMethods(node *ast.Node) {
+	for _, method := range ctx.methods[node.Lexeme] {
+		ctx.line("")
+		ctx.generateMethod(node, method)
+	}
+}
+
+func (ctx *Context) generateMethod(receiver *ast.Node, node *ast.Node) {
+	_, lexeme, _ := strings.Cut(node.Lexeme, ".")
+	empty := env.NewEnv(nil)
+	ctx.env = &empty
+	var patterns []string
+	for _, param := range node.Parameters() {
+		value := ctx.defaultArgument(param)
+		if variable(param.Lexeme) != param.Lexeme {
+			patterns = append(patterns, fmt.Sprintf("%s: %s = %s",
+				param.Lexeme, variable(param.Lexeme), value))
+			continue
+		}
+		patterns = append(patterns, fmt.Sprintf("%s = %s", param.Lexeme, value))
+	}
+	if len(patterns) == 0 {
+		ctx.line(fmt.Sprintf("%s() {", methodName(receiver, lexeme)))
+	} else {
+		ctx.line(fmt.Sprintf("%s({ %s } = {}) {",
+			methodName(receiver, lexeme), strings.Join(patterns, ", ")))
+	}
+	ctx.tabs += 1
+
+	methodEnv := env.NewEnv(nil)
+	ctx.env = &methodEnv
+	ctx.env.Put(env.Symbol{Lexeme: "self", SymbolType: ast.TypeParameter, TypeHint: receiver.Lexeme})
+	for _, param := range node.Parameters() {
+		ctx.env.Put(env.Symbol{Lexeme: param.Lexeme, SymbolType: ast.TypeParameter, TypeHint: param.TypeHint})
+	}
+	prevBlock := ctx.block
+	ctx.block = 0
+	for _, child := range node.Children[len(node.Children)-1].Children {
+		ctx.generateStatement(child)
+	}
+	ctx.block = prevBlock
+
+	ctx.tabs -= 1
+	ctx.line("}")
+}
+
+// defaultArgument generates the default of a parameter, which like the
+// default of a field cannot refer to any variables.
+func (ctx *Context) defaultArgument(param *ast.Node) string {
+	if len(param.Children) == 0 {
+		return ctx.defaultValue(param.TypeHint)
+	}
+	prevEnv := ctx.env
+	empty := env.NewEnv(nil)
+	ctx.env = &empty
+	value, _ := ctx.generateExpression(param.Children[0])
+	ctx.env = prevEnv
+	return value
+}
+
+// method returns the declaration of a method of a struct, or the signature
+// of a method of an interface.
+func (ctx *Context) method(typeHint string, lexeme string) *ast.Node {
+	methods := ctx.methods[typeHint]
+	if st := ctx.structs[typeHint]; st != nil && st.Type == ast.TypeInterfaceDeclaration {
+		methods = st.Children
+	}
+	for _, method := range methods {
+		if method.Lexeme == typeHint+"."+lexeme {
+			return method
+		}
+	}
+	panic(fmt.Sprintf("%s has no method %s", typeHint, lexeme))
+}
+
+func (ctx *Context) defaultValue(typeHint string) string {
+	if _, ok := ctx.structs.Optional(typeHint); ok {
+		return "null"
+	}
+	switch typeHint {
+	case "Int", "Float":
+		return "0"
+	case "Bool":
+		return "false"
+	case "String":
+		return "\"\""
+	}
+	st, ok := ctx.structs[typeHint]
+	if !ok {
+		panic(fmt.Sprintf("unknown type %s", typeHint))
+	}
+	if st.Type == ast.TypeEnumDeclaration {
+		return fmt.Sprintf("%s.%s()", className(typeHint), st.Children[0].Lexeme)
+	}
+	if st.Type == ast.TypeInterfaceDeclaration {
+		// The default value of the first struct implementing it
+		return ctx.defaultValue(ctx.impls[typeHint][0])
+	}
+	return fmt.Sprintf("new %s()", className(typeHint))
+}
+
+func (ctx *Context) generateStatement(node *ast.Node) {
+
+	switch node.Type {
+
+	case ast.TypeBlock:
+		ctx.blocks += 1
+		prevBlock, prevEnv := ctx.block, ctx.env
+		blockEnv := env.NewEnv(ctx.env)
+		ctx.block, ctx.env = ctx.blocks, &blockEnv
+		ctx.line(fmt.Sprintf("%s: {", blockLabel(ctx.block)))
+		ctx.tabs += 1
+		for _, child := range node.Children {
+			ctx.generateStatement(child)
+		}
+		ctx.tabs -= 1
+		ctx.line("}")
+		ctx.block, ctx.env = prevBlock, prevEnv
+
+	case ast.TypeBlocks, ast.TypeStatements, ast.TypeStatement:
+		for _, child := range node.Children {
+			ctx.generateStatement(child)
+		}
+
+	case ast.TypePrintStatement:
+		value, typeHint := ctx.generateExpression(node.Children[0])
+		switch typeHint {
+		case "Float":
+			// Like %f in C
+			ctx.line(fmt.Sprintf("console.log((%s).toFixed(6));", value))
+		case "Int", "Bool", "String":
+			ctx.line(fmt.Sprintf("console.log(%s);", value))
+		default:
+			panic(fmt.Sprintf("cannot print value of type %s", typeHint))
+		}
+
+	case ast.TypeAssignmentStatement, ast.TypeValStatement:
+		lexeme := node.Children[0].Lexeme
+		value, typeHint := ctx.generateExpression(node.Children[1])
+		if !isConstructor(node.Children[1]) {
+			value = ctx.clone(value, typeHint)
+		}
+		if strings.Contains(lexeme, ".") {
+			target, _ := ctx.generateExpression(node.Children[0])
+			ctx.line(fmt.Sprintf("%s = %s;", target, value))
+			return
+		}
+		if _, exists := ctx.env.Get(lexeme); exists {
+			ctx.line(fmt.Sprintf("%s = %s;", variable(lexeme), value))
+			return
+		}
+		ctx.env.Put(env.Symbol{
+			Lexeme:     lexeme,
+			SymbolType: ast.TypeIdentifier,
+			TypeHint:   typeHint,
+		})
+		keyword := "let"
+		if node.Type == ast.TypeValStatement {
+			keyword = "const"
+		}
+		ctx.line(fmt.Sprintf("%s %s = %s;", keyword, variable(lexeme), value))
+
+	case ast.TypeMatchStatement:
+		ctx.generateMatch(node)
+
+	case ast.TypeCallStatement:
+		call, _ := ctx.generateExpression(node.Children[0])
+		ctx.line(call + ";")
+
+	case ast.TypeReturnStatement:
+		value, _ := ctx.generateExpression(node.Children[0])
+		ctx.line(fmt.Sprintf("return %s;", value))
+
+	case ast.TypeSkipStatement:
+		ctx.line(fmt.Sprintf("break %s;", ctx.currentBlockLabel()))
+
+	case ast.TypeSkipIfStatement:
+		condition, _ := ctx.generateExpression(node.Children[0])
+		if !isComparison(node.Children[0]) {
+			condition = "(" + condition + ")"
+		}
+		ctx.line(fmt.Sprintf("if %s break %s;", condition, ctx.currentBlockLabel()))
+
+	default:
+		panic(fmt.Sprintf("cannot generate statement %s", node.Name))
+	}
+}
+
+// generateMatch keeps the matched value in a constant, whose name has a
+// digit and so never clashes with a variable, and binds the fields of an
+// arm as constants before its block.
+func (ctx *Context) generateMatch(node *ast.Node) {
+	ctx.matches += 1
+	subject := fmt.Sprintf("match%d", ctx.matches)
+	value, typeHint := ctx.generateExpression(node.Children[0])
+	ctx.line(fmt.Sprintf("const %s = %s;", subject, value))
+	if inner, ok := ctx.structs.Optional(typeHint); ok {
+		ctx.generateOptionalMatch(node, subject, inner)
+		return
+	}
+	ctx.line(fmt.Sprintf("switch (%s.tag) {", subject))
+	for _, arm := range node.Children[1:] {
+		ctx.line(fmt.Sprintf("case %s: {", quote(arm.Lexeme)))
+		ctx.tabs += 1
+		prevEnv := ctx.env
+		armEnv := env.NewEnv(ctx.env)
+		ctx.env = &armEnv
+		bindings, block := arm.Children[:len(arm.Children)-1], arm.Children[len(arm.Children)-1]
+		for _, binding := range bindings {
+			fieldType := ctx.structs.FieldType(ctx.variantType(typeHint, arm.Lexeme), binding.Lexeme)
+			field := ctx.clone(fmt.Sprintf("%s.value.%s", subject, binding.Lexeme), fieldType)
+			ctx.env.Put(env.Symbol{
+				Lexeme:     binding.Lexeme,
+				SymbolType: ast.TypeIdentifier,
+				TypeHint:   fieldType,
+			})
+			ctx.line(fmt.Sprintf("const %s = %s;", variable(binding.Lexeme), field))
+		}
+		ctx.generateStatement(block)
+		ctx.line("break;")
+		ctx.env = prevEnv
+		ctx.tabs -= 1
+		ctx.line("}")
+	}
+	ctx.line("}")
+}
+
+// generateOptionalMatch tests the matched optional for null, binding its
+// value in the Some arm.
+func (ctx *Context) generateOptionalMatch(node *ast.Node, subject string, inner string) {
+	for i, arm := range node.Children[1:] {
+		if i > 0 {
+			ctx.line("} else {")
+		} else if arm.Lexeme == "Some" {
+			ctx.line(fmt.Sprintf("if (%s !== null) {", subject))
+		} else {
+			ctx.line(fmt.Sprintf("if (%s === null) {", subject))
+		}
+		ctx.tabs += 1
+		prevEnv := ctx.env
+		armEnv := env.NewEnv(ctx.env)
+		ctx.env = &armEnv
+		bindings, block := arm.Children[:len(arm.Children)-1], arm.Children[len(arm.Children)-1]
+		for _, binding := range bindings {
+			ctx.env.Put(env.Symbol{
+				Lexeme:     binding.Lexeme,
+				SymbolType: ast.TypeIdentifier,
+				TypeHint:   inner,
+			})
+			ctx.line(fmt.Sprintf("const %s = %s;", variable(binding.Lexeme), ctx.clone(subject, inner)))
+		}
+		ctx.generateStatement(block)
+		ctx.env = prevEnv
+		ctx.tabs -= 1
+	}
+	ctx.line("}")
+}
+
+// variantType returns the struct holding the fields of a variant.
+func (ctx *Context) variantType(typeHint string, lexeme string) string {
+	for _, variant := range ctx.structs[typeHint].Children {
+		if variant.Lexeme == lexeme {
+			return variant.TypeHint
+		}
+	}
+	panic(fmt.Sprintf("%s has no variant %s", typeHint, lexeme))
+}
+
+func (ctx *Context) currentBlockLabel() string {
+	if ctx.block == 0 {
+		panic("skip outside of block")
+	}
+	return blockLabel(ctx.block)
+}
+
+// generateExpression returns the JavaScript for an expression and its type.
+func (ctx *Context) generateExpression(node *ast.Node) (string, string) {
+
+	switch node.Type {
+
+	case ast.TypeExpression:
+		return ctx.generateExpression(node.Children[0])
+
+	case ast.TypeOperator:
+		left, typeHint := ctx.generateExpression(node.Children[0])
+		right, rightType := ctx.generateExpression(node.Children[1])
+		if node.Lexeme == "??" {
+			// The result is optional if the default is
+			inner, _ := ctx.structs.Optional(typeHint)
+			if _, optional := ctx.structs.Optional(rightType); !optional && rightType != "" {
+				typeHint = inner
+			}
+			return fmt.Sprintf("(%s ?? %s)", left, right), typeHint
+		}
+		return ctx.binaryExpression(node.Lexeme, typeHint, left, right)
+
+	case ast.TypeNot:
+		value, _ := ctx.generateExpression(node.Children[0])
+		return fmt.Sprintf("!(%s)", value), "Bool"
+
+	case ast.TypeLiteral:
+		return quote(node.Lexeme), "String"
+
+	case ast.TypeNumber:
+		return fmt.Sprint(int32(node.Number)), "Int"
+
+	case ast.TypeBoolean:
+		if node.Number != 0 {
+			return "true", "Bool"
+		}
+		return "false", "Bool"
+
+	case ast.TypeNone:
+		return "null", ""
+
+	case ast.TypeIdentifier:
+		path := strings.Split(node.Lexeme, ".")
+		symbol, exists := ctx.env.Get(path[0])
+		if !exists {
+			panic(fmt.Sprintf("undeclared identifier %s", path[0]))
+		}
+		typeHint := symbol.TypeHint
+		for _, field := range path[1:] {
+			typeHint = ctx.structs.FieldType(typeHint, field)
+		}
+		path[0] = variable(path[0])
+		if symbol.SymbolType == ast.TypeParameter && symbol.Lexeme == "self" {
+			path[0] = "this"
+		}
+		return strings.Join(path, "."), typeHint
+
+	case ast.TypeMember:
+		object, typeHint := ctx.generateExpression(node.Children[0])
+		return fmt.Sprintf("%s.%s", object, node.Lexeme), ctx.structs.FieldType(typeHint, node.Lexeme)
+
+	case ast.TypeOptionalMember:
+		object, typeHint := ctx.generateExpression(node.Children[0])
+		inner, _ := ctx.structs.Optional(typeHint)
+		return fmt.Sprintf("(%s?.%s ?? null)", object, node.Lexeme),
+			ctx.optionalOf(ctx.structs.FieldType(inner, node.Lexeme))
+
+	case ast.TypeOptionalCall:
+		receiver, typeHint := ctx.generateExpression(node.Children[0])
+		inner, _ := ctx.structs.Optional(typeHint)
+		if b, ok := ir.GetBuiltinMethod(inner, node.Lexeme); ok {
+			call, result := ctx.generateBuiltin(b, []string{"$"}, node.Children[1:])
+			if _, optional := ctx.structs.Optional(result); !optional && result != "" {
+				result = ctx.optionalOf(result)
+			}
+			return fmt.Sprintf("(($) => $ === null ? null : %s)(%s)", call, receiver), result
+		}
+		call, result := ctx.generateCall(receiver+"?.", inner, node)
+		if result == "" {
+			return call, result
+		}
+		return fmt.Sprintf("(%s ?? null)", call), ctx.optionalOf(result)
+
+	case ast.TypeCall:
+		receiver, typeHint := ctx.generateExpression(node.Children[0])
+		if b, ok := ir.GetBuiltinMethod(typeHint, node.Lexeme); ok {
+			return ctx.generateBuiltin(b, []string{receiver}, node.Children[1:])
+		}
+		return ctx.generateCall(receiver+".", typeHint, node)
+
+	case ast.TypeStaticCall:
+		b, _ := ir.GetBuiltin(node.Lexeme)
+		return ctx.generateBuiltin(b, nil, node.Children)
+
+	case ast.TypeConstructor:
+		path := strings.Split(node.Lexeme, ".")
+		var arguments []string
+		for _, child := range node.Children {
+			value, typeHint := ctx.generateExpression(child.Children[0])
+			if !isConstructor(child.Children[0]) {
+				value = ctx.clone(value, typeHint)
+			}
+			arguments = append(arguments, fmt.Sprintf("%s: %s", child.Lexeme, value))
+		}
+		if len(path) > 1 {
+			if len(arguments) == 0 {
+				return fmt.Sprintf("%s.%s()", className(path[0]), path[1]), path[0]
+			}
+			return fmt.Sprintf("%s.%s({ %s })", className(path[0]), path[1], strings.Join(arguments, ", ")), path[0]
+		}
+		if len(arguments) == 0 {
+			return fmt.Sprintf("new %s()", className(node.Lexeme)), node.Lexeme
+		}
+		return fmt.Sprintf("new %s({ %s })", className(node.Lexeme), strings.Join(arguments, ", ")), node.Lexeme
+
+	default:
+		panic(fmt.Sprintf("cannot generate expression %s", node.Name))
+	}
+}
+
+// generateCall calls a method on a receiver followed by . or ?., passing
+// every argument, and returns the call and the result type of the method.
+func (ctx *Context) generateCall(receiver string, typeHint string, node *ast.Node) (string, string) {
+	method := ctx.method(typeHint, node.Lexeme)
+	arguments := make(map[string]*ast.Node)
+	for _, child := range node.Children[1:] {
+		arguments[child.Lexeme] = child.Children[0]
+	}
+	var values []string
+	for _, param := range method.Parameters() {
+		value := ctx.defaultArgument(param)
+		if argument, ok := arguments[param.Lexeme]; ok {
+			value, _ = ctx.generateExpression(argument)
+		}
+		values = append(values, fmt.Sprintf("%s: %s", param.Lexeme, value))
+	}
+	name := methodName(ctx.structs[typeHint], node.Lexeme)
+	if len(values) == 0 {
+		return fmt.Sprintf("%s%s()", receiver, name), method.TypeHint
+	}
+	return fmt.Sprintf("%s%s({ %s })", receiver, name, strings.Join(values, ", ")), method.TypeHint
+}
+
+// isValueStruct reports whether the type is a struct that is copied on
+// assignment, which ref structs are not.
+func (ctx *Context) isValueStruct(typeHint string) bool {
+	st, ok := ctx.structs[typeHint]
+	return ok && st.Type != ast.TypeRefStructDeclaration && st.Type != ast.TypeOptionalDeclaration
+}
+
+// clone copies a value of a value struct, or an optional holding one.
+func (ctx *Context) clone(value string, typeHint string) string {
+	if ctx.isValueStruct(typeHint) {
+		return value + ".clone()"
+	}
+	if inner, ok := ctx.structs.Optional(typeHint); ok && ctx.isValueStruct(inner) {
+		return fmt.Sprintf("(%s?.clone() ?? null)", value)
+	}
+	return value
+}
+
+// optionalOf returns the optional of a type, which was declared when the
+// program was lowered, or the type if it is already optional.
+func (ctx *Context) optionalOf(typeHint string) string {
+	if _, ok := ctx.structs.Optional(typeHint); ok {
+		return typeHint
+	}
+	return "Optional_" + typeHint
+}
+
+// binaryExpression divides integers with __divide__, since JavaScript
+// divides by zero to Infinity, which | 0 would turn into 0.
+func (ctx *Context) binaryExpression(operator string, typeHint string, left string, right string) (string, string) {
+	switch operator {
+	case "<", ">":
+		return fmt.Sprintf("(%s %s %s)", left, operator, right), "Bool"
+	case "+", "-", "/":
+		if typeHint == "Float" {
+			return fmt.Sprintf("Math.fround(%s %s %s)", left, operator, right), typeHint
+		}
+		if operator == "/" {
+			ctx.divides = true
+			return fmt.Sprintf("__divide__(%s, %s)", left, right), typeHint
+		}
+		return fmt.Sprintf("((%s %s %s) | 0)", left, operator, right), typeHint
+	case "*":
+		if typeHint == "Float" {
+			return fmt.Sprintf("Math.fround(%s * %s)", left, right), typeHint
+		}
+		// Multiplying as doubles loses the low bits of large products
+		return fmt.Sprintf("Math.imul(%s, %s)", left, right), typeHint
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
+
+func isConstructor(node *ast.Node) bool {
+	return unwrap(node).Type == ast.TypeConstructor
+}
+
+// isComparison reports whether the expression generates as a parenthesized
+// comparison.
+func isComparison(node *ast.Node) bool {
+	node = unwrap(node)
+	return node.Type == ast.TypeOperator && (node.Lexeme == "<" || node.Lexeme == ">")
+}
+
+func unwrap(node *ast.Node) *ast.Node {
+	for node.Type == ast.TypeExpression && len(node.Children) == 1 {
+		node = node.Children[0]
+	}
+	return node
+}
+
+// methodName renames methods that would clash with the members every class
+// or every enum class has. An enum cannot have a method named tag, since
+// that is one of its fields.
+func methodName(receiver *ast.Node, lexeme string) string {
+	if lexeme == "constructor" || lexeme == "clone" ||
+		(receiver.Type == ast.TypeEnumDeclaration && lexeme == "value") {
+		return lexeme + "$"
+	}
+	return lexeme
+}
+
+func blockLabel(block int) string {
+	return fmt.Sprintf("block%d", block)
+}
+
+var reserved = map[string]bool{
+	"await": true, "break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "implements": true, "import": true,
+	"in": true, "instanceof": true, "interface": true, "let": true,
+	"new": true, "null": true, "package": true, "private": true,
+	"protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true,
+	"with": true, "yield": true, "arguments": true, "eval": true,
+	"console": true,
+}
+
+// The globals the generated code uses, which a class must not shadow
+var builtins = map[string]bool{
+	"Math": true, "Number": true, "TextEncoder": true, "TextDecoder": true,
+	"Uint8Array": true,
+}
+
+// variable renames variables that would clash with JavaScript. Identifiers
+// cannot contain $, so this never collides.
+func variable(lexeme string) string {
+	if reserved[lexeme] {
+		return lexeme + "$"
+	}
+	return lexeme
+}
+
+func className(lexeme string) string {
+	if builtins[lexeme] {
+		return lexeme + "$"
+	}
+	return lexeme
+}
+
+func (ctx *Context) typeHintToString(lexeme string) string {
+	if inner, ok := ctx.structs.Optional(lexeme); ok {
+		return ctx.typeHintToString(inner) + " | null"
+	}
+	switch lexeme {
+	case "Int", "Float":
+		return "number"
+	case "Bool":
+		return "boolean"
+	case "String":
+		return "string"
+	default:
+		return className(lexeme)
+	}
+}
+
+func quote(text string) string {
+	bytes, _ := json.Marshal(text)
+	return string(bytes)
+}
+
+func (ctx *Context) line(text string) {
+	for i := 0; i < ctx.tabs && len(text) > 0; i++ {
+		ctx.sb.AppendRune('\t')
+	}
+	ctx.sb.Append(text)
+	ctx.sb.AppendRune('\n')
+}
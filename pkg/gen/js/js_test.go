@@ -0,0 +1,51 @@
+package js
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+)
+
+// TestIntegerDivision runs a program dividing by zero on Node, which must
+// fail like the VM does after printing the quotients before.
+func TestIntegerDivision(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(`a = 7
+b = 0
+c = 0 - a
+print a / 2
+print c / 2
+print a.toFloat() / 2.toFloat()
+print a / b
+print "never"
+`)))
+	parser := parser.NewParser(lexer.ScanAll())
+	code := Generate(ir.Lower(parser.Parse()))
+
+	script := filepath.Join(t.TempDir(), "division.mjs")
+	if err := os.WriteFile(script, []byte(code+"\nmain();\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	run := exec.Command(node, script)
+	run.Stdout, run.Stderr = &stdout, &stderr
+	if err := run.Run(); err == nil {
+		t.Error("dividing by zero did not fail")
+	}
+	if want := "3\n-3\n3.500000\n"; stdout.String() != want {
+		t.Errorf("printed %q, want %q", stdout.String(), want)
+	}
+	if !strings.Contains(stderr.String(), "RangeError: division by zero") {
+		t.Errorf("failed with\n%s", stderr.String())
+	}
+}
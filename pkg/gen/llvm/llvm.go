@@ -0,0 +1,574 @@
+package llvm
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"strings"
+
+	Text "github.com/linkdotnet/golang-stringbuilder"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Generates LLVM IR text from the three-address code.
+
+	Every local gets a stack slot from alloca in the entry block, and each
+	instruction loads its operands and stores its result, leaving it to
+	mem2reg to build the SSA form. Structs are named struct types with
+	nested structs inline, and constructors take a pointer to the struct
+	like __Construct_X__ in C. Methods take the same pointer to their
+	receiver, followed by their parameters, which get stack slots like
+	locals. Structs are passed and returned by value. Labels start new basic
+	blocks, and the code after a jump gets a fresh block so every block has
+	a terminator.
+
+	A call on an interface value loads a function pointer from a constant
+	array for the method, indexed by the tag. The array points at small
+	functions passing the field holding the struct on to its method.
+
+	Builtins call the functions of an embedded runtime, defined in LLVM IR on
+	top of the C library, which main gives its arguments first.
+
+	Pointers are typed, as in LLVM 14.
+*/
+
+// The runtime of the standard library, included when a program uses it
+//
+//go:embed runtime.ll
+var runtime string
+
+type Context struct {
+	tabs      int
+	sb        *Text.StringBuilder
+	program   *ir.Program
+	strings   map[string]string
+	registers int
+	blocks    int
+	builtins  bool // Whether the program uses the runtime
+}
+
+func Generate(program *ir.Program) string {
+	sb := Text.StringBuilder{}
+	ctx := Context{
+		sb:      &sb,
+		program: program,
+		strings: make(map[string]string),
+	}
+
+	for _, st := range program.Structs {
+		var fields []string
+		for _, field := range st.Fields {
+			fields = append(fields, typeHintToString(field.Type))
+		}
+		ctx.line(fmt.Sprintf("%%%s = type { %s }", st.Name, strings.Join(fields, ", ")))
+	}
+	if len(program.Structs) > 0 {
+		ctx.line("")
+	}
+
+	ctx.line("@.fmt.int = private unnamed_addr constant [4 x i8] c\"%d\\0A\\00\"")
+	ctx.line("@.fmt.float = private unnamed_addr constant [4 x i8] c\"%f\\0A\\00\"")
+	ctx.line("@.fmt.string = private unnamed_addr constant [4 x i8] c\"%s\\0A\\00\"")
+	ctx.stringConstant("true")
+	ctx.stringConstant("false")
+	ctx.generateStrings(program.Main)
+	for _, st := range program.Structs {
+		ctx.generateStrings(st.Constructor)
+	}
+	for _, method := range program.Methods {
+		ctx.generateStrings(method)
+	}
+	ctx.line("")
+	ctx.line("declare i32 @printf(i8*, ...)")
+	ctx.builtins = len(program.UsesBuiltins()) > 0
+	if ctx.builtins {
+		ctx.line("")
+		ctx.sb.Append(runtime)
+	}
+
+	for _, st := range program.Structs {
+		ctx.line("")
+		ctx.line(fmt.Sprintf("define void %s(%%%s* %%o) {", constructorName(st.Name), st.Name))
+		ctx.generateBody(st.Constructor)
+		ctx.tabs += 1
+		ctx.line("ret void")
+		ctx.tabs -= 1
+		ctx.line("}")
+	}
+
+	for _, method := range program.Methods {
+		ctx.line("")
+		ctx.line(fmt.Sprintf("define %s {", declaration(method, methodName(method.Name))))
+		ctx.generateBody(method)
+		if method.Result == "" {
+			ctx.tabs += 1
+			ctx.line("ret void")
+			ctx.tabs -= 1
+		}
+		ctx.line("}")
+	}
+	for _, st := range program.Structs {
+		if st.Interface && len(st.Variants) > 0 {
+			ctx.generateVTables(st)
+		}
+	}
+
+	ctx.line("")
+	if ctx.builtins {
+		ctx.line("define i32 @main(i32 %argc, i8** %argv) {")
+	} else {
+		ctx.line("define i32 @main() {")
+	}
+	ctx.generateBody(program.Main)
+	ctx.tabs += 1
+	ctx.line("ret i32 0")
+	ctx.tabs -= 1
+	ctx.line("}")
+	return ctx.sb.ToString()
+}
+
+// declaration returns the result, the name and the parameters of a method,
+// or of a function with the signature of the method of an interface.
+func declaration(fn *ir.Func, name string) string {
+	params := []string{fmt.Sprintf("%%%s* %%o", fn.Receiver)}
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("%s %s",
+			typeHintToString(param.Type), argument(param)))
+	}
+	return fmt.Sprintf("%s %s(%s)", resultType(fn), name, strings.Join(params, ", "))
+}
+
+// functionType returns the type of a pointer to a method of an interface.
+func functionType(fn *ir.Func) string {
+	params := []string{fmt.Sprintf("%%%s*", fn.Receiver)}
+	for _, param := range fn.Params {
+		params = append(params, typeHintToString(param.Type))
+	}
+	return fmt.Sprintf("%s (%s)*", resultType(fn), strings.Join(params, ", "))
+}
+
+func resultType(fn *ir.Func) string {
+	if fn.Result == "" {
+		return "void"
+	}
+	return typeHintToString(fn.Result)
+}
+
+// generateVTables defines the array of each method of an interface, with
+// a function for every struct implementing it.
+func (ctx *Context) generateVTables(st *ir.Struct) {
+	for _, signature := range st.Methods {
+		_, lexeme, _ := strings.Cut(signature.Name, ".")
+		var pointers []string
+		for _, variant := range st.Variants {
+			method := variant + "." + lexeme
+			index, _ := fieldIndex(st, variant)
+			name := dispatchName(st.Name, method)
+			ctx.line("")
+			ctx.line(fmt.Sprintf("define private %s {", declaration(signature, name)))
+			ctx.tabs += 1
+			ctx.line(fmt.Sprintf("%%self = getelementptr inbounds %%%s, %%%s* %%o, i32 0, i32 %d",
+				st.Name, st.Name, index))
+			args := []string{fmt.Sprintf("%%%s* %%self", variant)}
+			for _, param := range signature.Params {
+				args = append(args, fmt.Sprintf("%s %s", typeHintToString(param.Type), argument(param)))
+			}
+			call := fmt.Sprintf("call %s %s(%s)", resultType(signature),
+				methodName(method), strings.Join(args, ", "))
+			if signature.Result == "" {
+				ctx.line(call)
+				ctx.line("ret void")
+			} else {
+				ctx.line("%result = " + call)
+				ctx.line(fmt.Sprintf("ret %s %%result", resultType(signature)))
+			}
+			ctx.tabs -= 1
+			ctx.line("}")
+			pointers = append(pointers, fmt.Sprintf("%s %s", functionType(signature), name))
+		}
+		ctx.line("")
+		ctx.line(fmt.Sprintf("%s = private constant [%d x %s] [%s]", vtableName(signature.Name),
+			len(st.Variants), functionType(signature), strings.Join(pointers, ", ")))
+	}
+}
+
+// dispatch loads the function a call on an interface value runs.
+func (ctx *Context) dispatch(instr ir.Instr, signature *ir.Func) string {
+	st, _ := ctx.program.GetStruct(instr.Arg1.Type)
+	tagPointer, _ := ctx.fieldPointer(instr.Arg1, st.Fields[0].Lexeme)
+	tag := ctx.register()
+	ctx.line(fmt.Sprintf("%s = load i32, i32* %s", tag, tagPointer))
+	entry := ctx.register()
+	array := fmt.Sprintf("[%d x %s]", len(st.Variants), functionType(signature))
+	ctx.line(fmt.Sprintf("%s = getelementptr inbounds %s, %s* %s, i32 0, i32 %s",
+		entry, array, array, vtableName(signature.Name), tag))
+	function := ctx.register()
+	ctx.line(fmt.Sprintf("%s = load %s, %s* %s", function,
+		functionType(signature), functionType(signature), entry))
+	return function
+}
+
+func (ctx *Context) generateStrings(fn *ir.Func) {
+	for _, instr := range fn.Code {
+		for _, operand := range append([]ir.Operand{instr.Arg1, instr.Arg2}, instr.Args...) {
+			if operand.Kind == ir.OperandString {
+				ctx.stringConstant(operand.Lexeme)
+			}
+		}
+	}
+}
+
+// stringConstant declares a global for a string the first time it is seen.
+func (ctx *Context) stringConstant(text string) {
+	if _, exists := ctx.strings[text]; exists {
+		return
+	}
+	name := fmt.Sprintf("@.str.%d", len(ctx.strings))
+	ctx.strings[text] = name
+	ctx.line(fmt.Sprintf("%s = private unnamed_addr constant [%d x i8] c\"%s\\00\"",
+		name, len(text)+1, escape(text)))
+}
+
+func (ctx *Context) generateBody(fn *ir.Func) {
+	ctx.registers = 0
+	ctx.blocks = 0
+	ctx.line("entry:")
+	ctx.tabs += 1
+	for _, local := range append(append([]ir.Operand{}, fn.Params...), fn.Locals...) {
+		ctx.line(fmt.Sprintf("%s = alloca %s", slot(local), typeHintToString(local.Type)))
+	}
+	for _, param := range fn.Params {
+		ctx.store(param, argument(param))
+	}
+	if fn == ctx.program.Main && ctx.builtins {
+		ctx.line("call void @__Builtin_Process_init__(i32 %argc, i8** %argv)")
+	}
+	for _, instr := range fn.Code {
+		ctx.generate(instr)
+	}
+	ctx.tabs -= 1
+}
+
+func (ctx *Context) generate(instr ir.Instr) {
+
+	switch instr.Op {
+
+	case ir.OpCopy:
+		ctx.store(instr.Dst, ctx.value(instr.Arg1))
+
+	case ir.OpBinary:
+		a, b := ctx.value(instr.Arg1), ctx.value(instr.Arg2)
+		result := ctx.register()
+		ctx.line(fmt.Sprintf("%s = %s %s %s, %s", result,
+			binaryInstr(instr.Operator, instr.Arg1.Type),
+			typeHintToString(instr.Arg1.Type), a, b))
+		ctx.store(instr.Dst, result)
+
+	case ir.OpNot:
+		a := ctx.value(instr.Arg1)
+		result := ctx.register()
+		ctx.line(fmt.Sprintf("%s = xor i1 %s, true", result, a))
+		ctx.store(instr.Dst, result)
+
+	case ir.OpLabel:
+		ctx.line(fmt.Sprintf("br label %%%s", label(instr.Label)))
+		ctx.startBlock(label(instr.Label))
+
+	case ir.OpJump:
+		ctx.line(fmt.Sprintf("br label %%%s", label(instr.Label)))
+		ctx.startBlock(ctx.newBlock())
+
+	case ir.OpJumpIf:
+		condition := ctx.value(instr.Arg1)
+		next := ctx.newBlock()
+		ctx.line(fmt.Sprintf("br i1 %s, label %%%s, label %%%s",
+			condition, label(instr.Label), next))
+		ctx.startBlock(next)
+
+	case ir.OpAlloc:
+		ctx.line(fmt.Sprintf("call void %s(%s* %s)",
+			constructorName(instr.Dst.Type), typeHintToString(instr.Dst.Type), slot(instr.Dst)))
+
+	case ir.OpLoad:
+		pointer, typeHint := ctx.fieldPointer(instr.Arg1, instr.Field)
+		result := ctx.register()
+		ctx.line(fmt.Sprintf("%s = load %s, %s* %s", result,
+			typeHintToString(typeHint), typeHintToString(typeHint), pointer))
+		ctx.store(instr.Dst, result)
+
+	case ir.OpStore:
+		pointer, typeHint := ctx.fieldPointer(instr.Dst, instr.Field)
+		value := ctx.value(instr.Arg1)
+		ctx.line(fmt.Sprintf("store %s %s, %s* %s",
+			typeHintToString(typeHint), value, typeHintToString(typeHint), pointer))
+
+	case ir.OpPrint:
+		ctx.generatePrint(instr.Arg1)
+
+	case ir.OpCall:
+		args := []string{fmt.Sprintf("%%%s* %s", instr.Arg1.Type, pointer(instr.Arg1))}
+		for _, arg := range instr.Args {
+			args = append(args, fmt.Sprintf("%s %s", typeHintToString(arg.Type), ctx.value(arg)))
+		}
+		callee := methodName(instr.Func)
+		if ctx.program.IsInterface(instr.Arg1.Type) {
+			receiver, lexeme, _ := strings.Cut(instr.Func, ".")
+			signature, _ := ctx.program.GetMethod(receiver, lexeme)
+			callee = ctx.dispatch(instr, signature)
+		}
+		if instr.Dst.Kind == ir.OperandZero {
+			ctx.line(fmt.Sprintf("call void %s(%s)", callee, strings.Join(args, ", ")))
+			break
+		}
+		result := ctx.register()
+		ctx.line(fmt.Sprintf("%s = call %s %s(%s)", result, typeHintToString(instr.Dst.Type),
+			callee, strings.Join(args, ", ")))
+		ctx.store(instr.Dst, result)
+
+	case ir.OpBuiltin:
+		var args []string
+		for _, arg := range instr.Args {
+			args = append(args, fmt.Sprintf("%s %s", typeHintToString(arg.Type), ctx.value(arg)))
+		}
+		if instr.Dst.Kind == ir.OperandZero {
+			ctx.line(fmt.Sprintf("call void @%s(%s)", ir.BuiltinName(instr.Func), strings.Join(args, ", ")))
+			break
+		}
+		result := ctx.register()
+		ctx.line(fmt.Sprintf("%s = call %s @%s(%s)", result, typeHintToString(instr.Dst.Type),
+			ir.BuiltinName(instr.Func), strings.Join(args, ", ")))
+		ctx.store(instr.Dst, result)
+
+	case ir.OpReturn:
+		value := ctx.value(instr.Arg1)
+		ctx.line(fmt.Sprintf("ret %s %s", typeHintToString(instr.Arg1.Type), value))
+
+	default:
+		panic(fmt.Sprintf("cannot generate %s", instr))
+	}
+}
+
+func (ctx *Context) generatePrint(operand ir.Operand) {
+	value := ctx.value(operand)
+	format, argument := "@.fmt.string", "i8* "+value
+
+	switch operand.Type {
+	case "Int":
+		format, argument = "@.fmt.int", "i32 "+value
+	case "Float":
+		double := ctx.register()
+		ctx.line(fmt.Sprintf("%s = fpext float %s to double", double, value))
+		format, argument = "@.fmt.float", "double "+double
+	case "Bool":
+		text := ctx.register()
+		ctx.line(fmt.Sprintf("%s = select i1 %s, i8* %s, i8* %s", text, value,
+			ctx.stringPointer("true"), ctx.stringPointer("false")))
+		argument = "i8* " + text
+	case "String":
+	default:
+		panic(fmt.Sprintf("cannot print value of type %s", operand.Type))
+	}
+
+	ctx.line(fmt.Sprintf(
+		"call i32 (i8*, ...) @printf(i8* getelementptr inbounds ([4 x i8], [4 x i8]* %s, i32 0, i32 0), %s)",
+		format, argument))
+}
+
+// value returns an LLVM value for an operand, loading variables from their
+// stack slot.
+func (ctx *Context) value(operand ir.Operand) string {
+	switch operand.Kind {
+	case ir.OperandTemp, ir.OperandVar, ir.OperandSelf:
+		result := ctx.register()
+		typeHint := typeHintToString(operand.Type)
+		ctx.line(fmt.Sprintf("%s = load %s, %s* %s", result, typeHint, typeHint, pointer(operand)))
+		return result
+	case ir.OperandInt:
+		return fmt.Sprint(int32(operand.Number))
+	case ir.OperandFloat:
+		// Float constants must be exact, which the hexadecimal form always is
+		return fmt.Sprintf("0x%016X", math.Float64bits(float64(float32(operand.Float))))
+	case ir.OperandBool:
+		if operand.Number != 0 {
+			return "true"
+		}
+		return "false"
+	case ir.OperandString:
+		return ctx.stringPointer(operand.Lexeme)
+	default:
+		panic(fmt.Sprintf("cannot generate operand %s", operand))
+	}
+}
+
+func (ctx *Context) stringPointer(text string) string {
+	length := len(text) + 1
+	return fmt.Sprintf("getelementptr inbounds ([%d x i8], [%d x i8]* %s, i32 0, i32 0)",
+		length, length, ctx.strings[text])
+}
+
+func (ctx *Context) store(dst ir.Operand, value string) {
+	typeHint := typeHintToString(dst.Type)
+	ctx.line(fmt.Sprintf("store %s %s, %s* %s", typeHint, value, typeHint, slot(dst)))
+}
+
+// fieldPointer returns a pointer to the field at the end of a dotted path,
+// and the type of that field.
+func (ctx *Context) fieldPointer(base ir.Operand, path string) (string, string) {
+	typeHint := base.Type
+	indices := []string{"i32 0"}
+	for _, field := range strings.Split(path, ".") {
+		st, ok := ctx.program.GetStruct(typeHint)
+		if !ok {
+			panic(fmt.Sprintf("unknown struct %s", typeHint))
+		}
+		index, found := fieldIndex(st, field)
+		if !found {
+			panic(fmt.Sprintf("unknown field %s in %s", field, st.Name))
+		}
+		indices = append(indices, fmt.Sprintf("i32 %d", index))
+		typeHint = st.Fields[index].Type
+	}
+
+	result := ctx.register()
+	ctx.line(fmt.Sprintf("%s = getelementptr inbounds %%%s, %%%s* %s, %s",
+		result, base.Type, base.Type, pointer(base), strings.Join(indices, ", ")))
+	return result, typeHint
+}
+
+func fieldIndex(st *ir.Struct, lexeme string) (int, bool) {
+	for i, field := range st.Fields {
+		if field.Lexeme == lexeme {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (ctx *Context) register() string {
+	ctx.registers += 1
+	return fmt.Sprintf("%%r%d", ctx.registers)
+}
+
+func (ctx *Context) newBlock() string {
+	ctx.blocks += 1
+	return fmt.Sprintf("next%d", ctx.blocks)
+}
+
+func (ctx *Context) startBlock(name string) {
+	ctx.tabs -= 1
+	ctx.line(name + ":")
+	ctx.tabs += 1
+}
+
+func binaryInstr(operator string, typeHint string) string {
+	float := typeHint == "Float"
+	switch operator {
+	case "+":
+		if float {
+			return "fadd"
+		}
+		return "add"
+	case "-":
+		if float {
+			return "fsub"
+		}
+		return "sub"
+	case "*":
+		if float {
+			return "fmul"
+		}
+		return "mul"
+	case "/":
+		if float {
+			return "fdiv"
+		}
+		return "sdiv"
+	case "<":
+		if float {
+			return "fcmp olt"
+		}
+		return "icmp slt"
+	case ">":
+		if float {
+			return "fcmp ogt"
+		}
+		return "icmp sgt"
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
+
+func slot(operand ir.Operand) string {
+	return "%" + operand.String() + ".addr"
+}
+
+// pointer returns the address of a variable, which for self is the pointer
+// a constructor or method is called with.
+func pointer(operand ir.Operand) string {
+	if operand.Kind == ir.OperandSelf {
+		return "%o"
+	}
+	return slot(operand)
+}
+
+// argument names the value a parameter is passed as, before it is stored in
+// its slot.
+func argument(param ir.Operand) string {
+	return "%" + param.String() + ".arg"
+}
+
+func methodName(qualified string) string {
+	return "@" + qualified
+}
+
+func label(lexeme string) string {
+	return "L." + lexeme
+}
+
+func dispatchName(iface string, method string) string {
+	return fmt.Sprintf("@__Dispatch_%s__%s", iface, method)
+}
+
+func vtableName(signature string) string {
+	return fmt.Sprintf("@__VTable_%s", signature)
+}
+
+func constructorName(structName string) string {
+	return fmt.Sprintf("@__Construct_%s__", structName)
+}
+
+func typeHintToString(lexeme string) string {
+	switch lexeme {
+	case "Int":
+		return "i32"
+	case "Float":
+		return "float"
+	case "Bool":
+		return "i1"
+	case "String":
+		return "i8*"
+	default:
+		return "%" + lexeme
+	}
+}
+
+func escape(text string) string {
+	var sb strings.Builder
+	for _, b := range []byte(text) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			sb.WriteString(fmt.Sprintf("\\%02X", b))
+			continue
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+func (ctx *Context) line(text string) {
+	for i := 0; i < ctx.tabs; i++ {
+		ctx.sb.AppendRune('\t')
+	}
+	ctx.sb.Append(text)
+	ctx.sb.AppendRune('\n')
+}
@@ -0,0 +1,333 @@
+; The runtime of the standard library of dragon, in LLVM IR.
+;
+; Defines a function for each builtin, named after it like in C, such as
+; @__Builtin_String_length__ for String.length, on top of the C library.
+; main calls @__Builtin_Process_init__ with its arguments first. Strings
+; made by the runtime are never freed, since nothing tells when they are no
+; longer used.
+
+@__Builtin_argc__ = private global i32 0
+@__Builtin_argv__ = private global i8** null
+; The line read by hasLine, which readLine returns
+@__Builtin_line__ = private global i8* null
+@__Builtin_lineCapacity__ = private global i64 0
+@.fmt.builtin.int = private unnamed_addr constant [3 x i8] c"%d\00"
+@.fmt.builtin.float = private unnamed_addr constant [3 x i8] c"%f\00"
+@.str.builtin.true = private unnamed_addr constant [5 x i8] c"true\00"
+@.str.builtin.false = private unnamed_addr constant [6 x i8] c"false\00"
+
+declare i64 @strlen(i8*)
+declare i32 @strcmp(i8*, i8*)
+declare i8* @malloc(i64)
+declare i8* @realloc(i8*, i64)
+declare i8* @memcpy(i8*, i8*, i64)
+declare i32 @snprintf(i8*, i64, i8*, ...)
+declare i32 @getchar()
+declare void @exit(i32)
+declare float @sqrtf(float)
+declare float @fabsf(float)
+declare double @pow(double, double)
+declare i32 @llvm.fptosi.sat.i32.f32(float)
+
+; @__Builtin_copy__ copies length bytes of text into a new string.
+define private i8* @__Builtin_copy__(i8* %text, i64 %length) {
+entry:
+	%size = add i64 %length, 1
+	%copy = call i8* @malloc(i64 %size)
+	call i8* @memcpy(i8* %copy, i8* %text, i64 %length)
+	%end = getelementptr inbounds i8, i8* %copy, i64 %length
+	store i8 0, i8* %end
+	ret i8* %copy
+}
+
+define i32 @__Builtin_String_length__(i8* %text) {
+entry:
+	%length = call i64 @strlen(i8* %text)
+	%result = trunc i64 %length to i32
+	ret i32 %result
+}
+
+define i8* @__Builtin_String_concat__(i8* %text, i8* %other) {
+entry:
+	%length = call i64 @strlen(i8* %text)
+	%otherLength = call i64 @strlen(i8* %other)
+	%total = add i64 %length, %otherLength
+	%size = add i64 %total, 1
+	%result = call i8* @malloc(i64 %size)
+	call i8* @memcpy(i8* %result, i8* %text, i64 %length)
+	%rest = getelementptr inbounds i8, i8* %result, i64 %length
+	%otherSize = add i64 %otherLength, 1
+	call i8* @memcpy(i8* %rest, i8* %other, i64 %otherSize)
+	ret i8* %result
+}
+
+define i8* @__Builtin_String_substring__(i8* %text, i32 %start, i32 %end) {
+entry:
+	%wide = call i64 @strlen(i8* %text)
+	%length = trunc i64 %wide to i32
+	%startNegative = icmp slt i32 %start, 0
+	%startPositive = select i1 %startNegative, i32 0, i32 %start
+	%startLong = icmp sgt i32 %startPositive, %length
+	%from = select i1 %startLong, i32 %length, i32 %startPositive
+	%endBefore = icmp slt i32 %end, %from
+	%endAfter = select i1 %endBefore, i32 %from, i32 %end
+	%endLong = icmp sgt i32 %endAfter, %length
+	%to = select i1 %endLong, i32 %length, i32 %endAfter
+	%offset = sext i32 %from to i64
+	%first = getelementptr inbounds i8, i8* %text, i64 %offset
+	%count = sub i32 %to, %from
+	%size = sext i32 %count to i64
+	%result = call i8* @__Builtin_copy__(i8* %first, i64 %size)
+	ret i8* %result
+}
+
+define i32 @__Builtin_String_compare__(i8* %text, i8* %other) {
+entry:
+	%order = call i32 @strcmp(i8* %text, i8* %other)
+	%after = icmp sgt i32 %order, 0
+	%before = icmp slt i32 %order, 0
+	%a = zext i1 %after to i32
+	%b = zext i1 %before to i32
+	%result = sub i32 %a, %b
+	ret i32 %result
+}
+
+; @__Builtin_parse__ parses an optional - and decimal digits, and nothing
+; else, into an i32, and reports whether it could.
+define private i1 @__Builtin_parse__(i8* %text, i32* %value) {
+entry:
+	%sign = load i8, i8* %text
+	%negative = icmp eq i8 %sign, 45
+	%skip = zext i1 %negative to i64
+	%limit = add i64 2147483647, %skip
+	%digits = getelementptr inbounds i8, i8* %text, i64 %skip
+	%first = load i8, i8* %digits
+	%empty = icmp eq i8 %first, 0
+	br i1 %empty, label %fail, label %loop
+loop:
+	%at = phi i8* [ %digits, %entry ], [ %next, %digit ]
+	%number = phi i64 [ 0, %entry ], [ %sum, %digit ]
+	%c = load i8, i8* %at
+	%end = icmp eq i8 %c, 0
+	br i1 %end, label %done, label %check
+check:
+	%offset = sub i8 %c, 48
+	%isDigit = icmp ult i8 %offset, 10
+	br i1 %isDigit, label %digit, label %fail
+digit:
+	%d = zext i8 %offset to i64
+	%shifted = mul i64 %number, 10
+	%sum = add i64 %shifted, %d
+	%next = getelementptr inbounds i8, i8* %at, i64 1
+	%over = icmp sgt i64 %sum, %limit
+	br i1 %over, label %fail, label %loop
+done:
+	%negated = sub i64 0, %number
+	%signed = select i1 %negative, i64 %negated, i64 %number
+	%result = trunc i64 %signed to i32
+	store i32 %result, i32* %value
+	ret i1 true
+fail:
+	ret i1 false
+}
+
+define i32 @__Builtin_String_parseInt__(i8* %text) {
+entry:
+	%value = alloca i32
+	store i32 0, i32* %value
+	call i1 @__Builtin_parse__(i8* %text, i32* %value)
+	%result = load i32, i32* %value
+	ret i32 %result
+}
+
+define i1 @__Builtin_String_isInt__(i8* %text) {
+entry:
+	%value = alloca i32
+	%result = call i1 @__Builtin_parse__(i8* %text, i32* %value)
+	ret i1 %result
+}
+
+define i32 @__Builtin_Int_abs__(i32 %x) {
+entry:
+	%negative = icmp slt i32 %x, 0
+	%negated = sub i32 0, %x
+	%result = select i1 %negative, i32 %negated, i32 %x
+	ret i32 %result
+}
+
+define i32 @__Builtin_Int_min__(i32 %x, i32 %other) {
+entry:
+	%less = icmp slt i32 %x, %other
+	%result = select i1 %less, i32 %x, i32 %other
+	ret i32 %result
+}
+
+define i32 @__Builtin_Int_max__(i32 %x, i32 %other) {
+entry:
+	%greater = icmp sgt i32 %x, %other
+	%result = select i1 %greater, i32 %x, i32 %other
+	ret i32 %result
+}
+
+define float @__Builtin_Int_toFloat__(i32 %x) {
+entry:
+	%result = sitofp i32 %x to float
+	ret float %result
+}
+
+define i8* @__Builtin_Int_toString__(i32 %x) {
+entry:
+	%result = call i8* @malloc(i64 16)
+	call i32 (i8*, i64, i8*, ...) @snprintf(i8* %result, i64 16, i8* getelementptr inbounds ([3 x i8], [3 x i8]* @.fmt.builtin.int, i32 0, i32 0), i32 %x)
+	ret i8* %result
+}
+
+define float @__Builtin_Float_abs__(float %x) {
+entry:
+	%result = call float @fabsf(float %x)
+	ret float %result
+}
+
+define float @__Builtin_Float_min__(float %x, float %other) {
+entry:
+	%less = fcmp olt float %x, %other
+	%result = select i1 %less, float %x, float %other
+	ret float %result
+}
+
+define float @__Builtin_Float_max__(float %x, float %other) {
+entry:
+	%greater = fcmp ogt float %x, %other
+	%result = select i1 %greater, float %x, float %other
+	ret float %result
+}
+
+define float @__Builtin_Float_sqrt__(float %x) {
+entry:
+	%result = call float @sqrtf(float %x)
+	ret float %result
+}
+
+define float @__Builtin_Float_pow__(float %x, float %exponent) {
+entry:
+	%base = fpext float %x to double
+	%power = fpext float %exponent to double
+	%wide = call double @pow(double %base, double %power)
+	%result = fptrunc double %wide to float
+	ret float %result
+}
+
+define i32 @__Builtin_Float_toInt__(float %x) {
+entry:
+	%result = call i32 @llvm.fptosi.sat.i32.f32(float %x)
+	ret i32 %result
+}
+
+define i8* @__Builtin_Float_toString__(float %x) {
+entry:
+	%wide = fpext float %x to double
+	%format = getelementptr inbounds [3 x i8], [3 x i8]* @.fmt.builtin.float, i32 0, i32 0
+	%length = call i32 (i8*, i64, i8*, ...) @snprintf(i8* null, i64 0, i8* %format, double %wide)
+	%long = sext i32 %length to i64
+	%size = add i64 %long, 1
+	%result = call i8* @malloc(i64 %size)
+	call i32 (i8*, i64, i8*, ...) @snprintf(i8* %result, i64 %size, i8* %format, double %wide)
+	ret i8* %result
+}
+
+define i8* @__Builtin_Bool_toString__(i1 %x) {
+entry:
+	%result = select i1 %x, i8* getelementptr inbounds ([5 x i8], [5 x i8]* @.str.builtin.true, i32 0, i32 0), i8* getelementptr inbounds ([6 x i8], [6 x i8]* @.str.builtin.false, i32 0, i32 0)
+	ret i8* %result
+}
+
+define i1 @__Builtin_Process_hasLine__() {
+entry:
+	%first = call i32 @getchar()
+	%eof = icmp eq i32 %first, -1
+	br i1 %eof, label %none, label %loop
+loop:
+	%c = phi i32 [ %first, %entry ], [ %next, %append ]
+	%length = phi i64 [ 0, %entry ], [ %longer, %append ]
+	%capacity = load i64, i64* @__Builtin_lineCapacity__
+	%needed = add i64 %length, 1
+	%full = icmp uge i64 %needed, %capacity
+	br i1 %full, label %grow, label %write
+grow:
+	%unset = icmp eq i64 %capacity, 0
+	%doubled = mul i64 %capacity, 2
+	%grown = select i1 %unset, i64 64, i64 %doubled
+	store i64 %grown, i64* @__Builtin_lineCapacity__
+	%old = load i8*, i8** @__Builtin_line__
+	%new = call i8* @realloc(i8* %old, i64 %grown)
+	store i8* %new, i8** @__Builtin_line__
+	br label %write
+write:
+	%line = load i8*, i8** @__Builtin_line__
+	%end = icmp eq i32 %c, -1
+	%newline = icmp eq i32 %c, 10
+	%stop = or i1 %end, %newline
+	br i1 %stop, label %done, label %append
+append:
+	%at = getelementptr inbounds i8, i8* %line, i64 %length
+	%byte = trunc i32 %c to i8
+	store i8 %byte, i8* %at
+	%longer = add i64 %length, 1
+	%next = call i32 @getchar()
+	br label %loop
+done:
+	%terminator = getelementptr inbounds i8, i8* %line, i64 %length
+	store i8 0, i8* %terminator
+	ret i1 true
+none:
+	ret i1 false
+}
+
+define i8* @__Builtin_Process_readLine__() {
+entry:
+	%line = load i8*, i8** @__Builtin_line__
+	%length = call i64 @strlen(i8* %line)
+	%result = call i8* @__Builtin_copy__(i8* %line, i64 %length)
+	ret i8* %result
+}
+
+define i32 @__Builtin_Process_argCount__() {
+entry:
+	%argc = load i32, i32* @__Builtin_argc__
+	%any = icmp sgt i32 %argc, 0
+	%count = sub i32 %argc, 1
+	%result = select i1 %any, i32 %count, i32 0
+	ret i32 %result
+}
+
+define i1 @__Builtin_Process_hasArg__(i32 %index) {
+entry:
+	%count = call i32 @__Builtin_Process_argCount__()
+	%positive = icmp sge i32 %index, 0
+	%inside = icmp slt i32 %index, %count
+	%result = and i1 %positive, %inside
+	ret i1 %result
+}
+
+define i8* @__Builtin_Process_arg__(i32 %index) {
+entry:
+	%argv = load i8**, i8*** @__Builtin_argv__
+	%after = add i32 %index, 1
+	%offset = sext i32 %after to i64
+	%at = getelementptr inbounds i8*, i8** %argv, i64 %offset
+	%result = load i8*, i8** %at
+	ret i8* %result
+}
+
+define void @__Builtin_Process_exit__(i32 %code) {
+entry:
+	call void @exit(i32 %code)
+	unreachable
+}
+
+define void @__Builtin_Process_init__(i32 %argc, i8** %argv) {
+entry:
+	store i32 %argc, i32* @__Builtin_argc__
+	store i8** %argv, i8*** @__Builtin_argv__
+	ret void
+}
@@ -0,0 +1,528 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	The runtime of the standard library, as WebAssembly functions named like
+	in C, such as $__Builtin_String_length__, taking the receiver as $x.
+
+	Strings made by the runtime are allocated from a heap starting at the
+	second page of memory, which grows as needed and is never freed. The
+	stack keeps the first page. What wasm cannot do itself is imported from
+	the host, but only when used: read_line, arg_count, arg,
+	float_to_string, pow and exit. Functions returning a string get it from
+	the exported alloc, and write it with its terminating zero.
+*/
+
+const heapStart = 65536
+
+type builtin struct {
+	imports []string // The host functions it calls
+	strings []string // Constants whose addresses fill the verbs of code
+	code    string   // Its locals and instructions
+}
+
+// The signatures of the host functions
+var hostFuncs = map[string]string{
+	"read_line":       "(result i32)",
+	"arg_count":       "(result i32)",
+	"arg":             "(param i32) (result i32)",
+	"float_to_string": "(param f32) (result i32)",
+	"pow":             "(param f64 f64) (result f64)",
+	"exit":            "(param i32)",
+}
+
+var builtins = map[string]builtin{
+	"String.length": {code: `
+local.get $x
+call $__length`},
+
+	"String.concat": {code: `
+(local $length i32)
+(local $otherLength i32)
+(local $result i32)
+local.get $x
+call $__length
+local.set $length
+local.get $other
+call $__length
+local.set $otherLength
+local.get $length
+local.get $otherLength
+i32.add
+i32.const 1
+i32.add
+call $alloc
+local.tee $result
+local.get $x
+local.get $length
+memory.copy
+local.get $result
+local.get $length
+i32.add
+local.get $other
+local.get $otherLength
+i32.const 1
+i32.add
+memory.copy
+local.get $result`},
+
+	"String.substring": {code: `
+(local $length i32)
+local.get $x
+call $__length
+local.set $length
+i32.const 0
+local.get $start
+local.get $start
+i32.const 0
+i32.lt_s
+select
+local.set $start
+local.get $length
+local.get $start
+local.get $start
+local.get $length
+i32.gt_s
+select
+local.set $start
+local.get $start
+local.get $end
+local.get $end
+local.get $start
+i32.lt_s
+select
+local.set $end
+local.get $length
+local.get $end
+local.get $end
+local.get $length
+i32.gt_s
+select
+local.set $end
+local.get $x
+local.get $start
+i32.add
+local.get $end
+local.get $start
+i32.sub
+call $__copy`},
+
+	"String.compare": {code: `
+(local $a i32)
+(local $b i32)
+block $differ
+	block $equal
+		loop $next
+			local.get $x
+			i32.load8_u
+			local.set $a
+			local.get $other
+			i32.load8_u
+			local.set $b
+			local.get $a
+			local.get $b
+			i32.ne
+			br_if $differ
+			local.get $a
+			i32.eqz
+			br_if $equal
+			local.get $x
+			i32.const 1
+			i32.add
+			local.set $x
+			local.get $other
+			i32.const 1
+			i32.add
+			local.set $other
+			br $next
+		end
+	end
+	i32.const 0
+	return
+end
+local.get $a
+local.get $b
+i32.gt_u
+local.get $a
+local.get $b
+i32.lt_u
+i32.sub`},
+
+	"String.parseInt": {code: `
+local.get $x
+call $__parse
+drop
+global.get $__parsed`},
+
+	"String.isInt": {code: `
+local.get $x
+call $__parse`},
+
+	"Int.abs": {code: `
+i32.const 0
+local.get $x
+i32.sub
+local.get $x
+local.get $x
+i32.const 0
+i32.lt_s
+select`},
+
+	"Int.min": {code: `
+local.get $x
+local.get $other
+local.get $x
+local.get $other
+i32.lt_s
+select`},
+
+	"Int.max": {code: `
+local.get $x
+local.get $other
+local.get $x
+local.get $other
+i32.gt_s
+select`},
+
+	"Int.toFloat": {code: `
+local.get $x
+f32.convert_i32_s`},
+
+	"Int.toString": {code: `
+(local $at i32)
+(local $n i32)
+i32.const 12
+call $alloc
+i32.const 11
+i32.add
+local.tee $at
+i32.const 0
+i32.store8
+i32.const 0
+local.get $x
+i32.sub
+local.get $x
+local.get $x
+i32.const 0
+i32.lt_s
+select
+local.set $n
+loop $digit
+	local.get $at
+	i32.const 1
+	i32.sub
+	local.tee $at
+	local.get $n
+	i32.const 10
+	i32.rem_u
+	i32.const 48
+	i32.add
+	i32.store8
+	local.get $n
+	i32.const 10
+	i32.div_u
+	local.tee $n
+	br_if $digit
+end
+block $positive
+	local.get $x
+	i32.const 0
+	i32.ge_s
+	br_if $positive
+	local.get $at
+	i32.const 1
+	i32.sub
+	local.tee $at
+	i32.const 45
+	i32.store8
+end
+local.get $at`},
+
+	"Float.abs": {code: `
+local.get $x
+f32.abs`},
+
+	"Float.min": {code: `
+local.get $x
+local.get $other
+local.get $x
+local.get $other
+f32.lt
+select`},
+
+	"Float.max": {code: `
+local.get $x
+local.get $other
+local.get $x
+local.get $other
+f32.gt
+select`},
+
+	"Float.sqrt": {code: `
+local.get $x
+f32.sqrt`},
+
+	"Float.pow": {imports: []string{"pow"}, code: `
+local.get $x
+f64.promote_f32
+local.get $exponent
+f64.promote_f32
+call $pow
+f32.demote_f64`},
+
+	"Float.toInt": {code: `
+local.get $x
+i32.trunc_sat_f32_s`},
+
+	"Float.toString": {imports: []string{"float_to_string"}, code: `
+local.get $x
+call $float_to_string`},
+
+	"Bool.toString": {strings: []string{"true", "false"}, code: `
+i32.const %d
+i32.const %d
+local.get $x
+select`},
+
+	"Process.hasLine": {imports: []string{"read_line"}, code: `
+call $read_line
+global.set $__line
+global.get $__line
+i32.const 0
+i32.ne`},
+
+	"Process.readLine": {code: `
+global.get $__line`},
+
+	"Process.argCount": {imports: []string{"arg_count"}, code: `
+call $arg_count`},
+
+	"Process.hasArg": {imports: []string{"arg_count"}, code: `
+local.get $index
+call $arg_count
+i32.lt_u`},
+
+	"Process.arg": {imports: []string{"arg"}, code: `
+local.get $index
+call $arg`},
+
+	"Process.exit": {imports: []string{"exit"}, code: `
+local.get $code
+call $exit
+unreachable`},
+}
+
+// The functions the builtins share. $alloc is exported for the host.
+const helpers = `
+(global $heap (mut i32) (i32.const %d))
+(global $__line (mut i32) (i32.const 0))
+(global $__parsed (mut i32) (i32.const 0))
+(func $alloc (export "alloc") (param $size i32) (result i32)
+	(local $address i32)
+	global.get $heap
+	local.set $address
+	global.get $heap
+	local.get $size
+	i32.add
+	global.set $heap
+	block $done
+		loop $grow
+			global.get $heap
+			memory.size
+			i32.const 16
+			i32.shl
+			i32.le_u
+			br_if $done
+			i32.const 1
+			memory.grow
+			i32.const -1
+			i32.ne
+			br_if $grow
+			unreachable
+		end
+	end
+	local.get $address
+)
+(func $__length (param $text i32) (result i32)
+	(local $end i32)
+	local.get $text
+	local.set $end
+	block $done
+		loop $next
+			local.get $end
+			i32.load8_u
+			i32.eqz
+			br_if $done
+			local.get $end
+			i32.const 1
+			i32.add
+			local.set $end
+			br $next
+		end
+	end
+	local.get $end
+	local.get $text
+	i32.sub
+)
+(func $__copy (param $text i32) (param $length i32) (result i32)
+	(local $result i32)
+	local.get $length
+	i32.const 1
+	i32.add
+	call $alloc
+	local.tee $result
+	local.get $text
+	local.get $length
+	memory.copy
+	local.get $result
+	local.get $length
+	i32.add
+	i32.const 0
+	i32.store8
+	local.get $result
+)
+(func $__parse (param $text i32) (result i32)
+	(local $negative i32)
+	(local $limit i32)
+	(local $number i32)
+	(local $digit i32)
+	i32.const 0
+	global.set $__parsed
+	local.get $text
+	i32.load8_u
+	i32.const 45
+	i32.eq
+	local.tee $negative
+	local.get $text
+	i32.add
+	local.set $text
+	i32.const 2147483647
+	local.get $negative
+	i32.add
+	local.set $limit
+	block $fail
+		local.get $text
+		i32.load8_u
+		i32.eqz
+		br_if $fail
+		block $done
+			loop $next
+				local.get $text
+				i32.load8_u
+				local.tee $digit
+				i32.eqz
+				br_if $done
+				local.get $digit
+				i32.const 48
+				i32.sub
+				local.tee $digit
+				i32.const 10
+				i32.ge_u
+				br_if $fail
+				local.get $number
+				local.get $limit
+				local.get $digit
+				i32.sub
+				i32.const 10
+				i32.div_u
+				i32.gt_u
+				br_if $fail
+				local.get $number
+				i32.const 10
+				i32.mul
+				local.get $digit
+				i32.add
+				local.set $number
+				local.get $text
+				i32.const 1
+				i32.add
+				local.set $text
+				br $next
+			end
+		end
+		i32.const 0
+		local.get $number
+		i32.sub
+		local.get $number
+		local.get $negative
+		select
+		global.set $__parsed
+		i32.const 1
+		return
+	end
+	i32.const 0
+)`
+
+// generateImports imports the host functions the builtins of the program
+// call, in the order they are first needed.
+func (ctx *Context) generateImports(used []ir.Builtin) {
+	imported := make(map[string]bool)
+	for _, b := range used {
+		for _, name := range builtins[b.Name].imports {
+			if imported[name] {
+				continue
+			}
+			imported[name] = true
+			ctx.line(fmt.Sprintf("(import \"env\" \"%s\" (func $%s %s))", name, name, hostFuncs[name]))
+		}
+	}
+}
+
+// builtinStrings returns the constants the builtins of the program use.
+func builtinStrings(used []ir.Builtin) []string {
+	var constants []string
+	for _, b := range used {
+		constants = append(constants, builtins[b.Name].strings...)
+	}
+	return constants
+}
+
+// generateBuiltins generates the helpers and a function for each builtin
+// of the program.
+func (ctx *Context) generateBuiltins(used []ir.Builtin) {
+	ctx.lines(fmt.Sprintf(helpers, heapStart))
+	for _, b := range used {
+		definition, ok := builtins[b.Name]
+		if !ok {
+			panic(fmt.Sprintf("cannot generate builtin %s", b.Name))
+		}
+		var params []string
+		if !b.Static() {
+			params = append(params, fmt.Sprintf("(param $x %s)", valueType(b.Receiver())))
+		}
+		for _, param := range b.Params {
+			params = append(params, fmt.Sprintf("(param %s %s)", variable(param), valueType(param.Type)))
+		}
+		if b.Result != "" {
+			params = append(params, fmt.Sprintf("(result %s)", valueType(b.Result)))
+		}
+		ctx.line(fmt.Sprintf("(func $%s %s", ir.BuiltinName(b.Name), strings.Join(params, " ")))
+		code := definition.code
+		if len(definition.strings) > 0 {
+			var addresses []any
+			for _, constant := range definition.strings {
+				addresses = append(addresses, ctx.strings[constant])
+			}
+			code = fmt.Sprintf(code, addresses...)
+		}
+		ctx.tabs += 1
+		ctx.lines(code)
+		ctx.tabs -= 1
+		ctx.line(")")
+	}
+}
+
+// lines writes every line of text but the empty ones at the current depth.
+func (ctx *Context) lines(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" {
+			ctx.line(line)
+		}
+	}
+}
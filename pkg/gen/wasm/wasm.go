@@ -0,0 +1,510 @@
+package wasm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	Text "github.com/linkdotnet/golang-stringbuilder"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Generates WebAssembly text format from the three-address code.
+
+	Int, Bool and String are i32, Float is f32. Strings are null-terminated
+	and live in a data segment. Structs live in linear memory and are
+	referred to by i32 addresses. Struct variables get their own storage in
+	a stack frame, so assigning a struct copies it like in C.
+
+	Methods take the address of their receiver like constructors, followed
+	by their parameters, with structs passed by the address of the caller's
+	copy. A struct is returned by the address of the method's copy, which
+	the caller copies before anything else is placed on the stack.
+
+	Skips are forward jumps, so every label becomes the end of a wasm block
+	opened at the start of the function, nested so a branch to a label is
+	always inside its block.
+
+	A call on an interface value is a call_indirect into a table holding,
+	for each method of the interface, a function for every struct
+	implementing it in the order of their tags. The function passes the
+	address of the field holding the struct on to its method.
+
+	The module imports print_int, print_float, print_bool and print_string
+	from "env" and exports its memory and main. Builtins call the functions
+	of the runtime in builtin.go, generated only for programs using them.
+*/
+
+const dataStart = 8 // Address 0 is left unused
+
+type Context struct {
+	tabs    int
+	sb      *Text.StringBuilder
+	program *ir.Program
+	layouts map[string]*ir.Layout
+	strings map[string]int
+	labels  map[string]bool // The labels passed so far in the current function
+	vtables map[string]int  // The table index of the first function of a method of an interface
+}
+
+func Generate(program *ir.Program) string {
+	sb := Text.StringBuilder{}
+	ctx := Context{
+		sb:      &sb,
+		program: program,
+		layouts: make(map[string]*ir.Layout),
+		strings: make(map[string]int),
+		vtables: make(map[string]int),
+	}
+
+	ctx.line("(module")
+	ctx.tabs += 1
+	ctx.line("(import \"env\" \"print_int\" (func $print_int (param i32)))")
+	ctx.line("(import \"env\" \"print_float\" (func $print_float (param f32)))")
+	ctx.line("(import \"env\" \"print_bool\" (func $print_bool (param i32)))")
+	ctx.line("(import \"env\" \"print_string\" (func $print_string (param i32)))")
+	used := program.UsesBuiltins()
+	ctx.generateImports(used)
+	ctx.line("(memory (export \"memory\") 1)")
+
+	end := ctx.generateData(builtinStrings(used))
+	ctx.line(fmt.Sprintf("(global $sp (mut i32) (i32.const %d))", align(end)))
+	if len(used) > 0 {
+		ctx.generateBuiltins(used)
+	}
+
+	ctx.generateVTables()
+	for _, st := range program.Structs {
+		ctx.generateFunc(st.Constructor, constructorName(st.Name), "(param $self i32)")
+	}
+	for _, method := range program.Methods {
+		ctx.generateFunc(method, methodName(method.Name), signature(method))
+	}
+	ctx.generateFunc(program.Main, "$main", "(export \"main\")")
+
+	ctx.tabs -= 1
+	ctx.line(")")
+	return ctx.sb.ToString()
+}
+
+// generateVTables generates the functions calls on interface values go
+// through, the table holding them and a type for each method. It numbers
+// the functions in the table before the calls are generated.
+func (ctx *Context) generateVTables() {
+	var elements []string
+	for _, st := range ctx.program.Structs {
+		if !st.Interface || len(st.Variants) == 0 {
+			continue
+		}
+		for _, method := range st.Methods {
+			ctx.vtables[method.Name] = len(elements)
+			types := []string{"(param i32)"}
+			for _, param := range method.Params {
+				types = append(types, fmt.Sprintf("(param %s)", valueType(param.Type)))
+			}
+			if method.Result != "" {
+				types = append(types, fmt.Sprintf("(result %s)", valueType(method.Result)))
+			}
+			ctx.line(fmt.Sprintf("(type %s (func %s))", typeName(method.Name), strings.Join(types, " ")))
+			_, lexeme, _ := strings.Cut(method.Name, ".")
+			for _, variant := range st.Variants {
+				name := dispatchName(st.Name, variant+"."+lexeme)
+				elements = append(elements, name)
+				ctx.line(fmt.Sprintf("(func %s (type %s) %s", name, typeName(method.Name), signature(method)))
+				ctx.tabs += 1
+				offset, _ := ir.FieldPath(st.Name, variant, ctx.layout)
+				ctx.pushAddress(ir.Operand{Kind: ir.OperandSelf}, offset)
+				for _, param := range method.Params {
+					ctx.push(param)
+				}
+				ctx.line(fmt.Sprintf("call %s", methodName(variant+"."+lexeme)))
+				ctx.tabs -= 1
+				ctx.line(")")
+			}
+		}
+	}
+	if len(elements) > 0 {
+		ctx.line(fmt.Sprintf("(table %d funcref)", len(elements)))
+		ctx.line(fmt.Sprintf("(elem (i32.const 0) %s)", strings.Join(elements, " ")))
+	}
+}
+
+// generateData places every string constant, and the constants of the
+// runtime, in a data segment and returns the first free address after them.
+func (ctx *Context) generateData(constants []string) int {
+	address := dataStart
+	funcs := []*ir.Func{ctx.program.Main}
+	for _, st := range ctx.program.Structs {
+		funcs = append(funcs, st.Constructor)
+	}
+	funcs = append(funcs, ctx.program.Methods...)
+	var texts []string
+	for _, fn := range funcs {
+		for _, instr := range fn.Code {
+			for _, operand := range append([]ir.Operand{instr.Arg1, instr.Arg2}, instr.Args...) {
+				if operand.Kind == ir.OperandString {
+					texts = append(texts, operand.Lexeme)
+				}
+			}
+		}
+	}
+	for _, text := range append(texts, constants...) {
+		if _, exists := ctx.strings[text]; exists {
+			continue
+		}
+		ctx.strings[text] = address
+		ctx.line(fmt.Sprintf("(data (i32.const %d) \"%s\\00\")", address, escape(text)))
+		address += len(text) + 1
+	}
+	return address
+}
+
+func (ctx *Context) generateFunc(fn *ir.Func, name string, signature string) {
+	ctx.line(fmt.Sprintf("(func %s %s", name, signature))
+	ctx.tabs += 1
+	ctx.labels = make(map[string]bool)
+
+	ctx.line("(local $frame i32)")
+	for _, local := range fn.Locals {
+		ctx.line(fmt.Sprintf("(local %s %s)", variable(local), valueType(local.Type)))
+	}
+
+	ctx.line("global.get $sp")
+	ctx.line("local.set $frame")
+	for _, local := range fn.Locals {
+		if isScalar(local.Type) {
+			continue
+		}
+		ctx.line("global.get $sp")
+		ctx.line(fmt.Sprintf("local.set %s", variable(local)))
+		ctx.line("global.get $sp")
+		ctx.line(fmt.Sprintf("i32.const %d", ctx.layout(local.Type).Size))
+		ctx.line("i32.add")
+		ctx.line("global.set $sp")
+	}
+
+	var labels []string
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpLabel {
+			labels = append(labels, instr.Label)
+		}
+	}
+	for i := len(labels) - 1; i >= 0; i-- {
+		ctx.line(fmt.Sprintf("block $%s", labels[i]))
+		ctx.tabs += 1
+	}
+
+	for _, instr := range fn.Code {
+		ctx.generate(instr)
+	}
+
+	if last := len(fn.Code) - 1; last < 0 || fn.Code[last].Op != ir.OpReturn {
+		ctx.line("local.get $frame")
+		ctx.line("global.set $sp")
+	}
+	ctx.tabs -= 1
+	ctx.line(")")
+}
+
+func (ctx *Context) generate(instr ir.Instr) {
+
+	switch instr.Op {
+
+	case ir.OpCopy:
+		if !isScalar(instr.Dst.Type) {
+			ctx.push(instr.Dst)
+			ctx.push(instr.Arg1)
+			ctx.copyStruct(instr.Dst.Type)
+			return
+		}
+		ctx.push(instr.Arg1)
+		ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+
+	case ir.OpBinary:
+		ctx.push(instr.Arg1)
+		ctx.push(instr.Arg2)
+		ctx.line(binaryInstr(instr.Operator, instr.Arg1.Type))
+		ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+
+	case ir.OpNot:
+		ctx.push(instr.Arg1)
+		ctx.line("i32.eqz")
+		ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+
+	case ir.OpLabel:
+		ctx.tabs -= 1
+		ctx.line(fmt.Sprintf("end ;; %s", instr.Label))
+		ctx.labels[instr.Label] = true
+
+	case ir.OpJump:
+		ctx.checkForward(instr.Label)
+		ctx.line(fmt.Sprintf("br $%s", instr.Label))
+
+	case ir.OpJumpIf:
+		ctx.checkForward(instr.Label)
+		ctx.push(instr.Arg1)
+		ctx.line(fmt.Sprintf("br_if $%s", instr.Label))
+
+	case ir.OpAlloc:
+		ctx.push(instr.Dst)
+		ctx.line(fmt.Sprintf("call %s", constructorName(instr.Dst.Type)))
+
+	case ir.OpLoad:
+		offset, typeHint := ir.FieldPath(instr.Arg1.Type, instr.Field, ctx.layout)
+		if !isScalar(typeHint) {
+			ctx.push(instr.Dst)
+			ctx.pushAddress(instr.Arg1, offset)
+			ctx.copyStruct(typeHint)
+			return
+		}
+		ctx.push(instr.Arg1)
+		ctx.line(fmt.Sprintf("%s.load offset=%d", valueType(typeHint), offset))
+		ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+
+	case ir.OpStore:
+		offset, typeHint := ir.FieldPath(instr.Dst.Type, instr.Field, ctx.layout)
+		if !isScalar(typeHint) {
+			ctx.pushAddress(instr.Dst, offset)
+			ctx.push(instr.Arg1)
+			ctx.copyStruct(typeHint)
+			return
+		}
+		ctx.push(instr.Dst)
+		ctx.push(instr.Arg1)
+		ctx.line(fmt.Sprintf("%s.store offset=%d", valueType(typeHint), offset))
+
+	case ir.OpPrint:
+		ctx.push(instr.Arg1)
+		switch instr.Arg1.Type {
+		case "Int":
+			ctx.line("call $print_int")
+		case "Float":
+			ctx.line("call $print_float")
+		case "Bool":
+			ctx.line("call $print_bool")
+		case "String":
+			ctx.line("call $print_string")
+		default:
+			panic(fmt.Sprintf("cannot print value of type %s", instr.Arg1.Type))
+		}
+
+	case ir.OpCall:
+		structResult := instr.Dst.Kind != ir.OperandZero && !isScalar(instr.Dst.Type)
+		if structResult {
+			ctx.push(instr.Dst)
+		}
+		ctx.push(instr.Arg1)
+		for _, arg := range instr.Args {
+			ctx.push(arg)
+		}
+		if ctx.program.IsInterface(instr.Arg1.Type) {
+			offset, _ := ir.FieldPath(instr.Arg1.Type, "tag", ctx.layout)
+			ctx.push(instr.Arg1)
+			ctx.line(fmt.Sprintf("i32.load offset=%d", offset))
+			ctx.line(fmt.Sprintf("i32.const %d", ctx.vtables[instr.Func]))
+			ctx.line("i32.add")
+			ctx.line(fmt.Sprintf("call_indirect (type %s)", typeName(instr.Func)))
+		} else {
+			ctx.line(fmt.Sprintf("call %s", methodName(instr.Func)))
+		}
+		switch {
+		case structResult:
+			ctx.copyStruct(instr.Dst.Type)
+		case instr.Dst.Kind != ir.OperandZero:
+			ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+		}
+
+	case ir.OpBuiltin:
+		for _, arg := range instr.Args {
+			ctx.push(arg)
+		}
+		ctx.line(fmt.Sprintf("call $%s", ir.BuiltinName(instr.Func)))
+		if instr.Dst.Kind != ir.OperandZero {
+			ctx.line(fmt.Sprintf("local.set %s", variable(instr.Dst)))
+		}
+
+	case ir.OpReturn:
+		ctx.line("local.get $frame")
+		ctx.line("global.set $sp")
+		ctx.push(instr.Arg1)
+		ctx.line("return")
+
+	default:
+		panic(fmt.Sprintf("cannot generate %s", instr))
+	}
+}
+
+func (ctx *Context) checkForward(label string) {
+	if ctx.labels[label] {
+		panic(fmt.Sprintf("cannot generate backward jump to %s", label))
+	}
+}
+
+func (ctx *Context) push(operand ir.Operand) {
+	switch operand.Kind {
+	case ir.OperandTemp, ir.OperandVar:
+		ctx.line(fmt.Sprintf("local.get %s", variable(operand)))
+	case ir.OperandSelf:
+		ctx.line("local.get $self")
+	case ir.OperandInt:
+		ctx.line(fmt.Sprintf("i32.const %d", int32(operand.Number)))
+	case ir.OperandBool:
+		ctx.line(fmt.Sprintf("i32.const %d", operand.Number))
+	case ir.OperandFloat:
+		ctx.line(fmt.Sprintf("f32.const %s", floatLiteral(operand.Float)))
+	case ir.OperandString:
+		ctx.line(fmt.Sprintf("i32.const %d", ctx.strings[operand.Lexeme]))
+	default:
+		panic(fmt.Sprintf("cannot generate operand %s", operand))
+	}
+}
+
+func (ctx *Context) pushAddress(base ir.Operand, offset int) {
+	ctx.push(base)
+	if offset > 0 {
+		ctx.line(fmt.Sprintf("i32.const %d", offset))
+		ctx.line("i32.add")
+	}
+}
+
+// copyStruct copies a struct from the address on top of the stack to the
+// address below it.
+func (ctx *Context) copyStruct(typeHint string) {
+	ctx.line(fmt.Sprintf("i32.const %d", ctx.layout(typeHint).Size))
+	ctx.line("memory.copy")
+}
+
+func (ctx *Context) layout(name string) *ir.Layout {
+	if existing, ok := ctx.layouts[name]; ok {
+		return existing
+	}
+	st, ok := ctx.program.GetStruct(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown struct %s", name))
+	}
+	result := &ir.Layout{
+		Offsets: make(map[string]int),
+		Types:   make(map[string]string),
+	}
+	for _, field := range st.Fields {
+		result.Offsets[field.Lexeme] = result.Size
+		result.Types[field.Lexeme] = field.Type
+		if isScalar(field.Type) {
+			result.Size += 4
+		} else {
+			result.Size += ctx.layout(field.Type).Size
+		}
+	}
+	ctx.layouts[name] = result
+	return result
+}
+
+func binaryInstr(operator string, typeHint string) string {
+	prefix := "i32"
+	if typeHint == "Float" {
+		prefix = "f32"
+	}
+	signed := ""
+	if prefix == "i32" {
+		signed = "_s"
+	}
+	switch operator {
+	case "+":
+		return prefix + ".add"
+	case "-":
+		return prefix + ".sub"
+	case "*":
+		return prefix + ".mul"
+	case "/":
+		return prefix + ".div" + signed
+	case "<":
+		return prefix + ".lt" + signed
+	case ">":
+		return prefix + ".gt" + signed
+	default:
+		panic(fmt.Sprintf("unknown operator %s", operator))
+	}
+}
+
+func variable(operand ir.Operand) string {
+	return "$" + operand.String()
+}
+
+func constructorName(structName string) string {
+	return fmt.Sprintf("$__Construct_%s__", structName)
+}
+
+func methodName(qualified string) string {
+	return "$" + qualified
+}
+
+func dispatchName(iface string, method string) string {
+	return fmt.Sprintf("$__Dispatch_%s__%s", iface, method)
+}
+
+func typeName(signature string) string {
+	return fmt.Sprintf("$__Type_%s", signature)
+}
+
+func signature(fn *ir.Func) string {
+	params := []string{"(param $self i32)"}
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("(param %s %s)", variable(param), valueType(param.Type)))
+	}
+	if fn.Result != "" {
+		params = append(params, fmt.Sprintf("(result %s)", valueType(fn.Result)))
+	}
+	return strings.Join(params, " ")
+}
+
+func valueType(typeHint string) string {
+	if typeHint == "Float" {
+		return "f32"
+	}
+	return "i32"
+}
+
+func isScalar(typeHint string) bool {
+	return typeHint == "Int" ||
+		typeHint == "Float" ||
+		typeHint == "Bool" ||
+		typeHint == "String"
+}
+
+func align(address int) int {
+	return (address + 7) &^ 7
+}
+
+func floatLiteral(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "nan"
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 32)
+}
+
+func escape(text string) string {
+	var sb strings.Builder
+	for _, b := range []byte(text) {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			sb.WriteString(fmt.Sprintf("\\%02x", b))
+			continue
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+func (ctx *Context) line(text string) {
+	for i := 0; i < ctx.tabs; i++ {
+		ctx.sb.AppendRune('\t')
+	}
+	ctx.sb.Append(text)
+	ctx.sb.AppendRune('\n')
+}
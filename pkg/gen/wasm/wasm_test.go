@@ -0,0 +1,109 @@
+package wasm
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+	"github.com/magnetenstad/dragon-compiler/pkg/opt"
+)
+
+func TestExamplesAreValid(t *testing.T) {
+	sources, _ := filepath.Glob("../../../examples/*.bip")
+	if len(sources) == 0 {
+		t.Fatal("no examples")
+	}
+	for _, source := range sources {
+		t.Run(filepath.Base(source), func(t *testing.T) {
+			for level := 0; level <= 2; level++ {
+				program := ir.Lower(module.Load(source, nil))
+				opt.Optimize(program, level)
+				if err := validateWat(Generate(program)); err != nil {
+					t.Errorf("-O%d: %s", level, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"wrong operand", "f32.const 1\ni32.const 1\ni32.add\ndrop", "expected i32 on the stack, found f32"},
+		{"empty stack", "i32.add\ndrop", "which is empty"},
+		{"value left", "i32.const 1", "1 values left on the stack"},
+		{"unknown local", "local.get $missing\ndrop", "unknown local $missing"},
+		{"unknown function", "call $missing", "call of the unknown $missing"},
+		{"unknown label", "block $a\nbr $b\nend", "unknown label $b"},
+		{"mismatched end", "block $a\nend $b", "end $b closes $a"},
+		{"unclosed block", "block $a", "unclosed block"},
+		{"immutable global", "i32.const 1\nglobal.set $fixed", "immutable $fixed"},
+		{"bad literal", "i32.const 4294967296\ndrop", "bad i32 literal"},
+		{"bad alignment", "i32.const 0\ni32.load align=8\ndrop", "bad alignment"},
+	}
+	for _, test := range tests {
+		text := "(module\n(memory 1)\n(global $fixed i32 (i32.const 0))\n(func $f\n" + test.body + "\n)\n)"
+		err := validateWat(text)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+
+	for _, text := range []string{
+		"(module (func $f)",
+		"(module (data (i32.const 0) \"x\"))",
+		"(module (memory 1) (data (i32.const 65535) \"xy\"))",
+		"(module (table 1 funcref) (elem (i32.const 0) $missing))",
+		"(module (func $f) (func $f))",
+	} {
+		if err := validateWat(text); err == nil {
+			t.Errorf("%s was accepted", text)
+		}
+	}
+}
+
+func TestValidateAccepts(t *testing.T) {
+	text := `(module
+	(type $binary (func (param i32 i32) (result i32)))
+	(import "env" "log" (func $log (param i32)))
+	(memory (export "memory") 1)
+	(table 1 funcref)
+	(elem (i32.const 0) $add)
+	(global $sp (mut i32) (i32.const 8))
+	(func $add (type $binary) (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		local.get $b
+		i32.add
+	)
+	(func $main (export "main")
+		(local $x i32)
+		block $done
+			loop $next
+				local.get $x
+				i32.const 10
+				i32.ge_s
+				br_if $done
+				local.get $x
+				i32.const 1
+				i32.const 0
+				call_indirect (type $binary)
+				local.set $x
+				br $next
+			end
+		end ;; done
+		local.get $x
+		call $log
+		return
+		i32.add
+		drop
+	)
+)`
+	if err := validateWat(text); err != nil {
+		t.Error(err)
+	}
+}
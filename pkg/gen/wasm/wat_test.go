@@ -0,0 +1,1099 @@
+package wasm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	A validator for the WebAssembly text the backend generates, so the
+	tests need neither wat2wasm nor a runtime.
+
+	It parses the text into s-expressions, collects the types, functions,
+	globals, memories and tables of the module, and checks every function
+	body the way a runtime does when it loads the module: each instruction
+	must find operands of the right types on the stack, refer to locals,
+	globals, functions, types and labels that exist, and leave exactly the
+	results of its block. Only what the backend uses of the text format is
+	supported, so instructions written in folded form are rejected.
+*/
+
+type sexpr struct {
+	atom   string // The token, unless the expression is a list
+	str    bool   // Whether the atom is a string literal
+	list   []*sexpr
+	isList bool
+	line   int
+}
+
+func (e *sexpr) head() string {
+	if !e.isList || len(e.list) == 0 || e.list[0].isList {
+		return ""
+	}
+	return e.list[0].atom
+}
+
+func (e *sexpr) String() string {
+	if !e.isList {
+		return e.atom
+	}
+	var parts []string
+	for _, item := range e.list {
+		parts = append(parts, item.String())
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// parseWat parses text, which must hold a single s-expression.
+func parseWat(text string) (*sexpr, error) {
+	p := watParser{text: text, line: 1}
+	p.skip()
+	if p.pos >= len(p.text) || p.text[p.pos] != '(' {
+		return nil, fmt.Errorf("line %d: expected (", p.line)
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.pos < len(p.text) {
+		return nil, fmt.Errorf("line %d: text after the module", p.line)
+	}
+	return root, nil
+}
+
+type watParser struct {
+	text string
+	pos  int
+	line int
+}
+
+// skip skips white space and comments.
+func (p *watParser) skip() {
+	for p.pos < len(p.text) {
+		switch {
+		case p.text[p.pos] == '\n':
+			p.line++
+			p.pos++
+		case p.text[p.pos] == ' ' || p.text[p.pos] == '\t' || p.text[p.pos] == '\r':
+			p.pos++
+		case strings.HasPrefix(p.text[p.pos:], ";;"):
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.HasPrefix(p.text[p.pos:], "(;"):
+			end := strings.Index(p.text[p.pos:], ";)")
+			if end < 0 {
+				p.pos = len(p.text)
+				return
+			}
+			p.line += strings.Count(p.text[p.pos:p.pos+end], "\n")
+			p.pos += end + 2
+		default:
+			return
+		}
+	}
+}
+
+func (p *watParser) parse() (*sexpr, error) {
+	line := p.line
+	switch p.text[p.pos] {
+	case '(':
+		p.pos++
+		list := &sexpr{isList: true, line: line}
+		for {
+			p.skip()
+			if p.pos >= len(p.text) {
+				return nil, fmt.Errorf("line %d: unclosed (", line)
+			}
+			if p.text[p.pos] == ')' {
+				p.pos++
+				return list, nil
+			}
+			item, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			list.list = append(list.list, item)
+		}
+	case ')':
+		return nil, fmt.Errorf("line %d: unexpected )", line)
+	case '"':
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return &sexpr{atom: value, str: true, line: line}, nil
+	}
+	start := p.pos
+	for p.pos < len(p.text) && !strings.ContainsRune(" \t\r\n()\";", rune(p.text[p.pos])) {
+		p.pos++
+	}
+	return &sexpr{atom: p.text[start:p.pos], line: line}, nil
+}
+
+// parseString returns the bytes of a string literal.
+func (p *watParser) parseString() (string, error) {
+	line := p.line
+	var sb strings.Builder
+	p.pos++
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c == '\n' || c < 0x20:
+			return "", fmt.Errorf("line %d: control character in string", line)
+		case c != '\\':
+			sb.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.text) {
+			break
+		}
+		escaped := p.text[p.pos+1]
+		switch escaped {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '"', '\'', '\\':
+			sb.WriteByte(escaped)
+		default:
+			if p.pos+2 >= len(p.text) {
+				return "", fmt.Errorf("line %d: unclosed string", line)
+			}
+			value, err := strconv.ParseUint(p.text[p.pos+1:p.pos+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("line %d: bad escape in string", line)
+			}
+			sb.WriteByte(byte(value))
+			p.pos++
+		}
+		p.pos += 2
+	}
+	return "", fmt.Errorf("line %d: unclosed string", line)
+}
+
+type funcType struct {
+	params  []string
+	results []string
+}
+
+func (ft funcType) equal(other funcType) bool {
+	return strings.Join(ft.params, " ") == strings.Join(other.params, " ") &&
+		strings.Join(ft.results, " ") == strings.Join(other.results, " ")
+}
+
+type watGlobal struct {
+	valueType string
+	mutable   bool
+}
+
+type watModule struct {
+	types    map[string]funcType
+	funcs    map[string]funcType
+	globals  map[string]watGlobal
+	memories []int // The size of each memory, in pages
+	tables   []int // The size of each table
+	exports  map[string]bool
+}
+
+// validateWat reports the first reason the module in text would not load.
+func validateWat(text string) error {
+	root, err := parseWat(text)
+	if err != nil {
+		return err
+	}
+	if root.head() != "module" {
+		return fmt.Errorf("line %d: expected module", root.line)
+	}
+	m := &watModule{
+		types:   make(map[string]funcType),
+		funcs:   make(map[string]funcType),
+		globals: make(map[string]watGlobal),
+		exports: make(map[string]bool),
+	}
+
+	// The fields may refer to each other in any order, so they are
+	// declared before any is checked, types first since functions refer to
+	// them in their signatures
+	var funcs, data, elems []*sexpr
+	defined := false
+	for _, field := range root.list[1:] {
+		if field.head() != "type" {
+			continue
+		}
+		if err := m.declare(field, &defined); err != nil {
+			return err
+		}
+	}
+	for _, field := range root.list[1:] {
+		if field.head() == "type" {
+			continue
+		}
+		if err := m.declare(field, &defined); err != nil {
+			return err
+		}
+		switch field.head() {
+		case "func":
+			funcs = append(funcs, field)
+		case "data":
+			data = append(data, field)
+		case "elem":
+			elems = append(elems, field)
+		}
+	}
+	for _, field := range data {
+		if err := m.checkData(field); err != nil {
+			return err
+		}
+	}
+	for _, field := range elems {
+		if err := m.checkElem(field); err != nil {
+			return err
+		}
+	}
+	for _, field := range funcs {
+		if err := m.checkFunc(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *watModule) declare(field *sexpr, defined *bool) error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("line %d: %s", field.line, fmt.Sprintf(format, args...))
+	}
+	switch field.head() {
+	case "type":
+		if len(field.list) != 3 || field.list[2].head() != "func" {
+			return fail("expected (type $name (func ...))")
+		}
+		name := field.list[1].atom
+		if _, exists := m.types[name]; exists || !isId(name) {
+			return fail("bad or duplicate type %s", name)
+		}
+		ft, rest, err := m.typeUse(field.list[2].list[1:])
+		if err != nil || len(rest) > 0 {
+			return fail("bad type %s", name)
+		}
+		m.types[name] = ft
+	case "import":
+		if *defined {
+			return fail("import after a definition")
+		}
+		if len(field.list) != 4 || !field.list[1].str || !field.list[2].str || field.list[3].head() != "func" {
+			return fail("expected (import \"module\" \"name\" (func ...))")
+		}
+		return m.declareFunc(field.list[3], false)
+	case "func":
+		*defined = true
+		return m.declareFunc(field, true)
+	case "memory":
+		*defined = true
+		rest, err := m.exportsOf(field.list[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 1 || len(rest) > 2 {
+			return fail("expected (memory min max?)")
+		}
+		pages, err := strconv.Atoi(rest[0].atom)
+		if err != nil || pages > 65536 {
+			return fail("bad memory size %s", rest[0])
+		}
+		m.memories = append(m.memories, pages)
+	case "table":
+		*defined = true
+		if len(field.list) != 3 || field.list[2].atom != "funcref" {
+			return fail("expected (table size funcref)")
+		}
+		size, err := strconv.Atoi(field.list[1].atom)
+		if err != nil {
+			return fail("bad table size %s", field.list[1])
+		}
+		m.tables = append(m.tables, size)
+	case "global":
+		*defined = true
+		if len(field.list) != 4 {
+			return fail("expected (global $name type init)")
+		}
+		name := field.list[1].atom
+		if _, exists := m.globals[name]; exists || !isId(name) {
+			return fail("bad or duplicate global %s", name)
+		}
+		global := watGlobal{valueType: field.list[2].atom}
+		if field.list[2].head() == "mut" && len(field.list[2].list) == 2 {
+			global = watGlobal{valueType: field.list[2].list[1].atom, mutable: true}
+		}
+		if !isValueType(global.valueType) {
+			return fail("bad type of global %s", name)
+		}
+		if err := constant(field.list[3], global.valueType); err != nil {
+			return err
+		}
+		m.globals[name] = global
+	case "data", "elem":
+	default:
+		return fail("unknown field %s", field)
+	}
+	return nil
+}
+
+func (m *watModule) declareFunc(field *sexpr, exports bool) error {
+	if len(field.list) < 2 || !isId(field.list[1].atom) {
+		return fmt.Errorf("line %d: function without a name", field.line)
+	}
+	name := field.list[1].atom
+	if _, exists := m.funcs[name]; exists {
+		return fmt.Errorf("line %d: duplicate function %s", field.line, name)
+	}
+	rest := field.list[2:]
+	if exports {
+		var err error
+		if rest, err = m.exportsOf(rest); err != nil {
+			return err
+		}
+	}
+	ft, _, err := m.typeUse(rest)
+	if err != nil {
+		return fmt.Errorf("line %d: %s: %s", field.line, name, err)
+	}
+	m.funcs[name] = ft
+	return nil
+}
+
+// exportsOf records the inline exports at the start of items and returns
+// the items after them.
+func (m *watModule) exportsOf(items []*sexpr) ([]*sexpr, error) {
+	for len(items) > 0 && items[0].head() == "export" {
+		export := items[0]
+		if len(export.list) != 2 || !export.list[1].str {
+			return nil, fmt.Errorf("line %d: expected (export \"name\")", export.line)
+		}
+		if m.exports[export.list[1].atom] {
+			return nil, fmt.Errorf("line %d: duplicate export %s", export.line, export.list[1].atom)
+		}
+		m.exports[export.list[1].atom] = true
+		items = items[1:]
+	}
+	return items, nil
+}
+
+// typeUse reads the type, params and results at the start of items, and
+// returns the type with the items after them.
+func (m *watModule) typeUse(items []*sexpr) (funcType, []*sexpr, error) {
+	var declared *funcType
+	if len(items) > 0 && items[0].head() == "type" {
+		if len(items[0].list) != 2 {
+			return funcType{}, nil, fmt.Errorf("expected (type $name)")
+		}
+		ft, ok := m.types[items[0].list[1].atom]
+		if !ok {
+			return funcType{}, nil, fmt.Errorf("unknown type %s", items[0].list[1])
+		}
+		declared = &ft
+		items = items[1:]
+	}
+	var ft funcType
+	params, items, err := declarations(items, "param")
+	if err != nil {
+		return funcType{}, nil, err
+	}
+	for _, param := range params {
+		ft.params = append(ft.params, param.valueType)
+	}
+	for len(items) > 0 && items[0].head() == "result" {
+		for _, item := range items[0].list[1:] {
+			if !isValueType(item.atom) {
+				return funcType{}, nil, fmt.Errorf("bad result type %s", item)
+			}
+			ft.results = append(ft.results, item.atom)
+		}
+		items = items[1:]
+	}
+	if declared != nil {
+		if (len(ft.params) > 0 || len(ft.results) > 0) && !ft.equal(*declared) {
+			return funcType{}, nil, fmt.Errorf("params and results differ from the type")
+		}
+		ft = *declared
+	}
+	return ft, items, nil
+}
+
+type declaration struct {
+	name      string
+	valueType string
+}
+
+// declarations reads the params or locals, named like keyword, at the start
+// of items.
+func declarations(items []*sexpr, keyword string) ([]declaration, []*sexpr, error) {
+	var result []declaration
+	for len(items) > 0 && items[0].head() == keyword {
+		list := items[0].list[1:]
+		if len(list) == 2 && isId(list[0].atom) {
+			if !isValueType(list[1].atom) {
+				return nil, nil, fmt.Errorf("bad %s type %s", keyword, list[1])
+			}
+			result = append(result, declaration{list[0].atom, list[1].atom})
+		} else {
+			for _, item := range list {
+				if !isValueType(item.atom) {
+					return nil, nil, fmt.Errorf("bad %s type %s", keyword, item)
+				}
+				result = append(result, declaration{valueType: item.atom})
+			}
+		}
+		items = items[1:]
+	}
+	return result, items, nil
+}
+
+func (m *watModule) checkData(field *sexpr) error {
+	if len(m.memories) == 0 {
+		return fmt.Errorf("line %d: data without a memory", field.line)
+	}
+	if len(field.list) < 2 {
+		return fmt.Errorf("line %d: expected (data offset ...)", field.line)
+	}
+	offset, err := constantOffset(field.list[1])
+	if err != nil {
+		return err
+	}
+	size := 0
+	for _, item := range field.list[2:] {
+		if !item.str {
+			return fmt.Errorf("line %d: expected a string in data", item.line)
+		}
+		size += len(item.atom)
+	}
+	if offset+size > m.memories[0]*65536 {
+		return fmt.Errorf("line %d: data out of memory", field.line)
+	}
+	return nil
+}
+
+func (m *watModule) checkElem(field *sexpr) error {
+	if len(m.tables) == 0 {
+		return fmt.Errorf("line %d: elem without a table", field.line)
+	}
+	if len(field.list) < 2 {
+		return fmt.Errorf("line %d: expected (elem offset ...)", field.line)
+	}
+	offset, err := constantOffset(field.list[1])
+	if err != nil {
+		return err
+	}
+	for _, item := range field.list[2:] {
+		if _, ok := m.funcs[item.atom]; !ok {
+			return fmt.Errorf("line %d: unknown function %s in elem", item.line, item)
+		}
+	}
+	if offset+len(field.list)-2 > m.tables[0] {
+		return fmt.Errorf("line %d: elem out of table", field.line)
+	}
+	return nil
+}
+
+// constant checks that expr is a constant of valueType.
+func constant(expr *sexpr, valueType string) error {
+	if expr.head() != valueType+".const" || len(expr.list) != 2 {
+		return fmt.Errorf("line %d: expected (%s.const value)", expr.line, valueType)
+	}
+	return checkLiteral(valueType, expr.list[1].atom, expr.line)
+}
+
+func constantOffset(expr *sexpr) (int, error) {
+	if err := constant(expr, "i32"); err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseUint(expr.list[1].atom, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("line %d: bad offset %s", expr.line, expr.list[1])
+	}
+	return int(offset), nil
+}
+
+func checkLiteral(valueType string, literal string, line int) error {
+	var err error
+	switch valueType {
+	case "i32":
+		_, err = strconv.ParseInt(literal, 0, 32)
+		if err != nil {
+			_, err = strconv.ParseUint(literal, 0, 32)
+		}
+	case "i64":
+		_, err = strconv.ParseInt(literal, 0, 64)
+		if err != nil {
+			_, err = strconv.ParseUint(literal, 0, 64)
+		}
+	case "f32", "f64":
+		switch strings.TrimLeft(literal, "+-") {
+		case "inf", "nan":
+			return nil
+		}
+		var value float64
+		bits := 32
+		if valueType == "f64" {
+			bits = 64
+		}
+		value, err = strconv.ParseFloat(literal, bits)
+		if err == nil && (math.IsInf(value, 0) || math.IsNaN(value)) {
+			err = fmt.Errorf("out of range")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("line %d: bad %s literal %s", line, valueType, literal)
+	}
+	return nil
+}
+
+func isValueType(name string) bool {
+	return name == "i32" || name == "i64" || name == "f32" || name == "f64"
+}
+
+func isId(name string) bool {
+	if len(name) < 2 || name[0] != '$' {
+		return false
+	}
+	for _, c := range name[1:] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			strings.ContainsRune("!#$%&'*+-./:<=>?@\\^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// The operands and results of the instructions without immediates
+var signatures = func() map[string]funcType {
+	result := map[string]funcType{
+		"nop":         {},
+		"memory.size": {nil, []string{"i32"}},
+		"memory.grow": {[]string{"i32"}, []string{"i32"}},
+		"memory.copy": {[]string{"i32", "i32", "i32"}, nil},
+		"memory.fill": {[]string{"i32", "i32", "i32"}, nil},
+
+		"f32.demote_f64":      {[]string{"f64"}, []string{"f32"}},
+		"f64.promote_f32":     {[]string{"f32"}, []string{"f64"}},
+		"i32.wrap_i64":        {[]string{"i64"}, []string{"i32"}},
+		"i64.extend_i32_s":    {[]string{"i32"}, []string{"i64"}},
+		"i64.extend_i32_u":    {[]string{"i32"}, []string{"i64"}},
+		"i32.reinterpret_f32": {[]string{"f32"}, []string{"i32"}},
+		"f32.reinterpret_i32": {[]string{"i32"}, []string{"f32"}},
+		"i64.reinterpret_f64": {[]string{"f64"}, []string{"i64"}},
+		"f64.reinterpret_i64": {[]string{"i64"}, []string{"f64"}},
+	}
+	for _, t := range []string{"i32", "i64"} {
+		for _, op := range []string{"add", "sub", "mul", "div_s", "div_u", "rem_s", "rem_u",
+			"and", "or", "xor", "shl", "shr_s", "shr_u", "rotl", "rotr"} {
+			result[t+"."+op] = funcType{[]string{t, t}, []string{t}}
+		}
+		for _, op := range []string{"eq", "ne", "lt_s", "lt_u", "gt_s", "gt_u", "le_s", "le_u", "ge_s", "ge_u"} {
+			result[t+"."+op] = funcType{[]string{t, t}, []string{"i32"}}
+		}
+		for _, op := range []string{"clz", "ctz", "popcnt"} {
+			result[t+"."+op] = funcType{[]string{t}, []string{t}}
+		}
+		result[t+".eqz"] = funcType{[]string{t}, []string{"i32"}}
+		for _, f := range []string{"f32", "f64"} {
+			for _, op := range []string{"trunc", "trunc_sat"} {
+				result[t+"."+op+"_"+f+"_s"] = funcType{[]string{f}, []string{t}}
+				result[t+"."+op+"_"+f+"_u"] = funcType{[]string{f}, []string{t}}
+			}
+			result[f+".convert_"+t+"_s"] = funcType{[]string{t}, []string{f}}
+			result[f+".convert_"+t+"_u"] = funcType{[]string{t}, []string{f}}
+		}
+	}
+	for _, t := range []string{"f32", "f64"} {
+		for _, op := range []string{"add", "sub", "mul", "div", "min", "max", "copysign"} {
+			result[t+"."+op] = funcType{[]string{t, t}, []string{t}}
+		}
+		for _, op := range []string{"eq", "ne", "lt", "gt", "le", "ge"} {
+			result[t+"."+op] = funcType{[]string{t, t}, []string{"i32"}}
+		}
+		for _, op := range []string{"abs", "neg", "sqrt", "ceil", "floor", "trunc", "nearest"} {
+			result[t+"."+op] = funcType{[]string{t}, []string{t}}
+		}
+	}
+	return result
+}()
+
+// The natural alignment of the memory instructions, as a power of two, and
+// the type they load or store
+var memoryInstrs = map[string]struct {
+	align     int
+	valueType string
+}{
+	"i32.load": {2, "i32"}, "i32.load8_s": {0, "i32"}, "i32.load8_u": {0, "i32"},
+	"i32.load16_s": {1, "i32"}, "i32.load16_u": {1, "i32"},
+	"i64.load": {3, "i64"}, "f32.load": {2, "f32"}, "f64.load": {3, "f64"},
+	"i32.store": {2, "i32"}, "i32.store8": {0, "i32"}, "i32.store16": {1, "i32"},
+	"i64.store": {3, "i64"}, "f32.store": {2, "f32"}, "f64.store": {3, "f64"},
+}
+
+type control struct {
+	opcode      string // block, loop, if, else or func
+	label       string
+	results     []string
+	height      int
+	unreachable bool
+}
+
+type funcChecker struct {
+	module   *watModule
+	name     string
+	locals   map[string]string
+	indexes  []string // The types of the locals by index
+	results  []string
+	values   []string // The types on the stack, "" when unknown
+	controls []control
+	line     int
+}
+
+func (m *watModule) checkFunc(field *sexpr) error {
+	name := field.list[1].atom
+	rest := field.list[2:]
+	for len(rest) > 0 && rest[0].head() == "export" {
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && rest[0].head() == "type" {
+		rest = rest[1:]
+	}
+	fc := &funcChecker{module: m, name: name, locals: make(map[string]string), results: m.funcs[name].results}
+	params, rest, err := declarations(rest, "param")
+	if err != nil {
+		return fmt.Errorf("line %d: %s: %s", field.line, name, err)
+	}
+	if len(params) == 0 {
+		for _, param := range m.funcs[name].params {
+			params = append(params, declaration{valueType: param})
+		}
+	}
+	for len(rest) > 0 && rest[0].head() == "result" {
+		rest = rest[1:]
+	}
+	locals, body, err := declarations(rest, "local")
+	if err != nil {
+		return fmt.Errorf("line %d: %s: %s", field.line, name, err)
+	}
+	for _, local := range append(params, locals...) {
+		if local.name != "" {
+			if _, exists := fc.locals[local.name]; exists {
+				return fmt.Errorf("line %d: %s: duplicate local %s", field.line, name, local.name)
+			}
+			fc.locals[local.name] = local.valueType
+		}
+		fc.indexes = append(fc.indexes, local.valueType)
+	}
+
+	fc.controls = []control{{opcode: "func", results: fc.results}}
+	for i := 0; i < len(body); i++ {
+		instr := body[i]
+		fc.line = instr.line
+		if instr.isList {
+			return fc.fail("folded instruction %s", instr)
+		}
+		var immediates []*sexpr
+		for i+1 < len(body) && fc.isImmediate(instr.atom, body[i+1], len(immediates)) {
+			immediates = append(immediates, body[i+1])
+			i++
+		}
+		if err := fc.check(instr.atom, immediates); err != nil {
+			return err
+		}
+		if len(fc.controls) == 0 {
+			return fc.fail("end without a block")
+		}
+	}
+	fc.line = field.line
+	if len(fc.controls) != 1 {
+		return fc.fail("unclosed %s", fc.controls[len(fc.controls)-1].opcode)
+	}
+	return fc.end()
+}
+
+// isImmediate tells whether item is the next immediate of opcode, which
+// has count of them so far.
+func (fc *funcChecker) isImmediate(opcode string, item *sexpr, count int) bool {
+	if item.isList {
+		switch opcode {
+		case "block", "loop", "if":
+			return item.head() == "result"
+		case "call_indirect":
+			return item.head() == "type" && count == 0
+		}
+		return false
+	}
+	switch opcode {
+	case "local.get", "local.set", "local.tee", "global.get", "global.set", "call", "br", "br_if",
+		"i32.const", "i64.const", "f32.const", "f64.const":
+		return count == 0
+	case "block", "loop", "if", "else", "end":
+		return count == 0 && strings.HasPrefix(item.atom, "$")
+	}
+	if _, ok := memoryInstrs[opcode]; ok {
+		return strings.HasPrefix(item.atom, "offset=") || strings.HasPrefix(item.atom, "align=")
+	}
+	return false
+}
+
+func (fc *funcChecker) fail(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s: %s", fc.line, fc.name, fmt.Sprintf(format, args...))
+}
+
+func (fc *funcChecker) push(types ...string) {
+	fc.values = append(fc.values, types...)
+}
+
+func (fc *funcChecker) pop(expected string) (string, error) {
+	top := fc.controls[len(fc.controls)-1]
+	if len(fc.values) == top.height {
+		if top.unreachable {
+			return expected, nil
+		}
+		return "", fc.fail("expected %s on the stack, which is empty", orAny(expected))
+	}
+	actual := fc.values[len(fc.values)-1]
+	fc.values = fc.values[:len(fc.values)-1]
+	if actual != "" && expected != "" && actual != expected {
+		return "", fc.fail("expected %s on the stack, found %s", expected, actual)
+	}
+	if actual == "" {
+		return expected, nil
+	}
+	return actual, nil
+}
+
+func (fc *funcChecker) popAll(types []string) error {
+	for i := len(types) - 1; i >= 0; i-- {
+		if _, err := fc.pop(types[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unreachable drops the stack of the current block, whose end cannot be
+// reached from here.
+func (fc *funcChecker) unreachable() {
+	top := &fc.controls[len(fc.controls)-1]
+	fc.values = fc.values[:top.height]
+	top.unreachable = true
+}
+
+// end closes the current block, which must leave exactly its results.
+func (fc *funcChecker) end() error {
+	top := fc.controls[len(fc.controls)-1]
+	if err := fc.popAll(top.results); err != nil {
+		return err
+	}
+	if len(fc.values) != top.height {
+		return fc.fail("%d values left on the stack at the end of %s", len(fc.values)-top.height, top.opcode)
+	}
+	if top.opcode == "if" && len(top.results) > 0 {
+		return fc.fail("if with results but no else")
+	}
+	fc.controls = fc.controls[:len(fc.controls)-1]
+	fc.push(top.results...)
+	return nil
+}
+
+// target returns the types a branch to label takes.
+func (fc *funcChecker) target(label *sexpr) ([]string, error) {
+	depth, err := strconv.Atoi(label.atom)
+	if err != nil {
+		depth = -1
+		for i := len(fc.controls) - 1; i >= 0; i-- {
+			if fc.controls[i].label == label.atom {
+				depth = len(fc.controls) - 1 - i
+				break
+			}
+		}
+	}
+	if depth < 0 || depth >= len(fc.controls) {
+		return nil, fc.fail("unknown label %s", label)
+	}
+	target := fc.controls[len(fc.controls)-1-depth]
+	if target.opcode == "loop" {
+		return nil, nil
+	}
+	return target.results, nil
+}
+
+func (fc *funcChecker) local(index *sexpr) (string, error) {
+	if valueType, ok := fc.locals[index.atom]; ok {
+		return valueType, nil
+	}
+	if i, err := strconv.Atoi(index.atom); err == nil && i >= 0 && i < len(fc.indexes) {
+		return fc.indexes[i], nil
+	}
+	return "", fc.fail("unknown local %s", index)
+}
+
+func (fc *funcChecker) check(opcode string, immediates []*sexpr) error {
+	needs := func(count int) error {
+		if len(immediates) != count {
+			return fc.fail("%s takes %d immediates", opcode, count)
+		}
+		return nil
+	}
+
+	if ft, ok := signatures[opcode]; ok {
+		if err := needs(0); err != nil {
+			return err
+		}
+		if strings.HasPrefix(opcode, "memory.") && len(fc.module.memories) == 0 {
+			return fc.fail("%s without a memory", opcode)
+		}
+		if err := fc.popAll(ft.params); err != nil {
+			return err
+		}
+		fc.push(ft.results...)
+		return nil
+	}
+
+	if instr, ok := memoryInstrs[opcode]; ok {
+		if len(fc.module.memories) == 0 {
+			return fc.fail("%s without a memory", opcode)
+		}
+		for _, immediate := range immediates {
+			key, value, _ := strings.Cut(immediate.atom, "=")
+			number, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return fc.fail("bad %s", immediate)
+			}
+			if key == "align" && (number == 0 || number&(number-1) != 0 || number > 1<<instr.align) {
+				return fc.fail("bad alignment %s", immediate)
+			}
+		}
+		if strings.Contains(opcode, ".store") {
+			if err := fc.popAll([]string{"i32", instr.valueType}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if _, err := fc.pop("i32"); err != nil {
+			return err
+		}
+		fc.push(instr.valueType)
+		return nil
+	}
+
+	switch opcode {
+	case "i32.const", "i64.const", "f32.const", "f64.const":
+		if err := needs(1); err != nil {
+			return err
+		}
+		valueType := strings.TrimSuffix(opcode, ".const")
+		if err := checkLiteral(valueType, immediates[0].atom, fc.line); err != nil {
+			return err
+		}
+		fc.push(valueType)
+
+	case "local.get", "local.set", "local.tee":
+		if err := needs(1); err != nil {
+			return err
+		}
+		valueType, err := fc.local(immediates[0])
+		if err != nil {
+			return err
+		}
+		if opcode != "local.get" {
+			if _, err := fc.pop(valueType); err != nil {
+				return err
+			}
+		}
+		if opcode != "local.set" {
+			fc.push(valueType)
+		}
+
+	case "global.get", "global.set":
+		if err := needs(1); err != nil {
+			return err
+		}
+		global, ok := fc.module.globals[immediates[0].atom]
+		if !ok {
+			return fc.fail("unknown global %s", immediates[0])
+		}
+		if opcode == "global.get" {
+			fc.push(global.valueType)
+			break
+		}
+		if !global.mutable {
+			return fc.fail("global.set of the immutable %s", immediates[0])
+		}
+		if _, err := fc.pop(global.valueType); err != nil {
+			return err
+		}
+
+	case "call":
+		if err := needs(1); err != nil {
+			return err
+		}
+		ft, ok := fc.module.funcs[immediates[0].atom]
+		if !ok {
+			return fc.fail("call of the unknown %s", immediates[0])
+		}
+		if err := fc.popAll(ft.params); err != nil {
+			return err
+		}
+		fc.push(ft.results...)
+
+	case "call_indirect":
+		if err := needs(1); err != nil {
+			return err
+		}
+		if len(fc.module.tables) == 0 {
+			return fc.fail("call_indirect without a table")
+		}
+		ft, _, err := fc.module.typeUse(immediates)
+		if err != nil {
+			return fc.fail("%s", err)
+		}
+		if _, err := fc.pop("i32"); err != nil {
+			return err
+		}
+		if err := fc.popAll(ft.params); err != nil {
+			return err
+		}
+		fc.push(ft.results...)
+
+	case "block", "loop", "if":
+		label := ""
+		var results []string
+		for _, immediate := range immediates {
+			if !immediate.isList {
+				label = immediate.atom
+				continue
+			}
+			for _, item := range immediate.list[1:] {
+				if !isValueType(item.atom) {
+					return fc.fail("bad result type %s", item)
+				}
+				results = append(results, item.atom)
+			}
+		}
+		if opcode == "if" {
+			if _, err := fc.pop("i32"); err != nil {
+				return err
+			}
+		}
+		fc.controls = append(fc.controls, control{opcode: opcode, label: label, results: results, height: len(fc.values)})
+
+	case "else":
+		top := fc.controls[len(fc.controls)-1]
+		if top.opcode != "if" {
+			return fc.fail("else without if")
+		}
+		if len(immediates) > 0 && immediates[0].atom != top.label {
+			return fc.fail("else %s closes %s", immediates[0], blockName(top))
+		}
+		if err := fc.popAll(top.results); err != nil {
+			return err
+		}
+		if len(fc.values) != top.height {
+			return fc.fail("%d values left on the stack at else", len(fc.values)-top.height)
+		}
+		fc.controls[len(fc.controls)-1] = control{opcode: "else", label: top.label, results: top.results, height: top.height}
+
+	case "end":
+		top := fc.controls[len(fc.controls)-1]
+		if top.opcode == "func" {
+			return fc.fail("end outside a block")
+		}
+		if len(immediates) > 0 && immediates[0].atom != top.label {
+			return fc.fail("end %s closes %s", immediates[0], blockName(top))
+		}
+		return fc.end()
+
+	case "br", "br_if":
+		if err := needs(1); err != nil {
+			return err
+		}
+		if opcode == "br_if" {
+			if _, err := fc.pop("i32"); err != nil {
+				return err
+			}
+		}
+		types, err := fc.target(immediates[0])
+		if err != nil {
+			return err
+		}
+		if err := fc.popAll(types); err != nil {
+			return err
+		}
+		if opcode == "br" {
+			fc.unreachable()
+			break
+		}
+		fc.push(types...)
+
+	case "return":
+		if err := needs(0); err != nil {
+			return err
+		}
+		if err := fc.popAll(fc.results); err != nil {
+			return err
+		}
+		fc.unreachable()
+
+	case "unreachable":
+		if err := needs(0); err != nil {
+			return err
+		}
+		fc.unreachable()
+
+	case "drop":
+		if err := needs(0); err != nil {
+			return err
+		}
+		if _, err := fc.pop(""); err != nil {
+			return err
+		}
+
+	case "select":
+		if err := needs(0); err != nil {
+			return err
+		}
+		if _, err := fc.pop("i32"); err != nil {
+			return err
+		}
+		second, err := fc.pop("")
+		if err != nil {
+			return err
+		}
+		first, err := fc.pop(second)
+		if err != nil {
+			return err
+		}
+		fc.push(first)
+
+	default:
+		return fc.fail("unknown instruction %s", opcode)
+	}
+	return nil
+}
+
+func blockName(c control) string {
+	if c.label == "" {
+		return "an unlabeled " + c.opcode
+	}
+	return c.label
+}
+
+func orAny(name string) string {
+	if name == "" {
+		return "a value"
+	}
+	return name
+}
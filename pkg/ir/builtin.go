@@ -0,0 +1,148 @@
+package ir
+
+import "strings"
+
+/*
+	The standard library is built into every backend. Its functions are
+	called like methods on values of the built-in types, like
+	text.length() or 2.max(other 5), or on Process for what a program gets
+	from the outside, like Process.readLine(). Calls are checked against the
+	registry below, and become OpBuiltin instructions with the receiver, if
+	any, as their first argument.
+
+	The functions only take and return Int, Float, Bool and String, so
+	backends deal with nothing else. A function with an optional result,
+	like String.parseInt, is lowered to a hidden function telling whether
+	there is a value, and the function giving it, which is only called then.
+
+	Strings are bytes: length and substring count bytes, and compare orders
+	by them. substring clamps its indexes to the string, and gives "" when
+	end is not after start. parseInt takes an optional - and decimal digits,
+	and nothing else, and is none when the number does not fit an Int.
+	Int.abs wraps around for the smallest Int. Float.toInt truncates and
+	saturates, giving 0 for NaN. Float.min and Float.max give other when
+	either is NaN. toString formats a Float like print, with six decimals.
+	Float.pow computes in double precision, so it rounds the same on every
+	backend.
+
+	Process.readLine gives the next line of the standard input without its
+	newline, or none at its end. Process.hasLine reads the line, which
+	readLine then returns. Process.arg(index 0) is the first argument after
+	the program, and Process.exit ends the program with an exit code.
+*/
+
+type Builtin struct {
+	Name    string    // Like String.length or Process.exit
+	Params  []Operand // The parameters after the receiver
+	Result  string    // The type of the value returned, if any, which may be optional
+	Present string    // For an optional result, the function telling whether there is a value
+	Hidden  bool      // Only called by lowering
+}
+
+// Receiver returns the type the function is called on, like String.
+func (builtin Builtin) Receiver() string {
+	receiver, _, _ := strings.Cut(builtin.Name, ".")
+	return receiver
+}
+
+// Static reports whether the function is called on a type rather than a
+// value, like Process.exit.
+func (builtin Builtin) Static() bool {
+	return builtin.Receiver() == "Process"
+}
+
+// Types returns the type of the receiver, if any, followed by those of the
+// parameters, which are the types of the arguments of an OpBuiltin.
+func (builtin Builtin) Types() []string {
+	var types []string
+	if !builtin.Static() {
+		types = append(types, builtin.Receiver())
+	}
+	for _, param := range builtin.Params {
+		types = append(types, param.Type)
+	}
+	return types
+}
+
+// BuiltinName returns the function the backends give a builtin, like
+// __Builtin_String_length__ for String.length.
+func BuiltinName(name string) string {
+	return "__Builtin_" + strings.ReplaceAll(name, ".", "_") + "__"
+}
+
+func param(lexeme string, typeHint string) Operand {
+	return Operand{Kind: OperandVar, Lexeme: lexeme, Type: typeHint}
+}
+
+// Builtins is the registry of the standard library. Bytecode refers to the
+// functions by name, so they may be reordered.
+var Builtins = []Builtin{
+	{Name: "String.length", Result: "Int"},
+	{Name: "String.concat", Params: []Operand{param("other", "String")}, Result: "String"},
+	{Name: "String.substring", Params: []Operand{param("start", "Int"), param("end", "Int")}, Result: "String"},
+	{Name: "String.compare", Params: []Operand{param("other", "String")}, Result: "Int"},
+	{Name: "String.parseInt", Result: "Int?", Present: "String.isInt"},
+	{Name: "String.isInt", Result: "Bool", Hidden: true},
+
+	{Name: "Int.abs", Result: "Int"},
+	{Name: "Int.min", Params: []Operand{param("other", "Int")}, Result: "Int"},
+	{Name: "Int.max", Params: []Operand{param("other", "Int")}, Result: "Int"},
+	{Name: "Int.toFloat", Result: "Float"},
+	{Name: "Int.toString", Result: "String"},
+
+	{Name: "Float.abs", Result: "Float"},
+	{Name: "Float.min", Params: []Operand{param("other", "Float")}, Result: "Float"},
+	{Name: "Float.max", Params: []Operand{param("other", "Float")}, Result: "Float"},
+	{Name: "Float.sqrt", Result: "Float"},
+	{Name: "Float.pow", Params: []Operand{param("exponent", "Float")}, Result: "Float"},
+	{Name: "Float.toInt", Result: "Int"},
+	{Name: "Float.toString", Result: "String"},
+
+	{Name: "Bool.toString", Result: "String"},
+
+	{Name: "Process.readLine", Result: "String?", Present: "Process.hasLine"},
+	{Name: "Process.hasLine", Result: "Bool", Hidden: true},
+	{Name: "Process.argCount", Result: "Int"},
+	{Name: "Process.arg", Params: []Operand{param("index", "Int")}, Result: "String?", Present: "Process.hasArg"},
+	{Name: "Process.hasArg", Params: []Operand{param("index", "Int")}, Result: "Bool", Hidden: true},
+	{Name: "Process.exit", Params: []Operand{param("code", "Int")}},
+}
+
+// GetBuiltin returns the function of the standard library with the given
+// name, like String.length, including the hidden ones.
+func GetBuiltin(name string) (Builtin, bool) {
+	for _, builtin := range Builtins {
+		if builtin.Name == name {
+			return builtin, true
+		}
+	}
+	return Builtin{}, false
+}
+
+// GetBuiltinMethod returns the function of the standard library called by
+// a call with the given name on a value of a type, like length on a String.
+// Hidden functions are never called that way.
+func GetBuiltinMethod(typeHint string, lexeme string) (Builtin, bool) {
+	builtin, ok := GetBuiltin(typeHint + "." + lexeme)
+	return builtin, ok && !builtin.Hidden
+}
+
+// UsesBuiltins returns the functions of the standard library the program
+// calls, in the order of the registry, so backends only emit what is used.
+func (program *Program) UsesBuiltins() []Builtin {
+	used := make(map[string]bool)
+	for _, fn := range program.Funcs() {
+		for _, instr := range fn.Code {
+			if instr.Op == OpBuiltin {
+				used[instr.Func] = true
+			}
+		}
+	}
+	var builtins []Builtin
+	for _, builtin := range Builtins {
+		if used[builtin.Name] {
+			builtins = append(builtins, builtin)
+		}
+	}
+	return builtins
+}
@@ -0,0 +1,52 @@
+package ir
+
+import (
+	"math"
+)
+
+// Evaluate computes a binary operation on two constants. Ints are 32-bit
+// two's complement and wrap around on overflow, like int in the generated
+// C. Operations that would trap or be undefined at runtime are not folded.
+func Evaluate(operator string, a Operand, b Operand) (Operand, bool) {
+	if a.Kind == OperandInt && b.Kind == OperandInt {
+		x, y := int32(a.Number), int32(b.Number)
+		switch operator {
+		case "+":
+			return NewInt(int(x + y)), true
+		case "-":
+			return NewInt(int(x - y)), true
+		case "*":
+			return NewInt(int(x * y)), true
+		case "/":
+			if y == 0 || (x == math.MinInt32 && y == -1) {
+				return Operand{}, false
+			}
+			return NewInt(int(x / y)), true
+		case "<":
+			return NewBool(x < y), true
+		case ">":
+			return NewBool(x > y), true
+		}
+	}
+	if a.Kind == OperandFloat && b.Kind == OperandFloat {
+		x, y := float32(a.Float), float32(b.Float)
+		switch operator {
+		case "+":
+			return NewFloat(float64(x + y)), true
+		case "-":
+			return NewFloat(float64(x - y)), true
+		case "*":
+			return NewFloat(float64(x * y)), true
+		case "/":
+			if y == 0 {
+				return Operand{}, false
+			}
+			return NewFloat(float64(x / y)), true
+		case "<":
+			return NewBool(x < y), true
+		case ">":
+			return NewBool(x > y), true
+		}
+	}
+	return Operand{}, false
+}
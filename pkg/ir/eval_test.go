@@ -0,0 +1,55 @@
+package ir
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		operator string
+		a, b     Operand
+		want     Operand
+	}{
+		{"+", NewInt(2), NewInt(3), NewInt(5)},
+		{"-", NewInt(2), NewInt(3), NewInt(-1)},
+		{"*", NewInt(-4), NewInt(3), NewInt(-12)},
+		{"/", NewInt(7), NewInt(2), NewInt(3)},
+		{"/", NewInt(-7), NewInt(2), NewInt(-3)},
+		{"<", NewInt(2), NewInt(3), NewBool(true)},
+		{">", NewInt(2), NewInt(3), NewBool(false)},
+		{"+", NewInt(math.MaxInt32), NewInt(1), NewInt(math.MinInt32)},
+		{"-", NewInt(math.MinInt32), NewInt(1), NewInt(math.MaxInt32)},
+		{"*", NewInt(65536), NewInt(65536), NewInt(0)},
+		{"*", NewInt(math.MinInt32), NewInt(-1), NewInt(math.MinInt32)},
+		{"+", NewFloat(0.5), NewFloat(0.25), NewFloat(0.75)},
+		{"/", NewFloat(1), NewFloat(4), NewFloat(0.25)},
+		{"<", NewFloat(0.5), NewFloat(0.25), NewBool(false)},
+	}
+	for _, test := range tests {
+		got, ok := Evaluate(test.operator, test.a, test.b)
+		if !ok {
+			t.Errorf("%s %s %s was not folded", test.a, test.operator, test.b)
+		} else if got != test.want {
+			t.Errorf("%s %s %s = %s, want %s", test.a, test.operator, test.b, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateDoesNotFold(t *testing.T) {
+	tests := []struct {
+		operator string
+		a, b     Operand
+	}{
+		{"/", NewInt(1), NewInt(0)},
+		{"/", NewInt(0), NewInt(0)},
+		{"/", NewInt(math.MinInt32), NewInt(-1)},
+		{"/", NewFloat(1), NewFloat(0)},
+		{"+", NewInt(1), NewFloat(1)},
+	}
+	for _, test := range tests {
+		if got, ok := Evaluate(test.operator, test.a, test.b); ok {
+			t.Errorf("%s %s %s was folded to %s", test.a, test.operator, test.b, got)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+)
+
+/*
+	Generic structs and methods are monomorphized. A generic declaration is
+	a template that is never lowered itself. Each instantiation, like
+	Pair[Int, String], copies it with the type parameters replaced by the
+	type arguments and gets a name of its own, like Pair_3Int_6String, and
+	a generic method like Box.pair[U] called with a String gets one like
+	Box.pair_6String. Each type argument is prefixed with its length, so
+	arguments with underscores cannot run into each other, and since names
+	cannot contain digits, no declaration can have the name of an
+	instantiation. The copies replace the templates in the copy of the
+	AST the program keeps, and the type hints and constructors referring to
+	them are renamed, so backends generating from it see only the
+	instantiations.
+
+	Type arguments written out, like in a field of type Box[Int], are
+	instantiated before anything is declared. A constructor without them,
+	like Pair(first 1 second "x"), and a call of a generic method infer them
+	from the types of their arguments while lowering, and their
+	instantiations are declared right away and lowered after everything
+	else. Errors in an instantiation tell where it was needed, and write it
+	like in the source, like Pair[Int, String].
+*/
+
+const maxInstantiationDepth = 32
+
+// An instantiation of a generic struct, for inferring type arguments from
+// values of it
+type instance struct {
+	template  string
+	arguments []string
+}
+
+// The declarations of an instantiation left to check and declare once the
+// instantiations it needs are declared
+type pending struct {
+	st      *Struct
+	methods []*ast.Node
+}
+
+// collectGenerics takes the generic structs and methods out of the AST,
+// keeping them as templates, and checks their type parameters.
+func (lw *lowering) collectGenerics() {
+	interfaces := make(map[string]bool)
+	for _, declaration := range lw.root.Declarations {
+		if declaration.Type == ast.TypeInterfaceDeclaration {
+			interfaces[declaration.Lexeme] = true
+		}
+	}
+	checkParameters := func(node *ast.Node) {
+		seen := make(map[string]bool)
+		for _, parameter := range node.TypeParameters {
+			if seen[parameter.Lexeme] {
+				panic(fmt.Sprintf("%s has the type parameter %s twice, at line %d",
+					node.Lexeme, parameter.Lexeme, parameter.Line))
+			}
+			seen[parameter.Lexeme] = true
+			if parameter.TypeHint != "" && !interfaces[parameter.TypeHint] {
+				panic(fmt.Sprintf("%s of %s must implement %s, which is not an interface, at line %d",
+					parameter.Lexeme, node.Lexeme, parameter.TypeHint, parameter.Line))
+			}
+		}
+	}
+
+	var declarations []*ast.Node
+	for _, declaration := range lw.root.Declarations {
+		if len(declaration.TypeParameters) == 0 {
+			declarations = append(declarations, declaration)
+			continue
+		}
+		if _, exists := lw.generics[declaration.Lexeme]; exists {
+			panic(fmt.Sprintf("%s is already declared", declaration.Lexeme))
+		}
+		checkParameters(declaration)
+		lw.generics[declaration.Lexeme] = declaration
+	}
+	for _, declaration := range declarations {
+		if _, exists := lw.generics[declaration.Lexeme]; exists {
+			panic(fmt.Sprintf("%s is already declared", declaration.Lexeme))
+		}
+	}
+	lw.root.Declarations = declarations
+
+	var methods []*ast.Node
+	for _, method := range lw.root.Methods {
+		receiver, _, _ := strings.Cut(method.Lexeme, ".")
+		checkParameters(method)
+		if _, ok := lw.generics[receiver]; ok {
+			lw.genericMethods[receiver] = append(lw.genericMethods[receiver], method)
+		} else if len(method.TypeParameters) > 0 {
+			lw.addMethodTemplate(method, lw.root.Methods)
+		} else {
+			methods = append(methods, method)
+		}
+	}
+	lw.root.Methods = methods
+}
+
+// addMethodTemplate keeps a generic method of a struct that is not
+// generic, or of an instantiation, until it is called.
+func (lw *lowering) addMethodTemplate(method *ast.Node, methods []*ast.Node) {
+	for _, other := range methods {
+		if other != method && other.Lexeme == method.Lexeme {
+			panic(fmt.Sprintf("%s is already declared", method.Lexeme))
+		}
+	}
+	if _, exists := lw.methodTemplates[method.Lexeme]; exists {
+		panic(fmt.Sprintf("%s is already declared", method.Lexeme))
+	}
+	lw.methodTemplates[method.Lexeme] = method
+}
+
+// resolve instantiates the generic structs named with type arguments in
+// the type hints and constructors of a node and its children, and renames
+// them to their instantiations.
+func (lw *lowering) resolve(node *ast.Node) {
+	if node.TypeHint != "" {
+		node.TypeHint = lw.resolveType(node.TypeHint, node.Line)
+	}
+	if node.Type == ast.TypeConstructor && strings.Contains(node.Lexeme, "[") {
+		node.Lexeme = lw.resolveType(node.Lexeme, node.Line)
+	}
+	for _, child := range node.Children {
+		lw.resolve(child)
+	}
+}
+
+func (lw *lowering) resolveType(typeHint string, line int) string {
+	if inner, optional := strings.CutSuffix(typeHint, "?"); optional {
+		return lw.optional(lw.resolveType(inner, line), line)
+	}
+	name, arguments := splitType(typeHint)
+	template, generic := lw.generics[name]
+	if !generic {
+		if arguments != nil {
+			panic(fmt.Sprintf("%s is not generic and takes no type arguments, at line %d", name, line))
+		}
+		return typeHint
+	}
+	if arguments == nil {
+		panic(fmt.Sprintf("%s needs type arguments, like %s[Int], at line %d", name, name, line))
+	}
+	for i, argument := range arguments {
+		arguments[i] = lw.resolveType(argument, line)
+	}
+	return lw.instantiate(template, arguments, line)
+}
+
+// instantiate returns the name of the instantiation of a generic struct
+// with the given type arguments, copying the struct and its methods the
+// first time.
+func (lw *lowering) instantiate(template *ast.Node, arguments []string, line int) string {
+	key := instanceKey(template.Lexeme, arguments)
+	if name, exists := lw.instantiations[key]; exists {
+		return name
+	}
+	types := lw.bind(template, arguments, line)
+	name := mangle(template.Lexeme, arguments)
+	lw.instantiations[key] = name
+	lw.instances[name] = instance{template: template.Lexeme, arguments: arguments}
+	lw.origins[name] = line
+
+	lw.enter(name, line)
+	node := substitute(template, types)
+	node.Lexeme = name
+	node.TypeParameters = nil
+	lw.resolve(node)
+	var methods []*ast.Node
+	for _, method := range lw.genericMethods[template.Lexeme] {
+		method = substitute(method, types)
+		_, lexeme, _ := strings.Cut(method.Lexeme, ".")
+		method.Lexeme = name + "." + lexeme
+		if len(method.TypeParameters) > 0 {
+			lw.addMethodTemplate(method, methods)
+			continue
+		}
+		lw.resolve(method)
+		methods = append(methods, method)
+	}
+	lw.root.Declarations = append(lw.root.Declarations, node)
+	if lw.declared {
+		lw.declareStruct(node)
+		st := lw.program.Structs[len(lw.program.Structs)-1]
+		lw.pending = append(lw.pending, pending{st: st, methods: methods})
+	} else {
+		lw.root.Methods = append(lw.root.Methods, methods...)
+	}
+	lw.leave()
+	return name
+}
+
+// instantiateMethod returns the name of the instantiation of a generic
+// method for the type arguments inferred from the arguments of a call.
+func (lw *lowering) instantiateMethod(template *ast.Node, values map[string]Operand, line int) string {
+	receiver, lexeme, _ := strings.Cut(template.Lexeme, ".")
+	types := make(map[string]string)
+	for _, parameter := range template.Parameters() {
+		if value, ok := values[parameter.Lexeme]; ok {
+			lw.unify(template, parameter.TypeHint, value.Type, types, line)
+		}
+	}
+	arguments := lw.inferred(template, types, line)
+	key := instanceKey(template.Lexeme, arguments)
+	if name, exists := lw.instantiations[key]; exists {
+		return name
+	}
+	types = lw.bind(template, arguments, line)
+	name := mangle(lexeme, arguments)
+	lw.instantiations[key] = name
+	lw.instances[receiver+"."+name] = instance{template: template.Lexeme, arguments: arguments}
+	lw.origins[receiver+"."+name] = line
+
+	lw.enter(receiver+"."+name, line)
+	method := substitute(template, types)
+	method.Lexeme = receiver + "." + name
+	method.TypeParameters = nil
+	lw.resolve(method)
+	lw.pending = append(lw.pending, pending{methods: []*ast.Node{method}})
+	lw.leave()
+	return name
+}
+
+// instanceKey identifies an instantiation by its template and type
+// arguments, written like Pair[Int, String].
+func instanceKey(template string, arguments []string) string {
+	return template + "[" + strings.Join(arguments, ", ") + "]"
+}
+
+// mangle names an instantiation after its template and type arguments,
+// each prefixed with its length, like Pair_3Int_6String.
+func mangle(template string, arguments []string) string {
+	name := template
+	for _, argument := range arguments {
+		name += fmt.Sprintf("_%d%s", len(argument), argument)
+	}
+	return name
+}
+
+// bind checks the type arguments of an instantiation, which must be types
+// implementing the interfaces their parameters name, and maps each type
+// parameter to its argument.
+func (lw *lowering) bind(template *ast.Node, arguments []string, line int) map[string]string {
+	if len(arguments) != len(template.TypeParameters) {
+		panic(fmt.Sprintf("%s takes %d type arguments, not %d, at line %d",
+			template.Lexeme, len(template.TypeParameters), len(arguments), line))
+	}
+	types := make(map[string]string)
+	for i, parameter := range template.TypeParameters {
+		if !lw.isType(arguments[i]) {
+			panic(fmt.Sprintf("unknown type %s, given as %s of %s at line %d",
+				lw.typeName(arguments[i]), parameter.Lexeme, template.Lexeme, line))
+		}
+		if parameter.TypeHint != "" && !lw.implements(arguments[i], parameter.TypeHint) {
+			panic(fmt.Sprintf("%s does not implement %s, so it cannot be %s of %s, at line %d",
+				lw.typeName(arguments[i]), parameter.TypeHint, parameter.Lexeme, template.Lexeme, line))
+		}
+		types[parameter.Lexeme] = arguments[i]
+	}
+	return types
+}
+
+func (lw *lowering) isType(typeHint string) bool {
+	switch typeHint {
+	case "Int", "Float", "Bool", "String":
+		return true
+	}
+	for _, declaration := range lw.root.Declarations {
+		if declaration.Lexeme == typeHint {
+			return true
+		}
+	}
+	_, ok := lw.instances[typeHint]
+	return ok
+}
+
+// implements reports whether values of a type can be used as the given
+// interface, which only needs the impl declarations.
+func (lw *lowering) implements(typeHint string, iface string) bool {
+	if typeHint == iface {
+		return true
+	}
+	for _, impl := range lw.root.Impls {
+		if impl.Lexeme == iface && impl.TypeHint == typeHint {
+			return true
+		}
+	}
+	return false
+}
+
+// inferConstructor infers the type arguments of a generic struct from the
+// values given for its fields and returns the name of the instantiation.
+func (lw *lowering) inferConstructor(template *ast.Node, node *ast.Node, values []Operand) string {
+	types := make(map[string]string)
+	for i, child := range node.Children {
+		for _, field := range template.Children {
+			if field.Lexeme == child.Lexeme {
+				lw.unify(template, field.TypeHint, values[i].Type, types, node.Line)
+			}
+		}
+	}
+	return lw.instantiate(template, lw.inferred(template, types, node.Line), node.Line)
+}
+
+// unify binds the type parameters in a type hint of a template to the
+// parts of the type of a value they stand for. Types that do not fit are
+// left for the lowering of the instantiation to report.
+func (lw *lowering) unify(template *ast.Node, typeHint string, actual string, types map[string]string, line int) {
+	for _, parameter := range template.TypeParameters {
+		if parameter.Lexeme != typeHint {
+			continue
+		}
+		if bound, ok := types[typeHint]; ok && bound != actual {
+			panic(fmt.Sprintf("%s of %s is both %s and %s, at line %d",
+				lw.typeName(typeHint), template.Lexeme, lw.typeName(bound), lw.typeName(actual), line))
+		}
+		types[typeHint] = actual
+		return
+	}
+	if inner, optional := strings.CutSuffix(typeHint, "?"); optional {
+		// A value of the inner type can be given for an optional
+		if actualInner, ok := lw.optionals[actual]; ok {
+			actual = actualInner
+		}
+		if actual != noneType {
+			lw.unify(template, inner, actual, types, line)
+		}
+		return
+	}
+	name, arguments := splitType(typeHint)
+	inst, ok := lw.instances[actual]
+	if !ok || inst.template != name || len(inst.arguments) != len(arguments) {
+		return
+	}
+	for i, argument := range arguments {
+		lw.unify(template, argument, inst.arguments[i], types, line)
+	}
+}
+
+// inferred returns the inferred type arguments in the order of the type
+// parameters, which must all have been inferred.
+func (lw *lowering) inferred(template *ast.Node, types map[string]string, line int) []string {
+	var arguments []string
+	for _, parameter := range template.TypeParameters {
+		argument, ok := types[parameter.Lexeme]
+		if !ok {
+			panic(fmt.Sprintf("cannot infer %s of %s from the arguments at line %d",
+				parameter.Lexeme, template.Lexeme, line))
+		}
+		arguments = append(arguments, argument)
+	}
+	return arguments
+}
+
+// enter and leave surround an instantiation. Once the outermost one is
+// done, and every struct it needs is declared, the structs are checked
+// and their methods declared.
+func (lw *lowering) enter(name string, line int) {
+	lw.depth += 1
+	if lw.depth > maxInstantiationDepth {
+		panic(fmt.Sprintf("instantiating %s nests type arguments too deep, at line %d", name, line))
+	}
+}
+
+func (lw *lowering) leave() {
+	lw.depth -= 1
+	if lw.depth > 0 {
+		return
+	}
+	for len(lw.pending) > 0 {
+		next := lw.pending[0]
+		lw.pending = lw.pending[1:]
+		if next.st != nil {
+			lw.within(next.st.Name, func() { lw.checkStruct(next.st) })
+		}
+		for _, method := range next.methods {
+			lw.root.Methods = append(lw.root.Methods, method)
+			lw.within(method.Lexeme, func() { lw.declareMethod(method) })
+		}
+	}
+}
+
+// within runs a step of lowering a declaration, adding where it was
+// instantiated to its errors if it is an instantiation, or else the module
+// it comes from if it is imported.
+func (lw *lowering) within(name string, step func()) {
+	line, ok := lw.origins[name]
+	if !ok {
+		receiver, _, _ := strings.Cut(name, ".")
+		line, ok = lw.origins[receiver]
+	}
+	if source := lw.source(name); !ok && source != "" {
+		defer func() {
+			if err := recover(); err != nil {
+				panic(fmt.Sprintf("%v, in %s", err, source))
+			}
+		}()
+	}
+	if !ok {
+		step()
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			panic(fmt.Sprintf("%v, in %s instantiated at line %d", err, lw.memberName(name), line))
+		}
+	}()
+	step()
+}
+
+// substitute copies a node and its children, replacing the type parameters
+// in their type hints and constructors.
+func substitute(node *ast.Node, types map[string]string) *ast.Node {
+	copied := *node
+	copied.TypeHint = substituteType(node.TypeHint, types)
+	if node.Type == ast.TypeConstructor && !strings.Contains(node.Lexeme, ".") {
+		copied.Lexeme = substituteType(node.Lexeme, types)
+	}
+	copied.Children = nil
+	for _, child := range node.Children {
+		copied.Children = append(copied.Children, substitute(child, types))
+	}
+	copied.TypeParameters = nil
+	for _, parameter := range node.TypeParameters {
+		copied.TypeParameters = append(copied.TypeParameters, substitute(parameter, types))
+	}
+	return &copied
+}
+
+// substituteType replaces the names of type parameters in a type hint.
+func substituteType(typeHint string, types map[string]string) string {
+	var sb strings.Builder
+	word := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' }
+	runes := []rune(typeHint)
+	for i := 0; i < len(runes); {
+		if !word(runes[i]) {
+			sb.WriteRune(runes[i])
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && word(runes[i]) {
+			i++
+		}
+		name := string(runes[start:i])
+		if argument, ok := types[name]; ok {
+			name = argument
+		}
+		sb.WriteString(name)
+	}
+	return sb.String()
+}
+
+// splitType splits a type hint like Pair[Int, Box[String]] into the name
+// and the type arguments, which are nil if there are none.
+func splitType(typeHint string) (string, []string) {
+	name, rest, found := strings.Cut(typeHint, "[")
+	if !found {
+		return typeHint, nil
+	}
+	rest = strings.TrimSuffix(rest, "]")
+	var arguments []string
+	depth, start := 0, 0
+	for i, r := range rest {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				arguments = append(arguments, strings.TrimSpace(rest[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return name, append(arguments, strings.TrimSpace(rest[start:]))
+}
@@ -0,0 +1,434 @@
+package ir
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+)
+
+/*
+	A linear three-address code intermediate representation.
+	Sits between the AST and the backends.
+*/
+
+type OperandKind int
+
+const (
+	OperandZero OperandKind = iota
+	OperandTemp
+	OperandVar
+	OperandSelf
+	OperandInt
+	OperandFloat
+	OperandBool
+	OperandString
+)
+
+type Operand struct {
+	Kind    OperandKind
+	Lexeme  string // Name of variables, contents of strings
+	Number  int    // Index of temporaries, value of ints and bools
+	Float   float64
+	Type    string // Int, Float, Bool, String or the name of a struct
+	Version int    // Set by SSA construction, 0 for the original variable
+}
+
+func (operand Operand) IsConstant() bool {
+	return operand.Kind == OperandInt ||
+		operand.Kind == OperandFloat ||
+		operand.Kind == OperandBool ||
+		operand.Kind == OperandString
+}
+
+func (operand Operand) IsVariable() bool {
+	return operand.Kind == OperandTemp || operand.Kind == OperandVar
+}
+
+func (operand Operand) String() string {
+	if operand.Version > 0 && operand.IsVariable() {
+		base := operand
+		base.Version = 0
+		return fmt.Sprintf("%s_%d", base, operand.Version)
+	}
+	switch operand.Kind {
+	case OperandTemp:
+		return fmt.Sprintf("t%d", operand.Number)
+	case OperandVar:
+		return operand.Lexeme
+	case OperandSelf:
+		return "self"
+	case OperandInt:
+		return strconv.Itoa(operand.Number)
+	case OperandFloat:
+		return strconv.FormatFloat(operand.Float, 'g', -1, 64)
+	case OperandBool:
+		if operand.Number != 0 {
+			return "true"
+		}
+		return "false"
+	case OperandString:
+		return strconv.Quote(operand.Lexeme)
+	default:
+		return "_"
+	}
+}
+
+func NewInt(value int) Operand {
+	return Operand{Kind: OperandInt, Number: value, Type: "Int"}
+}
+
+func NewFloat(value float64) Operand {
+	return Operand{Kind: OperandFloat, Float: value, Type: "Float"}
+}
+
+func NewBool(value bool) Operand {
+	operand := Operand{Kind: OperandBool, Type: "Bool"}
+	if value {
+		operand.Number = 1
+	}
+	return operand
+}
+
+func NewString(value string) Operand {
+	return Operand{Kind: OperandString, Lexeme: value, Type: "String"}
+}
+
+type Op int
+
+const (
+	OpZero    Op = iota
+	OpCopy       // Dst = Arg1
+	OpBinary     // Dst = Arg1 Operator Arg2
+	OpNot        // Dst = !Arg1
+	OpLabel      // Label:
+	OpJump       // goto Label
+	OpJumpIf     // if Arg1 goto Label
+	OpAlloc      // Dst = new Dst.Type
+	OpLoad       // Dst = Arg1.Field
+	OpStore      // Dst.Field = Arg1
+	OpPrint      // print Arg1
+	OpPhi        // Dst = phi(Args), with one argument per predecessor
+	OpCall       // Dst = Arg1.Func(Args), where Dst is left out if nothing is returned
+	OpReturn     // return Arg1, the last instruction of a method returning a value
+	OpBuiltin    // Dst = Func(Args), a function of the standard library, where Dst is left out if nothing is returned
+)
+
+type Instr struct {
+	Op       Op
+	Dst      Operand
+	Arg1     Operand
+	Arg2     Operand
+	Args     []Operand
+	Operator string
+	Label    string
+	Field    string // A dotted path of field names
+	Line     int    // The source line the instruction was lowered from
+	Val      bool   // A copy binding Dst with val, which is never assigned again
+	Func     string // The method a call runs, like House.describe, or the builtin, like String.length
+}
+
+func (instr Instr) String() string {
+	switch instr.Op {
+	case OpCopy:
+		if instr.Val {
+			return fmt.Sprintf("val %s = %s", instr.Dst, instr.Arg1)
+		}
+		return fmt.Sprintf("%s = %s", instr.Dst, instr.Arg1)
+	case OpBinary:
+		return fmt.Sprintf("%s = %s %s %s",
+			instr.Dst, instr.Arg1, instr.Operator, instr.Arg2)
+	case OpNot:
+		return fmt.Sprintf("%s = !%s", instr.Dst, instr.Arg1)
+	case OpLabel:
+		return fmt.Sprintf("%s:", instr.Label)
+	case OpJump:
+		return fmt.Sprintf("goto %s", instr.Label)
+	case OpJumpIf:
+		return fmt.Sprintf("if %s goto %s", instr.Arg1, instr.Label)
+	case OpAlloc:
+		return fmt.Sprintf("%s = new %s", instr.Dst, instr.Dst.Type)
+	case OpLoad:
+		return fmt.Sprintf("%s = %s.%s", instr.Dst, instr.Arg1, instr.Field)
+	case OpStore:
+		return fmt.Sprintf("%s.%s = %s", instr.Dst, instr.Field, instr.Arg1)
+	case OpPrint:
+		return fmt.Sprintf("print %s", instr.Arg1)
+	case OpPhi:
+		args := make([]string, len(instr.Args))
+		for i, arg := range instr.Args {
+			args[i] = arg.String()
+		}
+		return fmt.Sprintf("%s = phi(%s)", instr.Dst, strings.Join(args, ", "))
+	case OpCall:
+		args := make([]string, len(instr.Args))
+		for i, arg := range instr.Args {
+			args[i] = arg.String()
+		}
+		_, method, _ := strings.Cut(instr.Func, ".")
+		call := fmt.Sprintf("%s.%s(%s)", instr.Arg1, method, strings.Join(args, ", "))
+		if instr.Dst.Kind == OperandZero {
+			return call
+		}
+		return fmt.Sprintf("%s = %s", instr.Dst, call)
+	case OpReturn:
+		return fmt.Sprintf("return %s", instr.Arg1)
+	case OpBuiltin:
+		args := make([]string, len(instr.Args))
+		for i, arg := range instr.Args {
+			args[i] = arg.String()
+		}
+		call := fmt.Sprintf("%s(%s)", instr.Func, strings.Join(args, ", "))
+		if instr.Dst.Kind == OperandZero {
+			return call
+		}
+		return fmt.Sprintf("%s = %s", instr.Dst, call)
+	default:
+		return "nop"
+	}
+}
+
+// Uses returns the operands read by the instruction.
+func (instr Instr) Uses() []Operand {
+	switch instr.Op {
+	case OpCopy, OpNot, OpJumpIf, OpLoad, OpPrint, OpReturn:
+		return []Operand{instr.Arg1}
+	case OpBinary:
+		return []Operand{instr.Arg1, instr.Arg2}
+	case OpStore:
+		return []Operand{instr.Dst, instr.Arg1}
+	case OpPhi, OpBuiltin:
+		return instr.Args
+	case OpCall:
+		return append([]Operand{instr.Arg1}, instr.Args...)
+	default:
+		return nil
+	}
+}
+
+// Def returns the operand written by the instruction, if any. A store only
+// writes part of its destination and is therefore not a definition.
+func (instr Instr) Def() (Operand, bool) {
+	switch instr.Op {
+	case OpCopy, OpBinary, OpNot, OpAlloc, OpLoad, OpPhi:
+		return instr.Dst, true
+	case OpCall, OpBuiltin:
+		return instr.Dst, instr.Dst.Kind != OperandZero
+	default:
+		return Operand{}, false
+	}
+}
+
+func (instr Instr) IsJump() bool {
+	return instr.Op == OpJump || instr.Op == OpJumpIf
+}
+
+// A Func is main, the constructor of a struct, named after the struct, or
+// a method, named like House.describe. Constructors and methods get the
+// struct as self, and methods may take parameters and return a value.
+// Neither self nor the parameters are ever assigned. A call of a method of
+// an interface, like Shape.area, runs the method of the struct held by the
+// interface value.
+type Func struct {
+	Name     string
+	Receiver string // The struct type of self, if any
+	Params   []Operand
+	Result   string // The type of the value returned, if any
+	Locals   []Operand
+	Code     []Instr
+	Source   string // The .bip file of the imported module it comes from, if any
+	// The variables declared in each block, by the label ending it, for
+	// backends releasing them there
+	Scopes map[string][]Operand
+}
+
+// IsMethod reports whether the function is a method rather than main or a
+// constructor.
+func (fn *Func) IsMethod() bool {
+	return strings.Contains(fn.Name, ".")
+}
+
+// Signature returns the name, the parameters and the result of a method
+// like in the source, as in House.next(by Int) House.
+func (fn *Func) Signature() string {
+	var params []string
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("%s %s", param, param.Type))
+	}
+	signature := fmt.Sprintf("%s(%s)", fn.Name, strings.Join(params, ", "))
+	if len(fn.Result) > 0 {
+		signature += " " + fn.Result
+	}
+	return signature
+}
+
+func (fn *Func) String() string {
+	var sb strings.Builder
+	var params []string
+	if len(fn.Receiver) > 0 {
+		params = append(params, fmt.Sprintf("self *%s", fn.Receiver))
+	}
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("%s %s", param, param.Type))
+	}
+	sb.WriteString(fmt.Sprintf("func %s(%s)", fn.Name, strings.Join(params, ", ")))
+	if len(fn.Result) > 0 {
+		sb.WriteString(" " + fn.Result)
+	}
+	sb.WriteString(" {\n")
+	for _, local := range fn.Locals {
+		sb.WriteString(fmt.Sprintf("\tvar %s %s\n", local, local.Type))
+	}
+	for _, instr := range fn.Code {
+		if instr.Op == OpLabel {
+			sb.WriteString(fmt.Sprintf("%s\n", instr))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\t%s\n", instr))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+type Field struct {
+	Lexeme   string
+	Type     string
+	Readonly bool // Only set by the default value or a constructor argument
+}
+
+type Struct struct {
+	Name        string
+	Fields      []Field
+	Constructor *Func
+	Ref         bool     // Instances are shared references instead of values
+	Variants    []string // The variants of an enum, in the order of their tags
+	Interface   bool     // An interface, whose variants are the structs implementing it
+	Methods     []*Func  // The methods an interface requires, which have no code
+	Optional    bool     // An optional, whose tag is 1 when it holds a value
+}
+
+// An enum is a struct whose first field is the tag, numbering its variants
+// in order. Each variant with fields has a field of its own, named after
+// it, holding a struct like Shape_Circle. Only the field of the variant
+// given by the tag is set, so backends may overlap them.
+//
+// An interface is laid out like an enum whose variants are the structs
+// implementing it, each with a field named after the struct, and is only
+// used through the methods its structs have in common. Its constructor
+// only sets the tag, since a value always comes from one of the structs.
+func (st *Struct) IsEnum() bool {
+	return len(st.Variants) > 0
+}
+
+// Tag returns the tag of a variant, or -1 if the enum has no such variant.
+func (st *Struct) Tag(variant string) int {
+	for i, name := range st.Variants {
+		if name == variant {
+			return i
+		}
+	}
+	return -1
+}
+
+func (st *Struct) GetField(lexeme string) (Field, bool) {
+	for _, field := range st.Fields {
+		if field.Lexeme == lexeme {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+type Program struct {
+	Structs []*Struct
+	Methods []*Func
+	Main    *Func
+	// The AST it was lowered from, with the generic declarations replaced
+	// by their instantiations and the optional types declared
+	Root *ast.RootNode
+}
+
+// Funcs returns the constructors, the methods and main, in that order.
+func (program *Program) Funcs() []*Func {
+	var funcs []*Func
+	for _, st := range program.Structs {
+		funcs = append(funcs, st.Constructor)
+	}
+	funcs = append(funcs, program.Methods...)
+	return append(funcs, program.Main)
+}
+
+// GetMethod returns the method of a struct with the given name, or the
+// signature of the method of an interface.
+func (program *Program) GetMethod(receiver string, lexeme string) (*Func, bool) {
+	for _, method := range program.Methods {
+		if method.Name == receiver+"."+lexeme {
+			return method, true
+		}
+	}
+	if st, ok := program.GetStruct(receiver); ok {
+		for _, method := range st.Methods {
+			if method.Name == receiver+"."+lexeme {
+				return method, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// IsInterface reports whether values of the type are interface values.
+func (program *Program) IsInterface(typeHint string) bool {
+	st, ok := program.GetStruct(typeHint)
+	return ok && st.Interface
+}
+
+func (program *Program) GetStruct(name string) (*Struct, bool) {
+	for _, st := range program.Structs {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+// IsRef reports whether values of the type are references to a ref struct.
+func (program *Program) IsRef(typeHint string) bool {
+	st, ok := program.GetStruct(typeHint)
+	return ok && st.Ref
+}
+
+func (program *Program) String() string {
+	var sb strings.Builder
+	for _, st := range program.Structs {
+		if st.Ref {
+			sb.WriteString("ref ")
+		}
+		if st.Interface {
+			sb.WriteString(fmt.Sprintf("interface %s(%s) {\n", st.Name, strings.Join(st.Variants, ", ")))
+		} else if st.IsEnum() {
+			sb.WriteString(fmt.Sprintf("enum %s(%s) {\n", st.Name, strings.Join(st.Variants, ", ")))
+		} else if st.Optional {
+			sb.WriteString(fmt.Sprintf("optional %s {\n", st.Name))
+		} else {
+			sb.WriteString(fmt.Sprintf("struct %s {\n", st.Name))
+		}
+		for _, field := range st.Fields {
+			sb.WriteString("\t")
+			if field.Readonly {
+				sb.WriteString("readonly ")
+			}
+			sb.WriteString(fmt.Sprintf("%s %s\n", field.Lexeme, field.Type))
+		}
+		for _, method := range st.Methods {
+			sb.WriteString(fmt.Sprintf("\tfn %s\n", method.Signature()))
+		}
+		sb.WriteString("}\n")
+		sb.WriteString(st.Constructor.String())
+	}
+	for _, method := range program.Methods {
+		sb.WriteString(method.String())
+	}
+	sb.WriteString(program.Main.String())
+	return sb.String()
+}
@@ -0,0 +1,23 @@
+package ir
+
+import "strings"
+
+// Layout is where a backend places the fields of a struct in memory.
+type Layout struct {
+	Size    int
+	Align   int               // Left 0 by backends that do not align fields
+	Offsets map[string]int    // From the start of the struct
+	Types   map[string]string // The type of each field
+}
+
+// FieldPath returns the offset and type at the end of a dotted field path,
+// like value.tag, given how the backend lays out each struct.
+func FieldPath(typeHint string, path string, layout func(string) *Layout) (int, string) {
+	offset := 0
+	for _, field := range strings.Split(path, ".") {
+		fields := layout(typeHint)
+		offset += fields.Offsets[field]
+		typeHint = fields.Types[field]
+	}
+	return offset, typeHint
+}
@@ -0,0 +1,1335 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/env"
+)
+
+/*
+	Lowers the AST to three-address code.
+	Every subexpression is evaluated into a temporary before
+	the statement that uses it, so backends never see nesting.
+*/
+
+type lowering struct {
+	program *Program
+	fn      *Func
+	env     *env.Env
+	block   int
+	blocks  int
+	matches int
+	checks  int // The number of ?? and ?. lowered
+	temps   int
+	line    int
+	locals  map[string][]Operand // The locals of each lexeme that variables may share
+	names   map[string]int       // The number of locals named after each lexeme
+	methods map[*Func]*ast.Node  // The declaration of each method, for default arguments
+	result  Operand              // The value returned by the current method
+
+	root            *ast.RootNode
+	generics        map[string]*ast.Node   // The generic structs
+	genericMethods  map[string][]*ast.Node // The methods of each generic struct
+	methodTemplates map[string]*ast.Node   // The generic methods of other structs
+	instances       map[string]instance    // The instantiations by name
+	instantiations  map[string]string      // The name of each instantiation by template and type arguments
+	origins         map[string]int         // The line each instantiation is first needed at
+	optionals       map[string]string      // The inner type of each optional
+	pending         []pending
+	depth           int
+	declared        bool // Whether the declarations have all been declared
+	constructors    int  // The number of constructors lowered
+	bodies          int  // The number of methods lowered
+}
+
+// Lower lowers a program. The AST is left as it is: the generic
+// declarations are replaced with their instantiations in a copy of it,
+// kept as the Root of the program for the backends generating from the AST.
+func Lower(root *ast.RootNode) *Program {
+	root = root.Copy()
+	lw := lowering{
+		program:         &Program{Root: root},
+		methods:         make(map[*Func]*ast.Node),
+		root:            root,
+		generics:        make(map[string]*ast.Node),
+		genericMethods:  make(map[string][]*ast.Node),
+		methodTemplates: make(map[string]*ast.Node),
+		instances:       make(map[string]instance),
+		instantiations:  make(map[string]string),
+		origins:         make(map[string]int),
+		optionals:       make(map[string]string),
+	}
+
+	lw.collectGenerics()
+	for _, impl := range root.Impls {
+		lw.resolve(impl)
+	}
+	for _, declaration := range append([]*ast.Node{}, root.Declarations...) {
+		lw.resolve(declaration)
+	}
+	for _, method := range append([]*ast.Node{}, root.Methods...) {
+		lw.resolve(method)
+	}
+	lw.resolve(root.Node)
+
+	for _, declaration := range root.Declarations {
+		lw.declareStruct(declaration)
+	}
+	for _, impl := range root.Impls {
+		lw.declareImpl(impl)
+	}
+	for _, declaration := range root.Declarations {
+		if declaration.Type == ast.TypeInterfaceDeclaration {
+			lw.declareInterface(declaration)
+		}
+	}
+	for _, st := range lw.program.Structs {
+		lw.checkStruct(st)
+	}
+	for _, declaration := range root.Methods {
+		lw.declareMethod(declaration)
+	}
+	for _, impl := range root.Impls {
+		lw.checkImpl(impl)
+	}
+	lw.declared = true
+	lw.lowerDeclarations()
+
+	lw.beginFunc(&Func{Name: "main"})
+	for _, child := range root.Children {
+		lw.lowerStatement(child)
+	}
+	lw.program.Main = lw.fn
+	lw.lowerDeclarations()
+
+	return lw.program
+}
+
+// lowerDeclarations lowers the constructors and methods not lowered yet,
+// until lowering them instantiates no more structs or methods.
+func (lw *lowering) lowerDeclarations() {
+	for lw.constructors < len(lw.root.Declarations) || lw.bodies < len(lw.root.Methods) {
+		for ; lw.constructors < len(lw.root.Declarations); lw.constructors++ {
+			declaration, st := lw.root.Declarations[lw.constructors], lw.program.Structs[lw.constructors]
+			lw.within(st.Name, func() { lw.lowerConstructor(declaration, st) })
+			st.Constructor.Source = lw.source(st.Name)
+		}
+		for ; lw.bodies < len(lw.root.Methods); lw.bodies++ {
+			declaration, fn := lw.root.Methods[lw.bodies], lw.program.Methods[lw.bodies]
+			lw.within(fn.Name, func() { lw.lowerMethod(declaration, fn) })
+			fn.Source = lw.source(fn.Name)
+		}
+	}
+}
+
+// source returns the .bip file of the imported module a struct or method
+// comes from, which its name starts with the prefix of, if any.
+func (lw *lowering) source(name string) string {
+	for _, module := range lw.root.Modules {
+		if strings.HasPrefix(name, module.Prefix) {
+			return module.Source
+		}
+	}
+	return ""
+}
+
+func (lw *lowering) beginFunc(fn *Func) {
+	globals := env.NewEnv(nil)
+	lw.fn = fn
+	lw.env = &globals
+	lw.block = 0
+	lw.temps = 0
+	lw.locals = make(map[string][]Operand)
+	lw.names = make(map[string]int)
+	lw.result = Operand{}
+}
+
+func (lw *lowering) emit(instr Instr) {
+	instr.Line = lw.line
+	lw.fn.Code = append(lw.fn.Code, instr)
+}
+
+func (lw *lowering) newTemp(typeHint string) Operand {
+	lw.temps += 1
+	temp := Operand{Kind: OperandTemp, Number: lw.temps, Type: typeHint}
+	lw.fn.Locals = append(lw.fn.Locals, temp)
+	return temp
+}
+
+func (lw *lowering) declareStruct(node *ast.Node) {
+	if node.Lexeme == "Process" {
+		panic("Process has the functions of the standard library and cannot be declared")
+	}
+	if _, exists := lw.program.GetStruct(node.Lexeme); exists {
+		panic(fmt.Sprintf("%s is already declared", node.Lexeme))
+	}
+	if node.Type == ast.TypeEnumDeclaration {
+		lw.declareEnum(node)
+		return
+	}
+	if node.Type == ast.TypeOptionalDeclaration {
+		lw.declareOptional(node)
+		return
+	}
+	if node.Type == ast.TypeInterfaceDeclaration {
+		lw.program.Structs = append(lw.program.Structs, &Struct{
+			Name:      node.Lexeme,
+			Fields:    []Field{{Lexeme: "tag", Type: "Int"}},
+			Interface: true,
+		})
+		return
+	}
+	st := &Struct{
+		Name: node.Lexeme,
+		Ref:  node.Type == ast.TypeRefStructDeclaration,
+	}
+	for _, child := range node.Children {
+		st.Fields = append(st.Fields, Field{
+			Lexeme:   child.Lexeme,
+			Type:     child.TypeHint,
+			Readonly: child.Type == ast.TypeReadonlyStructField,
+		})
+	}
+	lw.program.Structs = append(lw.program.Structs, st)
+}
+
+func (lw *lowering) declareEnum(node *ast.Node) {
+	st := &Struct{
+		Name:   node.Lexeme,
+		Fields: []Field{{Lexeme: "tag", Type: "Int"}},
+	}
+	for _, variant := range node.Children {
+		if st.Tag(variant.Lexeme) >= 0 {
+			panic(fmt.Sprintf("%s has the variant %s twice", lw.typeName(st.Name), variant.Lexeme))
+		}
+		st.Variants = append(st.Variants, variant.Lexeme)
+		if variant.TypeHint != "" {
+			st.Fields = append(st.Fields, Field{Lexeme: variant.Lexeme, Type: variant.TypeHint})
+		}
+	}
+	if !st.IsEnum() {
+		panic(fmt.Sprintf("%s has no variants", lw.typeName(st.Name)))
+	}
+	lw.program.Structs = append(lw.program.Structs, st)
+}
+
+// declareImpl adds a struct to the variants of an interface it implements.
+// Interface values are copied like structs, so neither enums nor ref
+// structs, which are shared, can implement one.
+func (lw *lowering) declareImpl(node *ast.Node) {
+	iface, ok := lw.program.GetStruct(node.Lexeme)
+	if !ok || !iface.Interface {
+		panic(fmt.Sprintf("cannot implement %s, it is not an interface, at line %d", node.Lexeme, node.Line))
+	}
+	st, ok := lw.program.GetStruct(node.TypeHint)
+	if !ok {
+		panic(fmt.Sprintf("unknown struct %s, at line %d", lw.typeName(node.TypeHint), node.Line))
+	}
+	if st.Interface || st.IsEnum() || st.Optional {
+		panic(fmt.Sprintf("%s cannot implement %s, only structs can, at line %d",
+			lw.typeName(st.Name), lw.typeName(iface.Name), node.Line))
+	}
+	if st.Ref {
+		panic(fmt.Sprintf("%s cannot implement %s, it is a ref struct and interface values are copied, at line %d",
+			lw.typeName(st.Name), lw.typeName(iface.Name), node.Line))
+	}
+	if iface.Tag(st.Name) >= 0 {
+		panic(fmt.Sprintf("%s already implements %s, at line %d", lw.typeName(st.Name), lw.typeName(iface.Name), node.Line))
+	}
+	iface.Variants = append(iface.Variants, st.Name)
+	iface.Fields = append(iface.Fields, Field{Lexeme: st.Name, Type: st.Name})
+}
+
+// declareInterface adds the signatures of the methods of an interface.
+func (lw *lowering) declareInterface(node *ast.Node) {
+	iface, _ := lw.program.GetStruct(node.Lexeme)
+	for _, signature := range node.Children {
+		if _, exists := lw.program.GetMethod(iface.Name, strings.TrimPrefix(signature.Lexeme, iface.Name+".")); exists {
+			panic(fmt.Sprintf("%s is already declared", signature.Lexeme))
+		}
+		fn := lw.declareSignature(signature, signature.Children)
+		lw.methods[fn] = signature
+		iface.Methods = append(iface.Methods, fn)
+	}
+}
+
+// checkImpl checks that a struct has every method of an interface it
+// implements, with the same parameters and result. Only the defaults may
+// differ, and a call through the interface uses those of the interface.
+func (lw *lowering) checkImpl(node *ast.Node) {
+	iface, _ := lw.program.GetStruct(node.Lexeme)
+	for _, signature := range iface.Methods {
+		lexeme := strings.TrimPrefix(signature.Name, iface.Name+".")
+		method, ok := lw.program.GetMethod(node.TypeHint, lexeme)
+		if !ok {
+			panic(fmt.Sprintf("%s does not implement %s, it has no method %s, at line %d",
+				lw.typeName(node.TypeHint), lw.typeName(iface.Name), lexeme, node.Line))
+		}
+		same := method.Result == signature.Result && len(method.Params) == len(signature.Params)
+		for i := 0; same && i < len(method.Params); i++ {
+			same = method.Params[i] == signature.Params[i]
+		}
+		if !same {
+			panic(fmt.Sprintf("%s does not match %s, so %s does not implement %s, at line %d",
+				method.Signature(), signature.Signature(), lw.typeName(node.TypeHint), lw.typeName(iface.Name), node.Line))
+		}
+	}
+}
+
+// checkStruct rejects references in value structs, which would need to
+// count the references on every copy, and structs containing themselves,
+// whose default values would never end.
+func (lw *lowering) checkStruct(st *Struct) {
+	for _, field := range st.Fields {
+		lw.checkType(field.Type)
+		if !st.Ref && lw.program.IsRef(field.Type) {
+			panic(fmt.Sprintf("%s is not a ref struct and cannot contain %s of ref struct %s",
+				lw.typeName(st.Name), field.Lexeme, lw.typeName(field.Type)))
+		}
+	}
+	lw.checkCycle(st, st.Name, map[string]bool{})
+}
+
+func (lw *lowering) checkCycle(st *Struct, root string, seen map[string]bool) {
+	seen[st.Name] = true
+	for _, field := range st.Fields {
+		if field.Type == root {
+			panic(fmt.Sprintf("%s contains itself through %s.%s",
+				lw.typeName(root), lw.typeName(st.Name), field.Lexeme))
+		}
+		inner, ok := lw.program.GetStruct(field.Type)
+		if ok && !seen[inner.Name] {
+			lw.checkCycle(inner, root, seen)
+		}
+	}
+}
+
+func (lw *lowering) lowerConstructor(node *ast.Node, st *Struct) {
+	lw.beginFunc(&Func{Name: st.Name, Receiver: st.Name})
+	self := Operand{Kind: OperandSelf, Type: st.Name}
+
+	if st.Interface {
+		lw.line = node.Line
+		lw.emit(Instr{Op: OpStore, Dst: self, Field: "tag", Arg1: NewInt(0)})
+		st.Constructor = lw.fn
+		return
+	}
+	if st.Optional {
+		// An optional starts out as none
+		lw.line = node.Line
+		lw.emit(Instr{Op: OpStore, Dst: self, Field: "tag", Arg1: NewInt(0)})
+		lw.emit(Instr{Op: OpStore, Dst: self, Field: "value", Arg1: lw.defaultValue(node.TypeHint)})
+		st.Constructor = lw.fn
+		return
+	}
+	if st.IsEnum() {
+		// An enum starts out as its first variant
+		lw.line = node.Line
+		lw.emit(Instr{Op: OpStore, Dst: self, Field: "tag", Arg1: NewInt(0)})
+		if field, ok := st.GetField(st.Variants[0]); ok {
+			payload := lw.defaultValue(field.Type)
+			lw.emit(Instr{Op: OpStore, Dst: self, Field: field.Lexeme, Arg1: payload})
+		}
+		st.Constructor = lw.fn
+		return
+	}
+	for _, child := range node.Children {
+		lw.line = child.Line
+		var value Operand
+		if len(child.Children) > 0 {
+			value = lw.lowerExpression(child.Children[0])
+		} else {
+			value = lw.defaultValue(child.TypeHint)
+		}
+		value = lw.convert(value, child.TypeHint)
+		if value.Type != child.TypeHint {
+			panic(fmt.Sprintf("cannot set %s.%s of type %s to %s, at line %d",
+				lw.typeName(st.Name), child.Lexeme, lw.typeName(child.TypeHint), lw.typeName(value.Type), child.Line))
+		}
+		lw.emit(Instr{Op: OpStore, Dst: self, Field: child.Lexeme, Arg1: value})
+	}
+
+	st.Constructor = lw.fn
+}
+
+// declareMethod adds the signature of a method, so it can be called before
+// its body is lowered.
+func (lw *lowering) declareMethod(node *ast.Node) {
+	receiver, lexeme, _ := strings.Cut(node.Lexeme, ".")
+	st, ok := lw.program.GetStruct(receiver)
+	if !ok {
+		panic(fmt.Sprintf("cannot declare %s, %s is not a struct", lw.memberName(node.Lexeme), lw.typeName(receiver)))
+	}
+	if st.Interface {
+		panic(fmt.Sprintf("cannot declare %s, %s is an interface", lw.memberName(node.Lexeme), lw.typeName(receiver)))
+	}
+	if st.Optional {
+		panic(fmt.Sprintf("cannot declare %s, %s is optional", lw.memberName(node.Lexeme), lw.typeName(receiver)))
+	}
+	if _, exists := lw.program.GetMethod(receiver, lexeme); exists {
+		panic(fmt.Sprintf("%s is already declared", node.Lexeme))
+	}
+	if _, exists := st.GetField(lexeme); exists {
+		panic(fmt.Sprintf("%s has both a field and a method named %s", lw.typeName(receiver), lexeme))
+	}
+	fn := lw.declareSignature(node, node.Parameters())
+	lw.methods[fn] = node
+	lw.program.Methods = append(lw.program.Methods, fn)
+}
+
+// declareSignature checks the result and the parameters of a method or the
+// method of an interface.
+func (lw *lowering) declareSignature(node *ast.Node, parameters []*ast.Node) *Func {
+	receiver, _, _ := strings.Cut(node.Lexeme, ".")
+	fn := &Func{Name: node.Lexeme, Receiver: receiver, Result: node.TypeHint}
+	if fn.Result != "" {
+		lw.checkType(fn.Result)
+	}
+	for _, parameter := range parameters {
+		if parameter.Lexeme == "self" {
+			panic(fmt.Sprintf("%s cannot have a parameter named self", node.Lexeme))
+		}
+		for _, other := range fn.Params {
+			if other.Lexeme == parameter.Lexeme {
+				panic(fmt.Sprintf("%s has the parameter %s twice", node.Lexeme, parameter.Lexeme))
+			}
+		}
+		lw.checkType(parameter.TypeHint)
+		fn.Params = append(fn.Params, Operand{
+			Kind:   OperandVar,
+			Lexeme: parameter.Lexeme,
+			Type:   parameter.TypeHint,
+		})
+	}
+	return fn
+}
+
+// lowerMethod lowers the body of a method, where self and the parameters
+// are bound like val. A method returning a value stores it in a temporary
+// and jumps to the end, so it always returns from its last instruction, and
+// must not reach its end without returning.
+func (lw *lowering) lowerMethod(node *ast.Node, fn *Func) {
+	lw.beginFunc(fn)
+	lw.line = node.Line
+	lw.env.Put(env.Symbol{
+		Lexeme:     "self",
+		SymbolType: ast.TypeParameter,
+		TypeHint:   fn.Receiver,
+		Readonly:   true,
+	})
+	for _, parameter := range fn.Params {
+		lw.env.Put(env.Symbol{
+			Lexeme:     parameter.Lexeme,
+			SymbolType: ast.TypeParameter,
+			TypeHint:   parameter.Type,
+			Readonly:   true,
+		})
+	}
+	if fn.Result != "" {
+		lw.result = lw.newTemp(fn.Result)
+	}
+
+	block := node.Children[len(node.Children)-1]
+	for _, child := range block.Children {
+		lw.lowerStatement(child)
+	}
+	if fn.Result == "" {
+		return
+	}
+	if fallsOff(fn.Code) {
+		panic(fmt.Sprintf("%s must return %s before its end", lw.memberName(fn.Name), lw.typeName(fn.Result)))
+	}
+	lw.emit(Instr{Op: OpLabel, Label: returnLabel})
+	lw.emit(Instr{Op: OpReturn, Arg1: lw.result})
+}
+
+const returnLabel = "Return"
+
+// fallsOff reports whether the end of the code can be reached. Every jump
+// is forward, so one pass finds the labels reachable jumps go to before
+// reaching them.
+func fallsOff(code []Instr) bool {
+	reachable := true
+	targets := make(map[string]bool)
+	for _, instr := range code {
+		switch instr.Op {
+		case OpLabel:
+			reachable = reachable || targets[instr.Label]
+		case OpJump, OpJumpIf:
+			if reachable {
+				targets[instr.Label] = true
+			}
+			reachable = reachable && instr.Op == OpJumpIf
+		}
+	}
+	return reachable
+}
+
+func (lw *lowering) checkType(typeHint string) {
+	switch typeHint {
+	case "Int", "Float", "Bool", "String":
+		return
+	}
+	st, ok := lw.program.GetStruct(typeHint)
+	if !ok {
+		panic(fmt.Sprintf("unknown type %s", lw.typeName(typeHint)))
+	}
+	if st.Interface && len(st.Variants) == 0 {
+		panic(fmt.Sprintf("no struct implements %s, so it has no values", lw.typeName(typeHint)))
+	}
+}
+
+func (lw *lowering) defaultValue(typeHint string) Operand {
+	switch typeHint {
+	case "Int":
+		return NewInt(0)
+	case "Float":
+		return NewFloat(0)
+	case "Bool":
+		return NewBool(false)
+	case "String":
+		return NewString("")
+	}
+	st, ok := lw.program.GetStruct(typeHint)
+	if !ok {
+		panic(fmt.Sprintf("unknown type %s", lw.typeName(typeHint)))
+	}
+	if st.Interface {
+		// The default value of the first struct implementing it
+		return lw.convert(lw.defaultValue(st.Variants[0]), typeHint)
+	}
+	instance := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpAlloc, Dst: instance})
+	return instance
+}
+
+// convert returns a struct given where an interface it implements is
+// expected as a value of the interface, and none or a value given where an
+// optional is expected as a value of the optional. Any other value is
+// returned as it is, for the caller to check its type.
+func (lw *lowering) convert(value Operand, typeHint string) Operand {
+	if lw.isOptional(typeHint) {
+		return lw.wrap(value, typeHint)
+	}
+	st, ok := lw.program.GetStruct(typeHint)
+	if !ok || !st.Interface || st.Tag(value.Type) < 0 {
+		return value
+	}
+	instance := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpAlloc, Dst: instance})
+	if tag := st.Tag(value.Type); tag > 0 {
+		lw.emit(Instr{Op: OpStore, Dst: instance, Field: "tag", Arg1: NewInt(tag)})
+	}
+	lw.emit(Instr{Op: OpStore, Dst: instance, Field: value.Type, Arg1: value})
+	return instance
+}
+
+func (lw *lowering) lowerStatement(node *ast.Node) {
+	if node.Line != 0 {
+		lw.line = node.Line
+	}
+
+	switch node.Type {
+
+	case ast.TypeBlock:
+		lw.blocks += 1
+		prevBlock, prevEnv := lw.block, lw.env
+		blockEnv := env.NewEnv(lw.env)
+		lw.block, lw.env = lw.blocks, &blockEnv
+		for _, child := range node.Children {
+			lw.lowerStatement(child)
+		}
+		lw.emit(Instr{Op: OpLabel, Label: endLabel(lw.block)})
+		lw.block, lw.env = prevBlock, prevEnv
+
+	case ast.TypeBlocks, ast.TypeStatements, ast.TypeStatement:
+		for _, child := range node.Children {
+			lw.lowerStatement(child)
+		}
+
+	case ast.TypePrintStatement:
+		value := lw.checked(lw.lowerExpression(node.Children[0]), "print")
+		lw.emit(Instr{Op: OpPrint, Arg1: value})
+
+	case ast.TypeAssignmentStatement:
+		value := lw.lowerExpression(node.Children[1])
+		if strings.Contains(node.Children[0].Lexeme, ".") {
+			lw.assignField(node.Children[0].Lexeme, value, node.Line)
+			return
+		}
+		if symbol, exists := lw.env.Get(node.Children[0].Lexeme); exists {
+			value = lw.convert(value, symbol.TypeHint)
+		} else {
+			value = lw.typed(value, node.Children[0].Lexeme)
+		}
+		variable := lw.declare(node.Children[0].Lexeme, value.Type, node.Line)
+		lw.emit(Instr{Op: OpCopy, Dst: variable, Arg1: value})
+
+	case ast.TypeValStatement:
+		value := lw.typed(lw.lowerExpression(node.Children[1]), node.Children[0].Lexeme)
+		variable := lw.declareVal(node.Children[0].Lexeme, value.Type, node.Line)
+		lw.emit(Instr{Op: OpCopy, Dst: variable, Arg1: value, Val: true})
+
+	case ast.TypeMatchStatement:
+		lw.lowerMatch(node)
+
+	case ast.TypeCallStatement:
+		switch node.Children[0].Type {
+		case ast.TypeOptionalCall:
+			lw.lowerOptionalAccess(node.Children[0])
+		case ast.TypeStaticCall:
+			lw.lowerStaticCall(node.Children[0])
+		default:
+			lw.lowerCall(node.Children[0])
+		}
+
+	case ast.TypeReturnStatement:
+		lw.lowerReturn(node)
+
+	case ast.TypeSkipStatement:
+		lw.emit(Instr{Op: OpJump, Label: lw.currentEndLabel()})
+
+	case ast.TypeSkipIfStatement:
+		condition := lw.checked(lw.lowerExpression(node.Children[0]), "skip_if on")
+		lw.emit(Instr{
+			Op:    OpJumpIf,
+			Arg1:  condition,
+			Label: lw.currentEndLabel(),
+		})
+
+	default:
+		panic(fmt.Sprintf("cannot lower statement %s", node.Name))
+	}
+}
+
+// lowerMatch checks that a match has exactly one arm for each variant and
+// runs the arm of the tag. Only > is available on every backend, so the
+// arms are tested in the order of their tags, and an arm is taken when the
+// tag is not greater than its own. An optional is matched like an enum with
+// the variants None and Some.
+func (lw *lowering) lowerMatch(node *ast.Node) {
+	subject := lw.lowerExpression(node.Children[0])
+	st, ok := lw.program.GetStruct(subject.Type)
+	if !ok || !(st.IsEnum() || st.Optional) || st.Interface {
+		panic(fmt.Sprintf("cannot match on %s, it is not an enum, at line %d", lw.typeName(subject.Type), node.Line))
+	}
+	variants := st.Variants
+	if st.Optional {
+		variants = optionalArms
+	}
+	arms := make([]*ast.Node, len(variants))
+	for _, arm := range node.Children[1:] {
+		tag := -1
+		for i, variant := range variants {
+			if variant == arm.Lexeme {
+				tag = i
+			}
+		}
+		if tag < 0 {
+			panic(fmt.Sprintf("%s has no variant %s, at line %d", lw.typeName(st.Name), arm.Lexeme, arm.Line))
+		}
+		if arms[tag] != nil {
+			panic(fmt.Sprintf("%s.%s is matched twice, at line %d", lw.typeName(st.Name), arm.Lexeme, arm.Line))
+		}
+		arms[tag] = arm
+	}
+	var missing []string
+	for tag, arm := range arms {
+		if arm == nil {
+			missing = append(missing, variants[tag])
+		}
+	}
+	if len(missing) > 0 {
+		panic(fmt.Sprintf("match on %s is not exhaustive, missing %s, at line %d",
+			lw.typeName(st.Name), strings.Join(missing, ", "), node.Line))
+	}
+
+	lw.matches += 1
+	match := lw.matches
+	tag := lw.newTemp("Int")
+	lw.emit(Instr{Op: OpLoad, Dst: tag, Arg1: subject, Field: "tag"})
+	for i, arm := range arms {
+		lw.line = arm.Line
+		last := i == len(arms)-1
+		next := fmt.Sprintf("Match_%d_%d", match, i+1)
+		if !last {
+			condition := lw.newTemp("Bool")
+			lw.emit(Instr{Op: OpBinary, Dst: condition, Arg1: tag, Arg2: NewInt(i), Operator: ">"})
+			lw.emit(Instr{Op: OpJumpIf, Arg1: condition, Label: next})
+		}
+		lw.lowerArm(arm, subject, st)
+		if !last {
+			lw.emit(Instr{Op: OpJump, Label: fmt.Sprintf("EndMatch_%d", match)})
+			lw.emit(Instr{Op: OpLabel, Label: next})
+		}
+	}
+	if len(arms) > 1 {
+		lw.emit(Instr{Op: OpLabel, Label: fmt.Sprintf("EndMatch_%d", match)})
+	}
+}
+
+// lowerArm binds the fields listed by an arm like variables bound with val,
+// in a scope around the block of the arm.
+func (lw *lowering) lowerArm(arm *ast.Node, subject Operand, st *Struct) {
+	prevEnv := lw.env
+	armEnv := env.NewEnv(lw.env)
+	lw.env = &armEnv
+
+	bindings, block := arm.Children[:len(arm.Children)-1], arm.Children[len(arm.Children)-1]
+	if st.Optional {
+		lw.bindValue(arm, bindings, subject, st)
+		bindings = nil
+	}
+	payload, _ := st.GetField(arm.Lexeme)
+	for _, binding := range bindings {
+		var field Field
+		if variant, ok := lw.program.GetStruct(payload.Type); ok {
+			field, ok = variant.GetField(binding.Lexeme)
+		}
+		if field.Type == "" {
+			panic(fmt.Sprintf("%s.%s has no field %s, at line %d",
+				lw.typeName(st.Name), arm.Lexeme, binding.Lexeme, binding.Line))
+		}
+		if _, exists := lw.env.Get(binding.Lexeme); exists {
+			panic(fmt.Sprintf("cannot bind %s in the %s arm, it is already declared, at line %d",
+				binding.Lexeme, arm.Lexeme, binding.Line))
+		}
+		value := lw.newTemp(field.Type)
+		lw.emit(Instr{
+			Op:    OpLoad,
+			Dst:   value,
+			Arg1:  subject,
+			Field: arm.Lexeme + "." + binding.Lexeme,
+		})
+		variable := lw.declareVal(binding.Lexeme, field.Type, binding.Line)
+		lw.emit(Instr{Op: OpCopy, Dst: variable, Arg1: value, Val: true})
+	}
+	lw.lowerStatement(block)
+
+	lw.env = prevEnv
+}
+
+// bindValue binds the value of an optional to the name the Some arm
+// gives it, if any.
+func (lw *lowering) bindValue(arm *ast.Node, bindings []*ast.Node, subject Operand, st *Struct) {
+	if len(bindings) == 0 {
+		return
+	}
+	if arm.Lexeme == "None" {
+		panic(fmt.Sprintf("cannot bind %s in the None arm, %s holds no value then, at line %d",
+			bindings[0].Lexeme, lw.typeName(st.Name), arm.Line))
+	}
+	if len(bindings) > 1 {
+		panic(fmt.Sprintf("the Some arm binds the value of %s to one name, not %d, at line %d",
+			lw.typeName(st.Name), len(bindings), arm.Line))
+	}
+	if _, exists := lw.env.Get(bindings[0].Lexeme); exists {
+		panic(fmt.Sprintf("cannot bind %s in the %s arm, it is already declared, at line %d",
+			bindings[0].Lexeme, arm.Lexeme, arm.Line))
+	}
+	field, _ := st.GetField("value")
+	value := lw.newTemp(field.Type)
+	lw.emit(Instr{Op: OpLoad, Dst: value, Arg1: subject, Field: field.Lexeme})
+	variable := lw.declareVal(bindings[0].Lexeme, field.Type, bindings[0].Line)
+	lw.emit(Instr{Op: OpCopy, Dst: variable, Arg1: value, Val: true})
+}
+
+func (lw *lowering) lowerReturn(node *ast.Node) {
+	if !lw.fn.IsMethod() {
+		panic("return outside of a method")
+	}
+	value := lw.lowerExpression(node.Children[0])
+	if lw.fn.Result == "" {
+		panic(fmt.Sprintf("cannot return a value from %s, which returns nothing, at line %d",
+			lw.memberName(lw.fn.Name), node.Line))
+	}
+	value = lw.convert(value, lw.fn.Result)
+	if value.Type != lw.fn.Result {
+		panic(fmt.Sprintf("cannot return %s from %s, which returns %s, at line %d",
+			lw.typeName(value.Type), lw.memberName(lw.fn.Name), lw.typeName(lw.fn.Result), node.Line))
+	}
+	lw.emit(Instr{Op: OpCopy, Dst: lw.result, Arg1: value})
+	lw.emit(Instr{Op: OpJump, Label: returnLabel})
+}
+
+// lowerCall calls a method with its arguments in the order of its
+// parameters. A parameter without an argument gets its default value,
+// evaluated at the call like the default of a field, or the default value
+// of its type. The result is a temporary, unless the method returns nothing.
+// A call on an interface value uses the signature and the defaults of the
+// interface.
+func (lw *lowering) lowerCall(node *ast.Node) Operand {
+	return lw.lowerCallOn(lw.lowerExpression(node.Children[0]), node)
+}
+
+// lowerCallOn lowers a call on a receiver that is already lowered.
+func (lw *lowering) lowerCallOn(receiver Operand, node *ast.Node) Operand {
+	if lw.isOptional(receiver.Type) {
+		panic(fmt.Sprintf("cannot call %s on %s, it may be none, so call it with ?. instead, at line %d",
+			node.Lexeme, lw.typeName(receiver.Type), node.Line))
+	}
+	if builtin, ok := GetBuiltinMethod(receiver.Type, node.Lexeme); ok {
+		return lw.lowerBuiltin(builtin, []Operand{receiver}, node.Children[1:], node.Line)
+	}
+	method, ok := lw.program.GetMethod(receiver.Type, node.Lexeme)
+	var values map[string]Operand // The arguments lowered to infer type arguments
+	if template, generic := lw.methodTemplates[receiver.Type+"."+node.Lexeme]; !ok && generic {
+		values = make(map[string]Operand)
+		for _, parameter := range template.Parameters() {
+			for _, child := range node.Children[1:] {
+				if child.Lexeme == parameter.Lexeme {
+					values[child.Lexeme] = lw.lowerExpression(child.Children[0])
+				}
+			}
+		}
+		node.Lexeme = lw.instantiateMethod(template, values, node.Line)
+		method, ok = lw.program.GetMethod(receiver.Type, node.Lexeme)
+	}
+	if !ok {
+		panic(fmt.Sprintf("%s has no method %s, at line %d", lw.typeName(receiver.Type), node.Lexeme, node.Line))
+	}
+	declaration := lw.methods[method]
+	arguments := namedArguments(lw.memberName(method.Name), method.Params, node.Children[1:], node.Line)
+
+	var args []Operand
+	for i, parameter := range method.Params {
+		var value Operand
+		if lowered, ok := values[parameter.Lexeme]; ok {
+			value = lowered
+		} else if argument, ok := arguments[parameter.Lexeme]; ok {
+			value = lw.lowerExpression(argument)
+		} else if defaults := declaration.Children[i].Children; len(defaults) > 0 {
+			prevEnv := lw.env
+			empty := env.NewEnv(nil)
+			lw.env = &empty
+			value = lw.lowerExpression(defaults[0])
+			lw.env = prevEnv
+		} else {
+			value = lw.defaultValue(parameter.Type)
+		}
+		value = lw.convert(value, parameter.Type)
+		if value.Type != parameter.Type {
+			panic(fmt.Sprintf("cannot pass %s as %s of type %s to %s, at line %d",
+				lw.typeName(value.Type), parameter.Lexeme, lw.typeName(parameter.Type), lw.memberName(method.Name), node.Line))
+		}
+		args = append(args, value)
+	}
+
+	call := Instr{Op: OpCall, Arg1: receiver, Args: args, Func: method.Name}
+	if method.Result != "" {
+		call.Dst = lw.newTemp(method.Result)
+	}
+	lw.emit(call)
+	return call.Dst
+}
+
+// namedArguments returns the expressions passed to the parameters of a
+// method or builtin by their names, which must be those of parameters.
+func namedArguments(name string, params []Operand, children []*ast.Node, line int) map[string]*ast.Node {
+	arguments := make(map[string]*ast.Node)
+	for _, child := range children {
+		found := false
+		for _, parameter := range params {
+			found = found || parameter.Lexeme == child.Lexeme
+		}
+		if !found {
+			panic(fmt.Sprintf("%s has no parameter %s, at line %d", name, child.Lexeme, line))
+		}
+		if _, exists := arguments[child.Lexeme]; exists {
+			panic(fmt.Sprintf("%s is passed to %s twice, at line %d", child.Lexeme, name, line))
+		}
+		arguments[child.Lexeme] = child.Children[0]
+	}
+	return arguments
+}
+
+// lowerStaticCall lowers a call of a function of the standard library on a
+// type, like Process.exit(code 1).
+func (lw *lowering) lowerStaticCall(node *ast.Node) Operand {
+	builtin, ok := GetBuiltin(node.Lexeme)
+	if !ok || builtin.Hidden || !builtin.Static() {
+		receiver, name, _ := strings.Cut(node.Lexeme, ".")
+		panic(fmt.Sprintf("%s has no function %s, at line %d", lw.typeName(receiver), name, node.Line))
+	}
+	return lw.lowerBuiltin(builtin, nil, node.Children, node.Line)
+}
+
+// lowerBuiltin lowers a call of a function of the standard library, whose
+// parameters have no defaults. An optional result is none unless the
+// function telling whether there is a value says so.
+func (lw *lowering) lowerBuiltin(builtin Builtin, args []Operand, children []*ast.Node, line int) Operand {
+	arguments := namedArguments(builtin.Name, builtin.Params, children, line)
+	for _, parameter := range builtin.Params {
+		argument, ok := arguments[parameter.Lexeme]
+		if !ok {
+			panic(fmt.Sprintf("%s needs %s, which has no default, at line %d", builtin.Name, parameter.Lexeme, line))
+		}
+		value := lw.convert(lw.lowerExpression(argument), parameter.Type)
+		if value.Type != parameter.Type {
+			panic(fmt.Sprintf("cannot pass %s as %s of type %s to %s, at line %d",
+				lw.typeName(value.Type), parameter.Lexeme, lw.typeName(parameter.Type), builtin.Name, line))
+		}
+		args = append(args, value)
+	}
+
+	if builtin.Present == "" {
+		call := Instr{Op: OpBuiltin, Args: args, Func: builtin.Name}
+		if builtin.Result != "" {
+			call.Dst = lw.newTemp(builtin.Result)
+		}
+		lw.emit(call)
+		return call.Dst
+	}
+	inner := strings.TrimSuffix(builtin.Result, "?")
+	typeHint := lw.optional(inner, line)
+	lw.checks += 1
+	noneLabel := fmt.Sprintf("None_%d", lw.checks)
+	endLabel := fmt.Sprintf("EndSome_%d", lw.checks)
+
+	present := lw.newTemp("Bool")
+	lw.emit(Instr{Op: OpBuiltin, Dst: present, Args: args, Func: builtin.Present})
+	absent := lw.newTemp("Bool")
+	lw.emit(Instr{Op: OpNot, Dst: absent, Arg1: present})
+	lw.emit(Instr{Op: OpJumpIf, Arg1: absent, Label: noneLabel})
+	value := lw.newTemp(inner)
+	lw.emit(Instr{Op: OpBuiltin, Dst: value, Args: args, Func: builtin.Name})
+	result := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: lw.wrap(value, typeHint)})
+	lw.emit(Instr{Op: OpJump, Label: endLabel})
+
+	lw.emit(Instr{Op: OpLabel, Label: noneLabel})
+	lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: lw.defaultValue(typeHint)})
+	lw.emit(Instr{Op: OpLabel, Label: endLabel})
+	return result
+}
+
+func (lw *lowering) currentEndLabel() string {
+	if lw.block == 0 {
+		panic("skip outside of block")
+	}
+	return endLabel(lw.block)
+}
+
+func endLabel(block int) string {
+	return fmt.Sprintf("EndBlock_%d", block)
+}
+
+// declare returns the variable with the given lexeme, assigned at a line.
+// The first assignment in a scope declares it, adding it to the environment
+// of the block, and later assignments in the scope or the blocks inside it
+// reassign it.
+func (lw *lowering) declare(lexeme string, typeHint string, line int) Operand {
+	symbol, exists := lw.env.Get(lexeme)
+	if exists {
+		if symbol.Readonly {
+			panic(fmt.Sprintf("cannot assign to %s, it is %s, at line %d", lexeme, binding(symbol), line))
+		}
+		if symbol.TypeHint != typeHint {
+			panic(fmt.Sprintf("cannot assign %s to %s of type %s, at line %d",
+				lw.typeName(typeHint), lexeme, lw.typeName(symbol.TypeHint), line))
+		}
+	} else {
+		symbol = env.Symbol{
+			Lexeme:     lexeme,
+			SymbolType: ast.TypeIdentifier,
+			TypeHint:   typeHint,
+			Name:       lw.local(lexeme, typeHint),
+		}
+		lw.env.Put(symbol)
+		lw.scope(lw.variable(symbol))
+	}
+	return lw.variable(symbol)
+}
+
+// declareVal declares a variable bound with val. It may not shadow another
+// variable, since every later assignment to the name is rejected.
+func (lw *lowering) declareVal(lexeme string, typeHint string, line int) Operand {
+	if _, exists := lw.env.Get(lexeme); exists {
+		panic(fmt.Sprintf("cannot bind %s with val, it is already declared, at line %d", lexeme, line))
+	}
+	symbol := env.Symbol{
+		Lexeme:     lexeme,
+		SymbolType: ast.TypeIdentifier,
+		TypeHint:   typeHint,
+		Name:       lw.newLocal(lexeme, typeHint).Lexeme,
+		Readonly:   true,
+	}
+	lw.env.Put(symbol)
+	lw.scope(lw.variable(symbol))
+	return lw.variable(symbol)
+}
+
+// scope adds a variable to those declared in the current block, if any.
+func (lw *lowering) scope(variable Operand) {
+	if lw.block == 0 {
+		return
+	}
+	if lw.fn.Scopes == nil {
+		lw.fn.Scopes = make(map[string][]Operand)
+	}
+	label := endLabel(lw.block)
+	lw.fn.Scopes[label] = append(lw.fn.Scopes[label], variable)
+}
+
+// local returns the name of the local holding a new variable. Variables
+// with the same lexeme in sibling blocks are never in scope at the same
+// time, so they share a local if they have the same type. A val gets a local
+// of its own, so that it is assigned only once.
+func (lw *lowering) local(lexeme string, typeHint string) string {
+	for _, local := range lw.locals[lexeme] {
+		if local.Type == typeHint {
+			return local.Lexeme
+		}
+	}
+	local := lw.newLocal(lexeme, typeHint)
+	lw.locals[lexeme] = append(lw.locals[lexeme], local)
+	return local.Lexeme
+}
+
+// newLocal adds a local named after the lexeme, or like x_01 if there
+// already is one. Lexemes have no digits and SSA versions never start with
+// 0, so the name cannot collide with anything else.
+func (lw *lowering) newLocal(lexeme string, typeHint string) Operand {
+	name := lexeme
+	if count := lw.names[lexeme]; count > 0 {
+		name = fmt.Sprintf("%s_0%d", lexeme, count)
+	}
+	lw.names[lexeme] += 1
+	local := Operand{Kind: OperandVar, Lexeme: name, Type: typeHint}
+	lw.fn.Locals = append(lw.fn.Locals, local)
+	return local
+}
+
+// assignField stores a value into a field of a struct variable at a line.
+// The variable must be declared and not bound with val. Instances of ref
+// structs are shared, so their fields are only set by their constructors,
+// like readonly fields.
+func (lw *lowering) assignField(lexeme string, value Operand, line int) {
+	path := strings.Split(lexeme, ".")
+	symbol, exists := lw.env.Get(path[0])
+	if !exists {
+		panic(fmt.Sprintf("undeclared identifier %s, at line %d", path[0], line))
+	}
+	if symbol.Readonly {
+		panic(fmt.Sprintf("cannot assign to %s, %s is %s, at line %d", lexeme, path[0], binding(symbol), line))
+	}
+	typeHint := symbol.TypeHint
+	for _, field := range path[1:] {
+		if lw.program.IsRef(typeHint) {
+			panic(fmt.Sprintf("cannot assign to %s, fields of ref struct %s are only set by its constructor, at line %d",
+				lexeme, lw.typeName(typeHint), line))
+		}
+		st := typeHint
+		typeHint = lw.fieldType(typeHint, []string{field}, line)
+		if lw.isReadonly(st, field) {
+			panic(fmt.Sprintf("cannot assign to %s, %s.%s is readonly, at line %d", lexeme, lw.typeName(st), field, line))
+		}
+	}
+	value = lw.convert(value, typeHint)
+	if value.Type != typeHint {
+		panic(fmt.Sprintf("cannot assign %s to %s of type %s, at line %d",
+			lw.typeName(value.Type), lexeme, lw.typeName(typeHint), line))
+	}
+	lw.emit(Instr{
+		Op:    OpStore,
+		Dst:   lw.variable(symbol),
+		Field: strings.Join(path[1:], "."),
+		Arg1:  value,
+	})
+}
+
+// binding describes how a readonly variable was bound, for errors.
+func binding(symbol env.Symbol) string {
+	if symbol.SymbolType == ast.TypeParameter {
+		return "a parameter"
+	}
+	return "bound with val"
+}
+
+// variable returns the operand of a variable, which is self for the
+// receiver of a method.
+func (lw *lowering) variable(symbol env.Symbol) Operand {
+	if symbol.SymbolType == ast.TypeParameter && symbol.Lexeme == "self" {
+		return Operand{Kind: OperandSelf, Type: symbol.TypeHint}
+	}
+	name := symbol.Lexeme
+	if symbol.Name != "" {
+		name = symbol.Name
+	}
+	return Operand{Kind: OperandVar, Lexeme: name, Type: symbol.TypeHint}
+}
+
+func (lw *lowering) lowerExpression(node *ast.Node) Operand {
+
+	switch node.Type {
+
+	case ast.TypeExpression:
+		return lw.lowerExpression(node.Children[0])
+
+	case ast.TypeOperator:
+		if node.Lexeme == "??" {
+			return lw.lowerCoalesce(node)
+		}
+		left := lw.checked(lw.lowerExpression(node.Children[0]), "use "+node.Lexeme+" on")
+		right := lw.checked(lw.lowerExpression(node.Children[1]), "use "+node.Lexeme+" on")
+		result := lw.newTemp(operatorType(node.Lexeme, left.Type))
+		lw.emit(Instr{
+			Op:       OpBinary,
+			Dst:      result,
+			Arg1:     left,
+			Arg2:     right,
+			Operator: node.Lexeme,
+		})
+		return result
+
+	case ast.TypeNot:
+		value := lw.checked(lw.lowerExpression(node.Children[0]), "use ! on")
+		result := lw.newTemp("Bool")
+		lw.emit(Instr{Op: OpNot, Dst: result, Arg1: value})
+		return result
+
+	case ast.TypeLiteral:
+		return NewString(node.Lexeme)
+
+	case ast.TypeNumber:
+		return NewInt(node.Number)
+
+	case ast.TypeBoolean:
+		return NewBool(node.Number != 0)
+
+	case ast.TypeNone:
+		return Operand{Type: noneType}
+
+	case ast.TypeIdentifier:
+		return lw.lowerIdentifier(node.Lexeme, node.Line)
+
+	case ast.TypeCall:
+		result := lw.lowerCall(node)
+		if result.Kind == OperandZero {
+			panic(fmt.Sprintf("%s returns nothing, so it has no value, at line %d", node.Lexeme, node.Line))
+		}
+		return result
+
+	case ast.TypeStaticCall:
+		result := lw.lowerStaticCall(node)
+		if result.Kind == OperandZero {
+			panic(fmt.Sprintf("%s returns nothing, so it has no value, at line %d", node.Lexeme, node.Line))
+		}
+		return result
+
+	case ast.TypeMember:
+		object := lw.lowerExpression(node.Children[0])
+		result := lw.newTemp(lw.fieldType(object.Type, []string{node.Lexeme}, node.Line))
+		lw.emit(Instr{Op: OpLoad, Dst: result, Arg1: object, Field: node.Lexeme})
+		return result
+
+	case ast.TypeOptionalMember, ast.TypeOptionalCall:
+		result := lw.lowerOptionalAccess(node)
+		if result.Kind == OperandZero {
+			panic(fmt.Sprintf("%s returns nothing, so it has no value, at line %d", node.Lexeme, node.Line))
+		}
+		return result
+
+	case ast.TypeConstructor:
+		if strings.Contains(node.Lexeme, ".") {
+			return lw.lowerVariant(node)
+		}
+		var values []Operand // The arguments lowered to infer type arguments
+		if template, generic := lw.generics[node.Lexeme]; generic {
+			for _, child := range node.Children {
+				values = append(values, lw.lowerExpression(child.Children[0]))
+			}
+			node.Lexeme = lw.inferConstructor(template, node, values)
+		}
+		st, ok := lw.program.GetStruct(node.Lexeme)
+		if !ok {
+			panic(fmt.Sprintf("unknown struct %s, at line %d", node.Lexeme, node.Line))
+		}
+		if st.Interface {
+			panic(fmt.Sprintf("%s is an interface and cannot be constructed, only the structs implementing it, at line %d",
+				lw.typeName(st.Name), node.Line))
+		}
+		if st.IsEnum() {
+			panic(fmt.Sprintf("%s is an enum and is constructed through a variant, like %s.%s, at line %d",
+				lw.typeName(st.Name), lw.typeName(st.Name), st.Variants[0], node.Line))
+		}
+		if st.Optional {
+			panic(fmt.Sprintf("%s is optional and cannot be constructed, give none or a value of %s instead, at line %d",
+				lw.typeName(st.Name), lw.typeName(lw.optionals[st.Name]), node.Line))
+		}
+		instance := lw.newTemp(st.Name)
+		lw.emit(Instr{Op: OpAlloc, Dst: instance})
+		for i, child := range node.Children {
+			field, ok := st.GetField(child.Lexeme)
+			if !ok {
+				panic(fmt.Sprintf("%s has no field %s, at line %d", lw.typeName(st.Name), child.Lexeme, child.Line))
+			}
+			var value Operand
+			if values != nil {
+				value = values[i]
+			} else {
+				value = lw.lowerExpression(child.Children[0])
+			}
+			value = lw.convert(value, field.Type)
+			if value.Type != field.Type {
+				panic(fmt.Sprintf("cannot set %s.%s of type %s to %s, at line %d",
+					lw.typeName(st.Name), field.Lexeme, lw.typeName(field.Type), lw.typeName(value.Type), child.Line))
+			}
+			lw.emit(Instr{
+				Op:    OpStore,
+				Dst:   instance,
+				Field: child.Lexeme,
+				Arg1:  value,
+			})
+		}
+		return instance
+
+	default:
+		panic(fmt.Sprintf("cannot lower expression %s", node.Name))
+	}
+}
+
+// lowerVariant constructs an enum, which starts out as its first variant
+// with default fields, and sets the tag and the fields of the given variant.
+func (lw *lowering) lowerVariant(node *ast.Node) Operand {
+	path := strings.Split(node.Lexeme, ".")
+	st, ok := lw.program.GetStruct(path[0])
+	if !ok || !st.IsEnum() || st.Interface {
+		panic(fmt.Sprintf("unknown enum %s, at line %d", path[0], node.Line))
+	}
+	tag := st.Tag(path[1])
+	if tag < 0 {
+		panic(fmt.Sprintf("%s has no variant %s, at line %d", lw.typeName(st.Name), path[1], node.Line))
+	}
+	instance := lw.newTemp(st.Name)
+	lw.emit(Instr{Op: OpAlloc, Dst: instance})
+	if tag > 0 {
+		lw.emit(Instr{Op: OpStore, Dst: instance, Field: "tag", Arg1: NewInt(tag)})
+	}
+	field, ok := st.GetField(path[1])
+	if !ok {
+		if len(node.Children) > 0 {
+			panic(fmt.Sprintf("%s has no field %s, at line %d", node.Lexeme, node.Children[0].Lexeme, node.Children[0].Line))
+		}
+		return instance
+	}
+	if tag == 0 && len(node.Children) == 0 {
+		return instance
+	}
+	variant, _ := lw.program.GetStruct(field.Type)
+	payload := lw.defaultValue(field.Type)
+	for _, child := range node.Children {
+		field, ok := variant.GetField(child.Lexeme)
+		if !ok {
+			panic(fmt.Sprintf("%s has no field %s, at line %d", node.Lexeme, child.Lexeme, child.Line))
+		}
+		value := lw.convert(lw.lowerExpression(child.Children[0]), field.Type)
+		if value.Type != field.Type {
+			panic(fmt.Sprintf("cannot set %s.%s of type %s to %s, at line %d",
+				node.Lexeme, field.Lexeme, lw.typeName(field.Type), lw.typeName(value.Type), child.Line))
+		}
+		lw.emit(Instr{Op: OpStore, Dst: payload, Field: child.Lexeme, Arg1: value})
+	}
+	lw.emit(Instr{Op: OpStore, Dst: instance, Field: field.Lexeme, Arg1: payload})
+	return instance
+}
+
+func (lw *lowering) lowerIdentifier(lexeme string, line int) Operand {
+	path := strings.Split(lexeme, ".")
+	symbol, exists := lw.env.Get(path[0])
+	if !exists {
+		panic(fmt.Sprintf("undeclared identifier %s, at line %d", path[0], line))
+	}
+	variable := lw.variable(symbol)
+	if len(path) == 1 {
+		return variable
+	}
+	typeHint := lw.fieldType(symbol.TypeHint, path[1:], line)
+	result := lw.newTemp(typeHint)
+	lw.emit(Instr{
+		Op:    OpLoad,
+		Dst:   result,
+		Arg1:  variable,
+		Field: strings.Join(path[1:], "."),
+	})
+	return result
+}
+
+func (lw *lowering) isReadonly(typeHint string, lexeme string) bool {
+	st, _ := lw.program.GetStruct(typeHint)
+	field, _ := st.GetField(lexeme)
+	return field.Readonly
+}
+
+// fieldType follows a path of field names from a struct type.
+func (lw *lowering) fieldType(typeHint string, path []string, line int) string {
+	for _, lexeme := range path {
+		st, ok := lw.program.GetStruct(typeHint)
+		if !ok {
+			panic(fmt.Sprintf("%s is not a struct, at line %d", lw.typeName(typeHint), line))
+		}
+		if st.Interface {
+			panic(fmt.Sprintf("%s is an interface, whose values are only used through its methods, at line %d",
+				lw.typeName(typeHint), line))
+		}
+		if st.IsEnum() {
+			panic(fmt.Sprintf("%s is an enum, whose fields are only bound by match, at line %d", lw.typeName(typeHint), line))
+		}
+		if st.Optional {
+			panic(fmt.Sprintf("cannot use %s.%s, %s may be none, so use ?. instead, at line %d",
+				lw.typeName(typeHint), lexeme, lw.typeName(typeHint), line))
+		}
+		field, ok := st.GetField(lexeme)
+		if !ok {
+			panic(fmt.Sprintf("%s has no field %s, at line %d", lw.typeName(typeHint), lexeme, line))
+		}
+		typeHint = field.Type
+	}
+	return typeHint
+}
+
+// typeName writes a type for errors like in the source, like Int? for
+// Optional_Int and Pair[Int, String] for Pair_3Int_6String.
+func (lw *lowering) typeName(typeHint string) string {
+	if inner, ok := lw.optionals[typeHint]; ok {
+		return lw.typeName(inner) + "?"
+	}
+	inst, ok := lw.instances[typeHint]
+	if !ok || strings.Contains(typeHint, ".") {
+		return typeHint
+	}
+	return lw.instanceName(inst.template, inst.arguments)
+}
+
+// memberName writes a method, or another name on a type, for errors like
+// in the source, like Box.pair[String] for Box.pair_6String.
+func (lw *lowering) memberName(name string) string {
+	receiver, lexeme, found := strings.Cut(name, ".")
+	if !found {
+		return lw.typeName(name)
+	}
+	if inst, ok := lw.instances[name]; ok {
+		_, lexeme, _ = strings.Cut(inst.template, ".")
+		return lw.typeName(receiver) + "." + lw.instanceName(lexeme, inst.arguments)
+	}
+	return lw.typeName(receiver) + "." + lexeme
+}
+
+func (lw *lowering) instanceName(template string, arguments []string) string {
+	names := make([]string, len(arguments))
+	for i, argument := range arguments {
+		names[i] = lw.typeName(argument)
+	}
+	return instanceKey(template, names)
+}
+
+func operatorType(operator string, operandType string) string {
+	switch operator {
+	case "<", ">", "<=", ">=", "==", "!=":
+		return "Bool"
+	default:
+		return operandType
+	}
+}
@@ -0,0 +1,184 @@
+package ir_test
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
+)
+
+// The structs the programs construct, with constructors and semicolons in
+// their defaults
+const structs = `struct Point {
+    x Int = 1
+    y Int = 2
+    label String = "p; q"
+}
+
+struct Line {
+    from Point
+    to Point = Point(x 3 y 4 label "to; end")
+}
+
+`
+
+// run lowers source and runs it in the VM, returning what it prints.
+func run(t *testing.T, source string) string {
+	lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(structs + source)))
+	parser := parser.NewParser(lexer.ScanAll())
+	program := ir.Lower(parser.Parse())
+
+	var out strings.Builder
+	if err := vm.New(bytecode.Compile(program), &out).Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestConstructorPositions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"assignment", `
+p = Point(x 5)
+print p.x
+print p.y`, "5\n2\n"},
+		{"skip_if condition", `
+{
+    skip_if Point(x 3).x > 2
+    print "not skipped"
+}
+{
+    skip_if Point().x > 2
+    print "not skipped"
+}`, "not skipped\n"},
+		{"first statement of a block", `
+{
+    p = Point(y 9)
+    print p.y
+    {
+        q = Line(from p)
+        print q.from.y
+    }
+}`, "9\n9\n"},
+		{"nested arguments", `
+line = Line(from Point(x Point(x 4).x + 1 y (Point(y 6).y)))
+print line.from.x
+print line.from.y
+print Point(x 2).x + Point(x 3).x`, "5\n6\n5\n"},
+		{"field defaults", `
+line = Line(from Point())
+print line.from.x
+print line.to.y
+print line.to.label
+print Line(from Point()).to.x`, "1\n4\nto; end\n3\n"},
+		{"string literals with semicolons", `
+print "a; b"
+p = Point(label "c; d")
+print p.label
+print Point().label
+print "e; f"`, "a; b\nc; d\np; q\ne; f\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := run(t, test.source); got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestInstanceNames instantiates generics with type arguments whose names
+// would run into each other if they were joined with underscores.
+func TestInstanceNames(t *testing.T) {
+	source := `struct Pair[A, B] {
+    first A
+    second B
+
+    fn with[C, D](value C other D) Int {
+        return (value.size * 10) + other.size
+    }
+}
+
+struct Two { size Int = 1 }
+struct Two_Words { size Int = 2 }
+struct Words_Int { size Int = 3 }
+struct Int_Two { size Int = 4 }
+struct Words_Int_Two { size Int = 5 }
+
+a = Pair[Two_Words, Int](first Two_Words() second 5)
+b = Pair[Two, Words_Int](first Two() second Words_Int())
+print a.first.size
+print a.second
+print b.first.size
+print b.second.size
+print a.with(value Two_Words() other Int_Two())
+print a.with(value Two() other Words_Int_Two())
+`
+	if got, want := run(t, source), "2\n5\n1\n3\n24\n15\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
+
+// lowerError lowers source and returns the error it is rejected with.
+func lowerError(source string) (message string) {
+	defer func() {
+		message = fmt.Sprint(recover())
+	}()
+	lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(source)))
+	parser := parser.NewParser(lexer.ScanAll())
+	ir.Lower(parser.Parse())
+	return "no error"
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"x = 1\nprint y", "undeclared identifier y, at line 2"},
+		{"struct P {\n    a Int\n}\n\np = P(\n    b 1)", "P has no field b, at line 6"},
+		{"struct P {\n    a Int\n}\np = P()\nprint p.b", "P has no field b, at line 5"},
+		{
+			"interface I {\n    fn f()\n}\nstruct S {\n    a Int\n}\n\nimpl I for S",
+			"S does not implement I, it has no method f, at line 8",
+		},
+		{
+			"struct Pair[A, B] {\n    first A\n    second B = \"x\"\n}\n\np = Pair[Int, Int](first 1)",
+			"cannot set Pair[Int, Int].second of type Int to String, at line 3, " +
+				"in Pair[Int, Int] instantiated at line 6",
+		},
+		{
+			"struct Pair[A, B] {\n    first A\n    second B\n}\n\np = Pair(first 1 second 2)\n" +
+				"p = Pair[Int, Int](\n    first 1\n    second \"x\")",
+			"cannot set Pair[Int, Int].second of type Int to String, at line 9",
+		},
+		{
+			"struct Box {\n    size Int = 1\n\n    fn pair[U](other U) Int {\n        return other\n    }\n}\n" +
+				"print Box().pair(other \"x\")",
+			"cannot return String from Box.pair[String], which returns Int, at line 5, " +
+				"in Box.pair[String] instantiated at line 8",
+		},
+		{
+			"struct P {\n    a Int?\n}\n\nfn P.f() Int {\n    return self.a\n}",
+			"cannot return Int? from P.f, which returns Int, at line 6",
+		},
+		{
+			"struct Q {\n    b Int = 1\n}\nstruct P {\n    a Q?\n}\nx = P().a\nprint x.b",
+			"cannot use Q?.b, Q? may be none, so use ?. instead, at line 8",
+		},
+	}
+	for _, test := range tests {
+		if got := lowerError(test.source); got != test.want {
+			t.Errorf("%q is rejected with %q, want %q", test.source, got, test.want)
+		}
+	}
+}
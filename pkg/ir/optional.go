@@ -0,0 +1,228 @@
+package ir
+
+import (
+	"fmt"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+)
+
+/*
+	An optional type, like Int? or House?, holds either a value of its inner
+	type or none. Each optional is a struct of its own, named like
+	Optional_Int, whose tag is 1 when it holds a value, and whose value is
+	the default of the inner type when it is none, so backends need nothing
+	for it. Optionals are declared the first time they are needed, like
+	instantiations of generic structs, and type hints like Int? are renamed
+	to them. The declaration in the AST of the program has the inner type
+	as type hint, for the backends generating from the AST. Errors write
+	optionals like in the source, like Int?.
+
+	none has no type of its own, so it can only be given where an optional
+	is expected, and a value of the inner type given there is wrapped. The
+	value of an optional is only used once it is checked: a?.b and a?.b()
+	give none if a is none, a ?? b gives the value of a or else b, which is
+	only evaluated then, and a match with a Some and a None arm binds it.
+*/
+
+// The type of none, which no type hint can name
+const noneType = "none"
+
+// The arms of a match on an optional, in the order of the tag
+var optionalArms = []string{"None", "Some"}
+
+// optional returns the name of the optional of a type, declaring it the
+// first time.
+func (lw *lowering) optional(inner string, line int) string {
+	if _, ok := lw.optionals[inner]; ok {
+		panic(fmt.Sprintf("%s is already optional, at line %d", lw.typeName(inner), line))
+	}
+	name := "Optional_" + inner
+	if _, exists := lw.optionals[name]; exists {
+		return name
+	}
+	if !lw.isType(inner) {
+		panic(fmt.Sprintf("unknown type %s, at line %d", lw.typeName(inner), line))
+	}
+	for _, declaration := range lw.root.Declarations {
+		if declaration.Lexeme == name {
+			panic(fmt.Sprintf("%s is already declared, so %s? cannot be declared as it, at line %d",
+				name, lw.typeName(inner), line))
+		}
+	}
+	lw.optionals[name] = inner
+
+	node := &ast.Node{
+		Type:     ast.TypeOptionalDeclaration,
+		Lexeme:   name,
+		TypeHint: inner,
+		Line:     line,
+	}
+	node.SetNames()
+	lw.root.Declarations = append(lw.root.Declarations, node)
+	if lw.declared {
+		lw.enter(name, line)
+		lw.declareStruct(node)
+		st := lw.program.Structs[len(lw.program.Structs)-1]
+		lw.pending = append(lw.pending, pending{st: st})
+		lw.leave()
+	}
+	return name
+}
+
+// declareOptional declares the struct of an optional, which is a ref
+// struct if its inner type is one, since value structs cannot hold
+// references. The inner type may not be declared yet.
+func (lw *lowering) declareOptional(node *ast.Node) {
+	ref := false
+	for _, declaration := range lw.root.Declarations {
+		if declaration.Lexeme == node.TypeHint {
+			ref = declaration.Type == ast.TypeRefStructDeclaration
+		}
+	}
+	lw.program.Structs = append(lw.program.Structs, &Struct{
+		Name: node.Lexeme,
+		Fields: []Field{
+			{Lexeme: "tag", Type: "Int"},
+			{Lexeme: "value", Type: node.TypeHint},
+		},
+		Ref:      ref,
+		Optional: true,
+	})
+}
+
+func (lw *lowering) isOptional(typeHint string) bool {
+	_, ok := lw.optionals[typeHint]
+	return ok
+}
+
+// wrap returns none or a value of the inner type given where an optional
+// is expected as a value of the optional.
+func (lw *lowering) wrap(value Operand, typeHint string) Operand {
+	if value.Type == noneType {
+		return lw.defaultValue(typeHint)
+	}
+	value = lw.convert(value, lw.optionals[typeHint])
+	if value.Type != lw.optionals[typeHint] {
+		return value
+	}
+	instance := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpAlloc, Dst: instance})
+	lw.emit(Instr{Op: OpStore, Dst: instance, Field: "tag", Arg1: NewInt(1)})
+	lw.emit(Instr{Op: OpStore, Dst: instance, Field: "value", Arg1: value})
+	return instance
+}
+
+// checked rejects none and optionals where a value is used as it is.
+func (lw *lowering) checked(value Operand, use string) Operand {
+	if value.Type == noneType {
+		panic(fmt.Sprintf("cannot %s none", use))
+	}
+	if lw.isOptional(value.Type) {
+		panic(fmt.Sprintf("cannot %s %s, it may be none and must be checked with ?., ?? or match first",
+			use, lw.typeName(value.Type)))
+	}
+	return value
+}
+
+// typed rejects none where the type of a new variable comes from its
+// value.
+func (lw *lowering) typed(value Operand, lexeme string) Operand {
+	if value.Type == noneType {
+		panic(fmt.Sprintf("cannot declare %s as none, which has no type, so it is only given where an optional is expected",
+			lexeme))
+	}
+	return value
+}
+
+// present loads the tag of an optional and returns whether it holds a
+// value.
+func (lw *lowering) present(optional Operand) Operand {
+	tag := lw.newTemp("Int")
+	lw.emit(Instr{Op: OpLoad, Dst: tag, Arg1: optional, Field: "tag"})
+	present := lw.newTemp("Bool")
+	lw.emit(Instr{Op: OpBinary, Dst: present, Arg1: tag, Arg2: NewInt(0), Operator: ">"})
+	return present
+}
+
+// lowerCoalesce lowers a ?? b, which is the value of a if it holds one and
+// otherwise b. If b is optional too, so is the result.
+func (lw *lowering) lowerCoalesce(node *ast.Node) Operand {
+	optional := lw.lowerExpression(node.Children[0])
+	inner, ok := lw.optionals[optional.Type]
+	if !ok {
+		panic(fmt.Sprintf("cannot use ?? on %s, it is not optional", lw.typeName(optional.Type)))
+	}
+	lw.checks += 1
+	someLabel := fmt.Sprintf("Some_%d", lw.checks)
+	endLabel := fmt.Sprintf("EndSome_%d", lw.checks)
+
+	lw.emit(Instr{Op: OpJumpIf, Arg1: lw.present(optional), Label: someLabel})
+	otherwise := lw.lowerExpression(node.Children[1])
+	typeHint := inner
+	if otherwise.Type == noneType || lw.isOptional(otherwise.Type) {
+		typeHint = optional.Type
+	}
+	otherwise = lw.convert(otherwise, typeHint)
+	if otherwise.Type != typeHint {
+		panic(fmt.Sprintf("cannot use ?? with %s and %s, the default must be %s or %s",
+			lw.typeName(optional.Type), lw.typeName(otherwise.Type), lw.typeName(inner), lw.typeName(optional.Type)))
+	}
+	result := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: otherwise})
+	lw.emit(Instr{Op: OpJump, Label: endLabel})
+
+	lw.emit(Instr{Op: OpLabel, Label: someLabel})
+	if typeHint == inner {
+		value := lw.newTemp(inner)
+		lw.emit(Instr{Op: OpLoad, Dst: value, Arg1: optional, Field: "value"})
+		lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: value})
+	} else {
+		lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: optional})
+	}
+	lw.emit(Instr{Op: OpLabel, Label: endLabel})
+	return result
+}
+
+// lowerOptionalAccess lowers a?.b and a?.b(), which use the value of a if
+// it holds one and are none otherwise. The arguments of a call are only
+// evaluated if it is made. The result is optional, unless the method
+// returns nothing, in which case there is no result.
+func (lw *lowering) lowerOptionalAccess(node *ast.Node) Operand {
+	optional := lw.lowerExpression(node.Children[0])
+	inner, ok := lw.optionals[optional.Type]
+	if !ok {
+		panic(fmt.Sprintf("cannot use ?. on %s, it is not optional, so use . instead", lw.typeName(optional.Type)))
+	}
+	lw.checks += 1
+	noneLabel := fmt.Sprintf("None_%d", lw.checks)
+	endLabel := fmt.Sprintf("EndSome_%d", lw.checks)
+
+	absent := lw.newTemp("Bool")
+	lw.emit(Instr{Op: OpNot, Dst: absent, Arg1: lw.present(optional)})
+	lw.emit(Instr{Op: OpJumpIf, Arg1: absent, Label: noneLabel})
+	object := lw.newTemp(inner)
+	lw.emit(Instr{Op: OpLoad, Dst: object, Arg1: optional, Field: "value"})
+	var value Operand
+	if node.Type == ast.TypeOptionalCall {
+		value = lw.lowerCallOn(object, node)
+		if value.Kind == OperandZero {
+			lw.emit(Instr{Op: OpLabel, Label: noneLabel})
+			return value
+		}
+	} else {
+		value = lw.newTemp(lw.fieldType(inner, []string{node.Lexeme}, node.Line))
+		lw.emit(Instr{Op: OpLoad, Dst: value, Arg1: object, Field: node.Lexeme})
+	}
+	typeHint := value.Type
+	if !lw.isOptional(typeHint) {
+		typeHint = lw.optional(typeHint, node.Line)
+	}
+	result := lw.newTemp(typeHint)
+	lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: lw.convert(value, typeHint)})
+	lw.emit(Instr{Op: OpJump, Label: endLabel})
+
+	lw.emit(Instr{Op: OpLabel, Label: noneLabel})
+	lw.emit(Instr{Op: OpCopy, Dst: result, Arg1: lw.defaultValue(typeHint)})
+	lw.emit(Instr{Op: OpLabel, Label: endLabel})
+	return result
+}
@@ -21,6 +21,19 @@ const (
 	TypeTypeHint
 	TypeSkip
 	TypeSkipIf
+	TypeRef
+	TypeVal
+	TypeReadonly
+	TypeEnum
+	TypeMatch
+	TypeFn
+	TypeReturn
+	TypeInterface
+	TypeImpl
+	TypeFor
+	TypeNone
+	TypeOptionalChain
+	TypeImport
 )
 
 func (e TokenType) String() string {
@@ -43,6 +56,32 @@ func (e TokenType) String() string {
 		return "TypeStruct"
 	case TypeTypeHint:
 		return "TypeTypeHint"
+	case TypeRef:
+		return "TypeRef"
+	case TypeVal:
+		return "TypeVal"
+	case TypeReadonly:
+		return "TypeReadonly"
+	case TypeEnum:
+		return "TypeEnum"
+	case TypeMatch:
+		return "TypeMatch"
+	case TypeFn:
+		return "TypeFn"
+	case TypeReturn:
+		return "TypeReturn"
+	case TypeInterface:
+		return "TypeInterface"
+	case TypeImpl:
+		return "TypeImpl"
+	case TypeFor:
+		return "TypeFor"
+	case TypeNone:
+		return "TypeNone"
+	case TypeOptionalChain:
+		return "TypeOptionalChain"
+	case TypeImport:
+		return "TypeImport"
 	default:
 		return string(rune(e))
 	}
@@ -78,6 +117,18 @@ func NewLexer(reader io.RuneReader) Lexer {
 	lexer.reserve(Token{Type: TypePrint, Lexeme: "print"})
 	lexer.reserve(Token{Type: TypeNot, Lexeme: "!"})
 	lexer.reserve(Token{Type: TypeStruct, Lexeme: "struct"})
+	lexer.reserve(Token{Type: TypeRef, Lexeme: "ref"})
+	lexer.reserve(Token{Type: TypeVal, Lexeme: "val"})
+	lexer.reserve(Token{Type: TypeReadonly, Lexeme: "readonly"})
+	lexer.reserve(Token{Type: TypeEnum, Lexeme: "enum"})
+	lexer.reserve(Token{Type: TypeMatch, Lexeme: "match"})
+	lexer.reserve(Token{Type: TypeFn, Lexeme: "fn"})
+	lexer.reserve(Token{Type: TypeReturn, Lexeme: "return"})
+	lexer.reserve(Token{Type: TypeInterface, Lexeme: "interface"})
+	lexer.reserve(Token{Type: TypeImpl, Lexeme: "impl"})
+	lexer.reserve(Token{Type: TypeFor, Lexeme: "for"})
+	lexer.reserve(Token{Type: TypeNone, Lexeme: "none"})
+	lexer.reserve(Token{Type: TypeImport, Lexeme: "import"})
 	lexer.reserve(Token{Type: TypeSkip, Lexeme: "skip"})
 	lexer.reserve(Token{Type: TypeSkipIf, Lexeme: "skip_if"})
 	lexer.reserve(Token{Type: TypeTypeHint, Lexeme: "Int"})
@@ -133,6 +184,14 @@ func (lexer *Lexer) scan() (*Token, error) {
 		return lexer.scanOperator(token)
 	}
 
+	if lexer.peek == '?' {
+		return lexer.scanQuestionMark(token)
+	}
+
+	if reserved, exists := lexer.Lexemes[token.Lexeme]; exists {
+		token.Type = reserved.Type
+	}
+
 	lexer.peek = ' '
 	return &token, nil
 }
@@ -231,6 +290,23 @@ func (lexer *Lexer) scanOperator(token Token) (*Token, error) {
 	return &token, nil
 }
 
+// scanQuestionMark scans ?? as an operator and ?. as one token, and
+// otherwise the ? of an optional type, keeping the rune after it.
+func (lexer *Lexer) scanQuestionMark(token Token) (*Token, error) {
+	lexer.peekNext()
+	switch lexer.peek {
+	case '?':
+		token.Type = TypeOperator
+		token.Lexeme = "??"
+		lexer.peekNext()
+	case '.':
+		token.Type = TypeOptionalChain
+		token.Lexeme = "?."
+		lexer.peekNext()
+	}
+	return &token, nil
+}
+
 func (lexer *Lexer) ScanAll() []Token {
 	var tokens []Token
 	for {
@@ -0,0 +1,355 @@
+package module
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ast"
+	"github.com/magnetenstad/dragon-compiler/pkg/error"
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+	"github.com/magnetenstad/dragon-compiler/pkg/parser"
+)
+
+/*
+	Modules split a program over several .bip files.
+
+	import "geometry" loads geometry.bip, looked for next to the importing
+	file and then in each directory of the search path, and makes its types
+	available as geometry.Point. import "geometry" (Point, Shape) also makes
+	Point and Shape available without the module name. A module is loaded
+	once however often it is imported, and may not import itself, directly
+	or through other modules.
+
+	The modules are merged into the AST of the main file, imports first, so
+	the later passes see one program. The declarations of an imported module
+	are renamed after it, like Geometry_Point, so modules need not avoid
+	each other's names, and a module only sees the types it declares or
+	imports. Module names are lowercase letters, so the prefix of a name
+	tells which module it comes from. An imported module may only declare
+	types and methods, since the statements of the program are those of the
+	main file.
+*/
+
+type module struct {
+	name       string
+	prefix     string
+	source     string
+	root       *ast.RootNode
+	declared   map[string]*ast.Node // The types it declares, by their name in it
+	names      map[string]string    // The names of the types it uses without a module name
+	imports    map[string]*module   // The modules it imports, by name
+	importedBy map[string]string    // The file each name imported without its module comes from
+}
+
+type resolver struct {
+	path    []string
+	loaded  map[string]*module // The modules by absolute path
+	loading []*module          // The modules whose imports are being loaded
+	order   []*module          // The imported modules, each after its imports
+}
+
+// The types every module can use, and Process, which has the functions of
+// the standard library for the program
+var builtins = map[string]bool{"Int": true, "Float": true, "String": true, "Bool": true, "Process": true}
+
+// Resolve loads the modules imported by the program in root, parsed from
+// source, and merges them into it. Modules are looked for next to the file
+// importing them and then in the directories of path.
+func Resolve(root *ast.RootNode, source string, path []string) {
+	rs := resolver{path: path, loaded: make(map[string]*module)}
+	main := newModule("", source, root)
+	rs.loaded[absolute(source)] = main
+	rs.load(main)
+
+	var declarations, methods, impls []*ast.Node
+	for _, m := range rs.order {
+		root.Modules = append(root.Modules, &ast.Module{Name: m.name, Prefix: m.prefix, Source: m.source})
+		declarations = append(declarations, m.root.Declarations...)
+		methods = append(methods, m.root.Methods...)
+		impls = append(impls, m.root.Impls...)
+	}
+	for _, m := range rs.order {
+		for name := range main.declared {
+			if strings.HasPrefix(name, m.prefix) {
+				panic(fmt.Sprintf("cannot declare %s in %s, names starting with %s are kept for %s",
+					name, source, m.prefix, m.source))
+			}
+		}
+	}
+	root.Declarations = append(declarations, root.Declarations...)
+	root.Methods = append(methods, root.Methods...)
+	root.Impls = append(impls, root.Impls...)
+}
+
+// Load parses the program in source and resolves the modules it imports,
+// looking for them in the directories of path as Resolve does.
+func Load(source string, path []string) *ast.RootNode {
+	root := parse(source)
+	Resolve(root, source, path)
+	return root
+}
+
+func newModule(name string, source string, root *ast.RootNode) *module {
+	m := &module{
+		name:       name,
+		source:     source,
+		root:       root,
+		declared:   make(map[string]*ast.Node),
+		names:      make(map[string]string),
+		imports:    make(map[string]*module),
+		importedBy: make(map[string]string),
+	}
+	if name != "" {
+		m.prefix = strings.ToUpper(name[:1]) + name[1:] + "_"
+	}
+	for _, declaration := range root.Declarations {
+		m.declared[declaration.Lexeme] = declaration
+		m.names[declaration.Lexeme] = m.prefix + declaration.Lexeme
+	}
+	return m
+}
+
+// load loads the imports of a module, and then renames it.
+func (rs *resolver) load(m *module) {
+	rs.loading = append(rs.loading, m)
+	for _, node := range m.root.Imports {
+		rs.importInto(m, node)
+	}
+	rs.loading = rs.loading[:len(rs.loading)-1]
+	m.rename()
+}
+
+func (rs *resolver) importInto(m *module, node *ast.Node) {
+	name := moduleName(node.Lexeme)
+	for _, letter := range name {
+		if !unicode.IsLower(letter) {
+			panic(fmt.Sprintf("cannot import \"%s\" at line %d in %s, module names must be lowercase letters, like geometry",
+				node.Lexeme, node.Line, m.source))
+		}
+	}
+	source := rs.locate(node, m)
+	imported, ok := rs.loaded[absolute(source)]
+	if !ok {
+		for _, other := range rs.loaded {
+			if other.name == name {
+				panic(fmt.Sprintf("cannot import %s at line %d in %s, %s is already imported as %s",
+					source, node.Line, m.source, other.source, name))
+			}
+		}
+		imported = newModule(name, source, parse(source))
+		rs.loaded[absolute(source)] = imported
+		rs.load(imported)
+		imported.checkDeclarationsOnly()
+		rs.order = append(rs.order, imported)
+	}
+	for _, loading := range rs.loading {
+		if loading == imported {
+			panic(fmt.Sprintf("import cycle: %s", rs.cycle(imported)))
+		}
+	}
+	if other, ok := m.imports[name]; ok && other != imported {
+		panic(fmt.Sprintf("cannot import %s at line %d in %s, %s is already imported as %s",
+			source, node.Line, m.source, other.source, name))
+	}
+	m.imports[name] = imported
+
+	for _, child := range node.Children {
+		if _, ok := imported.declared[child.Lexeme]; !ok {
+			panic(fmt.Sprintf("%s has no type %s, at line %d in %s", source, child.Lexeme, child.Line, m.source))
+		}
+		if _, ok := m.declared[child.Lexeme]; ok {
+			panic(fmt.Sprintf("cannot import %s from %s at line %d in %s, which declares a %s of its own",
+				child.Lexeme, source, child.Line, m.source, child.Lexeme))
+		}
+		if from, ok := m.importedBy[child.Lexeme]; ok && from != source {
+			panic(fmt.Sprintf("cannot import %s from %s at line %d in %s, it is already imported from %s",
+				child.Lexeme, source, child.Line, m.source, from))
+		}
+		m.names[child.Lexeme] = imported.prefix + child.Lexeme
+		m.importedBy[child.Lexeme] = source
+	}
+}
+
+// locate finds the file of an imported module, next to the file importing
+// it or in a directory of the search path.
+func (rs *resolver) locate(node *ast.Node, m *module) string {
+	filename := strings.TrimSuffix(node.Lexeme, ".bip") + ".bip"
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	directories := append([]string{filepath.Dir(m.source)}, rs.path...)
+	for _, directory := range directories {
+		candidate := filepath.Join(directory, filename)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	panic(fmt.Sprintf("cannot find \"%s\" imported at line %d in %s, looked in %s",
+		node.Lexeme, node.Line, m.source, strings.Join(directories, ", ")))
+}
+
+// cycle lists the files importing each other, from a module being loaded
+// back to itself.
+func (rs *resolver) cycle(imported *module) string {
+	var sources []string
+	for i := len(rs.loading) - 1; i >= 0; i-- {
+		sources = append([]string{rs.loading[i].source}, sources...)
+		if rs.loading[i] == imported {
+			break
+		}
+	}
+	return strings.Join(append(sources, imported.source), " imports ")
+}
+
+// checkDeclarationsOnly rejects statements in an imported module.
+func (m *module) checkDeclarationsOnly() {
+	var check func(node *ast.Node)
+	check = func(node *ast.Node) {
+		if node.Type == ast.TypeStatement && len(node.Children) > 0 {
+			panic(fmt.Sprintf("%s is imported and can only declare types and methods, but has a statement at line %d",
+				m.source, node.Line))
+		}
+		for _, child := range node.Children {
+			check(child)
+		}
+	}
+	check(m.root.Node)
+}
+
+func moduleName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".bip")
+}
+
+func absolute(source string) string {
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return source
+	}
+	return path
+}
+
+func parse(source string) *ast.RootNode {
+	file, err := os.Open(source)
+	error.Check(err)
+	defer file.Close()
+
+	lexer := lexer.NewLexer(bufio.NewReader(file))
+	parser := parser.NewParser(lexer.ScanAll())
+	return parser.Parse()
+}
+
+// rename renames the types in the declarations of a module to the names
+// they have in the program. The type parameters of generic structs and
+// methods are not renamed, within the declarations they belong to.
+func (m *module) rename() {
+	for _, method := range m.root.Methods {
+		receiver, _, _ := strings.Cut(method.Lexeme, ".")
+		parameters := typeParameters(method)
+		if declaration, ok := m.declared[receiver]; ok {
+			for name := range typeParameters(declaration) {
+				parameters[name] = true
+			}
+		}
+		m.renameNode(method, parameters)
+	}
+	for _, declaration := range m.root.Declarations {
+		m.renameNode(declaration, typeParameters(declaration))
+	}
+	for _, impl := range m.root.Impls {
+		m.renameNode(impl, nil)
+	}
+	m.renameNode(m.root.Node, nil)
+}
+
+func typeParameters(node *ast.Node) map[string]bool {
+	parameters := make(map[string]bool)
+	for _, parameter := range node.TypeParameters {
+		parameters[parameter.Lexeme] = true
+	}
+	return parameters
+}
+
+func (m *module) renameNode(node *ast.Node, parameters map[string]bool) {
+	if node.TypeHint != "" {
+		node.TypeHint = m.renameType(node.TypeHint, parameters, node.Line)
+	}
+	switch node.Type {
+	case ast.TypeStructDeclaration, ast.TypeRefStructDeclaration, ast.TypeEnumDeclaration,
+		ast.TypeInterfaceDeclaration, ast.TypeImplDeclaration, ast.TypeConstructor:
+		node.Lexeme = m.renameType(node.Lexeme, parameters, node.Line)
+	case ast.TypeMethodDeclaration, ast.TypeMethodSignature, ast.TypeStaticCall:
+		receiver, method, _ := strings.Cut(node.Lexeme, ".")
+		node.Lexeme = m.renameType(receiver, parameters, node.Line) + "." + method
+	}
+	for _, child := range node.Children {
+		m.renameNode(child, parameters)
+	}
+	for _, parameter := range node.TypeParameters {
+		m.renameNode(parameter, parameters)
+	}
+}
+
+// renameType renames the types in a type hint or a constructor, like
+// geometry.Pair[Point, Int]? or Shape.Circle, where the variant keeps its
+// name.
+func (m *module) renameType(typeHint string, parameters map[string]bool, line int) string {
+	runes := []rune(typeHint)
+	var sb strings.Builder
+	for i := 0; i < len(runes); {
+		end := wordEnd(runes, i)
+		if end == i {
+			sb.WriteRune(runes[i])
+			i++
+			continue
+		}
+		word := string(runes[i:end])
+		switch {
+		case unicode.IsLower(runes[i]):
+			// A module, followed by a dot and a type
+			nameEnd := wordEnd(runes, end+1)
+			sb.WriteString(m.qualified(word, string(runes[end+1:nameEnd]), line))
+			end = nameEnd
+		case i > 0 && runes[i-1] == '.', parameters[word], builtins[word]:
+			sb.WriteString(word)
+		default:
+			sb.WriteString(m.unqualified(word))
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+func wordEnd(runes []rune, i int) int {
+	for i < len(runes) && (unicode.IsLetter(runes[i]) || runes[i] == '_') {
+		i++
+	}
+	return i
+}
+
+// qualified returns the name in the program of a type named with the
+// module it comes from, like geometry.Point.
+func (m *module) qualified(moduleName string, name string, line int) string {
+	imported, ok := m.imports[moduleName]
+	if !ok {
+		panic(fmt.Sprintf("unknown module %s, at line %d in %s, it must be imported first",
+			moduleName, line, m.source))
+	}
+	if _, ok := imported.declared[name]; !ok {
+		panic(fmt.Sprintf("%s has no type %s, at line %d in %s", imported.source, name, line, m.source))
+	}
+	return imported.prefix + name
+}
+
+// unqualified returns the name in the program of a type named without a
+// module. A type the module does not know is left to be reported as
+// unknown, under a name no other module can declare.
+func (m *module) unqualified(name string) string {
+	if renamed, ok := m.names[name]; ok {
+		return renamed
+	}
+	return m.prefix + name
+}
@@ -0,0 +1,135 @@
+package opt
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+// removeDeadCode removes instructions without side effects whose result
+// is never read, other than by instructions removed as well. A call is kept
+// for what the method does besides returning, and so is a builtin, since
+// some read input or end the program.
+func removeDeadCode(fn *ir.Func) bool {
+	graph := cfg.Build(fn)
+	// The reads of a dead instruction keep nothing live, so a chain of dead
+	// copies goes at once
+	liveness := dataflow.Solve(graph, dataflow.Analysis[dataflow.Set[string]]{
+		Direction: dataflow.Backward,
+		Boundary:  dataflow.NewSet[string](),
+		Init:      func() dataflow.Set[string] { return dataflow.NewSet[string]() },
+		Meet:      dataflow.Union[string],
+		Transfer: func(block *cfg.Block, out dataflow.Set[string]) dataflow.Set[string] {
+			live := out.Copy()
+			for i := len(block.Instrs) - 1; i >= 0; i-- {
+				if !isDead(block.Instrs[i], live) {
+					dataflow.TransferLive(block.Instrs[i], live)
+				}
+			}
+			return live
+		},
+		Equal: dataflow.Equal[string],
+	})
+
+	changed := false
+	for _, block := range graph.Blocks {
+		dead := make([]bool, len(block.Instrs))
+		live := liveness.Out[block].Copy()
+		for i := len(block.Instrs) - 1; i >= 0; i-- {
+			dead[i] = isDead(block.Instrs[i], live)
+			if !dead[i] {
+				dataflow.TransferLive(block.Instrs[i], live)
+			}
+		}
+		instrs := block.Instrs[:0]
+		for i, instr := range block.Instrs {
+			if dead[i] {
+				changed = true
+				continue
+			}
+			instrs = append(instrs, instr)
+		}
+		block.Instrs = instrs
+	}
+	fn.Code = graph.Code()
+	return changed
+}
+
+// isDead reports whether an instruction only writes a variable that is not
+// live after it.
+func isDead(instr ir.Instr, live dataflow.Set[string]) bool {
+	target, ok := instr.Def()
+	if instr.Op == ir.OpStore {
+		target, ok = instr.Dst, instr.Dst.IsVariable()
+	}
+	return ok && instr.Op != ir.OpCall && instr.Op != ir.OpBuiltin && !live[target.String()]
+}
+
+// removeUnreachable removes the blocks that can never execute.
+func removeUnreachable(fn *ir.Func) bool {
+	graph := cfg.Build(fn)
+	reachable := graph.Reachable()
+	changed := false
+	var code []ir.Instr
+	for _, block := range graph.Blocks {
+		if !reachable[block] && len(block.Instrs) > 0 {
+			changed = true
+			continue
+		}
+		code = append(code, block.Instrs...)
+	}
+	fn.Code = code
+	return changed
+}
+
+// simplifyJumps resolves conditional jumps on constants, and removes jumps
+// to the next instruction and labels nothing jumps to.
+func simplifyJumps(fn *ir.Func) bool {
+	changed := false
+	code := fn.Code[:0]
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpJumpIf && instr.Arg1.Kind == ir.OperandBool {
+			changed = true
+			if instr.Arg1.Number == 0 {
+				continue
+			}
+			instr = ir.Instr{Op: ir.OpJump, Label: instr.Label, Line: instr.Line}
+		}
+		code = append(code, instr)
+	}
+
+	targets := make(map[string]bool)
+	for i, instr := range code {
+		if !instr.IsJump() {
+			continue
+		}
+		fallsThrough := false
+		for _, next := range code[i+1:] {
+			if next.Op != ir.OpLabel {
+				break
+			}
+			if next.Label == instr.Label {
+				fallsThrough = true
+				break
+			}
+		}
+		if fallsThrough {
+			code[i] = ir.Instr{}
+			changed = true
+			continue
+		}
+		targets[instr.Label] = true
+	}
+
+	fn.Code = code[:0]
+	for _, instr := range code {
+		if instr.Op == ir.OpZero || (instr.Op == ir.OpLabel && !targets[instr.Label]) {
+			if instr.Op == ir.OpLabel {
+				changed = true
+			}
+			continue
+		}
+		fn.Code = append(fn.Code, instr)
+	}
+	return changed
+}
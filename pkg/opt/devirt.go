@@ -0,0 +1,96 @@
+package opt
+
+import (
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+// devirtualize calls the method of the struct directly when a call on an
+// interface value can only run one of them, either because a single struct
+// implements the interface, or because the value was built from a struct
+// earlier in the same block, possibly passing through fields and copies on
+// the way. The struct is loaded from the interface value into a new
+// temporary.
+func devirtualize(program *ir.Program, fn *ir.Func) bool {
+	temps := 0
+	for _, local := range fn.Locals {
+		if local.Kind == ir.OperandTemp && local.Number > temps {
+			temps = local.Number
+		}
+	}
+	changed := false
+	// The struct held by interface values, by variable or by field path
+	// like x.shape
+	known := make(map[string]string)
+	forget := func(path string) {
+		for key := range known {
+			if key == path || strings.HasPrefix(key, path+".") {
+				delete(known, key)
+			}
+		}
+	}
+	var code []ir.Instr
+	for _, instr := range fn.Code {
+		switch instr.Op {
+		case ir.OpLabel:
+			known = make(map[string]string)
+		case ir.OpStore:
+			path := instr.Dst.String() + "." + instr.Field
+			forget(path)
+			if st, ok := program.GetStruct(instr.Dst.Type); ok && st.Interface && st.Tag(instr.Field) >= 0 {
+				known[instr.Dst.String()] = instr.Field
+			} else if variant, ok := known[instr.Arg1.String()]; ok {
+				known[path] = variant
+			}
+		case ir.OpCall:
+			st, ok := program.GetStruct(instr.Arg1.Type)
+			if !ok || !st.Interface {
+				// The method may assign to the fields of the struct
+				for key := range known {
+					if strings.HasPrefix(key, instr.Arg1.String()+".") {
+						delete(known, key)
+					}
+				}
+				break
+			}
+			variant, ok := known[instr.Arg1.String()]
+			if len(st.Variants) == 1 {
+				variant, ok = st.Variants[0], true
+			}
+			if !ok {
+				break
+			}
+			temps++
+			value := ir.Operand{Kind: ir.OperandTemp, Number: temps, Type: variant}
+			fn.Locals = append(fn.Locals, value)
+			code = append(code, ir.Instr{
+				Op:    ir.OpLoad,
+				Dst:   value,
+				Arg1:  instr.Arg1,
+				Field: variant,
+				Line:  instr.Line,
+			})
+			instr.Arg1 = value
+			instr.Func = variant + "." + strings.TrimPrefix(instr.Func, st.Name+".")
+			changed = true
+		}
+		if dst, ok := instr.Def(); ok {
+			forget(dst.String())
+			source := instr.Arg1.String()
+			if instr.Op == ir.OpLoad {
+				source += "." + instr.Field
+			} else if instr.Op != ir.OpCopy {
+				source = ""
+			}
+			for key, variant := range known {
+				if source != "" && (key == source || strings.HasPrefix(key, source+".")) {
+					known[dst.String()+strings.TrimPrefix(key, source)] = variant
+				}
+			}
+		}
+		code = append(code, instr)
+	}
+	fn.Code = code
+	return changed
+}
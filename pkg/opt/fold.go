@@ -0,0 +1,34 @@
+package opt
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+// fold evaluates an operation on constants at compile time, turning the
+// instruction into a copy of the result.
+func fold(instr *ir.Instr) bool {
+	switch instr.Op {
+	case ir.OpBinary:
+		value, ok := ir.Evaluate(instr.Operator, instr.Arg1, instr.Arg2)
+		if ok {
+			*instr = ir.Instr{
+				Op:   ir.OpCopy,
+				Dst:  instr.Dst,
+				Arg1: value,
+				Line: instr.Line,
+			}
+			return true
+		}
+	case ir.OpNot:
+		if instr.Arg1.Kind == ir.OperandBool {
+			*instr = ir.Instr{
+				Op:   ir.OpCopy,
+				Dst:  instr.Dst,
+				Arg1: ir.NewBool(instr.Arg1.Number == 0),
+				Line: instr.Line,
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package opt
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/ssa"
+)
+
+/*
+	Optimization passes over the three-address code.
+	-O1 calls methods directly where the struct behind an interface value is
+	known, folds and propagates constants and removes unreachable code.
+	-O2 also propagates copies and removes dead code, and runs sparse
+	conditional constant propagation and global value numbering in SSA form.
+	The passes are repeated until none of them changes the code.
+*/
+
+type pass func(fn *ir.Func) bool
+
+func Optimize(program *ir.Program, level int) {
+	var passes []pass
+	if level >= 1 {
+		passes = append(passes,
+			propagateConstants,
+			removeUnreachable,
+			simplifyJumps)
+	}
+	if level >= 2 {
+		// Copies are propagated along with the constants
+		passes[0] = propagateCopies
+		passes = append(passes,
+			coalesceTemps,
+			removeDeadCode)
+	}
+	if len(passes) == 0 {
+		return
+	}
+
+	for _, fn := range program.Funcs() {
+		devirtualize(program, fn)
+		optimizeFunc(fn, passes, level)
+	}
+}
+
+func optimizeFunc(fn *ir.Func, passes []pass, level int) {
+	runPasses(fn, passes)
+	if level >= 2 {
+		graph := ssa.Build(fn)
+		ssa.PropagateConstants(graph)
+		ssa.NumberValues(graph)
+		ssa.Destroy(graph)
+		runPasses(fn, passes)
+	}
+	removeUnusedLocals(fn)
+}
+
+func runPasses(fn *ir.Func, passes []pass) {
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			if pass(fn) {
+				changed = true
+			}
+		}
+	}
+}
+
+// removeUnusedLocals drops temporaries and variables no instruction mentions.
+func removeUnusedLocals(fn *ir.Func) {
+	used := make(map[string]bool)
+	for _, instr := range fn.Code {
+		operands := append([]ir.Operand{instr.Dst, instr.Arg1, instr.Arg2}, instr.Args...)
+		for _, operand := range operands {
+			if operand.IsVariable() {
+				used[operand.String()] = true
+			}
+		}
+	}
+	locals := fn.Locals[:0]
+	for _, local := range fn.Locals {
+		if used[local.String()] {
+			locals = append(locals, local)
+		}
+	}
+	fn.Locals = locals
+}
+
+// replaceUses rewrites the operands an instruction reads as values.
+// The destination of a store is updated in place and is left alone, like
+// the struct a field is loaded from or a method is called on.
+func replaceUses(instr *ir.Instr, replace func(ir.Operand) (ir.Operand, bool)) bool {
+	changed := false
+	update := func(operand *ir.Operand) {
+		if !operand.IsVariable() {
+			return
+		}
+		if replacement, ok := replace(*operand); ok {
+			*operand = replacement
+			changed = true
+		}
+	}
+	switch instr.Op {
+	case ir.OpCopy, ir.OpNot, ir.OpJumpIf, ir.OpPrint, ir.OpStore, ir.OpReturn:
+		update(&instr.Arg1)
+	case ir.OpBinary:
+		update(&instr.Arg1)
+		update(&instr.Arg2)
+	case ir.OpCall, ir.OpBuiltin:
+		for i := range instr.Args {
+			update(&instr.Args[i])
+		}
+	}
+	return changed
+}
+
+func isScalar(typeHint string) bool {
+	return typeHint == "Int" ||
+		typeHint == "Float" ||
+		typeHint == "Bool" ||
+		typeHint == "String"
+}
@@ -0,0 +1,98 @@
+package opt
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+	"github.com/magnetenstad/dragon-compiler/pkg/module"
+	"github.com/magnetenstad/dragon-compiler/pkg/vm"
+)
+
+// run compiles the program in source at level and runs it in the VM,
+// returning what it prints and the code it exits with.
+func run(t *testing.T, source string, level int) (string, int) {
+	program := ir.Lower(module.Load(source, nil))
+	Optimize(program, level)
+
+	var out strings.Builder
+	machine := vm.New(bytecode.Compile(program), &out)
+	machine.Input(strings.NewReader("dragon\n"))
+	machine.Args([]string{"dragon"})
+	if err := machine.Run(); err != nil {
+		var exitError *vm.ExitError
+		if !errors.As(err, &exitError) {
+			t.Fatalf("%s at -O%d: %s", source, level, err)
+		}
+		return out.String(), exitError.Code
+	}
+	return out.String(), 0
+}
+
+func TestLevelsKeepOutput(t *testing.T) {
+	sources, _ := filepath.Glob("../../examples/*.bip")
+	if len(sources) == 0 {
+		t.Fatal("no examples")
+	}
+	for _, source := range sources {
+		t.Run(filepath.Base(source), func(t *testing.T) {
+			want, wantCode := run(t, source, 0)
+			for level := 1; level <= 2; level++ {
+				got, code := run(t, source, level)
+				if got != want || code != wantCode {
+					t.Errorf("-O%d printed %q and exited with %d, -O0 printed %q and exited with %d",
+						level, got, code, want, wantCode)
+				}
+			}
+		})
+	}
+}
+
+func variable(name string) ir.Operand {
+	return ir.Operand{Kind: ir.OperandVar, Lexeme: name, Type: "Int"}
+}
+
+// chain makes main with a chain of variables, each one more than the last,
+// printing the last.
+func chain(length int) *ir.Func {
+	fn := &ir.Func{Name: "main"}
+	previous := variable("a")
+	fn.Code = append(fn.Code, ir.Instr{Op: ir.OpCopy, Dst: previous, Arg1: ir.NewInt(0)})
+	for i := 1; i < length; i++ {
+		next := variable(strings.Repeat("a", i+1))
+		fn.Code = append(fn.Code, ir.Instr{Op: ir.OpBinary, Operator: "+", Dst: next, Arg1: previous, Arg2: ir.NewInt(1)})
+		previous = next
+	}
+	fn.Code = append(fn.Code, ir.Instr{Op: ir.OpPrint, Arg1: previous})
+	for _, instr := range fn.Code[:length] {
+		fn.Locals = append(fn.Locals, instr.Dst)
+	}
+	return fn
+}
+
+// TestPropagateChains checks that one pass resolves a chain of constants.
+func TestPropagateChains(t *testing.T) {
+	fn := chain(50)
+	if !propagateConstants(fn) || propagateConstants(fn) {
+		t.Fatal("propagating the chain took more than one pass")
+	}
+	if print := fn.Code[len(fn.Code)-1]; print.Arg1 != ir.NewInt(49) {
+		t.Fatalf("printed %s, want 49", print.Arg1)
+	}
+}
+
+// TestRemoveDeadChains checks that one pass removes a chain nothing reads,
+// though each link reads the one before.
+func TestRemoveDeadChains(t *testing.T) {
+	fn := chain(50)
+	fn.Code[len(fn.Code)-1].Arg1 = ir.NewInt(7)
+	if !removeDeadCode(fn) || removeDeadCode(fn) {
+		t.Fatal("removing the chain took more than one pass")
+	}
+	if len(fn.Code) != 1 {
+		t.Errorf("%d instructions left, want the print", len(fn.Code))
+	}
+}
@@ -0,0 +1,186 @@
+package opt
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+type reachingInfo struct {
+	graph    *cfg.Graph
+	reaching *dataflow.Reaching
+	sources  map[dataflow.Definition]copySource // The source of each copy, as of the last walk
+}
+
+// copySource is the variable a copy reads and its definitions reaching the copy.
+type copySource struct {
+	operand     ir.Operand
+	definitions []dataflow.Definition
+}
+
+// definitions returns the definitions of a variable in a set of reaching
+// definitions, and false if the variable may be unassigned.
+func (info reachingInfo) definitions(reaching dataflow.Bits, variable string) ([]dataflow.Definition, bool) {
+	definitions := info.reaching.Of(reaching, variable)
+	for _, definition := range definitions {
+		if definition.IsEntry() {
+			return nil, false
+		}
+	}
+	return definitions, len(definitions) > 0
+}
+
+func (info reachingInfo) instr(definition dataflow.Definition) ir.Instr {
+	return info.graph.Blocks[definition.Block].Instrs[definition.Index]
+}
+
+// propagateConstants replaces reads of a variable with a constant when every
+// definition reaching the read assigns that same constant.
+func propagateConstants(fn *ir.Func) bool {
+	return propagate(fn, false)
+}
+
+// propagateCopies propagates constants, and also replaces reads of x with y
+// after a copy x = y, as long as that copy is the only definition of x
+// reaching the read and y has not been redefined in between. Structs are
+// updated in place by stores, so only scalar copies are propagated.
+func propagateCopies(fn *ir.Func) bool {
+	return propagate(fn, true)
+}
+
+// propagate folds each instruction as soon as its operands are replaced,
+// so a chain of constants is resolved in one walk over the blocks. Neither
+// moves a definition, so the reaching definitions are found once and the
+// walks repeat until they change nothing.
+func propagate(fn *ir.Func, copies bool) bool {
+	graph := cfg.Build(fn)
+	info := reachingInfo{
+		graph:    graph,
+		reaching: dataflow.ReachingDefinitions(graph),
+		sources:  make(map[dataflow.Definition]copySource),
+	}
+	changed := false
+	for walking := true; walking; {
+		walking = false
+		for _, block := range graph.Blocks {
+			info.reaching.Walk(block, func(i int, reaching dataflow.Bits) {
+				instr := &block.Instrs[i]
+				replaced := replaceUses(instr, func(use ir.Operand) (ir.Operand, bool) {
+					if constant, ok := info.constant(reaching, use); ok {
+						return constant, true
+					}
+					if copies {
+						return info.source(reaching, use)
+					}
+					return ir.Operand{}, false
+				})
+				if fold(instr) || replaced {
+					walking, changed = true, true
+				}
+				if instr.Op == ir.OpCopy && instr.Arg1.IsVariable() {
+					copy := dataflow.Definition{Variable: instr.Dst.String(), Block: block.Index, Index: i}
+					info.sources[copy] = copySource{
+						operand:     instr.Arg1,
+						definitions: info.reaching.Of(reaching, instr.Arg1.String()),
+					}
+				}
+			})
+		}
+	}
+	fn.Code = graph.Code()
+	return changed
+}
+
+// constant returns the constant every definition of use reaching a read assigns.
+func (info reachingInfo) constant(reaching dataflow.Bits, use ir.Operand) (ir.Operand, bool) {
+	definitions, ok := info.definitions(reaching, use.String())
+	if !ok {
+		return ir.Operand{}, false
+	}
+	var constant ir.Operand
+	for j, definition := range definitions {
+		instr := info.instr(definition)
+		if instr.Op != ir.OpCopy || !instr.Arg1.IsConstant() {
+			return ir.Operand{}, false
+		}
+		if j > 0 && instr.Arg1 != constant {
+			return ir.Operand{}, false
+		}
+		constant = instr.Arg1
+	}
+	return constant, true
+}
+
+// source returns y for a read of x reached only by the copy x = y, if y
+// still has the definitions it had at the copy. A copy the walk has not
+// reached yet is left for the next walk.
+func (info reachingInfo) source(reaching dataflow.Bits, use ir.Operand) (ir.Operand, bool) {
+	if !isScalar(use.Type) {
+		return ir.Operand{}, false
+	}
+	definitions, ok := info.definitions(reaching, use.String())
+	if !ok || len(definitions) != 1 {
+		return ir.Operand{}, false
+	}
+	copy := info.instr(definitions[0])
+	source, ok := info.sources[definitions[0]]
+	if copy.Op != ir.OpCopy || !ok || source.operand != copy.Arg1 || source.operand == use {
+		return ir.Operand{}, false
+	}
+	if !sameDefinitions(source.definitions, info.reaching.Of(reaching, source.operand.String())) {
+		return ir.Operand{}, false
+	}
+	return source.operand, true
+}
+
+func sameDefinitions(a []dataflow.Definition, b []dataflow.Definition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	in := dataflow.NewSet[dataflow.Definition]()
+	for _, definition := range a {
+		in[definition] = true
+	}
+	for _, definition := range b {
+		if !in[definition] {
+			return false
+		}
+	}
+	return true
+}
+
+// coalesceTemps computes a value directly into x when a temporary is only
+// used by the copy x = t right after its definition.
+func coalesceTemps(fn *ir.Func) bool {
+	uses := make(map[string]int)
+	for _, instr := range fn.Code {
+		for _, use := range instr.Uses() {
+			if use.IsVariable() {
+				uses[use.String()] += 1
+			}
+		}
+	}
+
+	changed := false
+	code := fn.Code[:0]
+	for i := 0; i < len(fn.Code); i++ {
+		instr := fn.Code[i]
+		if i+1 < len(fn.Code) {
+			next := fn.Code[i+1]
+			temp := instr.Dst
+			if (instr.Op == ir.OpBinary || instr.Op == ir.OpNot || instr.Op == ir.OpLoad) &&
+				temp.Kind == ir.OperandTemp &&
+				next.Op == ir.OpCopy && next.Arg1 == temp &&
+				uses[temp.String()] == 1 {
+				instr.Dst = next.Dst
+				code = append(code, instr)
+				i += 1
+				changed = true
+				continue
+			}
+		}
+		code = append(code, instr)
+	}
+	fn.Code = code
+	return changed
+}
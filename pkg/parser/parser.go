@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/magnetenstad/dragon-compiler/pkg/ast"
 	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
@@ -42,6 +43,19 @@ func (parser *Parser) match(tType lexer.TokenType) lexer.Token {
 	return lexer.Token{}
 }
 
+func (parser *Parser) lookaheadLine() int {
+	return parser.lookahead.Position.Line
+}
+
+// peek returns the token n places after the lookahead, or the zero token
+// past the end.
+func (parser *Parser) peek(n int) lexer.Token {
+	if parser.index+n < len(parser.tokens) {
+		return parser.tokens[parser.index+n]
+	}
+	return lexer.Token{}
+}
+
 func (parser *Parser) next() bool {
 	parser.line = parser.lookahead.Position.Line
 
@@ -82,11 +96,12 @@ func (parser *Parser) matchProgram() {
 }
 
 func (parser *Parser) matchBlock(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeBlock}
+	node := ast.Node{Type: ast.TypeBlock, Line: parser.lookaheadLine()}
 
 	parser.match('{')
 
-	for parser.lookahead.Type != '}' {
+	for parser.lookahead.Type != '}' &&
+		parser.lookahead.Type != lexer.TypeZero {
 		if parser.lookahead.Type == '{' {
 			node.ParseAsChild(parser.matchBlock)
 			continue
@@ -101,7 +116,7 @@ func (parser *Parser) matchBlock(parent *ast.Node) *ast.Node {
 }
 
 func (parser *Parser) matchStatements(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeStatements}
+	node := ast.Node{Type: ast.TypeStatements, Line: parser.lookaheadLine()}
 
 	for parser.lookahead.Type != '{' &&
 		parser.lookahead.Type != '}' &&
@@ -112,7 +127,7 @@ func (parser *Parser) matchStatements(parent *ast.Node) *ast.Node {
 }
 
 func (parser *Parser) matchStatement(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeStatement}
+	node := ast.Node{Type: ast.TypeStatement, Line: parser.lookaheadLine()}
 
 	switch parser.lookahead.Type {
 
@@ -122,15 +137,46 @@ func (parser *Parser) matchStatement(parent *ast.Node) *ast.Node {
 	case lexer.TypeIdentifier:
 		node.ParseAsChild(parser.matchAssignmentStatement)
 
+	case lexer.TypeTypeHint:
+		if parser.startsCall() {
+			node.ParseAsChild(parser.matchCallStatement)
+		} else {
+			parser.panic("matchStatement", "statement")
+		}
+
+	case lexer.TypeVal:
+		node.ParseAsChild(parser.matchValStatement)
+
 	case lexer.TypeSkip:
 		node.ParseAsChild(parser.matchSkipStatement)
 
 	case lexer.TypeSkipIf:
 		node.ParseAsChild(parser.matchSkipIfStatement)
 
-	case lexer.TypeStruct:
+	case lexer.TypeStruct, lexer.TypeRef:
 		parser.root.Declarations = append(parser.root.Declarations, parser.matchStructDeclaration(&node))
 
+	case lexer.TypeEnum:
+		parser.root.Declarations = append(parser.root.Declarations, parser.matchEnumDeclaration(&node))
+
+	case lexer.TypeMatch:
+		node.ParseAsChild(parser.matchMatchStatement)
+
+	case lexer.TypeFn:
+		parser.root.Methods = append(parser.root.Methods, parser.matchMethodDeclaration(""))
+
+	case lexer.TypeInterface:
+		parser.root.Declarations = append(parser.root.Declarations, parser.matchInterfaceDeclaration(&node))
+
+	case lexer.TypeImpl:
+		parser.root.Impls = append(parser.root.Impls, parser.matchImplDeclaration(&node))
+
+	case lexer.TypeReturn:
+		node.ParseAsChild(parser.matchReturnStatement)
+
+	case lexer.TypeImport:
+		parser.root.Imports = append(parser.root.Imports, parser.matchImport(&node))
+
 	default:
 		parser.panic("matchStatement", "statement")
 	}
@@ -141,100 +187,424 @@ func (parser *Parser) matchStatement(parent *ast.Node) *ast.Node {
 }
 
 func (parser *Parser) matchPrintStatement(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypePrintStatement}
+	node := ast.Node{Type: ast.TypePrintStatement, Line: parser.lookaheadLine()}
 	parser.match(lexer.TypePrint)
 	node.ParseAsChild(parser.matchExpression)
 	return &node
 }
 
+// matchAssignmentStatement parses an assignment, or a call of a method
+// like house.paint() or owner?.paint() for what it prints, which starts the
+// same way.
 func (parser *Parser) matchAssignmentStatement(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeAssignmentStatement}
+	node := ast.Node{Type: ast.TypeAssignmentStatement, Line: parser.lookaheadLine()}
+	target := parser.matchPath()
+	if target.Type != ast.TypeIdentifier {
+		return parser.callStatement(target, "matchAssignmentStatement")
+	}
+	node.AddChild(target)
+	parser.match('=')
+	node.ParseAsChild(parser.matchExpression)
+	return &node
+}
+
+// matchCallStatement parses a call starting with a type, like
+// Process.exit(code 1) or Point(x 1).show().
+func (parser *Parser) matchCallStatement(parent *ast.Node) *ast.Node {
+	return parser.callStatement(parser.matchConstructor(""), "matchCallStatement")
+}
+
+// startsCall reports whether the type in the lookahead starts a call, by
+// being followed by a name after a dot or by arguments.
+func (parser *Parser) startsCall() bool {
+	switch parser.peek(1).Type {
+	case '(':
+		return true
+	case '.':
+		return parser.peek(2).Type == lexer.TypeIdentifier
+	}
+	return false
+}
+
+// callStatement makes a statement of a call parsed for what it does.
+func (parser *Parser) callStatement(target *ast.Node, where string) *ast.Node {
+	node := ast.Node{Type: ast.TypeCallStatement, Line: target.Line}
+	if target.Type != ast.TypeCall && target.Type != ast.TypeOptionalCall &&
+		target.Type != ast.TypeStaticCall {
+		parser.panic(where, "(")
+	}
+	node.AddChild(target)
+	return &node
+}
+
+func (parser *Parser) matchReturnStatement(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeReturnStatement, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeReturn)
+	node.ParseAsChild(parser.matchExpression)
+	return &node
+}
+
+func (parser *Parser) matchValStatement(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeValStatement, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeVal)
 	token := parser.match(lexer.TypeIdentifier)
 	node.AddChild(&ast.Node{
 		Type:   ast.TypeIdentifier,
 		Lexeme: token.Lexeme,
+		Line:   token.Position.Line,
 	})
 	parser.match('=')
 	node.ParseAsChild(parser.matchExpression)
 	return &node
 }
 
+// matchImport parses import "geometry", or import "geometry" (Point, Shape)
+// to also use Point and Shape without the module name.
+func (parser *Parser) matchImport(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeImport, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeImport)
+	node.Lexeme = parser.match(lexer.TypeLiteral).Lexeme
+	if parser.lookahead.Type != '(' {
+		return &node
+	}
+	parser.match('(')
+	for parser.lookahead.Type != ')' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		token := parser.match(lexer.TypeTypeHint)
+		node.AddChild(&ast.Node{
+			Type:   ast.TypeIdentifier,
+			Lexeme: token.Lexeme,
+			Line:   token.Position.Line,
+		})
+		if parser.lookahead.Type != ')' {
+			parser.match(',')
+		}
+	}
+	parser.match(')')
+	return &node
+}
+
 func (parser *Parser) matchSkipStatement(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeSkipStatement}
+	node := ast.Node{Type: ast.TypeSkipStatement, Line: parser.lookaheadLine()}
 	parser.match(lexer.TypeSkip)
 	return &node
 }
 
 func (parser *Parser) matchSkipIfStatement(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeSkipIfStatement}
+	node := ast.Node{Type: ast.TypeSkipIfStatement, Line: parser.lookaheadLine()}
 	parser.match(lexer.TypeSkipIf)
 	node.ParseAsChild(parser.matchExpression)
 	return &node
 }
 func (parser *Parser) matchStructDeclaration(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeStructDeclaration}
+	node := ast.Node{Type: ast.TypeStructDeclaration, Line: parser.lookaheadLine()}
 
+	if parser.lookahead.Type == lexer.TypeRef {
+		parser.match(lexer.TypeRef)
+		node.Type = ast.TypeRefStructDeclaration
+	}
 	parser.match(lexer.TypeStruct)
 	nameToken := parser.match(lexer.TypeTypeHint)
 	node.Lexeme = nameToken.Lexeme
+	parser.matchTypeParameters(&node)
 
 	parser.match('{')
+	for parser.lookahead.Type != '}' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		if parser.lookahead.Type == lexer.TypeFn {
+			parser.root.Methods = append(parser.root.Methods, parser.matchMethodDeclaration(node.Lexeme))
+			continue
+		}
+		parser.matchStructField(&node)
+	}
+	parser.match('}')
 
-	for parser.lookahead.Type != '}' {
-		fieldNode := ast.Node{Type: ast.TypeStructField}
-		idToken := parser.match(lexer.TypeIdentifier)
-		typeToken := parser.match(lexer.TypeTypeHint)
-		node.AddChild(&fieldNode)
-		fieldNode.Lexeme = idToken.Lexeme
-		fieldNode.TypeHint = typeToken.Lexeme
+	return &node
+}
+
+func (parser *Parser) matchStructFields(node *ast.Node, end lexer.TokenType) {
+	for parser.lookahead.Type != end &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		parser.matchStructField(node)
+	}
+}
+
+func (parser *Parser) matchStructField(node *ast.Node) {
+	fieldNode := ast.Node{Type: ast.TypeStructField, Line: parser.lookaheadLine()}
+	if parser.lookahead.Type == lexer.TypeReadonly {
+		parser.match(lexer.TypeReadonly)
+		fieldNode.Type = ast.TypeReadonlyStructField
+	}
+	idToken := parser.match(lexer.TypeIdentifier)
+	node.AddChild(&fieldNode)
+	fieldNode.Lexeme = idToken.Lexeme
+	fieldNode.TypeHint = parser.matchTypeHint()
+	if parser.lookahead.Type == '=' {
+		parser.match('=')
+		fieldNode.ParseAsChild(parser.matchExpression)
+	}
+}
+
+// matchMethodDeclaration parses a method, like fn House.describe() String,
+// or like fn describe() String inside the struct given as receiver. The
+// lexeme is the name of the method after the name of its struct, and the
+// parameters come before the block, which is the last child.
+func (parser *Parser) matchMethodDeclaration(receiver string) *ast.Node {
+	node := ast.Node{Type: ast.TypeMethodDeclaration, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeFn)
+	if receiver == "" {
+		receiver = parser.match(lexer.TypeTypeHint).Lexeme
+		parser.match('.')
+	}
+	node.Lexeme = receiver + "." + parser.match(lexer.TypeIdentifier).Lexeme
+	parser.matchTypeParameters(&node)
+	parser.matchSignature(&node)
+	node.ParseAsChild(parser.matchBlock)
+
+	return &node
+}
+
+// matchTypeParameters parses the type parameters of a generic struct or
+// method, like [A, B Stage], where B must implement the interface Stage.
+func (parser *Parser) matchTypeParameters(node *ast.Node) {
+	if parser.lookahead.Type != '[' {
+		return
+	}
+	parser.match('[')
+	for parser.lookahead.Type != ']' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		token := parser.match(lexer.TypeTypeHint)
+		parameterNode := ast.Node{
+			Type:   ast.TypeTypeParameter,
+			Lexeme: token.Lexeme,
+			Line:   token.Position.Line,
+		}
+		if parser.lookahead.Type == lexer.TypeTypeHint || parser.lookahead.Type == lexer.TypeIdentifier {
+			parameterNode.TypeHint = parser.matchTypeName()
+		}
+		node.TypeParameters = append(node.TypeParameters, &parameterNode)
+		if parser.lookahead.Type != ']' {
+			parser.match(',')
+		}
+	}
+	parser.match(']')
+}
+
+// matchTypeHint parses a type, which may give the type arguments of a
+// generic struct, like Pair[Int, Box[String]]. The type hint keeps them as
+// written, with a comma and a space between them, followed by a ? if the
+// type is optional, like Int?.
+func (parser *Parser) matchTypeHint() string {
+	typeHint := parser.matchTypeName()
+	if parser.lookahead.Type == '[' {
+		typeHint += parser.matchTypeArguments()
+	}
+	if parser.lookahead.Type == '?' {
+		parser.match('?')
+		typeHint += "?"
+	}
+	return typeHint
+}
+
+// matchTypeName parses the name of a type, which may come from an imported
+// module, like geometry.Point.
+func (parser *Parser) matchTypeName() string {
+	if parser.lookahead.Type != lexer.TypeIdentifier {
+		return parser.match(lexer.TypeTypeHint).Lexeme
+	}
+	module := parser.match(lexer.TypeIdentifier).Lexeme
+	parser.match('.')
+	return module + "." + parser.match(lexer.TypeTypeHint).Lexeme
+}
+
+func (parser *Parser) matchTypeArguments() string {
+	var arguments []string
+	parser.match('[')
+	for parser.lookahead.Type != ']' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		arguments = append(arguments, parser.matchTypeHint())
+		if parser.lookahead.Type != ']' {
+			parser.match(',')
+		}
+	}
+	parser.match(']')
+	return "[" + strings.Join(arguments, ", ") + "]"
+}
+
+// matchSignature parses the parameters and the result type of a method
+// into the node of the method.
+func (parser *Parser) matchSignature(node *ast.Node) {
+	parser.match('(')
+	for parser.lookahead.Type != ')' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		parameterNode := ast.Node{Type: ast.TypeParameter, Line: parser.lookaheadLine()}
+		parameterNode.Lexeme = parser.match(lexer.TypeIdentifier).Lexeme
+		parameterNode.TypeHint = parser.matchTypeHint()
 		if parser.lookahead.Type == '=' {
 			parser.match('=')
-			fieldNode.ParseAsChild(parser.matchExpression)
+			parameterNode.ParseAsChild(parser.matchExpression)
+		}
+		node.AddChild(&parameterNode)
+	}
+	parser.match(')')
+	if parser.lookahead.Type == lexer.TypeTypeHint || parser.lookahead.Type == lexer.TypeIdentifier {
+		node.TypeHint = parser.matchTypeHint()
+	}
+}
+
+// matchInterfaceDeclaration parses an interface, whose children are the
+// signatures of its methods, named like methods but without a block.
+func (parser *Parser) matchInterfaceDeclaration(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeInterfaceDeclaration, Line: parser.lookaheadLine()}
+
+	parser.match(lexer.TypeInterface)
+	node.Lexeme = parser.match(lexer.TypeTypeHint).Lexeme
+
+	parser.match('{')
+	for parser.lookahead.Type != '}' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		signatureNode := ast.Node{Type: ast.TypeMethodSignature, Line: parser.lookaheadLine()}
+		parser.match(lexer.TypeFn)
+		signatureNode.Lexeme = node.Lexeme + "." + parser.match(lexer.TypeIdentifier).Lexeme
+		parser.matchSignature(&signatureNode)
+		node.AddChild(&signatureNode)
+	}
+	parser.match('}')
+
+	return &node
+}
+
+// matchImplDeclaration parses impl Shape for Square, with the interface as
+// lexeme and the struct as type hint.
+func (parser *Parser) matchImplDeclaration(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeImplDeclaration, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeImpl)
+	node.Lexeme = parser.matchTypeName()
+	parser.match(lexer.TypeFor)
+	node.TypeHint = parser.matchTypeHint()
+	return &node
+}
+
+// matchEnumDeclaration parses an enum, whose variants may have fields like
+// a struct. The fields of a variant become a struct of their own, named
+// like Shape_Circle and declared before the enum, and the variant refers
+// to it by its type hint.
+func (parser *Parser) matchEnumDeclaration(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeEnumDeclaration, Line: parser.lookaheadLine()}
+
+	parser.match(lexer.TypeEnum)
+	nameToken := parser.match(lexer.TypeTypeHint)
+	node.Lexeme = nameToken.Lexeme
+
+	parser.match('{')
+	for parser.lookahead.Type != '}' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		variantNode := ast.Node{Type: ast.TypeEnumVariant, Line: parser.lookaheadLine()}
+		variantNode.Lexeme = parser.match(lexer.TypeTypeHint).Lexeme
+		if parser.lookahead.Type == '(' {
+			payload := ast.Node{
+				Type:   ast.TypeStructDeclaration,
+				Lexeme: node.Lexeme + "_" + variantNode.Lexeme,
+				Line:   variantNode.Line,
+			}
+			parser.match('(')
+			parser.matchStructFields(&payload, ')')
+			parser.match(')')
+			if len(payload.Children) > 0 {
+				variantNode.TypeHint = payload.Lexeme
+				parser.root.Declarations = append(parser.root.Declarations, &payload)
+			}
 		}
+		node.AddChild(&variantNode)
 	}
+	parser.match('}')
+
+	return &node
+}
+
+// matchMatchStatement parses a match on an enum, with an arm for each
+// variant. An arm lists the fields of the variant it binds in parentheses
+// before its block, which is the last child of the arm.
+func (parser *Parser) matchMatchStatement(parent *ast.Node) *ast.Node {
+	node := ast.Node{Type: ast.TypeMatchStatement, Line: parser.lookaheadLine()}
+	parser.match(lexer.TypeMatch)
+	node.ParseAsChild(parser.matchExpression)
 
+	parser.match('{')
+	for parser.lookahead.Type != '}' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		armNode := ast.Node{Type: ast.TypeMatchArm, Line: parser.lookaheadLine()}
+		armNode.Lexeme = parser.match(lexer.TypeTypeHint).Lexeme
+		if parser.lookahead.Type == '(' {
+			parser.match('(')
+			for parser.lookahead.Type != ')' &&
+				parser.lookahead.Type != lexer.TypeZero &&
+				!parser.hasError {
+				token := parser.match(lexer.TypeIdentifier)
+				armNode.AddChild(&ast.Node{
+					Type:   ast.TypeIdentifier,
+					Lexeme: token.Lexeme,
+					Line:   token.Position.Line,
+				})
+			}
+			parser.match(')')
+		}
+		armNode.ParseAsChild(parser.matchBlock)
+		node.AddChild(&armNode)
+	}
 	parser.match('}')
 
 	return &node
 }
 
 func (parser *Parser) matchExpression(parent *ast.Node) *ast.Node {
-	node := ast.Node{Type: ast.TypeExpression}
+	node := ast.Node{Type: ast.TypeExpression, Line: parser.lookaheadLine()}
 
 	switch parser.lookahead.Type {
 
 	case lexer.TypeIdentifier:
-		token := parser.match(lexer.TypeIdentifier)
-		for parser.lookahead.Type == '.' {
-			parser.match('.')
-			token.Lexeme += "."
-			token.Lexeme += parser.match(lexer.TypeIdentifier).Lexeme
-		}
-		node.AddChild(&ast.Node{
-			Type:   ast.TypeIdentifier,
-			Lexeme: token.Lexeme,
-		})
+		node.AddChild(parser.matchPath())
 
 	case lexer.TypeLiteral:
 		token := parser.match(lexer.TypeLiteral)
-		node.AddChild(&ast.Node{
+		node.AddChild(parser.matchPostfix(&ast.Node{
 			Type:   ast.TypeLiteral,
 			Lexeme: token.Lexeme,
-		})
+			Line:   token.Position.Line,
+		}))
 
 	case lexer.TypeNumber:
 		token := parser.match(lexer.TypeNumber)
-		node.AddChild(&ast.Node{
+		node.AddChild(parser.matchPostfix(&ast.Node{
 			Type:   ast.TypeNumber,
 			Number: token.Value,
-		})
+			Line:   token.Position.Line,
+		}))
 
 	case lexer.TypeBoolean:
 		token := parser.match(lexer.TypeBoolean)
-		node.AddChild(&ast.Node{
+		node.AddChild(parser.matchPostfix(&ast.Node{
 			Type:   ast.TypeBoolean,
 			Number: token.Value,
 			Lexeme: token.Lexeme,
+			Line:   token.Position.Line,
+		}))
+
+	case lexer.TypeNone:
+		token := parser.match(lexer.TypeNone)
+		node.AddChild(&ast.Node{
+			Type:   ast.TypeNone,
+			Lexeme: token.Lexeme,
+			Line:   token.Position.Line,
 		})
 
 	case lexer.TypeNot:
@@ -242,31 +612,19 @@ func (parser *Parser) matchExpression(parent *ast.Node) *ast.Node {
 		notNode := &ast.Node{
 			Type:   ast.TypeNot,
 			Lexeme: token.Lexeme,
+			Line:   token.Position.Line,
 		}
 		node.AddChild(notNode)
 		notNode.ParseAsChild(parser.matchExpression)
 
 	case lexer.TypeTypeHint:
-		token := parser.match(lexer.TypeTypeHint)
-		constructorNode := &ast.Node{
-			Type:   ast.TypeConstructor,
-			Lexeme: token.Lexeme,
-		}
-		node.AddChild(constructorNode)
-		parser.match('(')
-		for parser.lookahead.Type != ')' {
-			fieldNode := ast.Node{Type: ast.TypeStructArgument}
-			idToken := parser.match(lexer.TypeIdentifier)
-			fieldNode.ParseAsChild(parser.matchExpression)
-			constructorNode.AddChild(&fieldNode)
-			fieldNode.Lexeme = idToken.Lexeme
-		}
-		parser.match(')')
+		node.AddChild(parser.matchConstructor(""))
 
 	case '(':
 		parser.match('(')
 		node.ParseAsChild(parser.matchExpression)
 		parser.match(')')
+		node.Children[0] = parser.matchPostfix(node.Children[0])
 
 	default:
 		parser.panic("matchExpression", "expression")
@@ -285,6 +643,128 @@ func (parser *Parser) matchExpression(parent *ast.Node) *ast.Node {
 	return &node
 }
 
+// matchConstructor parses a constructor and what follows it, after the
+// module it is imported from, like geometry., if any. A type followed by a
+// name is a function of the standard library called on it instead, like
+// Process.argCount().
+func (parser *Parser) matchConstructor(module string) *ast.Node {
+	token := parser.match(lexer.TypeTypeHint)
+	constructorNode := &ast.Node{
+		Type:   ast.TypeConstructor,
+		Lexeme: module + token.Lexeme,
+		Line:   token.Position.Line,
+	}
+	if parser.lookahead.Type == '[' {
+		// The type arguments of a generic struct, like Pair[Int, String]
+		constructorNode.Lexeme += parser.matchTypeArguments()
+	}
+	// A variant of an enum, like Shape.Circle, needs no parentheses
+	variant := parser.lookahead.Type == '.'
+	if variant {
+		parser.match('.')
+		if parser.lookahead.Type == lexer.TypeIdentifier {
+			constructorNode.Type = ast.TypeStaticCall
+			constructorNode.Lexeme += "." + parser.match(lexer.TypeIdentifier).Lexeme
+			parser.matchArguments(constructorNode)
+			return parser.matchPostfix(constructorNode)
+		}
+		constructorNode.Lexeme += "." + parser.match(lexer.TypeTypeHint).Lexeme
+	}
+	if !variant || parser.lookahead.Type == '(' {
+		parser.matchArguments(constructorNode)
+	}
+	return parser.matchPostfix(constructorNode)
+}
+
+// matchPath parses a variable followed by the names of its fields, which
+// make up the lexeme of one identifier, like house.color.r. A name followed
+// by arguments is a method called on the path before it instead, and
+// everything after a ?. is parsed like after an expression. A variable
+// followed by a type is a module instead, like in geometry.Point(x 1).
+func (parser *Parser) matchPath() *ast.Node {
+	token := parser.match(lexer.TypeIdentifier)
+	node := &ast.Node{
+		Type:   ast.TypeIdentifier,
+		Lexeme: token.Lexeme,
+		Line:   token.Position.Line,
+	}
+	if parser.lookahead.Type == lexer.TypeOptionalChain {
+		return parser.matchPostfix(node)
+	}
+	for parser.lookahead.Type == '.' {
+		parser.match('.')
+		if parser.lookahead.Type == lexer.TypeTypeHint && node.Lexeme == token.Lexeme {
+			return parser.matchConstructor(token.Lexeme + ".")
+		}
+		name := parser.match(lexer.TypeIdentifier)
+		if parser.lookahead.Type == '(' {
+			return parser.matchPostfix(parser.matchCall(node, name))
+		}
+		node.Lexeme += "." + name.Lexeme
+		if parser.lookahead.Type == lexer.TypeOptionalChain {
+			return parser.matchPostfix(node)
+		}
+	}
+	return node
+}
+
+// matchPostfix parses the fields and calls following an expression that is
+// not a variable, like house.next().describe() or Point(x 1).x. Each one
+// becomes a node with the expression before it as its first child. Those
+// after ?., like house.owner?.name, are optional members and calls.
+func (parser *Parser) matchPostfix(node *ast.Node) *ast.Node {
+	for parser.lookahead.Type == '.' || parser.lookahead.Type == lexer.TypeOptionalChain {
+		optional := parser.lookahead.Type == lexer.TypeOptionalChain
+		parser.match(parser.lookahead.Type)
+		name := parser.match(lexer.TypeIdentifier)
+		if parser.lookahead.Type == '(' {
+			node = parser.matchCall(node, name)
+			if optional {
+				node.Type = ast.TypeOptionalCall
+			}
+			continue
+		}
+		node = &ast.Node{
+			Type:     ast.TypeMember,
+			Lexeme:   name.Lexeme,
+			Line:     name.Position.Line,
+			Children: []*ast.Node{node},
+		}
+		if optional {
+			node.Type = ast.TypeOptionalMember
+		}
+	}
+	return node
+}
+
+// matchCall parses the arguments of a method called on the receiver, which
+// becomes the first child of the call.
+func (parser *Parser) matchCall(receiver *ast.Node, name lexer.Token) *ast.Node {
+	node := &ast.Node{
+		Type:     ast.TypeCall,
+		Lexeme:   name.Lexeme,
+		Line:     name.Position.Line,
+		Children: []*ast.Node{receiver},
+	}
+	parser.matchArguments(node)
+	return node
+}
+
+// matchArguments parses the named arguments of a constructor or a call.
+func (parser *Parser) matchArguments(node *ast.Node) {
+	parser.match('(')
+	for parser.lookahead.Type != ')' &&
+		parser.lookahead.Type != lexer.TypeZero &&
+		!parser.hasError {
+		fieldNode := ast.Node{Type: ast.TypeStructArgument, Line: parser.lookaheadLine()}
+		idToken := parser.match(lexer.TypeIdentifier)
+		fieldNode.ParseAsChild(parser.matchExpression)
+		node.AddChild(&fieldNode)
+		fieldNode.Lexeme = idToken.Lexeme
+	}
+	parser.match(')')
+}
+
 func (parser *Parser) panic(where string, expected string) {
 	fmt.Printf(
 		"%s: syntax error at line %d, expected '%s', found '%s'\n",
@@ -316,7 +796,12 @@ func (parser *Parser) handleError(nType ast.NodeType) {
 		case ast.TypeStatement:
 			if tokenType == '{' ||
 				tokenType == lexer.TypePrint ||
-				tokenType == lexer.TypeIdentifier {
+				tokenType == lexer.TypeIdentifier ||
+				tokenType == lexer.TypeVal ||
+				tokenType == lexer.TypeMatch ||
+				tokenType == lexer.TypeFn ||
+				tokenType == lexer.TypeReturn ||
+				tokenType == lexer.TypeImport {
 				return
 			}
 			if tokenType == ';' {
@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/lexer"
+)
+
+// TestTruncatedInputs checks that the parser gives up on input ending in
+// the middle of a list, reporting a syntax error instead of looping.
+func TestTruncatedInputs(t *testing.T) {
+	inputs := []string{
+		"{ print 1",
+		"enum E {",
+		"enum E { A(",
+		"enum E { A(x Int",
+		"match e {",
+		"match e { A(",
+		"match e { A(x",
+		"match e { A(x) {",
+		"struct P { x",
+		"struct P { x Int",
+		"fn",
+		"fn P.x(",
+		"fn P.x(a Int",
+		"interface I {",
+		"interface I { fn",
+		"interface I { fn x(",
+		"struct P[",
+		"struct P[A",
+		"x = P[",
+		"x = P[Int,",
+		"fn P.x() P[",
+		"import \"geometry\" (",
+		"import \"geometry\" (Point",
+		"import \"geometry\" (Point,",
+	}
+	for _, input := range inputs {
+		done := make(chan bool)
+		go func() {
+			// Giving up may panic, which is fine as long as it ends
+			defer func() {
+				recover()
+				done <- true
+			}()
+			lexer := lexer.NewLexer(bufio.NewReader(strings.NewReader(input)))
+			parser := NewParser(lexer.ScanAll())
+			parser.Parse()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("parsing %q did not end", input)
+		}
+	}
+}
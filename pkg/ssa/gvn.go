@@ -0,0 +1,114 @@
+package ssa
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Dominator-based global value numbering.
+	Walks the dominator tree with a scoped table of the expressions
+	computed so far. A variable computing an expression already held by a
+	dominating variable becomes a copy of it, and every read is replaced by
+	the leader of its value. Loads are not numbered, since stores may change
+	the memory they read between two loads, and structs are never replaced
+	by a copy of them for the same reason.
+*/
+
+type valueKey struct {
+	op       ir.Op
+	operator string
+	arg1     ir.Operand
+	arg2     ir.Operand
+}
+
+// NumberValues removes redundant computations from a graph in SSA form.
+func NumberValues(graph *cfg.Graph) bool {
+	changed := false
+	leaders := make(map[ir.Operand]ir.Operand)
+	leader := func(operand ir.Operand) ir.Operand {
+		if found, ok := leaders[operand]; ok {
+			if found != operand {
+				changed = true
+			}
+			return found
+		}
+		return operand
+	}
+	table := make(map[valueKey]ir.Operand)
+
+	var visit func(block *cfg.Block)
+	visit = func(block *cfg.Block) {
+		var added []valueKey
+		for i := range block.Instrs {
+			instr := &block.Instrs[i]
+			if instr.Op == ir.OpStore {
+				instr.Arg1 = replaceVariable(instr.Arg1, leader)
+			} else {
+				renameUses(instr, leader)
+			}
+			if !instr.Dst.IsVariable() || instr.Dst.Version == 0 || !isScalar(instr.Dst.Type) {
+				continue
+			}
+
+			switch instr.Op {
+			case ir.OpCopy:
+				leaders[instr.Dst] = instr.Arg1
+
+			case ir.OpPhi:
+				same := true
+				for _, arg := range instr.Args {
+					if arg != instr.Args[0] {
+						same = false
+					}
+				}
+				if same && instr.Args[0] != instr.Dst && instr.Args[0].Version > 0 {
+					leaders[instr.Dst] = instr.Args[0]
+				}
+
+			case ir.OpBinary, ir.OpNot:
+				key := valueKey{
+					op:       instr.Op,
+					operator: instr.Operator,
+					arg1:     instr.Arg1,
+					arg2:     instr.Arg2,
+				}
+				if isCommutative(instr.Operator) && key.arg2.String() < key.arg1.String() {
+					key.arg1, key.arg2 = key.arg2, key.arg1
+				}
+				if existing, ok := table[key]; ok {
+					leaders[instr.Dst] = existing
+					*instr = ir.Instr{
+						Op:   ir.OpCopy,
+						Dst:  instr.Dst,
+						Arg1: existing,
+						Line: instr.Line,
+					}
+					changed = true
+					continue
+				}
+				table[key] = instr.Dst
+				added = append(added, key)
+			}
+		}
+		for _, dominated := range block.Dominated {
+			visit(dominated)
+		}
+		for _, key := range added {
+			delete(table, key)
+		}
+	}
+	visit(graph.Entry)
+	return changed
+}
+
+func isCommutative(operator string) bool {
+	return operator == "+" || operator == "*"
+}
+
+func isScalar(typeHint string) bool {
+	return typeHint == "Int" ||
+		typeHint == "Float" ||
+		typeHint == "Bool" ||
+		typeHint == "String"
+}
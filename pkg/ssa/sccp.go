@@ -0,0 +1,230 @@
+package ssa
+
+import (
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Sparse conditional constant propagation, after Wegman and Zadeck.
+	Values start out unknown and only move down the lattice
+	unknown -> constant -> varying. Blocks are only evaluated once an
+	edge into them is known to be executable, so constants on one side
+	of a conditional jump do not mix with values from code that never runs.
+*/
+
+type latticeState int
+
+const (
+	unknown latticeState = iota
+	constant
+	varying
+)
+
+type lattice struct {
+	state latticeState
+	value ir.Operand
+}
+
+func meet(a lattice, b lattice) lattice {
+	switch {
+	case a.state == unknown:
+		return b
+	case b.state == unknown:
+		return a
+	case a.state == varying || b.state == varying:
+		return lattice{state: varying}
+	case a.value != b.value:
+		return lattice{state: varying}
+	default:
+		return a
+	}
+}
+
+type edge struct {
+	from *cfg.Block
+	to   *cfg.Block
+}
+
+type instrRef struct {
+	block *cfg.Block
+	index int
+}
+
+type sccp struct {
+	graph      *cfg.Graph
+	values     map[string]lattice
+	executable map[edge]bool
+	visited    map[*cfg.Block]bool
+	uses       map[string][]instrRef
+	flowWork   []edge
+	ssaWork    []instrRef
+}
+
+// PropagateConstants replaces variables proven constant with their value.
+// Conditional jumps on constants are left for the jump simplification
+// after SSA destruction, so the edges of the graph stay valid.
+func PropagateConstants(graph *cfg.Graph) bool {
+	pass := sccp{
+		graph:      graph,
+		values:     make(map[string]lattice),
+		executable: make(map[edge]bool),
+		visited:    make(map[*cfg.Block]bool),
+		uses:       make(map[string][]instrRef),
+	}
+	for _, block := range graph.Blocks {
+		for i, instr := range block.Instrs {
+			for _, use := range instr.Uses() {
+				if use.IsVariable() {
+					pass.uses[use.String()] = append(pass.uses[use.String()], instrRef{block, i})
+				}
+			}
+		}
+	}
+
+	pass.flowWork = append(pass.flowWork, edge{nil, graph.Entry})
+	for len(pass.flowWork) > 0 || len(pass.ssaWork) > 0 {
+		if len(pass.flowWork) > 0 {
+			e := pass.flowWork[0]
+			pass.flowWork = pass.flowWork[1:]
+			pass.visitEdge(e)
+			continue
+		}
+		ref := pass.ssaWork[0]
+		pass.ssaWork = pass.ssaWork[1:]
+		if pass.visited[ref.block] {
+			pass.visitInstr(ref.block, ref.index)
+		}
+	}
+
+	return pass.rewrite()
+}
+
+func (pass *sccp) visitEdge(e edge) {
+	if pass.executable[e] {
+		return
+	}
+	pass.executable[e] = true
+	first := !pass.visited[e.to]
+	pass.visited[e.to] = true
+	for i, instr := range e.to.Instrs {
+		if instr.Op == ir.OpPhi || first {
+			pass.visitInstr(e.to, i)
+		}
+	}
+	if first {
+		last, _ := e.to.Last()
+		if last.Op != ir.OpJumpIf {
+			for _, succ := range e.to.Succs {
+				pass.flowWork = append(pass.flowWork, edge{e.to, succ})
+			}
+		}
+	}
+}
+
+func (pass *sccp) valueOf(operand ir.Operand) lattice {
+	if operand.IsConstant() {
+		return lattice{state: constant, value: operand}
+	}
+	if !operand.IsVariable() || operand.Version == 0 {
+		return lattice{state: varying}
+	}
+	return pass.values[operand.String()]
+}
+
+func (pass *sccp) visitInstr(block *cfg.Block, index int) {
+	instr := block.Instrs[index]
+	var result lattice
+
+	switch instr.Op {
+	case ir.OpPhi:
+		for i, pred := range block.Preds {
+			if pass.executable[edge{pred, block}] {
+				result = meet(result, pass.valueOf(instr.Args[i]))
+			}
+		}
+
+	case ir.OpCopy:
+		result = pass.valueOf(instr.Arg1)
+
+	case ir.OpBinary:
+		a, b := pass.valueOf(instr.Arg1), pass.valueOf(instr.Arg2)
+		switch {
+		case a.state == varying || b.state == varying:
+			result = lattice{state: varying}
+		case a.state == constant && b.state == constant:
+			value, ok := ir.Evaluate(instr.Operator, a.value, b.value)
+			result = lattice{state: varying}
+			if ok {
+				result = lattice{state: constant, value: value}
+			}
+		}
+
+	case ir.OpNot:
+		a := pass.valueOf(instr.Arg1)
+		result = a
+		if a.state == constant {
+			result.value = ir.NewBool(a.value.Number == 0)
+		}
+
+	case ir.OpJumpIf:
+		condition := pass.valueOf(instr.Arg1)
+		for _, succ := range block.Succs {
+			label, _ := succ.Label()
+			taken := label == instr.Label
+			if condition.state == varying || len(block.Succs) == 1 ||
+				(condition.state == constant && (condition.value.Number != 0) == taken) {
+				pass.flowWork = append(pass.flowWork, edge{block, succ})
+			}
+		}
+		return
+
+	default:
+		if _, ok := instr.Def(); ok {
+			result = lattice{state: varying}
+		}
+	}
+
+	def, ok := instr.Def()
+	if !ok {
+		return
+	}
+	name := def.String()
+	if pass.values[name] != result {
+		pass.values[name] = result
+		pass.ssaWork = append(pass.ssaWork, pass.uses[name]...)
+	}
+}
+
+func (pass *sccp) rewrite() bool {
+	changed := false
+	replace := func(operand ir.Operand) ir.Operand {
+		value := pass.values[operand.String()]
+		if operand.Version > 0 && value.state == constant {
+			changed = true
+			return value.value
+		}
+		return operand
+	}
+	for _, block := range pass.graph.Blocks {
+		if !pass.visited[block] {
+			continue
+		}
+		for i := range block.Instrs {
+			instr := &block.Instrs[i]
+			if instr.Op == ir.OpStore {
+				instr.Arg1 = replaceVariable(instr.Arg1, replace)
+				continue
+			}
+			renameUses(instr, replace)
+		}
+	}
+	return changed
+}
+
+func replaceVariable(operand ir.Operand, replace func(ir.Operand) ir.Operand) ir.Operand {
+	if operand.IsVariable() {
+		return replace(operand)
+	}
+	return operand
+}
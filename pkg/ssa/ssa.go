@@ -0,0 +1,364 @@
+package ssa
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/dataflow"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	Static single assignment form over the control-flow graph.
+	Phi nodes are placed on the iterated dominance frontiers of each
+	variable's definitions where the variable is live (pruned SSA),
+	and definitions are renamed to versions walking the dominator tree.
+	The graph is kept in memory while in SSA form, with the arguments
+	of each phi ordered like the predecessors of its block.
+*/
+
+// Build converts a function to SSA form. Unreachable code is dropped first.
+// The function must not already contain versioned variables.
+func Build(fn *ir.Func) *cfg.Graph {
+	graph := cfg.Build(fn)
+	reachable := graph.Reachable()
+	var code []ir.Instr
+	for _, block := range graph.Blocks {
+		if reachable[block] {
+			code = append(code, block.Instrs...)
+		}
+	}
+	fn.Code = code
+
+	graph = cfg.Build(fn)
+	graph.ComputeDominators()
+	insertPhis(graph)
+	rename(graph)
+	return graph
+}
+
+func insertPhis(graph *cfg.Graph) {
+	frontiers := graph.DominanceFrontiers()
+	liveness := dataflow.Liveness(graph)
+
+	variables := make(map[string]ir.Operand)
+	definedIn := make(map[string][]*cfg.Block)
+	for _, block := range graph.Blocks {
+		for _, instr := range block.Instrs {
+			def, ok := instr.Def()
+			if !ok {
+				continue
+			}
+			name := def.String()
+			variables[name] = def
+			if len(definedIn[name]) == 0 || definedIn[name][len(definedIn[name])-1] != block {
+				definedIn[name] = append(definedIn[name], block)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hasPhi := make(map[*cfg.Block]bool)
+		work := append([]*cfg.Block{}, definedIn[name]...)
+		for len(work) > 0 {
+			block := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, frontier := range frontiers[block] {
+				if hasPhi[frontier] || !liveness.In[frontier][name] {
+					continue
+				}
+				hasPhi[frontier] = true
+				insertPhi(frontier, variables[name])
+				work = append(work, frontier)
+			}
+		}
+	}
+}
+
+func insertPhi(block *cfg.Block, variable ir.Operand) {
+	phi := ir.Instr{
+		Op:   ir.OpPhi,
+		Dst:  variable,
+		Args: make([]ir.Operand, len(block.Preds)),
+	}
+	for i := range phi.Args {
+		phi.Args[i] = variable
+	}
+	if len(block.Instrs) > 0 {
+		phi.Line = block.Instrs[0].Line
+	}
+	at := 0
+	if _, ok := block.Label(); ok {
+		at = 1
+	}
+	block.Instrs = append(block.Instrs[:at],
+		append([]ir.Instr{phi}, block.Instrs[at:]...)...)
+}
+
+func rename(graph *cfg.Graph) {
+	counters := make(map[string]int)
+	stacks := make(map[string][]int)
+
+	current := func(operand ir.Operand) ir.Operand {
+		stack := stacks[operand.String()]
+		if len(stack) > 0 {
+			operand.Version = stack[len(stack)-1]
+		}
+		return operand
+	}
+
+	var visit func(block *cfg.Block)
+	visit = func(block *cfg.Block) {
+		var pushed []string
+		for i := range block.Instrs {
+			instr := &block.Instrs[i]
+			if instr.Op != ir.OpPhi {
+				renameUses(instr, current)
+			}
+			if def, ok := instr.Def(); ok && def.Version == 0 {
+				name := def.String()
+				counters[name] += 1
+				stacks[name] = append(stacks[name], counters[name])
+				pushed = append(pushed, name)
+				instr.Dst.Version = counters[name]
+			}
+		}
+		for _, succ := range block.Succs {
+			index := predIndex(succ, block)
+			for i := range succ.Instrs {
+				phi := &succ.Instrs[i]
+				if phi.Op != ir.OpPhi {
+					continue
+				}
+				base := phi.Args[index]
+				base.Version = 0
+				phi.Args[index] = current(base)
+			}
+		}
+		for _, dominated := range block.Dominated {
+			visit(dominated)
+		}
+		for _, name := range pushed {
+			stacks[name] = stacks[name][:len(stacks[name])-1]
+		}
+	}
+	visit(graph.Entry)
+}
+
+// renameUses rewrites the variables an instruction reads, including the
+// destination of a store.
+func renameUses(instr *ir.Instr, rename func(ir.Operand) ir.Operand) {
+	update := func(operand *ir.Operand) {
+		if operand.IsVariable() {
+			*operand = rename(*operand)
+		}
+	}
+	switch instr.Op {
+	case ir.OpCopy, ir.OpNot, ir.OpJumpIf, ir.OpLoad, ir.OpPrint, ir.OpReturn:
+		update(&instr.Arg1)
+	case ir.OpBinary:
+		update(&instr.Arg1)
+		update(&instr.Arg2)
+	case ir.OpStore:
+		update(&instr.Dst)
+		update(&instr.Arg1)
+	case ir.OpCall:
+		update(&instr.Arg1)
+		for i := range instr.Args {
+			update(&instr.Args[i])
+		}
+	case ir.OpPhi, ir.OpBuiltin:
+		for i := range instr.Args {
+			update(&instr.Args[i])
+		}
+	}
+}
+
+func predIndex(block *cfg.Block, pred *cfg.Block) int {
+	for i, p := range block.Preds {
+		if p == pred {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("%s is not a predecessor of %s", pred.Name(), block.Name()))
+}
+
+// Destroy replaces the phis of a graph in SSA form with copies at the end
+// of each predecessor and writes the code back to the function. Critical
+// edges are split so the copies only run on their own edge. The split edges
+// are placed right before their target, so every jump stays a forward jump
+// if it was one before.
+func Destroy(graph *cfg.Graph) {
+	fn := graph.Func
+	temps := maxTemp(fn)
+	labels := make(map[string]bool)
+	for _, instr := range fn.Code {
+		if instr.Op == ir.OpLabel {
+			labels[instr.Label] = true
+		}
+	}
+	newLabel := func() string {
+		for i := 1; ; i++ {
+			label := fmt.Sprintf("SplitEdge_%d", i)
+			if !labels[label] {
+				labels[label] = true
+				return label
+			}
+		}
+	}
+
+	fallthroughs := make(map[*cfg.Block][]ir.Instr) // Copies on the edge from the previous block
+	splits := make(map[*cfg.Block][][]ir.Instr)     // Copies on edges from conditional jumps
+
+	for _, block := range graph.Blocks {
+		var phis []ir.Instr
+		for _, instr := range block.Instrs {
+			if instr.Op == ir.OpPhi {
+				phis = append(phis, instr)
+			}
+		}
+		if len(phis) == 0 {
+			continue
+		}
+
+		for index, pred := range block.Preds {
+			copies := parallelCopy(phis, index, &temps, fn)
+			last, _ := pred.Last()
+			label, _ := block.Label()
+
+			switch {
+			case last.Op == ir.OpJump:
+				pred.Instrs = append(pred.Instrs[:len(pred.Instrs)-1],
+					append(copies, last)...)
+
+			case last.Op == ir.OpJumpIf && len(pred.Succs) > 1 && last.Label == label:
+				split := newLabel()
+				pred.Instrs[len(pred.Instrs)-1].Label = split
+				section := append([]ir.Instr{{Op: ir.OpLabel, Label: split}}, copies...)
+				splits[block] = append(splits[block], section)
+
+			case last.Op == ir.OpJumpIf && len(pred.Succs) > 1:
+				fallthroughs[block] = append(fallthroughs[block], copies...)
+
+			case last.Op == ir.OpJumpIf:
+				pred.Instrs = append(pred.Instrs[:len(pred.Instrs)-1],
+					append(copies, last)...)
+
+			default:
+				pred.Instrs = append(pred.Instrs, copies...)
+			}
+		}
+	}
+
+	var code []ir.Instr
+	for _, block := range graph.Blocks {
+		code = append(code, fallthroughs[block]...)
+		label, _ := block.Label()
+		for _, section := range splits[block] {
+			code = append(code, ir.Instr{Op: ir.OpJump, Label: label})
+			code = append(code, section...)
+		}
+		for _, instr := range block.Instrs {
+			if instr.Op != ir.OpPhi {
+				code = append(code, instr)
+			}
+		}
+	}
+	fn.Code = code
+	updateLocals(fn)
+}
+
+// parallelCopy assigns the arguments of the phis for one predecessor.
+// All phis read their arguments at once, so when one phi assigns a variable
+// another reads, the arguments are saved in fresh temporaries first.
+func parallelCopy(phis []ir.Instr, index int, temps *int, fn *ir.Func) []ir.Instr {
+	assigned := make(map[ir.Operand]bool)
+	for _, phi := range phis {
+		assigned[phi.Dst] = true
+	}
+	conflict := false
+	for _, phi := range phis {
+		if assigned[phi.Args[index]] && phi.Args[index] != phi.Dst {
+			conflict = true
+		}
+	}
+
+	var copies []ir.Instr
+	if !conflict {
+		for _, phi := range phis {
+			if phi.Args[index] != phi.Dst {
+				copies = append(copies, ir.Instr{
+					Op: ir.OpCopy, Dst: phi.Dst, Arg1: phi.Args[index], Line: phi.Line,
+				})
+			}
+		}
+		return copies
+	}
+
+	saved := make([]ir.Operand, len(phis))
+	for i, phi := range phis {
+		*temps += 1
+		saved[i] = ir.Operand{Kind: ir.OperandTemp, Number: *temps, Type: phi.Dst.Type}
+		fn.Locals = append(fn.Locals, saved[i])
+		copies = append(copies, ir.Instr{
+			Op: ir.OpCopy, Dst: saved[i], Arg1: phi.Args[index], Line: phi.Line,
+		})
+	}
+	for i, phi := range phis {
+		copies = append(copies, ir.Instr{
+			Op: ir.OpCopy, Dst: phi.Dst, Arg1: saved[i], Line: phi.Line,
+		})
+	}
+	return copies
+}
+
+func maxTemp(fn *ir.Func) int {
+	temps := 0
+	for _, local := range fn.Locals {
+		if local.Kind == ir.OperandTemp && local.Number > temps {
+			temps = local.Number
+		}
+	}
+	return temps
+}
+
+// updateLocals declares every version of the variables the code mentions,
+// in place of the original variable where that is no longer used.
+func updateLocals(fn *ir.Func) {
+	versions := make(map[string][]ir.Operand)
+	seen := make(map[ir.Operand]bool)
+	note := func(operand ir.Operand) {
+		if !operand.IsVariable() || seen[operand] {
+			return
+		}
+		seen[operand] = true
+		base := operand
+		base.Version = 0
+		versions[base.String()] = append(versions[base.String()], operand)
+	}
+	for _, instr := range fn.Code {
+		note(instr.Dst)
+		note(instr.Arg1)
+		note(instr.Arg2)
+		for _, arg := range instr.Args {
+			note(arg)
+		}
+	}
+
+	var locals []ir.Operand
+	for _, local := range fn.Locals {
+		used := versions[local.String()]
+		sort.Slice(used, func(i, j int) bool {
+			return used[i].Version < used[j].Version
+		})
+		locals = append(locals, used...)
+	}
+	fn.Locals = locals
+}
@@ -0,0 +1,190 @@
+package ssa
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/cfg"
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+func variable(name string, version int) ir.Operand {
+	return ir.Operand{Kind: ir.OperandVar, Lexeme: name, Type: "Int", Version: version}
+}
+
+var (
+	x = variable("x", 0)
+	y = variable("y", 0)
+	c = ir.Operand{Kind: ir.OperandVar, Lexeme: "c", Type: "Bool"}
+)
+
+func label(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpLabel, Label: name}
+}
+
+func jump(name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJump, Label: name}
+}
+
+func jumpIf(condition ir.Operand, name string) ir.Instr {
+	return ir.Instr{Op: ir.OpJumpIf, Arg1: condition, Label: name}
+}
+
+func assign(dst ir.Operand, src ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpCopy, Dst: dst, Arg1: src}
+}
+
+func phi(dst ir.Operand, args ...ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpPhi, Dst: dst, Args: args}
+}
+
+func print(operand ir.Operand) ir.Instr {
+	return ir.Instr{Op: ir.OpPrint, Arg1: operand}
+}
+
+func function(code ...ir.Instr) *ir.Func {
+	return &ir.Func{Name: "main", Code: code, Locals: []ir.Operand{x, y, c}}
+}
+
+// format writes code one instruction after the other, separated by "; ".
+func format(code []ir.Instr) string {
+	lines := make([]string, len(code))
+	for i, instr := range code {
+		lines[i] = instr.String()
+	}
+	return strings.Join(lines, "; ")
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   *ir.Func
+		want string
+	}{
+		{
+			"straight line",
+			function(assign(x, ir.NewInt(1)), assign(x, x), print(x)),
+			"x_1 = 1; x_2 = x_1; print x_2",
+		},
+		{
+			"diamond",
+			function(
+				assign(x, ir.NewInt(1)),
+				jumpIf(c, "Else"),
+				assign(x, ir.NewInt(2)),
+				jump("End"),
+				label("Else"),
+				assign(x, ir.NewInt(3)),
+				label("End"),
+				print(x),
+			),
+			"x_1 = 1; if c goto Else; x_2 = 2; goto End; Else:; x_3 = 3; End:; x_4 = phi(x_2, x_3); print x_4",
+		},
+		{
+			// x is dead at the join, so it gets no phi, while y does
+			"pruned",
+			function(
+				assign(x, ir.NewInt(1)),
+				assign(y, ir.NewInt(1)),
+				jumpIf(c, "End"),
+				assign(x, ir.NewInt(2)),
+				assign(y, x),
+				label("End"),
+				print(y),
+			),
+			"x_1 = 1; y_1 = 1; if c goto End; x_2 = 2; y_2 = x_2; End:; y_3 = phi(y_1, y_2); print y_3",
+		},
+		{
+			// The phi at the header reads the version from the back edge
+			"loop",
+			function(
+				assign(x, ir.NewInt(0)),
+				label("Top"),
+				jumpIf(c, "End"),
+				assign(x, x),
+				jump("Top"),
+				label("End"),
+				print(x),
+			),
+			"x_1 = 0; Top:; x_2 = phi(x_1, x_3); if c goto End; x_3 = x_2; goto Top; End:; print x_2",
+		},
+		{
+			// Only the reachable code is renamed
+			"unreachable",
+			function(jump("End"), assign(x, ir.NewInt(1)), label("End"), assign(x, ir.NewInt(2)), print(x)),
+			"goto End; End:; x_1 = 2; print x_1",
+		},
+	}
+	for _, test := range tests {
+		if got := format(Build(test.fn).Code()); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	x1, x2, x3, x4 := variable("x", 1), variable("x", 2), variable("x", 3), variable("x", 4)
+	y1, y2 := variable("y", 1), variable("y", 2)
+	tests := []struct {
+		name string
+		fn   *ir.Func
+		want string
+	}{
+		{
+			"diamond",
+			function(
+				assign(x1, ir.NewInt(1)),
+				jumpIf(c, "Else"),
+				assign(x2, ir.NewInt(2)),
+				jump("End"),
+				label("Else"),
+				assign(x3, ir.NewInt(3)),
+				label("End"),
+				phi(x4, x2, x3),
+				print(x4),
+			),
+			"x_1 = 1; if c goto Else; x_2 = 2; x_4 = x_2; goto End; Else:; x_3 = 3; x_4 = x_3; End:; print x_4",
+		},
+		{
+			// The jump to End is a critical edge, so its copy gets a block
+			// of its own, placed right before End
+			"critical edge",
+			function(
+				assign(x1, ir.NewInt(1)),
+				jumpIf(c, "End"),
+				assign(x2, ir.NewInt(2)),
+				label("End"),
+				phi(x3, x1, x2),
+				print(x3),
+			),
+			"x_1 = 1; if c goto SplitEdge_1; x_2 = 2; x_3 = x_2; goto End; SplitEdge_1:; x_3 = x_1; End:; print x_3",
+		},
+		{
+			// The phis swap x and y on the back edge, so the copies go
+			// through temporaries
+			"swap",
+			function(
+				assign(x1, ir.NewInt(1)),
+				assign(y1, ir.NewInt(2)),
+				label("Top"),
+				phi(x2, x1, y2),
+				phi(y2, y1, x2),
+				jumpIf(c, "Top"),
+				print(x2),
+			),
+			"x_1 = 1; y_1 = 2; x_2 = x_1; y_2 = y_1; goto Top; SplitEdge_1:; t1 = y_2; t2 = x_2; x_2 = t1; y_2 = t2; " +
+				"Top:; if c goto SplitEdge_1; print x_2",
+		},
+	}
+	for _, test := range tests {
+		Destroy(cfg.Build(test.fn))
+		if got := format(test.fn.Code); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, got, test.want)
+		}
+		for _, local := range test.fn.Locals {
+			if local.Kind == ir.OperandVar && local.Lexeme != "c" && local.Version == 0 {
+				t.Errorf("%s: %s is still declared", test.name, local)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/ir"
+)
+
+/*
+	The functions of the standard library, implemented natively with the
+	meaning given in pkg/ir. A program reads lines from the input given to
+	Input and gets the arguments given to Args.
+*/
+
+// An ExitError is returned by Run when the program ends itself with a
+// code other than 0 through Process.exit.
+type ExitError struct {
+	Code int
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", err.Code)
+}
+
+// exited unwinds the frames when the program calls Process.exit.
+type exited struct {
+	code int
+}
+
+func (err exited) Error() string {
+	return fmt.Sprintf("exit %d", err.code)
+}
+
+type native func(vm *VM, args []Value) (Value, error)
+
+var natives = map[string]native{
+	"String.length": func(vm *VM, args []Value) (Value, error) {
+		return intValue(int32(len(args[0].String))), nil
+	},
+	"String.concat": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(args[0].String + args[1].String), nil
+	},
+	"String.substring": func(vm *VM, args []Value) (Value, error) {
+		text := args[0].String
+		start := clamp(args[1].Int, 0, int32(len(text)))
+		end := clamp(args[2].Int, start, int32(len(text)))
+		return stringValue(text[start:end]), nil
+	},
+	"String.compare": func(vm *VM, args []Value) (Value, error) {
+		return intValue(int32(strings.Compare(args[0].String, args[1].String))), nil
+	},
+	"String.parseInt": func(vm *VM, args []Value) (Value, error) {
+		value, _ := parseInt(args[0].String)
+		return intValue(value), nil
+	},
+	"String.isInt": func(vm *VM, args []Value) (Value, error) {
+		_, ok := parseInt(args[0].String)
+		return boolValue(ok), nil
+	},
+
+	"Int.abs": func(vm *VM, args []Value) (Value, error) {
+		if args[0].Int < 0 {
+			return intValue(-args[0].Int), nil
+		}
+		return args[0], nil
+	},
+	"Int.min": func(vm *VM, args []Value) (Value, error) {
+		if args[0].Int < args[1].Int {
+			return args[0], nil
+		}
+		return args[1], nil
+	},
+	"Int.max": func(vm *VM, args []Value) (Value, error) {
+		if args[0].Int > args[1].Int {
+			return args[0], nil
+		}
+		return args[1], nil
+	},
+	"Int.toFloat": func(vm *VM, args []Value) (Value, error) {
+		return floatValue(float32(args[0].Int)), nil
+	},
+	"Int.toString": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(args[0].Format()), nil
+	},
+
+	"Float.abs": func(vm *VM, args []Value) (Value, error) {
+		return floatValue(float32(math.Abs(float64(args[0].Float)))), nil
+	},
+	"Float.min": func(vm *VM, args []Value) (Value, error) {
+		if args[0].Float < args[1].Float {
+			return args[0], nil
+		}
+		return args[1], nil
+	},
+	"Float.max": func(vm *VM, args []Value) (Value, error) {
+		if args[0].Float > args[1].Float {
+			return args[0], nil
+		}
+		return args[1], nil
+	},
+	"Float.sqrt": func(vm *VM, args []Value) (Value, error) {
+		return floatValue(float32(math.Sqrt(float64(args[0].Float)))), nil
+	},
+	"Float.pow": func(vm *VM, args []Value) (Value, error) {
+		return floatValue(float32(math.Pow(float64(args[0].Float), float64(args[1].Float)))), nil
+	},
+	"Float.toInt": func(vm *VM, args []Value) (Value, error) {
+		x := args[0].Float
+		switch {
+		case x != x:
+			return intValue(0), nil
+		case x >= math.MaxInt32:
+			return intValue(math.MaxInt32), nil
+		case x <= math.MinInt32:
+			return intValue(math.MinInt32), nil
+		}
+		return intValue(int32(x)), nil
+	},
+	"Float.toString": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(args[0].Format()), nil
+	},
+
+	"Bool.toString": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(args[0].Format()), nil
+	},
+
+	"Process.hasLine": func(vm *VM, args []Value) (Value, error) {
+		if vm.in == nil {
+			return boolValue(false), nil
+		}
+		line, err := vm.in.ReadString('\n')
+		if line == "" && err != nil {
+			return boolValue(false), nil
+		}
+		vm.line = strings.TrimSuffix(line, "\n")
+		return boolValue(true), nil
+	},
+	"Process.readLine": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(vm.line), nil
+	},
+	"Process.argCount": func(vm *VM, args []Value) (Value, error) {
+		return intValue(int32(len(vm.args))), nil
+	},
+	"Process.hasArg": func(vm *VM, args []Value) (Value, error) {
+		return boolValue(args[0].Int >= 0 && int(args[0].Int) < len(vm.args)), nil
+	},
+	"Process.arg": func(vm *VM, args []Value) (Value, error) {
+		return stringValue(vm.args[args[0].Int]), nil
+	},
+	"Process.exit": func(vm *VM, args []Value) (Value, error) {
+		return Value{}, exited{code: int(args[0].Int)}
+	},
+}
+
+// callBuiltin pops the arguments of a builtin, checking their kinds, and
+// pushes its result, if any.
+func (vm *VM) callBuiltin(name string) error {
+	builtin, _ := ir.GetBuiltin(name)
+	run, ok := natives[name]
+	if !ok {
+		return fmt.Errorf("builtin %s is not available", name)
+	}
+	types := builtin.Types()
+	args := make([]Value, len(types))
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = vm.pop()
+		if args[i].Kind != kindOf(types[i]) {
+			return fmt.Errorf("%s needs %s arguments", name, strings.Join(types, ", "))
+		}
+	}
+	result, err := run(vm, args)
+	if err != nil {
+		return err
+	}
+	if builtin.Result != "" {
+		vm.push(result)
+	}
+	return nil
+}
+
+// builtinArgs returns the number of arguments of a builtin of the program.
+func (vm *VM) builtinArgs(index int) int {
+	builtin, _ := ir.GetBuiltin(vm.program.Builtins[index])
+	return len(builtin.Types())
+}
+
+// Input makes the program read lines from r.
+func (vm *VM) Input(r io.Reader) {
+	vm.in = bufio.NewReader(r)
+}
+
+// Args gives the program its arguments, the first of which is
+// Process.arg(index 0).
+func (vm *VM) Args(args []string) {
+	vm.args = args
+}
+
+func kindOf(typeHint string) Kind {
+	switch typeHint {
+	case "Int":
+		return KindInt
+	case "Float":
+		return KindFloat
+	case "Bool":
+		return KindBool
+	default:
+		return KindString
+	}
+}
+
+// parseInt parses an optional - and decimal digits, and nothing else, into
+// an Int, and reports whether it could.
+func parseInt(text string) (int32, bool) {
+	digits := strings.TrimPrefix(text, "-")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(text, 10, 32)
+	return int32(value), err == nil
+}
+
+func clamp(value int32, low int32, high int32) int32 {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+func stringValue(value string) Value {
+	return Value{Kind: KindString, String: value}
+}
+
+func floatValue(value float32) Value {
+	return Value{Kind: KindFloat, Float: value}
+}
@@ -0,0 +1,426 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/magnetenstad/dragon-compiler/pkg/bytecode"
+)
+
+/*
+	A stack virtual machine running bytecode from pkg/bytecode.
+
+	Each call gets a frame with its locals, self and program counter, and
+	all frames share one operand stack. Ints wrap around like int32, and
+	division by zero is a runtime error instead of a crash. Both stacks are
+	bounded, so a corrupt program cannot exhaust the memory of its host.
+*/
+
+const maxFrames = 1024
+const maxStack = 1 << 16
+
+type Kind byte
+
+const (
+	KindNone Kind = iota // An unassigned local
+	KindInt
+	KindFloat
+	KindBool
+	KindString
+	KindStruct
+)
+
+type Value struct {
+	Kind   Kind
+	Int    int32 // Value of ints, 0 or 1 for bools
+	Float  float32
+	String string
+	Struct *Instance
+}
+
+type Instance struct {
+	Type   int // Index of the struct in the program
+	Ref    bool
+	Fields []Value
+}
+
+// Copy copies a struct value, including the structs nested inside it. An
+// instance of a ref struct is shared instead.
+func (value Value) Copy() Value {
+	if value.Kind != KindStruct || value.Struct.Ref {
+		return value
+	}
+	copied := &Instance{Type: value.Struct.Type, Fields: make([]Value, len(value.Struct.Fields))}
+	for i, field := range value.Struct.Fields {
+		copied.Fields[i] = field.Copy()
+	}
+	return Value{Kind: KindStruct, Struct: copied}
+}
+
+// Format returns the text print writes for the value, like printf in C.
+func (value Value) Format() string {
+	switch value.Kind {
+	case KindInt:
+		return fmt.Sprint(value.Int)
+	case KindFloat:
+		return fmt.Sprintf("%f", float64(value.Float))
+	case KindBool:
+		if value.Int != 0 {
+			return "true"
+		}
+		return "false"
+	case KindString:
+		return value.String
+	case KindStruct:
+		return "<struct>"
+	default:
+		return "<none>"
+	}
+}
+
+type frame struct {
+	fn     *bytecode.Func
+	pc     int
+	locals []Value
+	self   Value
+}
+
+type VM struct {
+	program *bytecode.Program
+	out     io.Writer
+	trace   io.Writer
+	in      *bufio.Reader
+	args    []string
+	line    string // The line read by Process.hasLine
+	stack   []Value
+	frames  []*frame
+}
+
+// New prepares a program to run, writing what it prints to out.
+func New(program *bytecode.Program, out io.Writer) *VM {
+	return &VM{program: program, out: out}
+}
+
+// Trace writes every instruction and the stack before it to w.
+func (vm *VM) Trace(w io.Writer) {
+	vm.trace = w
+}
+
+// Run runs main to completion, or until the program calls Process.exit,
+// which ends it with an ExitError unless its code is 0. The program must
+// have passed bytecode.Verify, which Decode always does.
+func (vm *VM) Run() error {
+	vm.stack = vm.stack[:0]
+	vm.frames = nil
+	vm.call(vm.program.Main, Value{})
+
+	for len(vm.frames) > 0 {
+		if len(vm.frames) > maxFrames || len(vm.stack) > maxStack {
+			return fmt.Errorf("stack overflow")
+		}
+		if err := vm.step(); err != nil {
+			var exit exited
+			if errors.As(err, &exit) {
+				vm.frames = nil
+				if exit.code != 0 {
+					return &ExitError{Code: exit.code}
+				}
+				return nil
+			}
+			fr := vm.frames[len(vm.frames)-1]
+			return fmt.Errorf("%s at %d: %w", fr.fn.Name, fr.pc, err)
+		}
+	}
+	return nil
+}
+
+func (vm *VM) call(index int, self Value) {
+	fn := &vm.program.Funcs[index]
+	vm.frames = append(vm.frames, &frame{
+		fn:     fn,
+		locals: make([]Value, fn.Locals),
+		self:   self,
+	})
+}
+
+func (vm *VM) step() error {
+	fr := vm.frames[len(vm.frames)-1]
+	if fr.pc >= len(fr.fn.Code) {
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		return nil
+	}
+	if vm.trace != nil {
+		vm.traceInstr(fr)
+	}
+
+	op := bytecode.Opcode(fr.fn.Code[fr.pc])
+	operands := bytecode.Operands(fr.fn.Code, fr.pc)
+	next := fr.pc + op.Size()
+	if !vm.hasOperands(op, operands) {
+		return fmt.Errorf("stack underflow in %s", op)
+	}
+
+	switch op {
+
+	case bytecode.OpNop:
+
+	case bytecode.OpConst:
+		vm.push(constantValue(vm.program.Constants[operands[0]]))
+
+	case bytecode.OpLoad:
+		vm.push(fr.locals[operands[0]])
+
+	case bytecode.OpStore:
+		fr.locals[operands[0]] = vm.pop().Copy()
+
+	case bytecode.OpSelf:
+		if fr.self.Kind != KindStruct {
+			return fmt.Errorf("self outside a constructor or method")
+		}
+		vm.push(fr.self)
+
+	case bytecode.OpAddInt, bytecode.OpSubInt, bytecode.OpMulInt, bytecode.OpDivInt,
+		bytecode.OpLessInt, bytecode.OpMoreInt:
+		b, a := vm.pop(), vm.pop()
+		if a.Kind != KindInt || b.Kind != KindInt {
+			return fmt.Errorf("%s needs two ints", op)
+		}
+		result, err := intBinary(op, a.Int, b.Int)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+
+	case bytecode.OpAddFloat, bytecode.OpSubFloat, bytecode.OpMulFloat, bytecode.OpDivFloat,
+		bytecode.OpLessFloat, bytecode.OpMoreFloat:
+		b, a := vm.pop(), vm.pop()
+		if a.Kind != KindFloat || b.Kind != KindFloat {
+			return fmt.Errorf("%s needs two floats", op)
+		}
+		vm.push(floatBinary(op, a.Float, b.Float))
+
+	case bytecode.OpNot:
+		a := vm.pop()
+		if a.Kind != KindBool {
+			return fmt.Errorf("not needs a bool")
+		}
+		vm.push(boolValue(a.Int == 0))
+
+	case bytecode.OpJump:
+		next = operands[0]
+
+	case bytecode.OpJumpIf:
+		a := vm.pop()
+		if a.Kind != KindBool {
+			return fmt.Errorf("jumpif needs a bool")
+		}
+		if a.Int != 0 {
+			next = operands[0]
+		}
+
+	case bytecode.OpNew:
+		st := vm.program.Structs[operands[0]]
+		instance := Value{Kind: KindStruct, Struct: &Instance{
+			Type:   operands[0],
+			Ref:    st.Ref,
+			Fields: make([]Value, len(st.Fields)),
+		}}
+		vm.push(instance)
+		fr.pc = next
+		vm.call(st.Constructor, instance)
+		return nil
+
+	case bytecode.OpGetField:
+		a := vm.pop()
+		if err := vm.checkField(a, operands[0]); err != nil {
+			return err
+		}
+		vm.push(a.Struct.Fields[operands[0]])
+
+	case bytecode.OpSetField:
+		value, a := vm.pop(), vm.pop()
+		if err := vm.checkField(a, operands[0]); err != nil {
+			return err
+		}
+		a.Struct.Fields[operands[0]] = value.Copy()
+
+	case bytecode.OpPrint:
+		fmt.Fprintln(vm.out, vm.pop().Format())
+
+	case bytecode.OpCall:
+		return vm.invoke(fr, next, operands[0])
+
+	case bytecode.OpDispatch:
+		table := vm.program.Tables[operands[0]]
+		receiver := &vm.stack[len(vm.stack)-1-vm.program.Funcs[table.Funcs[0]].Params]
+		if receiver.Kind != KindStruct || len(receiver.Struct.Fields) == 0 {
+			return fmt.Errorf("call of %s on a value that is not an interface", table.Name)
+		}
+		tag := receiver.Struct.Fields[0]
+		if tag.Kind != KindInt || tag.Int < 0 || int(tag.Int) >= len(table.Funcs) ||
+			int(tag.Int)+1 >= len(receiver.Struct.Fields) {
+			return fmt.Errorf("call of %s on an interface with a bad tag", table.Name)
+		}
+		// The field after the tag holding the struct, like in an enum
+		*receiver = receiver.Struct.Fields[tag.Int+1]
+		return vm.invoke(fr, next, table.Funcs[tag.Int])
+
+	case bytecode.OpReturn:
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		return nil
+
+	case bytecode.OpBuiltin:
+		if err := vm.callBuiltin(vm.program.Builtins[operands[0]]); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown opcode %d", byte(op))
+	}
+
+	fr.pc = next
+	return nil
+}
+
+// invoke pops the arguments and the receiver of a method and calls it,
+// returning to next.
+func (vm *VM) invoke(fr *frame, next int, index int) error {
+	callee := &vm.program.Funcs[index]
+	args := make([]Value, callee.Params)
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = vm.pop().Copy()
+	}
+	self := vm.pop()
+	if self.Kind != KindStruct {
+		return fmt.Errorf("call of %s on a value that is not a struct", callee.Name)
+	}
+	fr.pc = next
+	vm.call(index, self)
+	copy(vm.frames[len(vm.frames)-1].locals, args)
+	return nil
+}
+
+// hasOperands reports whether the stack holds enough values for op.
+func (vm *VM) hasOperands(op bytecode.Opcode, operands []int) bool {
+	needed := 0
+	switch op {
+	case bytecode.OpStore, bytecode.OpNot, bytecode.OpJumpIf,
+		bytecode.OpGetField, bytecode.OpPrint:
+		needed = 1
+	case bytecode.OpAddInt, bytecode.OpSubInt, bytecode.OpMulInt, bytecode.OpDivInt,
+		bytecode.OpLessInt, bytecode.OpMoreInt,
+		bytecode.OpAddFloat, bytecode.OpSubFloat, bytecode.OpMulFloat, bytecode.OpDivFloat,
+		bytecode.OpLessFloat, bytecode.OpMoreFloat,
+		bytecode.OpSetField:
+		needed = 2
+	}
+	if op == bytecode.OpCall {
+		needed = 1 + vm.program.Funcs[operands[0]].Params
+	}
+	if op == bytecode.OpBuiltin {
+		needed = vm.builtinArgs(operands[0])
+	}
+	if op == bytecode.OpDispatch {
+		needed = 1 + vm.program.Funcs[vm.program.Tables[operands[0]].Funcs[0]].Params
+	}
+	return len(vm.stack) >= needed
+}
+
+func (vm *VM) checkField(value Value, index int) error {
+	if value.Kind != KindStruct {
+		return fmt.Errorf("field access on a value that is not a struct")
+	}
+	if index >= len(value.Struct.Fields) {
+		return fmt.Errorf("field %d out of range in %s",
+			index, vm.program.Structs[value.Struct.Type].Name)
+	}
+	return nil
+}
+
+func (vm *VM) push(value Value) {
+	vm.stack = append(vm.stack, value)
+}
+
+func (vm *VM) pop() Value {
+	value := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return value
+}
+
+func (vm *VM) traceInstr(fr *frame) {
+	stack := make([]string, len(vm.stack))
+	for i, value := range vm.stack {
+		stack[i] = value.Format()
+	}
+	fmt.Fprintf(vm.trace, "%s %-32s [%s]\n", fr.fn.Name,
+		bytecode.DisassembleInstr(vm.program, fr.fn.Code, fr.pc),
+		strings.Join(stack, ", "))
+}
+
+func intBinary(op bytecode.Opcode, a int32, b int32) (Value, error) {
+	switch op {
+	case bytecode.OpAddInt:
+		return intValue(a + b), nil
+	case bytecode.OpSubInt:
+		return intValue(a - b), nil
+	case bytecode.OpMulInt:
+		return intValue(a * b), nil
+	case bytecode.OpDivInt:
+		if b == 0 {
+			return Value{}, fmt.Errorf("division by zero")
+		}
+		if a == math.MinInt32 && b == -1 {
+			return intValue(a), nil // Wraps around like the other operators
+		}
+		return intValue(a / b), nil
+	case bytecode.OpLessInt:
+		return boolValue(a < b), nil
+	default:
+		return boolValue(a > b), nil
+	}
+}
+
+func floatBinary(op bytecode.Opcode, a float32, b float32) Value {
+	switch op {
+	case bytecode.OpAddFloat:
+		return Value{Kind: KindFloat, Float: a + b}
+	case bytecode.OpSubFloat:
+		return Value{Kind: KindFloat, Float: a - b}
+	case bytecode.OpMulFloat:
+		return Value{Kind: KindFloat, Float: a * b}
+	case bytecode.OpDivFloat:
+		return Value{Kind: KindFloat, Float: a / b}
+	case bytecode.OpLessFloat:
+		return boolValue(a < b)
+	default:
+		return boolValue(a > b)
+	}
+}
+
+func constantValue(constant bytecode.Constant) Value {
+	switch constant.Kind {
+	case bytecode.ConstantInt:
+		return intValue(constant.Int)
+	case bytecode.ConstantFloat:
+		return Value{Kind: KindFloat, Float: constant.Float}
+	case bytecode.ConstantBool:
+		return boolValue(constant.Int != 0)
+	default:
+		return Value{Kind: KindString, String: constant.String}
+	}
+}
+
+func intValue(value int32) Value {
+	return Value{Kind: KindInt, Int: value}
+}
+
+func boolValue(value bool) Value {
+	if value {
+		return Value{Kind: KindBool, Int: 1}
+	}
+	return Value{Kind: KindBool}
+}